@@ -40,7 +40,7 @@ func pushCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVarP(&opts.targetRef, "target", "t", "", "reference where the bundle will be pushed")
+	cmd.Flags().StringVarP(&opts.targetRef, "target", "t", "", "reference where the bundle will be pushed, under the latest tag if it has neither a tag nor a digest")
 	cmd.Flags().StringSliceVar(&opts.insecureRegistries, "insecure-registries", nil, "Use plain HTTP for those registries")
 	cmd.Flags().BoolVar(&opts.allowFallbacks, "allow-fallbacks", true, "Enable automatic compatibility fallbacks for registries without support for custom media type, or OCI manifests")
 	cmd.Flags().StringSliceVar(&opts.invocationPlatforms, "invocation-platforms", nil, "Platforms to push (for multi-arch invocation images)")
@@ -85,7 +85,8 @@ func runPush(opts pushOptions) error {
 	if err != nil {
 		return err
 	}
-	d, err := remotes.Push(context.Background(), &b, relocationMap, ref, resolver, opts.allowFallbacks)
+	d, err := remotes.PushWithOptions(context.Background(), &b, relocationMap, ref, resolver,
+		remotes.WithAllowFallbacks(opts.allowFallbacks), remotes.WithDefaultLatestTag())
 	if err != nil {
 		return err
 	}
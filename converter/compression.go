@@ -0,0 +1,95 @@
+package converter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// ConfigCompressionGzip is the media type suffix of a gzip compressed config blob
+	ConfigCompressionGzip = "gzip"
+	// ConfigCompressionZstd is the media type suffix of a zstd compressed config blob
+	ConfigCompressionZstd = "zstd"
+)
+
+// compressConfig compresses the config blob with the given compression. The output only depends on the input, so
+// the same bundle always yields the same digest.
+func compressConfig(blob []byte, compression string) ([]byte, error) {
+	switch compression {
+	case ConfigCompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(blob); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case ConfigCompressionZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(blob, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported config compression %q", compression)
+	}
+}
+
+const (
+	// DefaultMaxDecompressedConfigSize is the default maximum size of a decompressed config blob, in bytes
+	DefaultMaxDecompressedConfigSize = 64 << 20
+	// zstdMinDecoderMemory bounds the memory of the zstd decoder no lower than the default window of the zstd
+	// encoders, which the decoder rejects frames above
+	zstdMinDecoderMemory = 8 << 20
+)
+
+// DecompressConfig decompresses a config blob according to the compression suffix of its media type, like
+// "application/vnd.cnab.config.v1+json+gzip". Blobs without compression suffix are returned unchanged.
+// The decompression fails with a SizeLimitExceededError once the decompressed config is larger than maxSize, so a
+// small compressed blob cannot exhaust the memory. A maxSize lower or equal to zero means
+// DefaultMaxDecompressedConfigSize.
+func DecompressConfig(mediaType string, blob []byte, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecompressedConfigSize
+	}
+	var r io.Reader
+	switch {
+	case strings.HasSuffix(mediaType, "+"+ConfigCompressionGzip):
+		gzipReader, err := gzip.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress config blob with media type %q: %w", mediaType, err)
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	case strings.HasSuffix(mediaType, "+"+ConfigCompressionZstd):
+		maxMemory := uint64(maxSize) + 1
+		if maxMemory < zstdMinDecoderMemory {
+			maxMemory = zstdMinDecoderMemory
+		}
+		decoder, err := zstd.NewReader(bytes.NewReader(blob), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxMemory))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress config blob with media type %q: %w", mediaType, err)
+		}
+		defer decoder.Close()
+		r = decoder
+	default:
+		return blob, nil
+	}
+	// Reading one byte more than the limit tells a config of exactly maxSize bytes from a larger one
+	decompressed, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress config blob with media type %q: %w", mediaType, err)
+	}
+	if err := CheckSizeLimit("decompressed config blob", int64(len(decompressed)), maxSize); err != nil {
+		return nil, fmt.Errorf("failed to decompress config blob with media type %q: %w", mediaType, err)
+	}
+	return decompressed, nil
+}
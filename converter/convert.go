@@ -5,12 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/cnabio/cnab-go/bundle"
 	"github.com/cnabio/cnab-to-oci/relocation"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	ocischema "github.com/opencontainers/image-spec/specs-go"
 	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -34,6 +39,18 @@ const ( // Top Level annotations and values
 	ArtifactTypeAnnotation = "org.opencontainers.artifactType"
 	// ArtifactTypeValue is the value of ArtifactTypeAnnotion for CNAB bundles
 	ArtifactTypeValue = "application/vnd.cnab.manifest.v1"
+	// OCISpecVersionAnnotation is the top level annotation specifying the version of the OCI image specification the
+	// index complies with
+	OCISpecVersionAnnotation = "org.opencontainers.image.spec.version"
+	// CNABPackagingAnnotation is the top level annotation specifying whether the bundle is thin or thick
+	CNABPackagingAnnotation = "io.cnab.bundle.packaging"
+	// CNABPackagingThin is the CNABPackagingAnnotation value for bundles only referencing their images
+	CNABPackagingThin = "thin"
+	// CNABPackagingThick is the CNABPackagingAnnotation value for bundles exported alongside their images
+	CNABPackagingThick = "thick"
+	// CNABTotalSizeAnnotation is the top level annotation specifying the total size in bytes of the content referenced
+	// by the index, each blob counted once
+	CNABTotalSizeAnnotation = "io.cnab.bundle.size"
 )
 
 const ( // Descriptor level annotations and values
@@ -45,11 +62,20 @@ const ( // Descriptor level annotations and values
 	CNABDescriptorTypeComponent cnabDescriptorTypeValue = "component"
 	// CNABDescriptorTypeConfig is the CNABDescriptorTypeAnnotation value for bundle configuration
 	CNABDescriptorTypeConfig cnabDescriptorTypeValue = "config"
+	// CNABDescriptorTypeExtra is the CNABDescriptorTypeAnnotation value for the extra descriptors carrying auxiliary
+	// artifacts, added with AppendDescriptors
+	CNABDescriptorTypeExtra cnabDescriptorTypeValue = "extra"
 
 	// CNABDescriptorComponentNameAnnotation is a decriptor-level annotation specifying the component name
 	CNABDescriptorComponentNameAnnotation = "io.cnab.component.name"
+	// CNABDescriptorImageNameAnnotation is a descriptor-level annotation specifying the image name of the bundle the
+	// descriptor was relocated from, set with WithImageNameAnnotations
+	CNABDescriptorImageNameAnnotation = "io.cnab.image.name"
 )
 
+// ErrBundleConfigNotFound is returned when an index does not reference a CNAB bundle config, meaning it is not a CNAB bundle
+var ErrBundleConfigNotFound = errors.New("bundle config not found")
+
 // GetBundleConfigManifestDescriptor returns the CNAB runtime config manifest descriptor from a OCI index
 func GetBundleConfigManifestDescriptor(ix *ocischemav1.Index) (ocischemav1.Descriptor, error) {
 	for _, d := range ix.Manifests {
@@ -57,17 +83,55 @@ func GetBundleConfigManifestDescriptor(ix *ocischemav1.Index) (ocischemav1.Descr
 			return d, nil
 		}
 	}
-	return ocischemav1.Descriptor{}, errors.New("bundle config not found")
+	return ocischemav1.Descriptor{}, ErrBundleConfigNotFound
+}
+
+// IsBundleConfigBlob returns true if the bundle config descriptor of an index references the bundle config blob
+// directly, without config manifest, meaning it is neither a manifest nor an index
+func IsBundleConfigBlob(d ocischemav1.Descriptor) bool {
+	return !images.IsManifestType(d.MediaType) && !images.IsIndexType(d.MediaType)
+}
+
+// IsCNABIndex returns true if the index references a CNAB bundle config, meaning it is a CNAB bundle
+func IsCNABIndex(ix ocischemav1.Index) bool {
+	_, err := GetBundleConfigManifestDescriptor(&ix)
+	return err == nil
+}
+
+// GetBundlePackaging returns the CNABPackagingAnnotation value of an index, or an empty string if the index does not
+// specify whether the bundle is thin or thick
+func GetBundlePackaging(ix ocischemav1.Index) string {
+	return ix.Annotations[CNABPackagingAnnotation]
+}
+
+// GetBundleTotalSize returns the CNABTotalSizeAnnotation value of an index, or 0 if the index does not specify it
+func GetBundleTotalSize(ix ocischemav1.Index) (int64, error) {
+	value, ok := ix.Annotations[CNABTotalSizeAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q", CNABTotalSizeAnnotation, value)
+	}
+	return size, nil
 }
 
-// ConvertBundleToOCIIndex converts a CNAB bundle into an OCI Index representation
+// ConvertBundleToOCIIndex converts a CNAB bundle into an OCI Index representation.
+// The index manifests are always in the same order: the bundle config, the invocation image, the component images
+// sorted by component name, then the extra descriptors in the given order, so the same bundle always yields the same
+// index digest.
 func ConvertBundleToOCIIndex(b *bundle.Bundle, targetRef reference.Named,
-	bundleConfigManifestRef ocischemav1.Descriptor, relocationMap relocation.ImageRelocationMap) (*ocischemav1.Index, error) {
+	bundleConfigManifestRef ocischemav1.Descriptor, relocationMap relocation.ImageRelocationMap, options ...ConvertOption) (*ocischemav1.Index, error) {
+	cfg, err := newConvertConfig(options...)
+	if err != nil {
+		return nil, err
+	}
 	annotations, err := makeAnnotations(b)
 	if err != nil {
 		return nil, err
 	}
-	manifests, err := makeManifests(b, targetRef, bundleConfigManifestRef, relocationMap)
+	manifests, err := makeManifests(b, targetRef, bundleConfigManifestRef, relocationMap, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -78,14 +142,210 @@ func ConvertBundleToOCIIndex(b *bundle.Bundle, targetRef reference.Named,
 		Annotations: annotations,
 		Manifests:   manifests,
 	}
+	if err := AppendDescriptors(&result, cfg.extraDescriptors...); err != nil {
+		return nil, err
+	}
+	if len(cfg.platforms) != 0 {
+		if err := FilterIndexByPlatform(&result, cfg.platforms); err != nil {
+			return nil, err
+		}
+	}
 	return &result, nil
 }
 
+// AppendDescriptors appends extra descriptors, like the manifest of an auxiliary artifact, to the index manifests in
+// the given order, annotated with the CNABDescriptorTypeExtra descriptor type so pulls ignore them. Each descriptor
+// must have a media type and a valid digest, must not be annotated with another CNAB descriptor type, and must not
+// already be referenced by the index.
+func AppendDescriptors(ix *ocischemav1.Index, descriptors ...ocischemav1.Descriptor) error {
+	referenced := make(map[digest.Digest]struct{}, len(ix.Manifests)+len(descriptors))
+	for _, d := range ix.Manifests {
+		referenced[d.Digest] = struct{}{}
+	}
+	extras := make([]ocischemav1.Descriptor, len(descriptors))
+	for i, d := range descriptors {
+		if err := validateExtraDescriptor(d); err != nil {
+			return err
+		}
+		if _, ok := referenced[d.Digest]; ok {
+			return fmt.Errorf("invalid extra descriptor %s: already referenced by the index", d.Digest)
+		}
+		referenced[d.Digest] = struct{}{}
+		// Leave the annotations of the caller untouched
+		annotations := make(map[string]string, len(d.Annotations)+1)
+		for k, v := range d.Annotations {
+			annotations[k] = v
+		}
+		annotations[CNABDescriptorTypeAnnotation] = CNABDescriptorTypeExtra
+		d.Annotations = annotations
+		extras[i] = d
+	}
+	ix.Manifests = append(ix.Manifests, extras...)
+	return nil
+}
+
+func validateExtraDescriptor(d ocischemav1.Descriptor) error {
+	if d.MediaType == "" {
+		return fmt.Errorf("invalid extra descriptor %s: media type cannot be empty", d.Digest)
+	}
+	if err := d.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid extra descriptor digest %q: %s", d.Digest, err)
+	}
+	if t, ok := d.Annotations[CNABDescriptorTypeAnnotation]; ok && t != CNABDescriptorTypeExtra {
+		return fmt.Errorf("invalid extra descriptor %s: it cannot be annotated with the CNAB descriptor type %q", d.Digest, t)
+	}
+	return nil
+}
+
+// ConvertBundleToDockerManifestList converts a CNAB bundle into a Docker manifest list, and returns its payload and
+// descriptor. The payload is the one pushed when falling back from an OCI index to a Docker manifest list.
+func ConvertBundleToDockerManifestList(b *bundle.Bundle, targetRef reference.Named,
+	bundleConfigManifestRef ocischemav1.Descriptor, relocationMap relocation.ImageRelocationMap, options ...ConvertOption) ([]byte, ocischemav1.Descriptor, error) {
+	ix, err := ConvertBundleToOCIIndex(b, targetRef, bundleConfigManifestRef, relocationMap, options...)
+	if err != nil {
+		return nil, ocischemav1.Descriptor{}, err
+	}
+	return MarshalDockerManifestList(ix, "")
+}
+
+type indexWrapper struct {
+	ocischemav1.Index
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+type manifestListWrapper struct {
+	ocischemav1.Index
+	MediaType    string `json:"mediaType,omitempty"`
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// MarshalOCIIndex marshals an index as an OCI index, with the CNABIndexMediaType media type, and returns its payload
+// and descriptor. The artifactType field is set if artifactType is not empty, and the index schema version defaults
+// to OCIIndexSchemaVersion. The index is marshaled with json.Marshal, unless WithJSONMarshaler is given.
+func MarshalOCIIndex(ix *ocischemav1.Index, artifactType string, options ...MarshalOption) ([]byte, ocischemav1.Descriptor, error) {
+	if ix.MediaType != "" && ix.MediaType != CNABIndexMediaType {
+		return nil, ocischemav1.Descriptor{}, fmt.Errorf("media type %q does not match an OCI index", ix.MediaType)
+	}
+	cfg, err := newMarshalConfig(options...)
+	if err != nil {
+		return nil, ocischemav1.Descriptor{}, err
+	}
+	w := &indexWrapper{Index: *ix, ArtifactType: artifactType}
+	w.SchemaVersion = indexSchemaVersion(ix)
+	return marshalIndexWith(cfg.marshal, w, CNABIndexMediaType)
+}
+
+// MarshalDockerManifestList marshals an index as a Docker manifest list, with the CNABManifestListMediaType media
+// type, and returns its payload and descriptor. The artifactType field is set if artifactType is not empty, and the
+// index schema version defaults to OCIIndexSchemaVersion. The index is marshaled with json.Marshal, unless
+// WithJSONMarshaler is given.
+func MarshalDockerManifestList(ix *ocischemav1.Index, artifactType string, options ...MarshalOption) ([]byte, ocischemav1.Descriptor, error) {
+	if ix.MediaType != "" && ix.MediaType != CNABManifestListMediaType {
+		return nil, ocischemav1.Descriptor{}, fmt.Errorf("media type %q does not match a Docker manifest list", ix.MediaType)
+	}
+	cfg, err := newMarshalConfig(options...)
+	if err != nil {
+		return nil, ocischemav1.Descriptor{}, err
+	}
+	w := &manifestListWrapper{Index: *ix, MediaType: CNABManifestListMediaType, ArtifactType: artifactType}
+	w.SchemaVersion = indexSchemaVersion(ix)
+	return marshalIndexWith(cfg.marshal, w, CNABManifestListMediaType)
+}
+
+// UnmarshalIndex unmarshals an index payload pushed as an OCI index, with the CNABIndexMediaType media type, or as a
+// Docker manifest list, with the CNABManifestListMediaType media type, like by older versions. It fails for other
+// media types, and if the media type set in the payload does not match the one it was fetched with.
+func UnmarshalIndex(payload []byte, mediaType string) (ocischemav1.Index, error) {
+	var ix ocischemav1.Index
+	switch mediaType {
+	case CNABIndexMediaType, CNABManifestListMediaType:
+	default:
+		return ocischemav1.Index{}, fmt.Errorf("unsupported media type %q for a bundle manifest, expected %q or %q", mediaType, CNABIndexMediaType, CNABManifestListMediaType)
+	}
+	if err := json.Unmarshal(payload, &ix); err != nil {
+		return ocischemav1.Index{}, err
+	}
+	// The media type is optional in an OCI index, and always set in a Docker manifest list
+	if ix.MediaType != mediaType && (ix.MediaType != "" || mediaType == CNABManifestListMediaType) {
+		return ocischemav1.Index{}, fmt.Errorf("media type %q of the bundle manifest does not match %q", ix.MediaType, mediaType)
+	}
+	return ix, nil
+}
+
+// GetArtifactType returns the artifactType field of an index payload, or an empty string if it is not set
+func GetArtifactType(indexPayload []byte) (string, error) {
+	var w indexWrapper
+	if err := json.Unmarshal(indexPayload, &w); err != nil {
+		return "", err
+	}
+	return w.ArtifactType, nil
+}
+
+// indexSchemaVersion returns the schema version of the index, or OCIIndexSchemaVersion if it is not set, as strict
+// clients reject indexes without schemaVersion
+func indexSchemaVersion(ix *ocischemav1.Index) int {
+	if ix.SchemaVersion == 0 {
+		return OCIIndexSchemaVersion
+	}
+	return ix.SchemaVersion
+}
+
+func marshalIndex(w interface{}, mediaType string) ([]byte, ocischemav1.Descriptor, error) {
+	return marshalIndexWith(json.Marshal, w, mediaType)
+}
+
+func marshalIndexWith(marshal JSONMarshaler, w interface{}, mediaType string) ([]byte, ocischemav1.Descriptor, error) {
+	payload, err := marshal(w)
+	if err != nil {
+		return nil, ocischemav1.Descriptor{}, err
+	}
+	return payload, ocischemav1.Descriptor{
+		Digest:    digest.FromBytes(payload),
+		MediaType: mediaType,
+		Size:      int64(len(payload)),
+	}, nil
+}
+
+// FilterIndexByPlatform removes the index descriptors not matching any of the given platforms.
+// Descriptors without platform are kept. It fails if the bundle config descriptor does not remain in the index.
+func FilterIndexByPlatform(ix *ocischemav1.Index, supportedPlatforms []ocischemav1.Platform) error {
+	matcher := platforms.Any(supportedPlatforms...)
+	var manifests []ocischemav1.Descriptor
+	for _, d := range ix.Manifests {
+		if d.Platform == nil || matcher.Match(*d.Platform) {
+			manifests = append(manifests, d)
+		}
+	}
+	filtered := *ix
+	filtered.Manifests = manifests
+	if _, err := GetBundleConfigManifestDescriptor(&filtered); err != nil {
+		return fmt.Errorf("no bundle config left in the index after filtering platforms: %w", err)
+	}
+	ix.Manifests = manifests
+	return nil
+}
+
 // GenerateRelocationMap generates the bundle relocation map
-func GenerateRelocationMap(ix *ocischemav1.Index, b *bundle.Bundle, originRepo reference.Named) (relocation.ImageRelocationMap, error) {
+func GenerateRelocationMap(ix *ocischemav1.Index, b *bundle.Bundle, originRepo reference.Named, options ...ConvertOption) (relocation.ImageRelocationMap, error) {
+	cfg, err := newConvertConfig(options...)
+	if err != nil {
+		return nil, err
+	}
 	relocationMap := relocation.ImageRelocationMap{}
 
 	for _, d := range ix.Manifests {
+		if d.Annotations[CNABDescriptorTypeAnnotation] == CNABDescriptorTypeExtra {
+			// Auxiliary artifacts are not bundle images
+			continue
+		}
+		if d.Annotations[CNABDescriptorTypeAnnotation] == CNABDescriptorTypeConfig {
+			// The bundle config may be referenced without manifest
+			continue
+		}
+		if len(d.URLs) > 0 {
+			// Foreign images are not in the repository
+			continue
+		}
 		switch d.MediaType {
 		case ocischemav1.MediaTypeImageManifest, ocischemav1.MediaTypeImageIndex:
 		case images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList:
@@ -96,9 +356,6 @@ func GenerateRelocationMap(ix *ocischemav1.Index, b *bundle.Bundle, originRepo r
 		if !ok {
 			return nil, fmt.Errorf("manifest descriptor %q has no CNAB descriptor type annotation %q", d.Digest, CNABDescriptorTypeAnnotation)
 		}
-		if descriptorType == CNABDescriptorTypeConfig {
-			continue
-		}
 		// strip tag/digest from originRepo
 		originRepo, err := reference.ParseNormalizedNamed(originRepo.Name())
 		if err != nil {
@@ -115,7 +372,11 @@ func GenerateRelocationMap(ix *ocischemav1.Index, b *bundle.Bundle, originRepo r
 			if len(b.InvocationImages) == 0 {
 				return nil, fmt.Errorf("unknown invocation image: %q", d.Digest)
 			}
-			relocationMap[b.InvocationImages[0].Image] = refFamiliar
+			image, err := cfg.imageReference(b.InvocationImages[0].Image)
+			if err != nil {
+				return nil, err
+			}
+			relocationMap[image] = refFamiliar
 
 		// The current descriptor is a component image
 		case CNABDescriptorTypeComponent:
@@ -127,7 +388,11 @@ func GenerateRelocationMap(ix *ocischemav1.Index, b *bundle.Bundle, originRepo r
 			if !ok {
 				return nil, fmt.Errorf("component %q not found in bundle", componentName)
 			}
-			relocationMap[c.Image] = refFamiliar
+			image, err := cfg.imageReference(c.Image)
+			if err != nil {
+				return nil, err
+			}
+			relocationMap[image] = refFamiliar
 		default:
 			return nil, fmt.Errorf("invalid CNAB descriptor type %q in descriptor %q", descriptorType, d.Digest)
 		}
@@ -136,6 +401,40 @@ func GenerateRelocationMap(ix *ocischemav1.Index, b *bundle.Bundle, originRepo r
 	return relocationMap, nil
 }
 
+// RelocationMapFromAnnotations reads the relocation map of an index pushed with WithImageNameAnnotations, associating
+// the CNABDescriptorImageNameAnnotation of each image descriptor to its digested reference in the repository of
+// originRepo, without the bundle. The image descriptors without the annotation are left out of the map, and returned.
+func RelocationMapFromAnnotations(ix *ocischemav1.Index, originRepo reference.Named) (relocation.ImageRelocationMap, []ocischemav1.Descriptor, error) {
+	repo, err := reference.ParseNormalizedNamed(originRepo.Name())
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid bundle reference %q: %s", originRepo, err)
+	}
+	relocationMap := relocation.ImageRelocationMap{}
+	var missing []ocischemav1.Descriptor
+	for _, d := range ix.Manifests {
+		switch d.Annotations[CNABDescriptorTypeAnnotation] {
+		case CNABDescriptorTypeInvocation, CNABDescriptorTypeComponent:
+		default:
+			continue
+		}
+		if len(d.URLs) > 0 {
+			// Foreign images are not in the repository
+			continue
+		}
+		image, ok := d.Annotations[CNABDescriptorImageNameAnnotation]
+		if !ok {
+			missing = append(missing, d)
+			continue
+		}
+		ref, err := reference.WithDigest(repo, d.Digest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create a digested reference for manifest descriptor %q: %s", d.Digest, err)
+		}
+		relocationMap[image] = reference.FamiliarString(ref)
+	}
+	return relocationMap, missing, nil
+}
+
 func makeAnnotations(b *bundle.Bundle) (map[string]string, error) {
 	result := map[string]string{
 		CNABRuntimeVersionAnnotation:      string(b.SchemaVersion),
@@ -162,27 +461,39 @@ func makeAnnotations(b *bundle.Bundle) (map[string]string, error) {
 }
 
 func makeManifests(b *bundle.Bundle, targetReference reference.Named,
-	bundleConfigManifestReference ocischemav1.Descriptor, relocationMap relocation.ImageRelocationMap) ([]ocischemav1.Descriptor, error) {
+	bundleConfigManifestReference ocischemav1.Descriptor, relocationMap relocation.ImageRelocationMap, cfg convertConfig) ([]ocischemav1.Descriptor, error) {
 	if len(b.InvocationImages) != 1 {
 		return nil, errors.New("only one invocation image supported")
 	}
-	if bundleConfigManifestReference.Annotations == nil {
-		bundleConfigManifestReference.Annotations = map[string]string{}
+	// The annotations of the prepared config manifest descriptor are copied, not to be changed
+	annotations := make(map[string]string, len(bundleConfigManifestReference.Annotations)+1)
+	for k, v := range bundleConfigManifestReference.Annotations {
+		annotations[k] = v
 	}
-	bundleConfigManifestReference.Annotations[CNABDescriptorTypeAnnotation] = CNABDescriptorTypeConfig
+	annotations[CNABDescriptorTypeAnnotation] = CNABDescriptorTypeConfig
+	bundleConfigManifestReference.Annotations = annotations
 	manifests := []ocischemav1.Descriptor{bundleConfigManifestReference}
-	invocationImage, err := makeDescriptor(b.InvocationImages[0].BaseImage, targetReference, relocationMap)
+	invocationImage, err := makeInvocationImageDescriptor(b.InvocationImages[0].BaseImage, targetReference, relocationMap, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("invalid invocation image: %s", err)
 	}
-	invocationImage.Annotations = map[string]string{
-		CNABDescriptorTypeAnnotation: CNABDescriptorTypeInvocation,
+	if err := annotateImageName(&invocationImage, b.InvocationImages[0].BaseImage, cfg); err != nil {
+		return nil, fmt.Errorf("invalid invocation image: %s", err)
 	}
 	manifests = append(manifests, invocationImage)
 	images := makeSortedImages(b.Images)
 	for _, name := range images {
 		img := b.Images[name]
-		image, err := makeDescriptor(img.BaseImage, targetReference, relocationMap)
+		if cfg.skipMissingImages {
+			missing, err := isMissingImage(img.BaseImage, relocationMap, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid image: %s", err)
+			}
+			if missing {
+				continue
+			}
+		}
+		image, err := makeDescriptor(img.BaseImage, targetReference, relocationMap, cfg)
 		if err != nil {
 			return nil, fmt.Errorf("invalid image: %s", err)
 		}
@@ -190,11 +501,59 @@ func makeManifests(b *bundle.Bundle, targetReference reference.Named,
 			CNABDescriptorTypeAnnotation:          CNABDescriptorTypeComponent,
 			CNABDescriptorComponentNameAnnotation: name,
 		}
+		if err := annotateImageName(&image, img.BaseImage, cfg); err != nil {
+			return nil, fmt.Errorf("invalid image: %s", err)
+		}
 		manifests = append(manifests, image)
 	}
 	return manifests, nil
 }
 
+func makeInvocationImageDescriptor(baseImage bundle.BaseImage, targetReference reference.Named, relocationMap relocation.ImageRelocationMap, cfg convertConfig) (ocischemav1.Descriptor, error) {
+	if cfg.invocationImageIndex != nil {
+		descriptor := *cfg.invocationImageIndex
+		descriptor.Annotations = map[string]string{
+			CNABDescriptorTypeAnnotation:      CNABDescriptorTypeInvocation,
+			CNABDescriptorMultiArchAnnotation: "true",
+		}
+		return descriptor, nil
+	}
+	descriptor, err := makeDescriptor(baseImage, targetReference, relocationMap, cfg)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	descriptor.Annotations = map[string]string{
+		CNABDescriptorTypeAnnotation: CNABDescriptorTypeInvocation,
+	}
+	return descriptor, nil
+}
+
+// annotateImageName sets the CNABDescriptorImageNameAnnotation of an image descriptor with WithImageNameAnnotations
+func annotateImageName(descriptor *ocischemav1.Descriptor, baseImage bundle.BaseImage, cfg convertConfig) error {
+	// The URL of a foreign image is already in the descriptor
+	if !cfg.imageNameAnnotations || IsForeignImage(baseImage.Image) {
+		return nil
+	}
+	image, err := cfg.imageReference(baseImage.Image)
+	if err != nil {
+		return err
+	}
+	descriptor.Annotations[CNABDescriptorImageNameAnnotation] = image
+	return nil
+}
+
+func isMissingImage(baseImage bundle.BaseImage, relocationMap relocation.ImageRelocationMap, cfg convertConfig) (bool, error) {
+	if IsForeignImage(baseImage.Image) {
+		return false, nil
+	}
+	image, err := cfg.imageReference(baseImage.Image)
+	if err != nil {
+		return false, err
+	}
+	_, ok := relocationMap[image]
+	return !ok, nil
+}
+
 func makeSortedImages(images map[string]bundle.Image) []string {
 	var result []string
 	for k := range images {
@@ -204,10 +563,49 @@ func makeSortedImages(images map[string]bundle.Image) []string {
 	return result
 }
 
-func makeDescriptor(baseImage bundle.BaseImage, targetReference reference.Named, relocationMap relocation.ImageRelocationMap) (ocischemav1.Descriptor, error) {
-	relocatedImage, ok := relocationMap[baseImage.Image]
+// IsForeignImage returns true if the image of the bundle is specified with an http or https URL, like a base image
+// hosted on a CDN, rather than with a registry reference
+func IsForeignImage(image string) bool {
+	return strings.HasPrefix(image, "https://") || strings.HasPrefix(image, "http://")
+}
+
+// makeForeignDescriptor makes the descriptor of an image specified with a URL, carrying it in its urls field. It is
+// neither transformed nor looked up in the relocation map, so its digest and size must be set in the bundle.
+func makeForeignDescriptor(baseImage bundle.BaseImage) (ocischemav1.Descriptor, error) {
+	u, err := url.Parse(baseImage.Image)
+	if err != nil || u.Host == "" || u.Opaque != "" {
+		return ocischemav1.Descriptor{}, fmt.Errorf("image URL %q is not a valid absolute URL", baseImage.Image)
+	}
+	dgst, err := digest.Parse(baseImage.Digest)
+	if err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("image %q digest is not valid: %s", baseImage.Image, err)
+	}
+	if baseImage.Size == 0 {
+		return ocischemav1.Descriptor{}, fmt.Errorf("image %q size is not set", baseImage.Image)
+	}
+	mediaType, err := getMediaType(baseImage, baseImage.Image)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	return ocischemav1.Descriptor{
+		Digest:    dgst,
+		MediaType: mediaType,
+		Size:      int64(baseImage.Size),
+		URLs:      []string{baseImage.Image},
+	}, nil
+}
+
+func makeDescriptor(baseImage bundle.BaseImage, targetReference reference.Named, relocationMap relocation.ImageRelocationMap, cfg convertConfig) (ocischemav1.Descriptor, error) {
+	if IsForeignImage(baseImage.Image) {
+		return makeForeignDescriptor(baseImage)
+	}
+	image, err := cfg.imageReference(baseImage.Image)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	relocatedImage, ok := relocationMap[image]
 	if !ok {
-		return ocischemav1.Descriptor{}, fmt.Errorf("image %q not present in the relocation map", baseImage.Image)
+		return ocischemav1.Descriptor{}, fmt.Errorf("image %q not present in the relocation map", image)
 	}
 
 	named, err := reference.ParseNormalizedNamed(relocatedImage)
@@ -225,6 +623,19 @@ func makeDescriptor(baseImage bundle.BaseImage, targetReference reference.Named,
 	if err != nil {
 		return ocischemav1.Descriptor{}, err
 	}
+	if cached, ok := cfg.descriptorCache[digested.Digest()]; ok {
+		descriptor := ocischemav1.Descriptor{
+			Digest:    digested.Digest(),
+			MediaType: mediaType,
+			Size:      cached.Size,
+		}
+		if cached.Platform != nil {
+			platform := *cached.Platform
+			platform.OSFeatures = append([]string(nil), cached.Platform.OSFeatures...)
+			descriptor.Platform = &platform
+		}
+		return descriptor, nil
+	}
 	if baseImage.Size == 0 {
 		return ocischemav1.Descriptor{}, fmt.Errorf("image %q size is not set", relocatedImage)
 	}
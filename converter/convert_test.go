@@ -1,11 +1,17 @@
 package converter
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/cnabio/cnab-to-oci/relocation"
 	"github.com/cnabio/cnab-to-oci/tests"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"gotest.tools/v3/assert"
 )
@@ -101,6 +107,165 @@ func TestConvertFromFixedUpBundleToOCI(t *testing.T) {
 	assert.NilError(t, err)
 }
 
+func TestConvertBundleToOCIIndexIsReproducible(t *testing.T) {
+	bundleConfigDescriptor := ocischemav1.Descriptor{
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		MediaType: schema2.MediaTypeManifest,
+		Size:      315,
+	}
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+	b := tests.MakeTestBundle()
+	relocationMap := tests.MakeRelocationMap()
+	// Enough images for the map iteration order to vary between runs
+	for i := 0; i < 20; i++ {
+		image := b.Images["image-1"]
+		image.Image = fmt.Sprintf("my.registry/namespace/image-%d", i)
+		image.Digest = digest.FromString(image.Image).String()
+		b.Images[fmt.Sprintf("component-%d", i)] = image
+		relocationMap[image.Image] = "my.registry/namespace/my-app@" + image.Digest
+	}
+
+	digests := map[digest.Digest]struct{}{}
+	for i := 0; i < 100; i++ {
+		ix, err := ConvertBundleToOCIIndex(b, named, bundleConfigDescriptor, relocationMap)
+		assert.NilError(t, err)
+		payload, err := json.Marshal(ix)
+		assert.NilError(t, err)
+		digests[digest.FromBytes(payload)] = struct{}{}
+	}
+	assert.Equal(t, len(digests), 1)
+}
+
+func TestConvertBundleToOCIIndexWithExtraDescriptors(t *testing.T) {
+	bundleConfigDescriptor := ocischemav1.Descriptor{
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		MediaType: schema2.MediaTypeManifest,
+		Size:      315,
+	}
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+	policy := ocischemav1.Descriptor{
+		MediaType:   ocischemav1.MediaTypeImageManifest,
+		Digest:      digest.FromString("policy"),
+		Size:        6,
+		Annotations: map[string]string{"com.example.kind": "policy"},
+	}
+
+	ix, err := ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, bundleConfigDescriptor, tests.MakeRelocationMap(), WithExtraDescriptors(policy))
+	assert.NilError(t, err)
+	expected := tests.MakeTestOCIIndex().Manifests
+	assert.DeepEqual(t, expected, ix.Manifests[:len(expected)])
+	// The extra descriptor comes last, annotated without changing the annotations of the caller
+	extra := ix.Manifests[len(ix.Manifests)-1]
+	assert.Equal(t, policy.Digest, extra.Digest)
+	assert.DeepEqual(t, map[string]string{"com.example.kind": "policy", CNABDescriptorTypeAnnotation: CNABDescriptorTypeExtra}, extra.Annotations)
+	assert.DeepEqual(t, map[string]string{"com.example.kind": "policy"}, policy.Annotations)
+	// and is not a bundle image
+	relocationMap, err := GenerateRelocationMap(ix, tests.MakeTestBundle(), named)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tests.MakeRelocationMap()), len(relocationMap))
+
+	testCases := []struct {
+		name          string
+		descriptor    ocischemav1.Descriptor
+		expectedError string
+	}{
+		{
+			name:          "no media type",
+			descriptor:    ocischemav1.Descriptor{Digest: policy.Digest},
+			expectedError: "media type cannot be empty",
+		},
+		{
+			name:          "invalid digest",
+			descriptor:    ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: "sha256:invalid"},
+			expectedError: `invalid extra descriptor digest "sha256:invalid"`,
+		},
+		{
+			name: "bundle config",
+			descriptor: ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: policy.Digest,
+				Annotations: map[string]string{CNABDescriptorTypeAnnotation: CNABDescriptorTypeConfig}},
+			expectedError: `it cannot be annotated with the CNAB descriptor type "config"`,
+		},
+		{
+			name:          "collision with the bundle config",
+			descriptor:    ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: bundleConfigDescriptor.Digest},
+			expectedError: "already referenced by the index",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, bundleConfigDescriptor, tests.MakeRelocationMap(), WithExtraDescriptors(tc.descriptor))
+			assert.ErrorContains(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestConvertBundleToOCIIndexWithDescriptorCache(t *testing.T) {
+	bundleConfigDescriptor := ocischemav1.Descriptor{
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		MediaType: schema2.MediaTypeManifest,
+		Size:      315,
+	}
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+	expected := tests.MakeTestOCIIndex()
+	invocationImage := expected.Manifests[1]
+	platform := &ocischemav1.Platform{OS: "linux", Architecture: "arm64"}
+	cache := map[digest.Digest]ocischemav1.Descriptor{
+		invocationImage.Digest: {Size: 1234, Platform: platform},
+	}
+
+	// The size of the bundle is not needed for a cached image
+	src := tests.MakeTestBundle()
+	src.InvocationImages[0].Size = 0
+	ix, err := ConvertBundleToOCIIndex(src, named, bundleConfigDescriptor, tests.MakeRelocationMap(), WithDescriptorCache(cache))
+	assert.NilError(t, err)
+	assert.Equal(t, int64(1234), ix.Manifests[1].Size)
+	assert.DeepEqual(t, platform, ix.Manifests[1].Platform)
+	assert.Equal(t, invocationImage.MediaType, ix.Manifests[1].MediaType)
+	assert.DeepEqual(t, invocationImage.Annotations, ix.Manifests[1].Annotations)
+	// Missing images keep the size of the bundle
+	assert.DeepEqual(t, expected.Manifests[2:], ix.Manifests[2:])
+
+	_, err = ConvertBundleToOCIIndex(src, named, bundleConfigDescriptor, tests.MakeRelocationMap(),
+		WithDescriptorCache(map[digest.Digest]ocischemav1.Descriptor{invocationImage.Digest: {Size: 0}}))
+	assert.ErrorContains(t, err, "size must be positive")
+	_, err = ConvertBundleToOCIIndex(src, named, bundleConfigDescriptor, tests.MakeRelocationMap(),
+		WithDescriptorCache(map[digest.Digest]ocischemav1.Descriptor{invocationImage.Digest: {Digest: digest.FromString("other"), Size: 1}}))
+	assert.ErrorContains(t, err, "differs")
+}
+
+func TestConvertBundleToDockerManifestList(t *testing.T) {
+	bundleConfigDescriptor := ocischemav1.Descriptor{
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		MediaType: schema2.MediaTypeManifest,
+		Size:      315,
+	}
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+
+	payload, descriptor, err := ConvertBundleToDockerManifestList(tests.MakeTestBundle(), named, bundleConfigDescriptor, tests.MakeRelocationMap())
+	assert.NilError(t, err)
+	assert.Equal(t, CNABManifestListMediaType, descriptor.MediaType)
+	assert.Equal(t, digest.FromBytes(payload), descriptor.Digest)
+	assert.Equal(t, int64(len(payload)), descriptor.Size)
+
+	var manifestList struct {
+		SchemaVersion int                      `json:"schemaVersion"`
+		MediaType     string                   `json:"mediaType"`
+		Manifests     []ocischemav1.Descriptor `json:"manifests"`
+	}
+	assert.NilError(t, json.Unmarshal(payload, &manifestList))
+	assert.Equal(t, OCIIndexSchemaVersion, manifestList.SchemaVersion)
+	assert.Equal(t, CNABManifestListMediaType, manifestList.MediaType)
+	assert.DeepEqual(t, tests.MakeTestOCIIndex().Manifests, manifestList.Manifests)
+
+	// An OCI index is not marshaled as a manifest list
+	_, _, err = MarshalDockerManifestList(&ocischemav1.Index{MediaType: CNABIndexMediaType}, "")
+	assert.ErrorContains(t, err, `media type "application/vnd.oci.image.index.v1+json" does not match a Docker manifest list`)
+}
+
 func TestGetConfigDescriptor(t *testing.T) {
 	ix := &ocischemav1.Index{
 		Manifests: []ocischemav1.Descriptor{
@@ -145,7 +310,14 @@ func TestGetConfigDescriptor(t *testing.T) {
 	assert.DeepEqual(t, expected, d)
 	ix.Manifests = ix.Manifests[1:]
 	_, err = GetBundleConfigManifestDescriptor(ix)
-	assert.ErrorContains(t, err, "bundle config not found")
+	assert.Check(t, errors.Is(err, ErrBundleConfigNotFound))
+}
+
+func TestIsCNABIndex(t *testing.T) {
+	ix := tests.MakeTestOCIIndex()
+	assert.Check(t, IsCNABIndex(*ix))
+	ix.Manifests = ix.Manifests[1:]
+	assert.Check(t, !IsCNABIndex(*ix))
 }
 
 func TestGenerateRelocationMap(t *testing.T) {
@@ -162,3 +334,214 @@ func TestGenerateRelocationMap(t *testing.T) {
 	assert.NilError(t, err)
 	assert.DeepEqual(t, relocationMap, expected)
 }
+
+func TestRelocationMapFromAnnotations(t *testing.T) {
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+	bundleConfigDescriptor := ocischemav1.Descriptor{
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		MediaType: schema2.MediaTypeManifest,
+		Size:      315,
+	}
+	ix, err := ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, bundleConfigDescriptor, tests.MakeRelocationMap(), WithImageNameAnnotations())
+	assert.NilError(t, err)
+	assert.Equal(t, "my.registry/namespace/my-app-invoc", ix.Manifests[1].Annotations[CNABDescriptorImageNameAnnotation])
+	_, annotated := ix.Manifests[0].Annotations[CNABDescriptorImageNameAnnotation]
+	assert.Assert(t, !annotated)
+
+	// The relocation map is read without the bundle
+	relocationMap, missing, err := RelocationMapFromAnnotations(ix, named)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeRelocationMap(), relocationMap)
+	assert.Equal(t, 0, len(missing))
+
+	// The images without the annotation are left out
+	delete(ix.Manifests[2].Annotations, CNABDescriptorImageNameAnnotation)
+	relocationMap, missing, err = RelocationMapFromAnnotations(ix, named)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tests.MakeRelocationMap())-1, len(relocationMap))
+	assert.DeepEqual(t, []ocischemav1.Descriptor{ix.Manifests[2]}, missing)
+
+	// Without the option, the index is unchanged
+	ix, err = ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, bundleConfigDescriptor, tests.MakeRelocationMap())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestOCIIndex(), ix)
+	relocationMap, missing, err = RelocationMapFromAnnotations(ix, named)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(relocationMap))
+	assert.Equal(t, len(ix.Manifests)-1, len(missing))
+}
+
+func TestImageReferenceTransform(t *testing.T) {
+	bundleConfigDescriptor := ocischemav1.Descriptor{
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		MediaType: schema2.MediaTypeManifest,
+		Size:      315,
+	}
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+	toMirror := WithImageReferenceTransform(func(original reference.Named) (reference.Named, error) {
+		return reference.ParseNormalizedNamed(strings.Replace(original.String(), "my.registry/", "mirror.internal/", 1))
+	})
+	// The relocation map references the mirrored images
+	relocationMap := relocation.ImageRelocationMap{}
+	for image, relocated := range tests.MakeRelocationMap() {
+		relocationMap[strings.Replace(image, "my.registry/", "mirror.internal/", 1)] = relocated
+	}
+
+	ix, err := ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, bundleConfigDescriptor, relocationMap, toMirror)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestOCIIndex(), ix)
+	generated, err := GenerateRelocationMap(ix, tests.MakeTestBundle(), named, toMirror)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, relocationMap, generated)
+
+	// Transform errors name the offending reference
+	failing := WithImageReferenceTransform(func(original reference.Named) (reference.Named, error) {
+		return nil, errors.New("no mirror")
+	})
+	_, err = ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, bundleConfigDescriptor, relocationMap, failing)
+	assert.ErrorContains(t, err, `failed to transform image reference "my.registry/namespace/my-app-invoc": no mirror`)
+
+	// Digests must be preserved
+	b := tests.MakeTestBundle()
+	b.InvocationImages[0].Image = "my.registry/namespace/my-app-invoc@sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0343"
+	dropDigest := WithImageReferenceTransform(func(original reference.Named) (reference.Named, error) {
+		return reference.TrimNamed(original), nil
+	})
+	_, err = ConvertBundleToOCIIndex(b, named, bundleConfigDescriptor, relocationMap, dropDigest)
+	assert.ErrorContains(t, err, "digest of \"my.registry/namespace/my-app-invoc\" differs")
+}
+
+func TestConvertBundleWithForeignImage(t *testing.T) {
+	bundleConfigDescriptor := ocischemav1.Descriptor{
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		MediaType: schema2.MediaTypeManifest,
+		Size:      315,
+	}
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+	b := tests.MakeTestBundle()
+	foreign := b.Images["another-image"]
+	foreign.Image = "https://cdn.example.com/images/another-image/manifest.json"
+	b.Images["another-image"] = foreign
+	// The foreign image is not relocated
+	relocationMap := tests.MakeRelocationMap()
+	delete(relocationMap, "my.registry/namespace/another-image")
+
+	ix, err := ConvertBundleToOCIIndex(b, named, bundleConfigDescriptor, relocationMap, WithImageNameAnnotations())
+	assert.NilError(t, err)
+	var found bool
+	for _, d := range ix.Manifests {
+		if d.Annotations[CNABDescriptorComponentNameAnnotation] != "another-image" {
+			assert.Equal(t, 0, len(d.URLs))
+			continue
+		}
+		found = true
+		assert.DeepEqual(t, []string{"https://cdn.example.com/images/another-image/manifest.json"}, d.URLs)
+		assert.Equal(t, digest.Digest(foreign.Digest), d.Digest)
+		assert.Equal(t, int64(foreign.Size), d.Size)
+		assert.Equal(t, foreign.MediaType, d.MediaType)
+		assert.Equal(t, "", d.Annotations[CNABDescriptorImageNameAnnotation])
+	}
+	assert.Assert(t, found)
+
+	// The foreign image is left out of the relocation maps read back from the index
+	generated, err := GenerateRelocationMap(ix, b, named)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, relocationMap, generated)
+	fromAnnotations, missing, err := RelocationMapFromAnnotations(ix, named)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, relocationMap, fromAnnotations)
+	assert.Equal(t, 0, len(missing))
+
+	// The URL must be well-formed, and the digest and size set
+	for _, tc := range []struct {
+		name     string
+		image    string
+		digest   string
+		size     uint64
+		expected string
+	}{
+		{name: "no host", image: "https:///manifest.json", digest: foreign.Digest, size: foreign.Size, expected: "is not a valid absolute URL"},
+		{name: "invalid URL", image: "https://cdn.example.com/%zz", digest: foreign.Digest, size: foreign.Size, expected: "is not a valid absolute URL"},
+		{name: "no digest", image: foreign.Image, size: foreign.Size, expected: "digest is not valid"},
+		{name: "no size", image: foreign.Image, digest: foreign.Digest, expected: "size is not set"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tests.MakeTestBundle()
+			invalid := b.Images["another-image"]
+			invalid.Image, invalid.Digest, invalid.Size = tc.image, tc.digest, tc.size
+			b.Images["another-image"] = invalid
+			_, err := ConvertBundleToOCIIndex(b, named, bundleConfigDescriptor, relocationMap)
+			assert.ErrorContains(t, err, tc.expected)
+		})
+	}
+}
+
+func TestFilterIndexByPlatform(t *testing.T) {
+	linuxAmd64 := ocischemav1.Platform{OS: "linux", Architecture: "amd64"}
+	linuxArm64 := ocischemav1.Platform{OS: "linux", Architecture: "arm64"}
+	ix := tests.MakeTestOCIIndex()
+	ix.Manifests[2].Platform = &linuxAmd64
+	ix.Manifests[3].Platform = &linuxArm64
+
+	assert.NilError(t, FilterIndexByPlatform(ix, []ocischemav1.Platform{linuxAmd64}))
+	// The image for an other platform is dropped, images without platform are kept
+	assert.Equal(t, len(ix.Manifests), 3)
+	assert.Equal(t, ix.Manifests[0].Annotations[CNABDescriptorTypeAnnotation], CNABDescriptorTypeConfig)
+	assert.Equal(t, ix.Manifests[1].Annotations[CNABDescriptorTypeAnnotation], CNABDescriptorTypeInvocation)
+	assert.DeepEqual(t, ix.Manifests[2].Platform, &linuxAmd64)
+
+	// Filtering the bundle config out fails
+	ix = tests.MakeTestOCIIndex()
+	ix.Manifests[0].Platform = &linuxArm64
+	err := FilterIndexByPlatform(ix, []ocischemav1.Platform{linuxAmd64})
+	assert.Check(t, errors.Is(err, ErrBundleConfigNotFound))
+	assert.Equal(t, len(ix.Manifests), 4)
+
+	// Converted images have no platform, so they are all kept
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+	actual, err := ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, ocischemav1.Descriptor{
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		MediaType: schema2.MediaTypeManifest,
+		Size:      315,
+	}, tests.MakeRelocationMap(), WithPlatformFilter([]ocischemav1.Platform{linuxAmd64}))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestOCIIndex(), actual)
+}
+
+func TestUnmarshalIndex(t *testing.T) {
+	ociIndex, _, err := MarshalOCIIndex(tests.MakeTestOCIIndex(), "")
+	assert.NilError(t, err)
+	manifestList, _, err := MarshalDockerManifestList(tests.MakeTestOCIIndex(), "")
+	assert.NilError(t, err)
+
+	ix, err := UnmarshalIndex(ociIndex, CNABIndexMediaType)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestOCIIndex().Manifests, ix.Manifests)
+	ix, err = UnmarshalIndex(manifestList, CNABManifestListMediaType)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestOCIIndex().Manifests, ix.Manifests)
+
+	_, err = UnmarshalIndex(manifestList, CNABIndexMediaType)
+	assert.ErrorContains(t, err, `media type "application/vnd.docker.distribution.manifest.list.v2+json" of the bundle manifest does not match "application/vnd.oci.image.index.v1+json"`)
+	_, err = UnmarshalIndex(ociIndex, CNABManifestListMediaType)
+	assert.ErrorContains(t, err, `media type "" of the bundle manifest does not match`)
+	_, err = UnmarshalIndex(ociIndex, ocischemav1.MediaTypeImageManifest)
+	assert.ErrorContains(t, err, `unsupported media type "application/vnd.oci.image.manifest.v1+json" for a bundle manifest`)
+}
+
+func TestGetBundleTotalSize(t *testing.T) {
+	size, err := GetBundleTotalSize(ocischemav1.Index{})
+	assert.NilError(t, err)
+	assert.Equal(t, int64(0), size)
+	size, err = GetBundleTotalSize(ocischemav1.Index{Annotations: map[string]string{CNABTotalSizeAnnotation: "4242"}})
+	assert.NilError(t, err)
+	assert.Equal(t, int64(4242), size)
+	for _, value := range []string{"", "-1", "42 bytes"} {
+		_, err = GetBundleTotalSize(ocischemav1.Index{Annotations: map[string]string{CNABTotalSizeAnnotation: value}})
+		assert.ErrorContains(t, err, "invalid io.cnab.bundle.size annotation")
+	}
+}
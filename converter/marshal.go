@@ -0,0 +1,53 @@
+package converter
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+)
+
+// JSONMarshaler marshals an index to JSON, like json.Marshal or CanonicalJSONMarshal. The digest of the index is
+// computed from the marshaled bytes.
+type JSONMarshaler func(v interface{}) ([]byte, error)
+
+// CanonicalJSONMarshal marshals v as canonical JSON, following RFC 8785: the object keys are sorted, there is no
+// insignificant whitespace, and the strings are not escaped beyond what JSON requires. The same index always yields the
+// same bytes, whatever the field order of its Go types, which signing tools canonicalizing the payload can verify.
+func CanonicalJSONMarshal(v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return jsoncanonicalizer.Transform(payload)
+}
+
+// marshalConfig defines the input required to marshal an index
+type marshalConfig struct {
+	marshal JSONMarshaler
+}
+
+// MarshalOption is a helper for configuring the marshaling of an index
+type MarshalOption func(*marshalConfig) error
+
+func newMarshalConfig(options ...MarshalOption) (marshalConfig, error) {
+	cfg := marshalConfig{marshal: json.Marshal}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return marshalConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// WithJSONMarshaler marshals the index with marshal instead of json.Marshal, like CanonicalJSONMarshal for stable bytes
+// matching the canonical form signing tools expect
+func WithJSONMarshaler(marshal JSONMarshaler) MarshalOption {
+	return func(cfg *marshalConfig) error {
+		if marshal == nil {
+			return errors.New("the JSON marshaler must not be nil")
+		}
+		cfg.marshal = marshal
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestMarshalOCIIndexDeterminism(t *testing.T) {
+	ix := tests.MakeTestOCIIndex()
+	ix.Annotations["io.cnab.description"] = "<build> & <push>"
+	for _, tc := range []struct {
+		name    string
+		options []MarshalOption
+	}{
+		{name: "json.Marshal"},
+		{name: "canonical", options: []MarshalOption{WithJSONMarshaler(CanonicalJSONMarshal)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, descriptor, err := MarshalOCIIndex(ix, "application/vnd.cnab.bundle.v1", tc.options...)
+			assert.NilError(t, err)
+			for i := 0; i < 10; i++ {
+				again, againDescriptor, err := MarshalOCIIndex(ix, "application/vnd.cnab.bundle.v1", tc.options...)
+				assert.NilError(t, err)
+				assert.Assert(t, bytes.Equal(payload, again))
+				assert.DeepEqual(t, descriptor, againDescriptor)
+			}
+			unmarshaled, err := UnmarshalIndex(payload, CNABIndexMediaType)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, ix.Manifests, unmarshaled.Manifests)
+			assert.DeepEqual(t, ix.Annotations, unmarshaled.Annotations)
+		})
+	}
+
+	// Only the canonical mode is in canonical form, its keys sorted and its strings not escaped
+	payload, _, err := MarshalOCIIndex(ix, "application/vnd.cnab.bundle.v1")
+	assert.NilError(t, err)
+	canonical, err := jsoncanonicalizer.Transform(payload)
+	assert.NilError(t, err)
+	assert.Assert(t, !bytes.Equal(payload, canonical))
+	canonicalPayload, canonicalDescriptor, err := MarshalOCIIndex(ix, "application/vnd.cnab.bundle.v1", WithJSONMarshaler(CanonicalJSONMarshal))
+	assert.NilError(t, err)
+	assert.Equal(t, string(canonical), string(canonicalPayload))
+	assert.Assert(t, bytes.Contains(canonicalPayload, []byte(`"<build> & <push>"`)))
+	assert.Assert(t, bytes.HasPrefix(canonicalPayload, []byte(`{"annotations":`)))
+	assert.Equal(t, canonicalDescriptor.Digest.Algorithm().FromBytes(canonicalPayload), canonicalDescriptor.Digest)
+
+	// The Docker manifest lists can be canonical too
+	listPayload, _, err := MarshalDockerManifestList(ix, "", WithJSONMarshaler(CanonicalJSONMarshal))
+	assert.NilError(t, err)
+	canonical, err = jsoncanonicalizer.Transform(listPayload)
+	assert.NilError(t, err)
+	assert.Equal(t, string(canonical), string(listPayload))
+}
+
+func TestWithJSONMarshalerRejectsNil(t *testing.T) {
+	_, _, err := MarshalOCIIndex(&ocischemav1.Index{}, "", WithJSONMarshaler(nil))
+	assert.ErrorContains(t, err, "the JSON marshaler must not be nil")
+	_, err = CanonicalJSONMarshal(json.RawMessage(`{`))
+	assert.Assert(t, err != nil)
+}
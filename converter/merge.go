@@ -0,0 +1,75 @@
+package converter
+
+import (
+	"fmt"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/hashicorp/go-multierror"
+)
+
+// MergeBundles returns a bundle with the definition of a, its name, version, actions and parameters, and the union of
+// the images and invocation images of a and b, so a single Push indexes the images of both bundles under one bundle
+// config. Neither a nor b is modified.
+// The images are matched by name, the invocation images by reference. An image present in both bundles with a
+// different reference or digest is a conflict, and the returned error is a multierror listing every conflict.
+// Merging bundles with different invocation images returns a bundle ValidateBundleForPush rejects, as an index
+// references a single invocation image.
+func MergeBundles(a, b *bundle.Bundle) (*bundle.Bundle, error) {
+	payload, err := a.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	merged, err := bundle.Unmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *multierror.Error
+	for _, img := range b.InvocationImages {
+		i := findInvocationImage(merged.InvocationImages, img.Image)
+		if i < 0 {
+			merged.InvocationImages = append(merged.InvocationImages, *img.DeepCopy())
+			continue
+		}
+		if existing := merged.InvocationImages[i]; existing.Digest != img.Digest {
+			result = multierror.Append(result, fmt.Errorf("conflicting invocation image %q: digest %q in %q, %q in %q",
+				img.Image, existing.Digest, a.Name, img.Digest, b.Name))
+		}
+	}
+	if len(b.Images) > 0 && merged.Images == nil {
+		merged.Images = make(map[string]bundle.Image, len(b.Images))
+	}
+	for _, name := range makeSortedImages(b.Images) {
+		img := b.Images[name]
+		existing, ok := merged.Images[name]
+		if !ok {
+			merged.Images[name] = *img.DeepCopy()
+			continue
+		}
+		if existing.Image != img.Image || existing.Digest != img.Digest {
+			result = multierror.Append(result, fmt.Errorf("conflicting image %q: %q in %q, %q in %q",
+				name, formatImage(existing.BaseImage), a.Name, formatImage(img.BaseImage), b.Name))
+		}
+	}
+	if err := result.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func findInvocationImage(images []bundle.InvocationImage, image string) int {
+	for i, img := range images {
+		if img.Image == image {
+			return i
+		}
+	}
+	return -1
+}
+
+// formatImage formats the reference of an image with its digest, if any
+func formatImage(baseImage bundle.BaseImage) string {
+	if baseImage.Digest == "" {
+		return baseImage.Image
+	}
+	return baseImage.Image + "@" + baseImage.Digest
+}
@@ -0,0 +1,58 @@
+package converter
+
+import (
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/hashicorp/go-multierror"
+	"gotest.tools/v3/assert"
+)
+
+func TestMergeBundles(t *testing.T) {
+	a := tests.MakeTestBundle()
+	b := tests.MakeTestBundle()
+	b.Name = "other-app"
+	b.Images = map[string]bundle.Image{
+		"image-1": a.Images["image-1"],
+		"other-image": {BaseImage: bundle.BaseImage{
+			Image:     "my.registry/namespace/other-image",
+			ImageType: "oci",
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0344",
+		}},
+	}
+
+	merged, err := MergeBundles(a, b)
+	assert.NilError(t, err)
+	assert.Equal(t, "my-app", merged.Name)
+	assert.Equal(t, 3, len(merged.Images))
+	assert.Equal(t, "my.registry/namespace/other-image", merged.Images["other-image"].Image)
+	// The shared invocation image is not duplicated
+	assert.DeepEqual(t, a.InvocationImages, merged.InvocationImages)
+	assert.NilError(t, ValidateBundleForPush(merged))
+	// The inputs are left untouched
+	assert.DeepEqual(t, tests.MakeTestBundle(), a)
+	assert.Equal(t, 2, len(b.Images))
+}
+
+func TestMergeBundlesConflicts(t *testing.T) {
+	a := tests.MakeTestBundle()
+	b := tests.MakeTestBundle()
+	b.Name = "other-app"
+	b.InvocationImages[0].Digest = "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0345"
+	img := b.Images["image-1"]
+	img.Image = "my.registry/other/image-1"
+	b.Images["image-1"] = img
+	img = b.Images["another-image"]
+	img.Digest = "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0346"
+	b.Images["another-image"] = img
+
+	_, err := MergeBundles(a, b)
+	merr, ok := err.(*multierror.Error)
+	assert.Assert(t, ok, err)
+	assert.Equal(t, 3, len(merr.Errors), err)
+	assert.ErrorContains(t, merr.Errors[0], `conflicting invocation image "my.registry/namespace/my-app-invoc": digest "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0343" in "my-app", "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0345" in "other-app"`)
+	assert.ErrorContains(t, merr.Errors[1], `conflicting image "another-image": "my.registry/namespace/another-image@sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0342" in "my-app", "my.registry/namespace/another-image@sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0346" in "other-app"`)
+	assert.ErrorContains(t, merr.Errors[2], `conflicting image "image-1": "my.registry/namespace/image-1@`)
+}
@@ -0,0 +1,86 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocischema "github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CNABDescriptorMultiArchAnnotation is a descriptor-level annotation marking the invocation image descriptor
+// referencing the index made by MakeInvocationImageIndex, set to "true"
+const CNABDescriptorMultiArchAnnotation = "io.cnab.manifest.multiarch"
+
+// MakeInvocationImageIndex makes the index nesting the per-architecture manifests of a multi-architecture invocation
+// image, and returns its payload and descriptor. The index is a Docker manifest list if all the manifests are Docker
+// image manifests, and an OCI index otherwise. At least one manifest is required, and each of them must have a
+// platform with an os and an architecture, different from the platforms of the other manifests.
+func MakeInvocationImageIndex(manifests []ocischemav1.Descriptor) ([]byte, ocischemav1.Descriptor, error) {
+	if len(manifests) == 0 {
+		return nil, ocischemav1.Descriptor{}, errors.New("a multi-architecture invocation image requires at least one architecture")
+	}
+	mediaType := ocischemav1.MediaTypeImageIndex
+	if allDockerManifests(manifests) {
+		mediaType = images.MediaTypeDockerSchema2ManifestList
+	}
+	seen := make(map[string]struct{}, len(manifests))
+	for _, d := range manifests {
+		if err := validateArchitectureManifest(d); err != nil {
+			return nil, ocischemav1.Descriptor{}, fmt.Errorf("invalid invocation image manifest %s: %w", d.Digest, err)
+		}
+		platform := platforms.Format(*d.Platform)
+		if _, ok := seen[platform]; ok {
+			return nil, ocischemav1.Descriptor{}, fmt.Errorf("invalid invocation image manifest %s: platform %q is already referenced", d.Digest, platform)
+		}
+		seen[platform] = struct{}{}
+	}
+	ix := ocischemav1.Index{
+		Versioned: ocischema.Versioned{SchemaVersion: OCIIndexSchemaVersion},
+		Manifests: manifests,
+	}
+	if mediaType == images.MediaTypeDockerSchema2ManifestList {
+		return marshalIndex(&manifestListWrapper{Index: ix, MediaType: mediaType}, mediaType)
+	}
+	return marshalIndex(&indexWrapper{Index: ix}, mediaType)
+}
+
+func allDockerManifests(manifests []ocischemav1.Descriptor) bool {
+	for _, d := range manifests {
+		if d.MediaType != images.MediaTypeDockerSchema2Manifest {
+			return false
+		}
+	}
+	return true
+}
+
+func validateArchitectureManifest(d ocischemav1.Descriptor) error {
+	switch d.MediaType {
+	case ocischemav1.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+	default:
+		return fmt.Errorf("unsupported media type %q, expected %q or %q", d.MediaType, ocischemav1.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest)
+	}
+	if err := d.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid digest: %w", err)
+	}
+	if d.Size <= 0 {
+		return fmt.Errorf("size must be positive, got %d", d.Size)
+	}
+	if d.Platform == nil || d.Platform.OS == "" || d.Platform.Architecture == "" {
+		return errors.New("platform os and architecture are required")
+	}
+	return nil
+}
+
+// GetInvocationImageIndexDescriptor returns the invocation image descriptor of the index if it references an index
+// made by MakeInvocationImageIndex, annotated with CNABDescriptorMultiArchAnnotation
+func GetInvocationImageIndexDescriptor(ix *ocischemav1.Index) (ocischemav1.Descriptor, bool) {
+	for _, d := range ix.Manifests {
+		if d.Annotations[CNABDescriptorTypeAnnotation] == CNABDescriptorTypeInvocation && d.Annotations[CNABDescriptorMultiArchAnnotation] == "true" {
+			return d, true
+		}
+	}
+	return ocischemav1.Descriptor{}, false
+}
@@ -0,0 +1,105 @@
+package converter
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/images"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func makeArchitectureManifests(mediaType string) []ocischemav1.Descriptor {
+	return []ocischemav1.Descriptor{
+		{
+			MediaType: mediaType,
+			Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0345",
+			Size:      506,
+			Platform:  &ocischemav1.Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			MediaType: mediaType,
+			Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0346",
+			Size:      507,
+			Platform:  &ocischemav1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		},
+	}
+}
+
+func TestMakeInvocationImageIndex(t *testing.T) {
+	payload, descriptor, err := MakeInvocationImageIndex(makeArchitectureManifests(ocischemav1.MediaTypeImageManifest))
+	assert.NilError(t, err)
+	assert.Equal(t, ocischemav1.MediaTypeImageIndex, descriptor.MediaType)
+	assert.Equal(t, digest.FromBytes(payload), descriptor.Digest)
+	assert.Equal(t, int64(len(payload)), descriptor.Size)
+	var ix ocischemav1.Index
+	assert.NilError(t, json.Unmarshal(payload, &ix))
+	assert.Equal(t, OCIIndexSchemaVersion, ix.SchemaVersion)
+	assert.DeepEqual(t, makeArchitectureManifests(ocischemav1.MediaTypeImageManifest), ix.Manifests)
+
+	// Docker image manifests are nested in a Docker manifest list
+	payload, descriptor, err = MakeInvocationImageIndex(makeArchitectureManifests(images.MediaTypeDockerSchema2Manifest))
+	assert.NilError(t, err)
+	assert.Equal(t, images.MediaTypeDockerSchema2ManifestList, descriptor.MediaType)
+	assert.NilError(t, json.Unmarshal(payload, &ix))
+	assert.Equal(t, images.MediaTypeDockerSchema2ManifestList, ix.MediaType)
+}
+
+func TestMakeInvocationImageIndexErrors(t *testing.T) {
+	_, _, err := MakeInvocationImageIndex(nil)
+	assert.ErrorContains(t, err, "requires at least one architecture")
+
+	manifests := makeArchitectureManifests(ocischemav1.MediaTypeImageManifest)
+	manifests[1].Platform = &ocischemav1.Platform{OS: "linux"}
+	_, _, err = MakeInvocationImageIndex(manifests)
+	assert.ErrorContains(t, err, "platform os and architecture are required")
+
+	manifests = makeArchitectureManifests(ocischemav1.MediaTypeImageManifest)
+	manifests[1].Platform = manifests[0].Platform
+	_, _, err = MakeInvocationImageIndex(manifests)
+	assert.ErrorContains(t, err, `platform "linux/amd64" is already referenced`)
+
+	manifests = makeArchitectureManifests(ocischemav1.MediaTypeImageIndex)
+	_, _, err = MakeInvocationImageIndex(manifests)
+	assert.ErrorContains(t, err, "unsupported media type")
+}
+
+func TestConvertBundleToOCIIndexWithInvocationImageIndex(t *testing.T) {
+	named, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app:0.1.0")
+	assert.NilError(t, err)
+	_, invocationImageIndex, err := MakeInvocationImageIndex(makeArchitectureManifests(ocischemav1.MediaTypeImageManifest))
+	assert.NilError(t, err)
+	relocationMap := tests.MakeRelocationMap()
+	// The invocation image of the relocation map is not used
+	delete(relocationMap, "my.registry/namespace/my-app-invoc")
+
+	ix, err := ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, tests.MakeTestOCIIndex().Manifests[0], relocationMap,
+		WithInvocationImageIndex(invocationImageIndex))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, ocischemav1.Descriptor{
+		MediaType: ocischemav1.MediaTypeImageIndex,
+		Digest:    invocationImageIndex.Digest,
+		Size:      invocationImageIndex.Size,
+		Annotations: map[string]string{
+			CNABDescriptorTypeAnnotation:      CNABDescriptorTypeInvocation,
+			CNABDescriptorMultiArchAnnotation: "true",
+		},
+	}, ix.Manifests[1])
+	found, ok := GetInvocationImageIndexDescriptor(ix)
+	assert.Assert(t, ok)
+	assert.Equal(t, invocationImageIndex.Digest, found.Digest)
+	_, ok = GetInvocationImageIndexDescriptor(tests.MakeTestOCIIndex())
+	assert.Assert(t, !ok)
+
+	// The relocation map references the nested index
+	generated, err := GenerateRelocationMap(ix, tests.MakeTestBundle(), named)
+	assert.NilError(t, err)
+	assert.Equal(t, "my.registry/namespace/my-app@"+invocationImageIndex.Digest.String(), generated["my.registry/namespace/my-app-invoc"])
+
+	_, err = ConvertBundleToOCIIndex(tests.MakeTestBundle(), named, tests.MakeTestOCIIndex().Manifests[0], relocationMap,
+		WithInvocationImageIndex(ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: invocationImageIndex.Digest}))
+	assert.ErrorContains(t, err, "unsupported media type")
+}
@@ -0,0 +1,268 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/images"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// convertConfig defines the input required to convert a bundle to an OCI index
+type convertConfig struct {
+	platforms               []ocischemav1.Platform
+	transformImageReference ImageReferenceTransform
+	skipMissingImages       bool
+	extraDescriptors        []ocischemav1.Descriptor
+	descriptorCache         map[digest.Digest]ocischemav1.Descriptor
+	imageNameAnnotations    bool
+	invocationImageIndex    *ocischemav1.Descriptor
+}
+
+// ImageReferenceTransform rewrites an image reference of the bundle, for instance to point to a mirror
+type ImageReferenceTransform func(original reference.Named) (reference.Named, error)
+
+// ConvertOption is a helper for configuring a bundle conversion
+type ConvertOption func(*convertConfig) error
+
+func newConvertConfig(options ...ConvertOption) (convertConfig, error) {
+	cfg := convertConfig{}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return convertConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// WithPlatformFilter only keeps the index descriptors matching one of the given platforms.
+// Descriptors without platform are always kept.
+func WithPlatformFilter(platforms []ocischemav1.Platform) ConvertOption {
+	return func(cfg *convertConfig) error {
+		cfg.platforms = platforms
+		return nil
+	}
+}
+
+// WithImageReferenceTransform rewrites the invocation and component image references of the bundle before looking
+// them up in the relocation map, or adding them to a generated relocation map. The transform must preserve the digest
+// of digested references.
+func WithImageReferenceTransform(transform ImageReferenceTransform) ConvertOption {
+	return func(cfg *convertConfig) error {
+		cfg.transformImageReference = transform
+		return nil
+	}
+}
+
+// WithSkipMissingImages leaves the component images missing from the relocation map out of the index, instead of
+// failing the conversion. The invocation image is always required.
+func WithSkipMissingImages() ConvertOption {
+	return func(cfg *convertConfig) error {
+		cfg.skipMissingImages = true
+		return nil
+	}
+}
+
+// WithImageNameAnnotations annotates each image descriptor with the CNABDescriptorImageNameAnnotation, set to the
+// image name of the bundle, so the relocation map can be read back from the index with RelocationMapFromAnnotations
+func WithImageNameAnnotations() ConvertOption {
+	return func(cfg *convertConfig) error {
+		cfg.imageNameAnnotations = true
+		return nil
+	}
+}
+
+// WithInvocationImageIndex references the index of a multi-architecture invocation image made by
+// MakeInvocationImageIndex, annotated with CNABDescriptorMultiArchAnnotation, instead of the invocation image of the
+// relocation map. The index must be in the target repository.
+func WithInvocationImageIndex(descriptor ocischemav1.Descriptor) ConvertOption {
+	return func(cfg *convertConfig) error {
+		if descriptor.MediaType != ocischemav1.MediaTypeImageIndex && descriptor.MediaType != images.MediaTypeDockerSchema2ManifestList {
+			return fmt.Errorf("invalid invocation image index %s: unsupported media type %q", descriptor.Digest, descriptor.MediaType)
+		}
+		if err := descriptor.Digest.Validate(); err != nil {
+			return fmt.Errorf("invalid invocation image index digest %q: %s", descriptor.Digest, err)
+		}
+		cfg.invocationImageIndex = &ocischemav1.Descriptor{MediaType: descriptor.MediaType, Digest: descriptor.Digest, Size: descriptor.Size}
+		return nil
+	}
+}
+
+// WithExtraDescriptors appends the descriptors to the index manifests, after the bundle descriptors and in the given
+// order, to carry auxiliary artifacts in the bundle index. See AppendDescriptors.
+func WithExtraDescriptors(descriptors ...ocischemav1.Descriptor) ConvertOption {
+	return func(cfg *convertConfig) error {
+		for _, d := range descriptors {
+			if err := validateExtraDescriptor(d); err != nil {
+				return err
+			}
+		}
+		cfg.extraDescriptors = append(cfg.extraDescriptors, descriptors...)
+		return nil
+	}
+}
+
+// WithDescriptorCache sets the size and the platform of the image descriptors from the descriptors of the cache with
+// the same digest, like the ones returned by a prior resolution of the images, instead of the image sizes of the
+// bundle. The images missing from the cache keep the size of the bundle, without platform. Every cached descriptor
+// must have a positive size.
+func WithDescriptorCache(descriptors map[digest.Digest]ocischemav1.Descriptor) ConvertOption {
+	return func(cfg *convertConfig) error {
+		for d, desc := range descriptors {
+			if desc.Size <= 0 {
+				return fmt.Errorf("invalid cached descriptor %s: size must be positive, got %d", d, desc.Size)
+			}
+			if desc.Digest != "" && desc.Digest != d {
+				return fmt.Errorf("invalid cached descriptor %s: digest %s differs", d, desc.Digest)
+			}
+		}
+		cfg.descriptorCache = descriptors
+		return nil
+	}
+}
+
+// imageReference returns the image reference of the bundle image, transformed if a transform is configured
+func (cfg convertConfig) imageReference(image string) (string, error) {
+	if cfg.transformImageReference == nil {
+		return image, nil
+	}
+	return TransformImageReference(image, cfg.transformImageReference)
+}
+
+// TransformImageReference rewrites an image reference with the transform, and returns it in its familiar form. It
+// fails if the transform does not preserve the digest of a digested reference.
+func TransformImageReference(image string, transform ImageReferenceTransform) (string, error) {
+	original, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("image %q is not a valid image reference: %s", image, err)
+	}
+	transformed, err := transform(original)
+	if err != nil {
+		return "", fmt.Errorf("failed to transform image reference %q: %w", image, err)
+	}
+	if transformed == nil {
+		return "", fmt.Errorf("failed to transform image reference %q: no reference returned", image)
+	}
+	if digested, ok := original.(reference.Digested); ok {
+		if transformedDigested, ok := transformed.(reference.Digested); !ok || transformedDigested.Digest() != digested.Digest() {
+			return "", fmt.Errorf("failed to transform image reference %q: digest of %q differs", image, transformed)
+		}
+	}
+	return reference.FamiliarString(transformed), nil
+}
+
+// prepareConfig defines the input required to prepare a bundle config for a push
+type prepareConfig struct {
+	configMediaType  string
+	maxConfigSize    int64
+	maxManifestSize  int64
+	compressions     []string
+	digestAlgorithm  digest.Algorithm
+	artifactManifest bool
+	// manifestAnnotations are set on the config manifests and their descriptors
+	manifestAnnotations map[string]string
+}
+
+// PrepareOption is a helper for configuring the preparation of a bundle config
+type PrepareOption func(*prepareConfig) error
+
+func newPrepareConfig(options ...PrepareOption) (prepareConfig, error) {
+	cfg := prepareConfig{
+		configMediaType: CNABConfigMediaType,
+		digestAlgorithm: digest.Canonical,
+	}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return prepareConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// WithConfigMediaType overrides the CNAB config media type of the prepared config blob descriptor.
+// The fallbacks are unchanged: the OCI image config media type first, then the Docker format.
+func WithConfigMediaType(mediaType string) PrepareOption {
+	return func(cfg *prepareConfig) error {
+		if mediaType == "" {
+			return errors.New("config media type cannot be empty")
+		}
+		cfg.configMediaType = mediaType
+		return nil
+	}
+}
+
+// WithMaxConfigSize fails the preparation with a SizeLimitExceededError if the config blob is larger than the given
+// size, instead of letting the registry reject it. Zero means no limit.
+func WithMaxConfigSize(size int64) PrepareOption {
+	return func(cfg *prepareConfig) error {
+		if size < 0 {
+			return errors.New("max config size cannot be negative")
+		}
+		cfg.maxConfigSize = size
+		return nil
+	}
+}
+
+// WithMaxManifestSize fails the preparation with a SizeLimitExceededError if a config manifest is larger than the
+// given size, instead of letting the registry reject it. Zero means no limit.
+func WithMaxManifestSize(size int64) PrepareOption {
+	return func(cfg *prepareConfig) error {
+		if size < 0 {
+			return errors.New("max manifest size cannot be negative")
+		}
+		cfg.maxManifestSize = size
+		return nil
+	}
+}
+
+// WithConfigCompression compresses the config blob, adding the compression suffix to its media type. The blob is
+// compressed with zstd if allowZstd is set, with gzip as the first fallback, otherwise with gzip. The uncompressed
+// config, then the usual fallbacks, are used for registries rejecting compressed configs.
+func WithConfigCompression(allowZstd bool) PrepareOption {
+	return func(cfg *prepareConfig) error {
+		cfg.compressions = []string{ConfigCompressionGzip}
+		if allowZstd {
+			cfg.compressions = []string{ConfigCompressionZstd, ConfigCompressionGzip}
+		}
+		return nil
+	}
+}
+
+// WithDigestAlgorithm computes the digests of the config blob and of the config manifests, including the fallbacks,
+// with the given algorithm instead of SHA-256. It fails if the algorithm is not available.
+func WithDigestAlgorithm(algorithm digest.Algorithm) PrepareOption {
+	return func(cfg *prepareConfig) error {
+		if !algorithm.Available() {
+			return fmt.Errorf("unsupported digest algorithm %q", algorithm)
+		}
+		cfg.digestAlgorithm = algorithm
+		return nil
+	}
+}
+
+// WithArtifactManifest prepares the config as an artifact manifest first: an image manifest with the config media type
+// as its artifactType, the empty JSON blob as its config, and the uncompressed config blob as its only layer. The
+// usual formats are the fallbacks for registries rejecting it.
+func WithArtifactManifest() PrepareOption {
+	return func(cfg *prepareConfig) error {
+		cfg.artifactManifest = true
+		return nil
+	}
+}
+
+// WithConfigManifestAnnotations sets annotations, like build metadata, on the config manifest and on its descriptor
+// referenced by the index, for every format including the fallbacks. The Docker image manifest fallback has no
+// annotations field, so only its descriptor is annotated. The keys must not be empty.
+func WithConfigManifestAnnotations(annotations map[string]string) PrepareOption {
+	return func(cfg *prepareConfig) error {
+		for k := range annotations {
+			if k == "" {
+				return errors.New("config manifest annotation keys cannot be empty")
+			}
+		}
+		cfg.manifestAnnotations = annotations
+		return nil
+	}
+}
@@ -2,8 +2,10 @@ package converter
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/cnabio/cnab-go/bundle"
+	"github.com/containerd/containerd/images"
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/opencontainers/go-digest"
@@ -14,61 +16,182 @@ import (
 const (
 	// CNABConfigMediaType is the config media type of the CNAB config image manifest
 	CNABConfigMediaType = "application/vnd.cnab.config.v1+json"
+	// CNABIndexMediaType is the media type of the index pushed for a bundle
+	CNABIndexMediaType = ocischemav1.MediaTypeImageIndex
+	// CNABManifestListMediaType is the media type of the index pushed for a bundle to registries without OCI index
+	// support
+	CNABManifestListMediaType = images.MediaTypeDockerSchema2ManifestList
+	// EmptyJSONMediaType is the media type of the empty JSON blob, "{}", used as the config of artifact manifests
+	EmptyJSONMediaType = "application/vnd.oci.empty.v1+json"
 )
 
-// PreparedBundleConfig contains the config blob, image manifest (and fallback), and descriptors for a CNAB config
+// emptyJSON is the payload of the EmptyJSONMediaType blob
+var emptyJSON = []byte("{}")
+
+// SizeLimitExceededError is returned when a payload to push, or a decompressed config blob, is larger than the
+// configured limit
+type SizeLimitExceededError struct {
+	// Object is the kind of payload, like "config blob"
+	Object string
+	// Size is the size of the payload. The decompression of a config blob stops one byte past the limit, so its real
+	// size may be larger.
+	Size  int64
+	Limit int64
+}
+
+func (e *SizeLimitExceededError) Error() string {
+	return fmt.Sprintf("%s size of %d bytes exceeds the limit of %d bytes", e.Object, e.Size, e.Limit)
+}
+
+// CheckSizeLimit returns a SizeLimitExceededError if the size is over a non zero limit
+func CheckSizeLimit(object string, size, limit int64) error {
+	if limit > 0 && size > limit {
+		return &SizeLimitExceededError{Object: object, Size: size, Limit: limit}
+	}
+	return nil
+}
+
+// PreparedBundleConfig contains the config blob, image manifest (and fallback), and descriptors for a CNAB config.
+// It can be inspected, or stored, before being pushed with remotes.PushPreparedBundleConfig.
 type PreparedBundleConfig struct {
-	ConfigBlob           []byte
+	// ConfigBlob is the payload of the config blob, the bundle.json possibly compressed
+	ConfigBlob []byte
+	// ConfigBlobDescriptor is the descriptor of ConfigBlob, as referenced by Manifest, as its config or as the only
+	// layer of an artifact manifest
 	ConfigBlobDescriptor ocischemav1.Descriptor
-	Manifest             []byte
-	ManifestDescriptor   ocischemav1.Descriptor
-	Fallback             *PreparedBundleConfig
+	// EmptyConfigBlob is the empty JSON blob referenced as the config of an artifact manifest, pushed along with
+	// ConfigBlob. It is nil for the other formats.
+	EmptyConfigBlob []byte
+	// EmptyConfigBlobDescriptor is the descriptor of EmptyConfigBlob, if set
+	EmptyConfigBlobDescriptor ocischemav1.Descriptor
+	// Manifest is the payload of the image manifest referencing the config blob
+	Manifest []byte
+	// ManifestDescriptor is the descriptor of Manifest, as referenced by the bundle index
+	ManifestDescriptor ocischemav1.Descriptor
+	// Fallback is the config prepared in a more compatible format, pushed if this one is rejected. It is nil for the
+	// last format, the Docker image manifest.
+	Fallback *PreparedBundleConfig
+}
+
+// Formats returns the prepared config followed by its fallbacks, in the order they are tried when pushing
+func (c *PreparedBundleConfig) Formats() []*PreparedBundleConfig {
+	var formats []*PreparedBundleConfig
+	for current := c; current != nil; current = current.Fallback {
+		formats = append(formats, current)
+	}
+	return formats
 }
 
 // PrepareForPush serializes a bundle config, generates its image manifest, and its manifest descriptor
-func PrepareForPush(b *bundle.Bundle) (*PreparedBundleConfig, error) {
-	blob, err := b.Marshal()
+func PrepareForPush(b *bundle.Bundle, options ...PrepareOption) (*PreparedBundleConfig, error) {
+	cfg, err := newPrepareConfig(options...)
 	if err != nil {
 		return nil, err
 	}
-	fallbackChain := []bundleConfigPreparer{
-		prepareOCIBundleConfig(CNABConfigMediaType),
-		prepareOCIBundleConfig(ocischemav1.MediaTypeImageConfig),
-		prepareNonOCIBundleConfig,
+	blob, err := marshalConfigBlob(b, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var fallbackChain []bundleConfigPreparer
+	if cfg.artifactManifest {
+		fallbackChain = append(fallbackChain, prepareArtifactBundleConfig(cfg.configMediaType, cfg.digestAlgorithm, cfg.manifestAnnotations))
+	}
+	for _, compression := range cfg.compressions {
+		fallbackChain = append(fallbackChain, prepareCompressedOCIBundleConfig(cfg.configMediaType, compression, cfg.digestAlgorithm, cfg.manifestAnnotations))
 	}
+	fallbackChain = append(fallbackChain, prepareOCIBundleConfig(cfg.configMediaType, cfg.digestAlgorithm, cfg.manifestAnnotations))
+	if cfg.configMediaType != ocischemav1.MediaTypeImageConfig {
+		fallbackChain = append(fallbackChain, prepareOCIBundleConfig(ocischemav1.MediaTypeImageConfig, cfg.digestAlgorithm, cfg.manifestAnnotations))
+	}
+	fallbackChain = append(fallbackChain, prepareNonOCIBundleConfig(cfg.digestAlgorithm, cfg.manifestAnnotations))
 	var first, current *PreparedBundleConfig
 	for _, preparer := range fallbackChain {
-		cfg, err := preparer(blob)
+		prepared, err := preparer(blob)
 		if err != nil {
 			return nil, err
 		}
+		if err := CheckSizeLimit("config manifest", prepared.ManifestDescriptor.Size, cfg.maxManifestSize); err != nil {
+			return nil, err
+		}
 		if current == nil {
-			first = cfg
+			first = prepared
 		} else {
-			current.Fallback = cfg
+			current.Fallback = prepared
 		}
-		current = cfg
+		current = prepared
 	}
 	return first, nil
 }
 
-func descriptorOf(payload []byte, mediaType string) ocischemav1.Descriptor {
+// BundleConfigDigest returns the digest and the size the config blob of the bundle has once prepared with the same
+// options by PrepareForPush, without preparing its manifests, for instance to check whether the registry already has
+// it. With WithConfigCompression, this is the compressed blob pushed first, unless WithArtifactManifest is set.
+func BundleConfigDigest(b *bundle.Bundle, options ...PrepareOption) (digest.Digest, int64, error) {
+	cfg, err := newPrepareConfig(options...)
+	if err != nil {
+		return "", 0, err
+	}
+	blob, err := marshalConfigBlob(b, cfg)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(cfg.compressions) > 0 && !cfg.artifactManifest {
+		if blob, err = compressConfig(blob, cfg.compressions[0]); err != nil {
+			return "", 0, err
+		}
+	}
+	return cfg.digestAlgorithm.FromBytes(blob), int64(len(blob)), nil
+}
+
+// marshalConfigBlob serializes the bundle to the uncompressed config blob, checking its size limit
+func marshalConfigBlob(b *bundle.Bundle, cfg prepareConfig) ([]byte, error) {
+	blob, err := b.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckSizeLimit("config blob", int64(len(blob)), cfg.maxConfigSize); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+func descriptorOf(payload []byte, mediaType string, algorithm digest.Algorithm) ocischemav1.Descriptor {
 	return ocischemav1.Descriptor{
 		MediaType: mediaType,
-		Digest:    digest.FromBytes(payload),
+		Digest:    algorithm.FromBytes(payload),
 		Size:      int64(len(payload)),
 	}
 }
 
+// annotatedDescriptorOf returns the descriptor of a config manifest with a copy of its annotations
+func annotatedDescriptorOf(payload []byte, mediaType string, algorithm digest.Algorithm, annotations map[string]string) ocischemav1.Descriptor {
+	d := descriptorOf(payload, mediaType, algorithm)
+	d.Annotations = copyAnnotations(annotations)
+	return d
+}
+
+// copyAnnotations returns a copy of the annotations, or nil if there are none
+func copyAnnotations(annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		result[k] = v
+	}
+	return result
+}
+
 type bundleConfigPreparer func(blob []byte) (*PreparedBundleConfig, error)
 
-func prepareOCIBundleConfig(mediaType string) bundleConfigPreparer {
+func prepareOCIBundleConfig(mediaType string, algorithm digest.Algorithm, annotations map[string]string) bundleConfigPreparer {
 	return func(blob []byte) (*PreparedBundleConfig, error) {
 		manifest := ocischemav1.Manifest{
 			Versioned: ocischema.Versioned{
 				SchemaVersion: OCIIndexSchemaVersion,
 			},
-			Config: descriptorOf(blob, mediaType),
+			Config:      descriptorOf(blob, mediaType, algorithm),
+			Annotations: copyAnnotations(annotations),
 		}
 		manifestBytes, err := json.Marshal(&manifest)
 		if err != nil {
@@ -78,41 +201,101 @@ func prepareOCIBundleConfig(mediaType string) bundleConfigPreparer {
 			ConfigBlob:           blob,
 			ConfigBlobDescriptor: manifest.Config,
 			Manifest:             manifestBytes,
-			ManifestDescriptor:   descriptorOf(manifestBytes, ocischemav1.MediaTypeImageManifest),
+			ManifestDescriptor:   annotatedDescriptorOf(manifestBytes, ocischemav1.MediaTypeImageManifest, algorithm, annotations),
 		}, nil
 	}
 }
 
-func nonOCIDescriptorOf(blob []byte) distribution.Descriptor {
+// artifactManifest is an image manifest with the artifactType field, missing from the image-spec version in use
+type artifactManifest struct {
+	ocischemav1.Manifest
+	ArtifactType string `json:"artifactType"`
+}
+
+// prepareArtifactBundleConfig prepares an artifact manifest of the given artifact type, with the empty JSON config
+// and the config blob as its only layer
+func prepareArtifactBundleConfig(mediaType string, algorithm digest.Algorithm, annotations map[string]string) bundleConfigPreparer {
+	return func(blob []byte) (*PreparedBundleConfig, error) {
+		manifest := artifactManifest{
+			Manifest: ocischemav1.Manifest{
+				Versioned: ocischema.Versioned{
+					SchemaVersion: OCIIndexSchemaVersion,
+				},
+				MediaType:   ocischemav1.MediaTypeImageManifest,
+				Config:      descriptorOf(emptyJSON, EmptyJSONMediaType, algorithm),
+				Layers:      []ocischemav1.Descriptor{descriptorOf(blob, mediaType, algorithm)},
+				Annotations: copyAnnotations(annotations),
+			},
+			ArtifactType: mediaType,
+		}
+		manifestBytes, err := json.Marshal(&manifest)
+		if err != nil {
+			return nil, err
+		}
+		return &PreparedBundleConfig{
+			ConfigBlob:                blob,
+			ConfigBlobDescriptor:      manifest.Layers[0],
+			EmptyConfigBlob:           emptyJSON,
+			EmptyConfigBlobDescriptor: manifest.Config,
+			Manifest:                  manifestBytes,
+			ManifestDescriptor:        annotatedDescriptorOf(manifestBytes, ocischemav1.MediaTypeImageManifest, algorithm, annotations),
+		}, nil
+	}
+}
+
+// GetBundleConfigBlobDescriptor returns the descriptor of the config blob referenced by a bundle config manifest: its
+// config, or its only layer for an artifact manifest with an empty JSON config
+func GetBundleConfigBlobDescriptor(manifest ocischemav1.Manifest) ocischemav1.Descriptor {
+	if manifest.Config.MediaType == EmptyJSONMediaType && len(manifest.Layers) == 1 {
+		return manifest.Layers[0]
+	}
+	return manifest.Config
+}
+
+func prepareCompressedOCIBundleConfig(mediaType, compression string, algorithm digest.Algorithm, annotations map[string]string) bundleConfigPreparer {
+	return func(blob []byte) (*PreparedBundleConfig, error) {
+		compressed, err := compressConfig(blob, compression)
+		if err != nil {
+			return nil, err
+		}
+		return prepareOCIBundleConfig(mediaType+"+"+compression, algorithm, annotations)(compressed)
+	}
+}
+
+func nonOCIDescriptorOf(blob []byte, algorithm digest.Algorithm) distribution.Descriptor {
 	return distribution.Descriptor{
 		MediaType: schema2.MediaTypeImageConfig,
 		Size:      int64(len(blob)),
-		Digest:    digest.FromBytes(blob),
+		Digest:    algorithm.FromBytes(blob),
 	}
 }
 
-func prepareNonOCIBundleConfig(blob []byte) (*PreparedBundleConfig, error) {
-	desc := nonOCIDescriptorOf(blob)
-	man, err := schema2.FromStruct(schema2.Manifest{
-		Versioned: schema2.SchemaVersion,
-		// Add a descriptor for the configuration because some registries
-		// require the layers property to be defined and non-empty
-		Layers: []distribution.Descriptor{
-			desc,
-		},
-		Config: desc,
-	})
-	if err != nil {
-		return nil, err
-	}
-	manBytes, err := man.MarshalJSON()
-	if err != nil {
-		return nil, err
+// prepareNonOCIBundleConfig prepares a Docker image manifest. It has no annotations field, so the annotations are only
+// set on its descriptor.
+func prepareNonOCIBundleConfig(algorithm digest.Algorithm, annotations map[string]string) bundleConfigPreparer {
+	return func(blob []byte) (*PreparedBundleConfig, error) {
+		desc := nonOCIDescriptorOf(blob, algorithm)
+		man, err := schema2.FromStruct(schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			// Add a descriptor for the configuration because some registries
+			// require the layers property to be defined and non-empty
+			Layers: []distribution.Descriptor{
+				desc,
+			},
+			Config: desc,
+		})
+		if err != nil {
+			return nil, err
+		}
+		manBytes, err := man.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		return &PreparedBundleConfig{
+			ConfigBlob:           blob,
+			ConfigBlobDescriptor: descriptorOf(blob, schema2.MediaTypeImageConfig, algorithm),
+			Manifest:             manBytes,
+			ManifestDescriptor:   annotatedDescriptorOf(manBytes, schema2.MediaTypeManifest, algorithm, annotations),
+		}, nil
 	}
-	return &PreparedBundleConfig{
-		ConfigBlob:           blob,
-		ConfigBlobDescriptor: descriptorOf(blob, schema2.MediaTypeImageConfig),
-		Manifest:             manBytes,
-		ManifestDescriptor:   descriptorOf(manBytes, schema2.MediaTypeManifest),
-	}, nil
 }
@@ -1,9 +1,16 @@
 package converter
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"gotest.tools/v3/assert"
 )
 
@@ -26,3 +33,225 @@ func TestPrepareForPush(t *testing.T) {
 	assert.Equal(t, lastFallback.ManifestDescriptor.MediaType, "application/vnd.docker.distribution.manifest.v2+json")
 	assert.Equal(t, lastFallback.ConfigBlobDescriptor.MediaType, "application/vnd.docker.container.image.v1+json")
 }
+
+func TestPreparedBundleConfigFormats(t *testing.T) {
+	prepared, err := PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	var mediaTypes []string
+	for _, format := range prepared.Formats() {
+		mediaTypes = append(mediaTypes, format.ConfigBlobDescriptor.MediaType)
+		assert.Equal(t, digest.FromBytes(format.ConfigBlob), format.ConfigBlobDescriptor.Digest)
+		assert.Equal(t, digest.FromBytes(format.Manifest), format.ManifestDescriptor.Digest)
+	}
+	assert.DeepEqual(t, []string{CNABConfigMediaType, ocischemav1.MediaTypeImageConfig, schema2.MediaTypeImageConfig}, mediaTypes)
+}
+
+func TestPrepareForPushWithDigestAlgorithm(t *testing.T) {
+	prepared, err := PrepareForPush(tests.MakeTestBundle(), WithDigestAlgorithm(digest.SHA512))
+	assert.NilError(t, err)
+	for _, format := range prepared.Formats() {
+		assert.Equal(t, digest.SHA512.FromBytes(format.ConfigBlob), format.ConfigBlobDescriptor.Digest)
+		assert.Equal(t, digest.SHA512.FromBytes(format.Manifest), format.ManifestDescriptor.Digest)
+		// The manifests reference the config blob with the same algorithm
+		var manifest ocischemav1.Manifest
+		assert.NilError(t, json.Unmarshal(format.Manifest, &manifest))
+		assert.Equal(t, format.ConfigBlobDescriptor.Digest, manifest.Config.Digest)
+	}
+
+	_, err = PrepareForPush(tests.MakeTestBundle(), WithDigestAlgorithm("md5"))
+	assert.ErrorContains(t, err, `unsupported digest algorithm "md5"`)
+}
+
+func TestPrepareForPushWithConfigMediaType(t *testing.T) {
+	b := &bundle.Bundle{}
+	prepared, err := PrepareForPush(b, WithConfigMediaType("application/vnd.example.config.v1+json"))
+	assert.NilError(t, err)
+
+	assert.Equal(t, prepared.ConfigBlobDescriptor.MediaType, "application/vnd.example.config.v1+json")
+	var manifest ocischemav1.Manifest
+	assert.NilError(t, json.Unmarshal(prepared.Manifest, &manifest))
+	assert.DeepEqual(t, prepared.ConfigBlobDescriptor, manifest.Config)
+	// Fallbacks are unchanged
+	assert.Equal(t, prepared.Fallback.ConfigBlobDescriptor.MediaType, "application/vnd.oci.image.config.v1+json")
+	assert.Equal(t, prepared.Fallback.Fallback.ConfigBlobDescriptor.MediaType, "application/vnd.docker.container.image.v1+json")
+
+	// The image config media type is not tried twice
+	prepared, err = PrepareForPush(b, WithConfigMediaType(ocischemav1.MediaTypeImageConfig))
+	assert.NilError(t, err)
+	assert.Equal(t, prepared.Fallback.ConfigBlobDescriptor.MediaType, "application/vnd.docker.container.image.v1+json")
+	assert.Check(t, prepared.Fallback.Fallback == nil)
+
+	_, err = PrepareForPush(b, WithConfigMediaType(""))
+	assert.ErrorContains(t, err, "config media type cannot be empty")
+}
+
+func TestPrepareForPushWithConfigCompression(t *testing.T) {
+	b := &bundle.Bundle{Name: "my-app", Version: "0.1.0", SchemaVersion: "v1.0.0"}
+	uncompressed, err := b.Marshal()
+	assert.NilError(t, err)
+
+	prepared, err := PrepareForPush(b, WithConfigCompression(true))
+	assert.NilError(t, err)
+	var mediaTypes []string
+	for p := prepared; p != nil; p = p.Fallback {
+		mediaTypes = append(mediaTypes, p.ConfigBlobDescriptor.MediaType)
+		// Decompressing gives back the same bundle JSON
+		blob, err := DecompressConfig(p.ConfigBlobDescriptor.MediaType, p.ConfigBlob, 0)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, uncompressed, blob)
+	}
+	assert.DeepEqual(t, []string{
+		"application/vnd.cnab.config.v1+json+zstd",
+		"application/vnd.cnab.config.v1+json+gzip",
+		"application/vnd.cnab.config.v1+json",
+		"application/vnd.oci.image.config.v1+json",
+		"application/vnd.docker.container.image.v1+json",
+	}, mediaTypes)
+
+	// The compression is reproducible
+	again, err := PrepareForPush(b, WithConfigCompression(true))
+	assert.NilError(t, err)
+	assert.Equal(t, prepared.ConfigBlobDescriptor.Digest, again.ConfigBlobDescriptor.Digest)
+	assert.Equal(t, prepared.Fallback.ConfigBlobDescriptor.Digest, again.Fallback.ConfigBlobDescriptor.Digest)
+
+	// Without zstd, gzip is used
+	prepared, err = PrepareForPush(b, WithConfigCompression(false))
+	assert.NilError(t, err)
+	assert.Equal(t, "application/vnd.cnab.config.v1+json+gzip", prepared.ConfigBlobDescriptor.MediaType)
+	assert.Equal(t, "application/vnd.cnab.config.v1+json", prepared.Fallback.ConfigBlobDescriptor.MediaType)
+
+	_, err = DecompressConfig("application/vnd.cnab.config.v1+json+gzip", uncompressed, 0)
+	assert.ErrorContains(t, err, "failed to decompress config blob")
+}
+
+func TestDecompressConfigSizeLimit(t *testing.T) {
+	// Highly compressible, like a decompression bomb
+	uncompressed := bytes.Repeat([]byte{'a'}, 1<<20)
+	for _, compression := range []string{ConfigCompressionGzip, ConfigCompressionZstd} {
+		compressed, err := compressConfig(uncompressed, compression)
+		assert.NilError(t, err)
+		assert.Assert(t, len(compressed) < 1<<12)
+		mediaType := CNABConfigMediaType + "+" + compression
+
+		// A config of exactly the limit is decompressed
+		blob, err := DecompressConfig(mediaType, compressed, 1<<20)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, uncompressed, blob)
+
+		_, err = DecompressConfig(mediaType, compressed, 1<<20-1)
+		var sizeErr *SizeLimitExceededError
+		assert.Assert(t, errors.As(err, &sizeErr), err)
+		assert.Equal(t, "decompressed config blob", sizeErr.Object)
+		assert.Equal(t, int64(1<<20-1), sizeErr.Limit)
+	}
+
+	// The limit defaults to DefaultMaxDecompressedConfigSize
+	compressed, err := compressConfig(make([]byte, DefaultMaxDecompressedConfigSize+1), ConfigCompressionGzip)
+	assert.NilError(t, err)
+	_, err = DecompressConfig(CNABConfigMediaType+"+"+ConfigCompressionGzip, compressed, 0)
+	var sizeErr *SizeLimitExceededError
+	assert.Assert(t, errors.As(err, &sizeErr), err)
+	assert.Equal(t, int64(DefaultMaxDecompressedConfigSize), sizeErr.Limit)
+}
+
+func TestPrepareForPushWithArtifactManifest(t *testing.T) {
+	prepared, err := PrepareForPush(tests.MakeTestBundle(), WithArtifactManifest(), WithConfigCompression(false))
+	assert.NilError(t, err)
+	var manifest map[string]interface{}
+	assert.NilError(t, json.Unmarshal(prepared.Manifest, &manifest))
+	assert.Equal(t, CNABConfigMediaType, manifest["artifactType"])
+	assert.Equal(t, ocischemav1.MediaTypeImageManifest, manifest["mediaType"])
+	// The config is the empty JSON blob, and the uncompressed bundle config the only layer
+	var artifact ocischemav1.Manifest
+	assert.NilError(t, json.Unmarshal(prepared.Manifest, &artifact))
+	assert.DeepEqual(t, ocischemav1.Descriptor{
+		MediaType: EmptyJSONMediaType,
+		Digest:    "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+		Size:      2,
+	}, artifact.Config)
+	assert.DeepEqual(t, prepared.EmptyConfigBlobDescriptor, artifact.Config)
+	assert.Equal(t, "{}", string(prepared.EmptyConfigBlob))
+	assert.DeepEqual(t, []ocischemav1.Descriptor{prepared.ConfigBlobDescriptor}, artifact.Layers)
+	assert.DeepEqual(t, prepared.ConfigBlobDescriptor, GetBundleConfigBlobDescriptor(artifact))
+	expected, err := tests.MakeTestBundle().Marshal()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, expected, prepared.ConfigBlob)
+
+	// The usual formats are the fallbacks
+	var mediaTypes []string
+	for _, format := range prepared.Fallback.Formats() {
+		assert.Assert(t, format.EmptyConfigBlob == nil)
+		mediaTypes = append(mediaTypes, format.ConfigBlobDescriptor.MediaType)
+	}
+	assert.DeepEqual(t, []string{CNABConfigMediaType + "+gzip", CNABConfigMediaType, ocischemav1.MediaTypeImageConfig, schema2.MediaTypeImageConfig}, mediaTypes)
+
+	// The digest of the blob pushed first is the uncompressed one
+	d, size, err := BundleConfigDigest(tests.MakeTestBundle(), WithArtifactManifest(), WithConfigCompression(false))
+	assert.NilError(t, err)
+	assert.Equal(t, prepared.ConfigBlobDescriptor.Digest, d)
+	assert.Equal(t, prepared.ConfigBlobDescriptor.Size, size)
+}
+
+func TestPrepareForPushWithConfigManifestAnnotations(t *testing.T) {
+	annotations := map[string]string{"org.example.commit": "0123abc"}
+	prepared, err := PrepareForPush(tests.MakeTestBundle(), WithConfigManifestAnnotations(annotations), WithArtifactManifest())
+	assert.NilError(t, err)
+	formats := prepared.Formats()
+	assert.Equal(t, 4, len(formats))
+	for _, format := range formats {
+		assert.DeepEqual(t, annotations, format.ManifestDescriptor.Annotations)
+	}
+	// The Docker image manifest has no annotations field, only its descriptor is annotated
+	for _, format := range formats[:3] {
+		var manifest ocischemav1.Manifest
+		assert.NilError(t, json.Unmarshal(format.Manifest, &manifest))
+		assert.DeepEqual(t, annotations, manifest.Annotations)
+	}
+
+	// The descriptors do not share the annotations of the option
+	annotations["org.example.commit"] = "changed"
+	assert.Equal(t, "0123abc", prepared.ManifestDescriptor.Annotations["org.example.commit"])
+
+	_, err = PrepareForPush(tests.MakeTestBundle(), WithConfigManifestAnnotations(map[string]string{"": "value"}))
+	assert.ErrorContains(t, err, "config manifest annotation keys cannot be empty")
+}
+
+func TestPrepareForPushSizeLimits(t *testing.T) {
+	b := &bundle.Bundle{}
+	_, err := PrepareForPush(b, WithMaxConfigSize(1<<20), WithMaxManifestSize(1<<20))
+	assert.NilError(t, err)
+
+	_, err = PrepareForPush(b, WithMaxConfigSize(2))
+	var sizeErr *SizeLimitExceededError
+	assert.Assert(t, errors.As(err, &sizeErr), err)
+	assert.Equal(t, "config blob", sizeErr.Object)
+	assert.Equal(t, int64(2), sizeErr.Limit)
+	assert.ErrorContains(t, err, "config blob size of")
+
+	_, err = PrepareForPush(b, WithMaxManifestSize(10))
+	assert.Assert(t, errors.As(err, &sizeErr), err)
+	assert.Equal(t, "config manifest", sizeErr.Object)
+
+	_, err = PrepareForPush(b, WithMaxConfigSize(-1))
+	assert.ErrorContains(t, err, "max config size cannot be negative")
+}
+
+func TestBundleConfigDigest(t *testing.T) {
+	for _, options := range [][]PrepareOption{
+		nil,
+		{WithDigestAlgorithm(digest.SHA512)},
+		{WithConfigCompression(false)},
+		{WithConfigCompression(true)},
+	} {
+		prepared, err := PrepareForPush(tests.MakeTestBundle(), options...)
+		assert.NilError(t, err)
+		dgst, size, err := BundleConfigDigest(tests.MakeTestBundle(), options...)
+		assert.NilError(t, err)
+		assert.Equal(t, prepared.ConfigBlobDescriptor.Digest, dgst)
+		assert.Equal(t, prepared.ConfigBlobDescriptor.Size, size)
+	}
+
+	_, _, err := BundleConfigDigest(tests.MakeTestBundle(), WithMaxConfigSize(10))
+	var sizeErr *SizeLimitExceededError
+	assert.Assert(t, errors.As(err, &sizeErr), err)
+}
@@ -0,0 +1,108 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/docker/distribution/reference"
+	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// mediaTypeRegexp matches the media types of RFC 6838, as required for the descriptors by the OCI image specification
+var mediaTypeRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}$`)
+
+// ValidateBundleForPush checks that every image of the bundle can be referenced by the index: its reference must be
+// valid, with a tag or a digest, and its media type must be supported.
+// The returned error is a multierror listing every invalid image.
+func ValidateBundleForPush(b *bundle.Bundle) error {
+	var result *multierror.Error
+	if len(b.InvocationImages) != 1 {
+		result = multierror.Append(result, errors.New("only one invocation image supported"))
+	}
+	for i, img := range b.InvocationImages {
+		if err := validateImage(img.BaseImage); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid invocation image %d %q: %w", i, img.Image, err))
+		}
+	}
+	for _, name := range makeSortedImages(b.Images) {
+		img := b.Images[name]
+		if err := validateImage(img.BaseImage); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid image %q %q: %w", name, img.Image, err))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+func validateImage(baseImage bundle.BaseImage) error {
+	if baseImage.Image == "" {
+		return errors.New("image reference is empty")
+	}
+	if IsForeignImage(baseImage.Image) {
+		// An image hosted at a URL is not an image reference, its URL, digest, size and media type are checked instead
+		_, err := makeForeignDescriptor(baseImage)
+		return err
+	}
+	named, err := reference.ParseNormalizedNamed(baseImage.Image)
+	if err != nil {
+		return fmt.Errorf("not a valid image reference: %w", err)
+	}
+	if baseImage.Digest != "" {
+		if _, err := digest.Parse(baseImage.Digest); err != nil {
+			return fmt.Errorf("invalid digest %q: %w", baseImage.Digest, err)
+		}
+	}
+	_, tagged := named.(reference.Tagged)
+	_, digested := named.(reference.Digested)
+	if !tagged && !digested && baseImage.Digest == "" {
+		return errors.New("neither a tag nor a digest is set")
+	}
+	_, err = getMediaType(baseImage, baseImage.Image)
+	return err
+}
+
+// ValidateOCIIndex checks the index against the requirements of the OCI image specification: its schemaVersion must be
+// OCIIndexSchemaVersion, its media type, if set, CNABIndexMediaType or CNABManifestListMediaType, and every descriptor
+// must have a valid media type and digest, a non-negative size, and the os and architecture of its platform, if any.
+// The returned error is a multierror listing every violation.
+func ValidateOCIIndex(ix *ocischemav1.Index) error {
+	var result *multierror.Error
+	switch ix.SchemaVersion {
+	case OCIIndexSchemaVersion:
+	case 0:
+		result = multierror.Append(result, errors.New("schemaVersion is not set"))
+	default:
+		result = multierror.Append(result, fmt.Errorf("unsupported schemaVersion %d, expected %d", ix.SchemaVersion, OCIIndexSchemaVersion))
+	}
+	switch ix.MediaType {
+	case "", CNABIndexMediaType, CNABManifestListMediaType:
+	default:
+		result = multierror.Append(result, fmt.Errorf("unsupported index media type %q, expected %q or %q", ix.MediaType, CNABIndexMediaType, CNABManifestListMediaType))
+	}
+	for i, d := range ix.Manifests {
+		for _, err := range validateDescriptor(d) {
+			result = multierror.Append(result, fmt.Errorf("invalid descriptor %d %s: %w", i, d.Digest, err))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+func validateDescriptor(d ocischemav1.Descriptor) []error {
+	var errs []error
+	if !mediaTypeRegexp.MatchString(d.MediaType) {
+		errs = append(errs, fmt.Errorf("invalid media type %q", d.MediaType))
+	}
+	if err := d.Digest.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid digest: %w", err))
+	}
+	if d.Size < 0 {
+		errs = append(errs, fmt.Errorf("negative size %d", d.Size))
+	}
+	if d.Platform != nil && (d.Platform.OS == "" || d.Platform.Architecture == "") {
+		errs = append(errs, errors.New("platform os and architecture are required"))
+	}
+	return errs
+}
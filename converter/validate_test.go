@@ -0,0 +1,66 @@
+package converter
+
+import (
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/hashicorp/go-multierror"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestValidateBundleForPush(t *testing.T) {
+	assert.NilError(t, ValidateBundleForPush(tests.MakeTestBundle()))
+
+	b := tests.MakeTestBundle()
+	b.InvocationImages[0].Image = ""
+	b.Images["image-1"] = bundle.Image{BaseImage: bundle.BaseImage{Image: "Not A Reference", ImageType: "oci"}}
+	b.Images["image-2"] = bundle.Image{BaseImage: bundle.BaseImage{Image: "my.registry/namespace/image-2", ImageType: "oci"}}
+	b.Images["image-3"] = bundle.Image{BaseImage: bundle.BaseImage{Image: "my.registry/namespace/image-3:tag", MediaType: "application/unknown"}}
+	b.Images["image-4"] = bundle.Image{BaseImage: bundle.BaseImage{Image: "my.registry/namespace/image-4:tag", ImageType: "oci", Digest: "not-a-digest"}}
+	// Images hosted at a URL are valid with a digest and a size
+	b.Images["image-5"] = bundle.Image{BaseImage: bundle.BaseImage{Image: "https://cdn.example.com/image-5/manifest.json", ImageType: "oci",
+		Digest: "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341", Size: 507}}
+	b.Images["image-6"] = bundle.Image{BaseImage: bundle.BaseImage{Image: "https://cdn.example.com/image-6/manifest.json", ImageType: "oci",
+		Digest: "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341"}}
+
+	err := ValidateBundleForPush(b)
+	merr, ok := err.(*multierror.Error)
+	assert.Assert(t, ok, err)
+	assert.Equal(t, 6, len(merr.Errors), err)
+	assert.ErrorContains(t, merr.Errors[0], `invalid invocation image 0 "": image reference is empty`)
+	assert.ErrorContains(t, merr.Errors[1], `invalid image "image-1" "Not A Reference": not a valid image reference`)
+	assert.ErrorContains(t, merr.Errors[2], `invalid image "image-2" "my.registry/namespace/image-2": neither a tag nor a digest is set`)
+	assert.ErrorContains(t, merr.Errors[3], `invalid image "image-3" "my.registry/namespace/image-3:tag": unsupported media type "application/unknown"`)
+	assert.ErrorContains(t, merr.Errors[4], `invalid image "image-4" "my.registry/namespace/image-4:tag": invalid digest "not-a-digest"`)
+	assert.ErrorContains(t, merr.Errors[5], `invalid image "image-6" "https://cdn.example.com/image-6/manifest.json": image "https://cdn.example.com/image-6/manifest.json" size is not set`)
+}
+
+func TestValidateOCIIndex(t *testing.T) {
+	assert.NilError(t, ValidateOCIIndex(tests.MakeTestOCIIndex()))
+
+	ix := tests.MakeTestOCIIndex()
+	ix.SchemaVersion = 0
+	ix.MediaType = "application/json"
+	ix.Manifests[0].MediaType = ""
+	ix.Manifests[1].Digest = "sha256:invalid"
+	ix.Manifests[1].Size = -1
+	ix.Manifests[2].Platform = &ocischemav1.Platform{OS: "linux"}
+
+	err := ValidateOCIIndex(ix)
+	merr, ok := err.(*multierror.Error)
+	assert.Assert(t, ok, err)
+	assert.Equal(t, 6, len(merr.Errors), err)
+	assert.ErrorContains(t, merr.Errors[0], "schemaVersion is not set")
+	assert.ErrorContains(t, merr.Errors[1], `unsupported index media type "application/json"`)
+	assert.ErrorContains(t, merr.Errors[2], `invalid descriptor 0 sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341: invalid media type ""`)
+	assert.ErrorContains(t, merr.Errors[3], "invalid descriptor 1 sha256:invalid: invalid digest")
+	assert.ErrorContains(t, merr.Errors[4], "invalid descriptor 1 sha256:invalid: negative size -1")
+	assert.ErrorContains(t, merr.Errors[5], "invalid descriptor 2")
+	assert.ErrorContains(t, merr.Errors[5], "platform os and architecture are required")
+
+	ix = tests.MakeTestOCIIndex()
+	ix.SchemaVersion = 1
+	assert.ErrorContains(t, ValidateOCIIndex(ix), "unsupported schemaVersion 1, expected 2")
+}
@@ -0,0 +1,140 @@
+package remotes
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// anonymousFallbackResolver is a resolver reading anonymously when its credentials are rejected
+type anonymousFallbackResolver struct {
+	resolver  remotes.Resolver
+	anonymous remotes.Resolver
+}
+
+// NewAnonymousFallbackResolver wraps a resolver sending credentials to retry the resolutions and fetches rejected with
+// a 401 or 403 response with the anonymous resolver, like when the credentials are invalid for a registry serving
+// public bundles. The anonymous requests only ask for the pull scope of the repository.
+// Pushes are never retried anonymously.
+func NewAnonymousFallbackResolver(resolver, anonymous remotes.Resolver) remotes.Resolver {
+	return &anonymousFallbackResolver{resolver: resolver, anonymous: anonymous}
+}
+
+func (r *anonymousFallbackResolver) Resolve(ctx context.Context, ref string) (string, ocischemav1.Descriptor, error) {
+	name, desc, err := r.resolver.Resolve(ctx, ref)
+	if err == nil || !isAuthorizationError(err) {
+		return name, desc, err
+	}
+	log.G(ctx).Debugf("Failed to resolve %s with credentials, trying anonymously: %s", ref, err)
+	return r.anonymous.Resolve(anonymousContext(ctx, ref), ref)
+}
+
+func (r *anonymousFallbackResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	fetcher, err := r.resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	// Once a fetch succeeded anonymously, the next ones skip the rejected credentials
+	var anonymous int32
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+		if atomic.LoadInt32(&anonymous) == 0 {
+			rc, err := openFetch(ctx, fetcher, desc)
+			if err == nil || !isAuthorizationError(err) {
+				return rc, err
+			}
+			log.G(ctx).Debugf("Failed to fetch %s with credentials, trying anonymously: %s", desc.Digest, err)
+		}
+		ctx = anonymousContext(ctx, ref)
+		anonymousFetcher, err := r.anonymous.Fetcher(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := openFetch(ctx, anonymousFetcher, desc)
+		if err == nil {
+			atomic.StoreInt32(&anonymous, 1)
+		}
+		return rc, err
+	}), nil
+}
+
+// openFetch fetches desc and reads its first byte, as the docker fetcher only sends the request, and reports a
+// rejected authorization, on the first read
+func openFetch(ctx context.Context, fetcher remotes.Fetcher, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(rc)
+	if _, err := reader.Peek(1); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	return &peekedReadCloser{Reader: reader, Closer: rc}, nil
+}
+
+type peekedReadCloser struct {
+	*bufio.Reader
+	io.Closer
+}
+
+func (r *anonymousFallbackResolver) ListTags(ctx context.Context, repository string) ([]string, error) {
+	tags, err := listTags(ctx, r.resolver, repository)
+	if err == nil || !isAuthorizationError(err) {
+		return tags, err
+	}
+	log.G(ctx).Debugf("Failed to list the tags of %s with credentials, trying anonymously: %s", repository, err)
+	return listTags(anonymousContext(ctx, repository), r.anonymous, repository)
+}
+
+func (r *anonymousFallbackResolver) ListReferrers(ctx context.Context, repository string, subject digest.Digest) ([]Referrer, error) {
+	referrers, err := listRegistryReferrers(ctx, r.resolver, repository, subject)
+	if err == nil || !isAuthorizationError(err) {
+		return referrers, err
+	}
+	log.G(ctx).Debugf("Failed to list the referrers of %s in %s with credentials, trying anonymously: %s", subject, repository, err)
+	return listRegistryReferrers(anonymousContext(ctx, repository), r.anonymous, repository, subject)
+}
+
+func (r *anonymousFallbackResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return r.resolver.Pusher(ctx, ref)
+}
+
+// anonymousContext seeds the context with the pull scope of the repository of ref, as anonymous tokens are never
+// granted the push scope
+func anonymousContext(ctx context.Context, ref string) context.Context {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ctx
+	}
+	scoped, err := WithRepositoryScope(ctx, named, false)
+	if err != nil {
+		return ctx
+	}
+	return scoped
+}
+
+// isAuthorizationError returns true if the registry or its token server rejected the credentials of a request
+func isAuthorizationError(err error) bool {
+	if errors.Is(err, docker.ErrInvalidAuthorization) {
+		return true
+	}
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden
+	}
+	// The resolver reports the status of the registry responses in the message only
+	message := err.Error()
+	return strings.Contains(message, "401 Unauthorized") || strings.Contains(message, "403 Forbidden")
+}
@@ -0,0 +1,114 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/cli/cli/config/configfile"
+	configtypes "github.com/docker/cli/cli/config/types"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+// newPublicRegistry serves the content of a memory registry to anonymous token holders, rejecting any credentials.
+// The Docker-Content-Digest headers report the digests returned by reportedDigest for each request, if set.
+func newPublicRegistry(t *testing.T, content *memoryRegistry, reportedDigest func(*http.Request, digest.Digest) digest.Digest) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token":"anonymous"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer anonymous" || r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var dgst digest.Digest
+		host := strings.TrimPrefix(server.URL, "http://")
+		if r.URL.Path == "/v2/namespace/my-app/tags/list" {
+			serveTagsList(w, r, content, host+"/namespace/my-app")
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v2/namespace/my-app/manifests/sha256:"), strings.HasPrefix(r.URL.Path, "/v2/namespace/my-app/blobs/"):
+			dgst = digest.Digest(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		case strings.HasPrefix(r.URL.Path, "/v2/namespace/my-app/manifests/"):
+			dgst = content.tags[host+"/namespace/my-app:"+strings.TrimPrefix(r.URL.Path, "/v2/namespace/my-app/manifests/")]
+		}
+		payload, ok := content.content[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", content.descriptors[dgst].MediaType)
+		if reportedDigest != nil {
+			w.Header().Set("Docker-Content-Digest", reportedDigest(r, dgst).String())
+		} else {
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(payload)
+		}
+	}))
+	return server
+}
+
+func TestNewResolverWithAnonymousReadFallback(t *testing.T) {
+	content := newMemoryRegistry()
+	server := newPublicRegistry(t, content, nil)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, err := reference.ParseNormalizedNamed(host + "/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	relocationMap, err := relocateToRepository(tests.MakeRelocationMap(), ref)
+	assert.NilError(t, err)
+	_, err = Push(context.Background(), tests.MakeTestBundle(), relocationMap, ref, content, false)
+	assert.NilError(t, err)
+
+	cfg := configfile.New("")
+	cfg.AuthConfigs[host] = configtypes.AuthConfig{Username: "user", Password: "invalid"}
+
+	// The invalid credentials are rejected
+	_, _, _, err = PullWithOptions(context.Background(), ref, NewResolver(ResolverOptions{ConfigFile: cfg, PlainHTTPRegistries: []string{host}}), WithoutBundleValidation())
+	assert.ErrorContains(t, err, "401 Unauthorized")
+
+	resolver := NewResolver(ResolverOptions{ConfigFile: cfg, PlainHTTPRegistries: []string{host}, AnonymousReadFallback: true})
+	b, _, _, err := PullWithOptions(context.Background(), ref, resolver, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+
+	// Pushes are not retried anonymously
+	_, err = Push(context.Background(), tests.MakeTestBundle(), relocationMap, ref, resolver, false)
+	assert.ErrorContains(t, err, "401 Unauthorized")
+}
+
+// serveTagsList serves the tags of the repository, two per page
+func serveTagsList(w http.ResponseWriter, r *http.Request, content *memoryRegistry, repository string) {
+	var tags []string
+	for ref := range content.tags {
+		if tag := strings.TrimPrefix(ref, repository+":"); tag != ref && tag > r.URL.Query().Get("last") {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	if len(tags) > 2 {
+		tags = tags[:2]
+		w.Header().Set("Link", fmt.Sprintf(`<%s?last=%s&n=2>; rel="next"`, r.URL.Path, tags[1]))
+	}
+	_ = json.NewEncoder(w).Encode(tagList{Name: "namespace/my-app", Tags: tags})
+}
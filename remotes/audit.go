@@ -0,0 +1,20 @@
+package remotes
+
+import (
+	"time"
+
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AuditEvent records a payload durably written to a registry by a push
+type AuditEvent struct {
+	// Reference is the reference the payload was pushed to
+	Reference string
+	// Descriptor is the descriptor of the pushed payload, as committed
+	Descriptor ocischemav1.Descriptor
+	// Time is the time of the commit, in UTC
+	Time time.Time
+}
+
+// AuditFunc is called with an AuditEvent after each successful commit of a pushed payload, possibly concurrently
+type AuditFunc func(AuditEvent)
@@ -0,0 +1,288 @@
+package remotes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BlobStore is a plain object storage, like an S3 or a GCS bucket, holding the bundles of a repository without
+// registry. The keys are slash separated paths, like "blobs/sha256/<encoded digest>".
+type BlobStore interface {
+	// Put stores the content read from r under key, replacing any previous content
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Exists returns true if content is stored under key
+	Exists(ctx context.Context, key string) (bool, error)
+	// Get returns the content stored under key, or an error wrapping errdefs.ErrNotFound if there is none
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// PushToBlobStore pushes a bundle to a blob store instead of a registry, like Push: the config blob, the config
+// manifest and the index are stored under keys derived from their digests, in the layout of an oci-layout directory,
+// and the index.json pointer references the index under the tag of ref. Blobs already stored are skipped. The pointer
+// is updated by read-modify-write, so concurrent pushes of different tags to the same store must be serialized by the
+// caller. Fallbacks are never used as a blob store accepts any media type.
+func PushToBlobStore(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	store BlobStore,
+	options ...PushOption) (ocischemav1.Descriptor, error) {
+	options = append(options[:len(options):len(options)], WithAllowFallbacks(false))
+	return PushWithOptions(ctx, b, relocationMap, ref, NewBlobStoreResolver(store), options...)
+}
+
+// PullFromBlobStore pulls a bundle pushed to a blob store by PushToBlobStore, like PullWithOptions
+func PullFromBlobStore(ctx context.Context, ref reference.Named, store BlobStore, options ...PullOption) (*bundle.Bundle, relocation.ImageRelocationMap, digest.Digest, error) {
+	return PullWithOptions(ctx, ref, NewBlobStoreResolver(store), options...)
+}
+
+// NewBlobStoreResolver returns a resolver pushing to and fetching from a blob store, resolving the tags with its
+// index.json pointer. The repository of the references is ignored, a blob store holding a single repository.
+func NewBlobStoreResolver(store BlobStore) remotes.Resolver {
+	return &blobStoreResolver{store: store}
+}
+
+// blobStoreResolver is a remotes.Resolver on a blob store
+type blobStoreResolver struct {
+	store BlobStore
+	// mut serializes the updates of the pointer
+	mut sync.Mutex
+}
+
+// blobKey returns the key of the blob of the digest
+func blobKey(dgst digest.Digest) string {
+	return path.Join(layoutBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func (r *blobStoreResolver) Resolve(ctx context.Context, ref string) (string, ocischemav1.Descriptor, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", ocischemav1.Descriptor{}, err
+	}
+	pointer, err := r.readPointer(ctx)
+	if err != nil {
+		return "", ocischemav1.Descriptor{}, err
+	}
+	for _, d := range pointer.Manifests {
+		if matchesPointer(named, d) {
+			d.Annotations = nil
+			return ref, d, nil
+		}
+	}
+	return "", ocischemav1.Descriptor{}, fmt.Errorf("%s: %w", ref, errdefs.ErrNotFound)
+}
+
+// matchesPointer returns true if the descriptor of the pointer is the one referenced by the digest or the tag of ref
+func matchesPointer(ref reference.Named, d ocischemav1.Descriptor) bool {
+	if digested, ok := ref.(reference.Digested); ok {
+		return d.Digest == digested.Digest()
+	}
+	tagged, ok := reference.TagNameOnly(ref).(reference.Tagged)
+	return ok && d.Annotations[ocischemav1.AnnotationRefName] == tagged.Tag()
+}
+
+func (r *blobStoreResolver) Fetcher(_ context.Context, _ string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+		return r.store.Get(ctx, blobKey(desc.Digest))
+	}), nil
+}
+
+func (r *blobStoreResolver) Pusher(_ context.Context, ref string) (remotes.Pusher, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+	var tag string
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return remotes.PusherFunc(func(ctx context.Context, desc ocischemav1.Descriptor) (content.Writer, error) {
+		exists, err := r.store.Exists(ctx, blobKey(desc.Digest))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			// The tag is moved even if the index is already stored
+			if tag != "" {
+				if err := r.updatePointer(ctx, tag, desc); err != nil {
+					return nil, err
+				}
+			}
+			return nil, fmt.Errorf("blob %s: %w", desc.Digest, errdefs.ErrAlreadyExists)
+		}
+		return &blobStoreWriter{resolver: r, tag: tag, desc: desc}, nil
+	}), nil
+}
+
+// readPointer reads the index.json pointer, or returns an empty index if there is none yet
+func (r *blobStoreResolver) readPointer(ctx context.Context) (ocischemav1.Index, error) {
+	rc, err := r.store.Get(ctx, layoutIndexFile)
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return ocischemav1.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocischemav1.MediaTypeImageIndex}, nil
+	}
+	if err != nil {
+		return ocischemav1.Index{}, err
+	}
+	defer rc.Close()
+	var pointer ocischemav1.Index
+	if err := json.NewDecoder(rc).Decode(&pointer); err != nil {
+		return ocischemav1.Index{}, fmt.Errorf("invalid %s: %w", layoutIndexFile, err)
+	}
+	return pointer, nil
+}
+
+// updatePointer references the descriptor under the tag in the index.json pointer, replacing the descriptor of the
+// tag if any. The oci-layout file is stored along with the first pointer.
+func (r *blobStoreResolver) updatePointer(ctx context.Context, tag string, desc ocischemav1.Descriptor) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	pointer, err := r.readPointer(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pointer.Manifests) == 0 {
+		layout, err := json.Marshal(ocischemav1.ImageLayout{Version: ocischemav1.ImageLayoutVersion})
+		if err != nil {
+			return err
+		}
+		if err := r.store.Put(ctx, ocischemav1.ImageLayoutFile, bytes.NewReader(layout)); err != nil {
+			return err
+		}
+	}
+	manifests := []ocischemav1.Descriptor{}
+	for _, d := range pointer.Manifests {
+		if d.Annotations[ocischemav1.AnnotationRefName] != tag {
+			manifests = append(manifests, d)
+		}
+	}
+	pointer.Manifests = append(manifests, ocischemav1.Descriptor{
+		MediaType:   desc.MediaType,
+		Digest:      desc.Digest,
+		Size:        desc.Size,
+		Annotations: map[string]string{ocischemav1.AnnotationRefName: tag},
+	})
+	payload, err := json.Marshal(pointer)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(ctx, layoutIndexFile, bytes.NewReader(payload))
+}
+
+// blobStoreWriter buffers a pushed payload, and stores it on commit once its digest is verified
+type blobStoreWriter struct {
+	resolver *blobStoreResolver
+	tag      string
+	desc     ocischemav1.Descriptor
+	buf      bytes.Buffer
+}
+
+func (w *blobStoreWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *blobStoreWriter) Close() error {
+	return nil
+}
+
+func (w *blobStoreWriter) Digest() digest.Digest {
+	return w.desc.Digest.Algorithm().FromBytes(w.buf.Bytes())
+}
+
+func (w *blobStoreWriter) Commit(ctx context.Context, size int64, expected digest.Digest, _ ...content.Opt) error {
+	if size > 0 && size != int64(w.buf.Len()) {
+		return fmt.Errorf("unexpected commit size %d, expected %d: %w", w.buf.Len(), size, errdefs.ErrFailedPrecondition)
+	}
+	if actual := expected.Algorithm().FromBytes(w.buf.Bytes()); actual != expected {
+		return fmt.Errorf("unexpected commit digest %s, expected %s: %w", actual, expected, errdefs.ErrFailedPrecondition)
+	}
+	if err := w.resolver.store.Put(ctx, blobKey(expected), bytes.NewReader(w.buf.Bytes())); err != nil {
+		return err
+	}
+	if w.tag == "" {
+		return nil
+	}
+	return w.resolver.updatePointer(ctx, w.tag, w.desc)
+}
+
+func (w *blobStoreWriter) Status() (content.Status, error) {
+	return content.Status{Ref: w.desc.Digest.String(), Offset: int64(w.buf.Len()), Total: w.desc.Size}, nil
+}
+
+func (w *blobStoreWriter) Truncate(size int64) error {
+	if size < 0 || size > int64(w.buf.Len()) {
+		return fmt.Errorf("invalid truncate size %d", size)
+	}
+	w.buf.Truncate(int(size))
+	return nil
+}
+
+// MemoryBlobStore is a BlobStore in memory, for tests
+type MemoryBlobStore struct {
+	mut     sync.Mutex
+	content map[string][]byte
+}
+
+// NewMemoryBlobStore returns an empty MemoryBlobStore
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{content: map[string][]byte{}}
+}
+
+// Put stores the content read from r under key
+func (s *MemoryBlobStore) Put(_ context.Context, key string, r io.Reader) error {
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.content[key] = payload
+	return nil
+}
+
+// Exists returns true if content is stored under key
+func (s *MemoryBlobStore) Exists(_ context.Context, key string) (bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	_, ok := s.content[key]
+	return ok, nil
+}
+
+// Get returns the content stored under key
+func (s *MemoryBlobStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	payload, ok := s.content[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, errdefs.ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(payload)), nil
+}
+
+// Keys returns the keys of the stored content
+func (s *MemoryBlobStore) Keys() []string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	keys := make([]string, 0, len(s.content))
+	for key := range s.content {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,88 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func readPointer(t *testing.T, store *MemoryBlobStore) ocischemav1.Index {
+	t.Helper()
+	rc, err := store.Get(context.Background(), "index.json")
+	assert.NilError(t, err)
+	defer rc.Close()
+	payload, err := io.ReadAll(rc)
+	assert.NilError(t, err)
+	var pointer ocischemav1.Index
+	assert.NilError(t, json.Unmarshal(payload, &pointer))
+	return pointer
+}
+
+func TestBlobStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryBlobStore()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	descriptor, err := PushToBlobStore(ctx, tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, store)
+	assert.NilError(t, err)
+	assert.Equal(t, tests.BundleDigest, descriptor.Digest)
+
+	// The blobs are stored by digest, along with the pointer
+	bundleConfig, err := converter.PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	expected := []string{
+		blobKey(bundleConfig.ConfigBlobDescriptor.Digest),
+		blobKey(bundleConfig.ManifestDescriptor.Digest),
+		blobKey(descriptor.Digest),
+		"index.json",
+		"oci-layout",
+	}
+	sort.Strings(expected)
+	assert.DeepEqual(t, expected, store.Keys())
+	pointer := readPointer(t, store)
+	assert.Equal(t, 1, len(pointer.Manifests))
+	assert.Equal(t, descriptor.Digest, pointer.Manifests[0].Digest)
+	assert.Equal(t, "my-tag", pointer.Manifests[0].Annotations[ocischemav1.AnnotationRefName])
+
+	b, relocationMap, dgst, err := PullFromBlobStore(ctx, ref, store, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+	assert.DeepEqual(t, tests.MakeRelocationMap(), relocationMap)
+	assert.Equal(t, tests.BundleDigest, dgst)
+
+	// Another tag is added to the pointer, and pushing a tag again moves it
+	other, err := reference.ParseNamed("my.registry/namespace/my-app:other-tag")
+	assert.NilError(t, err)
+	// The options of the caller are left untouched, even with spare capacity
+	options := make([]PushOption, 1, 2)
+	options[0] = WithPushParallelism(1)
+	_, err = PushToBlobStore(ctx, tests.MakeTestBundle(), tests.MakeRelocationMap(), other, store, options...)
+	assert.NilError(t, err)
+	assert.Assert(t, options[:2][1] == nil)
+	changed := tests.MakeTestBundle()
+	changed.Description = "changed"
+	changedDescriptor, err := PushToBlobStore(ctx, changed, tests.MakeRelocationMap(), ref, store)
+	assert.NilError(t, err)
+	pointer = readPointer(t, store)
+	assert.Equal(t, 2, len(pointer.Manifests))
+	assert.Equal(t, tests.BundleDigest, pointer.Manifests[0].Digest)
+	assert.Equal(t, changedDescriptor.Digest, pointer.Manifests[1].Digest)
+	b, _, _, err = PullFromBlobStore(ctx, ref, store, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.Equal(t, "changed", b.Description)
+
+	unknown, err := reference.ParseNamed("my.registry/namespace/my-app:unknown")
+	assert.NilError(t, err)
+	_, _, _, err = PullFromBlobStore(ctx, unknown, store, WithoutBundleValidation())
+	assert.Assert(t, errdefs.IsNotFound(err), err)
+}
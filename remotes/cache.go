@@ -0,0 +1,56 @@
+package remotes
+
+import (
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// BlobCache remembers the content known to exist in registry repositories, so a push can skip the content already
+// pushed instead of asking the registry again. The same digest must still be pushed to other repositories.
+type BlobCache interface {
+	// Has returns true if the content is known to exist in the repository
+	Has(repository string, dgst digest.Digest) bool
+	// Put records that the content exists in the repository
+	Put(repository string, dgst digest.Digest)
+}
+
+// NewMemoryBlobCache returns an in-memory BlobCache, safe for concurrent use
+func NewMemoryBlobCache() BlobCache {
+	return &memoryBlobCache{blobs: map[string]map[digest.Digest]struct{}{}}
+}
+
+type memoryBlobCache struct {
+	blobs map[string]map[digest.Digest]struct{}
+	mut   sync.RWMutex
+}
+
+func (c *memoryBlobCache) Has(repository string, dgst digest.Digest) bool {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	_, ok := c.blobs[repository][dgst]
+	return ok
+}
+
+func (c *memoryBlobCache) Put(repository string, dgst digest.Digest) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.blobs[repository] == nil {
+		c.blobs[repository] = map[digest.Digest]struct{}{}
+	}
+	c.blobs[repository][dgst] = struct{}{}
+}
+
+// cacheRepository returns the repository under which content pushed to ref can be cached. Content pushed under a tag
+// is never cached, as the tag must be updated even if the content already exists.
+func cacheRepository(ref string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", false
+	}
+	if _, tagged := named.(reference.Tagged); tagged {
+		return "", false
+	}
+	return named.Name(), true
+}
@@ -0,0 +1,49 @@
+package remotes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestMemoryBlobCache(t *testing.T) {
+	cache := NewMemoryBlobCache()
+	dgst := digest.FromString("content")
+	assert.Check(t, !cache.Has("my.registry/namespace/my-app", dgst))
+	cache.Put("my.registry/namespace/my-app", dgst)
+	assert.Check(t, cache.Has("my.registry/namespace/my-app", dgst))
+	// The same digest in another repository is unknown
+	assert.Check(t, !cache.Has("my.registry/namespace/other-app", dgst))
+}
+
+func TestPushWithBlobCache(t *testing.T) {
+	cache := NewMemoryBlobCache()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	pusher := &mockPusher{}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher}, WithBlobCache(cache))
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(pusher.pushedDescriptors))
+	assert.Check(t, cache.Has("my.registry/namespace/my-app", pusher.pushedDescriptors[0].Digest))
+
+	// Only the index is pushed again, to update the tag
+	pusher = &mockPusher{}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher}, WithBlobCache(cache))
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(pusher.pushedDescriptors))
+	assert.Equal(t, ocischemav1.MediaTypeImageIndex, pusher.pushedDescriptors[0].MediaType)
+
+	// The bundle config is pushed again to another repository, failing later as the images are not relocated there
+	other, err := reference.ParseNamed("my.registry/namespace/other-app:my-tag")
+	assert.NilError(t, err)
+	pusher = &mockPusher{}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), other, &mockResolver{pusher: pusher}, WithBlobCache(cache))
+	assert.ErrorContains(t, err, "not in the same repository")
+	assert.Equal(t, 2, len(pusher.pushedDescriptors))
+}
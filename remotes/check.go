@@ -0,0 +1,153 @@
+package remotes
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/hashicorp/go-multierror"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// ImageStatus is the reachability of a bundle image checked by CheckBundleImages
+type ImageStatus struct {
+	// Reference is the reference the image was resolved with, relocated if the relocation map has one for the image
+	Reference string
+	// Descriptor is the resolved descriptor, if the image is reachable
+	Descriptor ocischemav1.Descriptor
+	// Err is the reason the image is unreachable, nil if it is reachable
+	Err error
+}
+
+// checkImagesConfig defines the input required for a CheckBundleImages operation
+type checkImagesConfig struct {
+	maxConcurrentJobs int
+	strict            bool
+}
+
+// CheckImagesOption is a helper for configuring a CheckBundleImages
+type CheckImagesOption func(*checkImagesConfig) error
+
+// WithCheckParallelism changes the max number of images resolved concurrently.
+// A value lower or equal to zero keeps the default, bounded by GOMAXPROCS.
+func WithCheckParallelism(maxConcurrentJobs int) CheckImagesOption {
+	return func(cfg *checkImagesConfig) error {
+		if maxConcurrentJobs > 0 {
+			cfg.maxConcurrentJobs = maxConcurrentJobs
+		}
+		return nil
+	}
+}
+
+// WithStrictImageCheck makes CheckBundleImages fail with a multierror reporting every unreachable image, instead of
+// only reporting them in the returned statuses.
+func WithStrictImageCheck() CheckImagesOption {
+	return func(cfg *checkImagesConfig) error {
+		cfg.strict = true
+		return nil
+	}
+}
+
+// CheckBundleImages resolves the invocation images and the component images of a pulled bundle, at their relocated
+// reference if the relocation map has one, to confirm each of them can be fetched before deploying the bundle. The
+// returned statuses are keyed by the image reference of the bundle, like the relocation map. An image is unreachable
+// if it cannot be resolved, or if it resolves to another digest than the one recorded in the bundle.
+// The images hosted at a URL are not in a registry, so they are not checked and have no status.
+// The images are resolved concurrently, bounded by the configured parallelism. The check stops with the error of the
+// context once it is done.
+func CheckBundleImages(ctx context.Context, b *bundle.Bundle, relocationMap relocation.ImageRelocationMap, resolver remotes.Resolver,
+	options ...CheckImagesOption) (map[string]ImageStatus, error) {
+	log.G(ctx).Debug("Checking bundle images")
+	cfg := checkImagesConfig{maxConcurrentJobs: runtime.GOMAXPROCS(0)}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	baseImages := make([]bundle.BaseImage, 0, len(b.InvocationImages)+len(b.Images))
+	for _, img := range b.InvocationImages {
+		if !converter.IsForeignImage(img.Image) {
+			baseImages = append(baseImages, img.BaseImage)
+		}
+	}
+	for _, name := range sortedImageNames(b.Images) {
+		if img := b.Images[name]; !converter.IsForeignImage(img.Image) {
+			baseImages = append(baseImages, img.BaseImage)
+		}
+	}
+
+	var mut sync.Mutex
+	statuses := make(map[string]ImageStatus, len(baseImages))
+	group := &errgroup.Group{}
+	group.SetLimit(cfg.maxConcurrentJobs)
+	for _, baseImage := range baseImages {
+		baseImage := baseImage
+		group.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			status := checkImage(ctx, baseImage, relocationMap, resolver)
+			mut.Lock()
+			defer mut.Unlock()
+			statuses[baseImage.Image] = status
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !cfg.strict {
+		return statuses, nil
+	}
+	var result *multierror.Error
+	for _, image := range sortedStatusImages(statuses) {
+		if status := statuses[image]; status.Err != nil {
+			result = multierror.Append(result, fmt.Errorf("image %q is unreachable at %q: %w", image, status.Reference, status.Err))
+		}
+	}
+	return statuses, result.ErrorOrNil()
+}
+
+func checkImage(ctx context.Context, baseImage bundle.BaseImage, relocationMap relocation.ImageRelocationMap, resolver remotes.Resolver) ImageStatus {
+	status := ImageStatus{Reference: baseImage.Image}
+	if relocated, ok := relocationMap[baseImage.Image]; ok {
+		status.Reference = relocated
+	}
+	named, err := reference.ParseNormalizedNamed(status.Reference)
+	if err != nil {
+		status.Err = fmt.Errorf("%q is not a valid reference: %w", status.Reference, err)
+		return status
+	}
+	_, descriptor, err := resolver.Resolve(withMutedContext(ctx), reference.TagNameOnly(named).String())
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	if baseImage.Digest != "" && descriptor.Digest.String() != baseImage.Digest {
+		status.Err = fmt.Errorf("resolved digest %s does not match the bundle digest %s", descriptor.Digest, baseImage.Digest)
+		return status
+	}
+	status.Descriptor = descriptor
+	return status
+}
+
+func sortedStatusImages(statuses map[string]ImageStatus) []string {
+	images := make([]string, 0, len(statuses))
+	for image := range statuses {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
@@ -0,0 +1,70 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestCheckBundleImages(t *testing.T) {
+	registry := newMemoryRegistry()
+	b := tests.MakeTestBundle()
+	// another-image is missing from the registry
+	for _, img := range []string{b.InvocationImages[0].Digest, b.Images["image-1"].Digest} {
+		registry.descriptors[digest.Digest(img)] = ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: digest.Digest(img), Size: 507}
+	}
+	relocationMap := tests.MakeRelocationMap()
+
+	statuses, err := CheckBundleImages(context.Background(), b, relocationMap, registry, WithCheckParallelism(2))
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(statuses))
+	for _, image := range []string{"my.registry/namespace/my-app-invoc", "my.registry/namespace/image-1"} {
+		assert.NilError(t, statuses[image].Err)
+		assert.Equal(t, relocationMap[image], statuses[image].Reference)
+		assert.Equal(t, relocationMap[image], "my.registry/namespace/my-app@"+statuses[image].Descriptor.Digest.String())
+	}
+	missing := statuses["my.registry/namespace/another-image"]
+	assert.Equal(t, relocationMap["my.registry/namespace/another-image"], missing.Reference)
+	assert.Assert(t, errdefs.IsNotFound(missing.Err), missing.Err)
+
+	// A relocation to another digest than the bundle one is reported
+	relocationMap["my.registry/namespace/image-1"] = "my.registry/namespace/my-app@" + b.InvocationImages[0].Digest
+	statuses, err = CheckBundleImages(context.Background(), b, relocationMap, registry, WithStrictImageCheck())
+	assert.ErrorContains(t, err, `image "my.registry/namespace/another-image" is unreachable at "my.registry/namespace/my-app@sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0342"`)
+	assert.ErrorContains(t, err, `image "my.registry/namespace/image-1" is unreachable`)
+	assert.ErrorContains(t, statuses["my.registry/namespace/image-1"].Err, "does not match the bundle digest")
+	assert.NilError(t, statuses["my.registry/namespace/my-app-invoc"].Err)
+}
+
+func TestCheckBundleImagesSkipsForeignImages(t *testing.T) {
+	registry := newMemoryRegistry()
+	b := tests.MakeTestBundle()
+	for _, img := range []string{b.InvocationImages[0].Digest, b.Images["image-1"].Digest} {
+		registry.descriptors[digest.Digest(img)] = ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: digest.Digest(img), Size: 507}
+	}
+	// another-image is hosted at a URL, not in the registry
+	foreign := b.Images["another-image"]
+	foreign.Image = "https://cdn.example.com/images/another-image/manifest.json"
+	b.Images["another-image"] = foreign
+	relocationMap := tests.MakeRelocationMap()
+	delete(relocationMap, "my.registry/namespace/another-image")
+
+	statuses, err := CheckBundleImages(context.Background(), b, relocationMap, registry, WithStrictImageCheck())
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(statuses))
+	_, ok := statuses[foreign.Image]
+	assert.Assert(t, !ok)
+}
+
+func TestCheckBundleImagesCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := CheckBundleImages(ctx, tests.MakeTestBundle(), tests.MakeRelocationMap(), newMemoryRegistry())
+	assert.Assert(t, errors.Is(err, context.Canceled), err)
+}
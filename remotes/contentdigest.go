@@ -0,0 +1,53 @@
+package remotes
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// contentDigestTransport cross-checks the Docker-Content-Digest header of the responses to manifest and blob requests
+// by digest against the requested digest. The header is optional, so only a mismatch fails the request, with a
+// ContentDigestMismatchError.
+type contentDigestTransport struct {
+	base http.RoundTripper
+}
+
+func (t *contentDigestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp, err
+	}
+	expected, ok := requestedDigest(req)
+	if !ok {
+		return resp, nil
+	}
+	actual, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	// A digest of another algorithm may identify the same content, it cannot be compared
+	if err != nil || actual.Algorithm() != expected.Algorithm() || actual == expected {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, &ContentDigestMismatchError{URL: req.URL.String(), Expected: expected, Actual: actual}
+}
+
+// requestedDigest returns the digest of a manifest or blob request by digest
+func requestedDigest(req *http.Request) (digest.Digest, bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return "", false
+	}
+	path := req.URL.Path
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", false
+	}
+	if !strings.HasSuffix(path[:i], "/manifests") && !strings.HasSuffix(path[:i], "/blobs") {
+		return "", false
+	}
+	dgst, err := digest.Parse(path[i+1:])
+	if err != nil {
+		return "", false
+	}
+	return dgst, true
+}
@@ -0,0 +1,84 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestContentDigestTransport(t *testing.T) {
+	const (
+		expected digest.Digest = "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341"
+		other    digest.Digest = "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0342"
+	)
+	var reported string
+	transport := &contentDigestTransport{base: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+		if reported != "" {
+			resp.Header.Set("Docker-Content-Digest", reported)
+		}
+		return resp, nil
+	})}
+	roundTrip := func(method, path string) error {
+		req, err := http.NewRequest(method, "https://my.registry"+path, nil)
+		assert.NilError(t, err)
+		_, err = transport.RoundTrip(req)
+		return err
+	}
+
+	// Without the header, nothing is checked
+	assert.NilError(t, roundTrip(http.MethodGet, "/v2/namespace/my-app/manifests/"+expected.String()))
+	reported = expected.String()
+	assert.NilError(t, roundTrip(http.MethodGet, "/v2/namespace/my-app/manifests/"+expected.String()))
+
+	reported = other.String()
+	err := roundTrip(http.MethodHead, "/v2/namespace/my-app/manifests/"+expected.String())
+	var mismatchErr *ContentDigestMismatchError
+	assert.Assert(t, errors.As(err, &mismatchErr), err)
+	assert.Equal(t, expected, mismatchErr.Expected)
+	assert.Equal(t, other, mismatchErr.Actual)
+	assert.Check(t, errors.As(roundTrip(http.MethodGet, "/v2/namespace/my-app/blobs/"+expected.String()), &mismatchErr))
+
+	// Requests by tag, pushes, and digests of another algorithm are not checked
+	assert.NilError(t, roundTrip(http.MethodGet, "/v2/namespace/my-app/manifests/my-tag"))
+	assert.NilError(t, roundTrip(http.MethodPut, "/v2/namespace/my-app/manifests/"+expected.String()))
+	reported = digest.SHA512.FromString("content").String()
+	assert.NilError(t, roundTrip(http.MethodGet, "/v2/namespace/my-app/manifests/"+expected.String()))
+}
+
+func TestPullDetectsContentDigestMismatch(t *testing.T) {
+	content := newMemoryRegistry()
+	// The tag resolves correctly, but the requests by digest report another digest
+	server := newPublicRegistry(t, content, func(r *http.Request, dgst digest.Digest) digest.Digest {
+		if strings.Contains(r.URL.Path, "/manifests/sha256:") {
+			return "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341"
+		}
+		return dgst
+	})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, err := reference.ParseNormalizedNamed(host + "/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	relocationMap, err := relocateToRepository(tests.MakeRelocationMap(), ref)
+	assert.NilError(t, err)
+	_, err = Push(context.Background(), tests.MakeTestBundle(), relocationMap, ref, content, false)
+	assert.NilError(t, err)
+
+	_, _, _, err = PullWithOptions(context.Background(), ref, NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}}), WithoutBundleValidation())
+	var mismatchErr *ContentDigestMismatchError
+	assert.Assert(t, errors.As(err, &mismatchErr), err)
+	assert.Equal(t, digest.Digest("sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341"), mismatchErr.Actual)
+}
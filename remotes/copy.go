@@ -0,0 +1,122 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Copy copies a bundle from srcRef to dstRef: the bundle config, every image manifest referenced by the index with
+// its layers, and finally the index itself. Blobs are mounted from the source repository when both references are on
+// the same registry, and downloaded from the source then uploaded to the destination otherwise.
+// The index only references its manifests by digest, so it is pushed unchanged and keeps its digest.
+func Copy(ctx context.Context, srcRef, dstRef reference.Named, srcResolver, dstResolver remotes.Resolver) (ocischemav1.Descriptor, error) {
+	logger := log.G(ctx)
+	logger.Debugf("Copying CNAB Bundle %s to %s", srcRef, dstRef)
+
+	index, indexDescriptor, err := getIndex(ctx, srcRef, srcResolver)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	if _, err := converter.GetBundleConfigManifestDescriptor(&index); err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to copy bundle %q: %w", srcRef, err)
+	}
+
+	ctx = withMutedContext(ctx)
+	srcRepo := reference.TrimNamed(srcRef)
+	fetcher, err := srcResolver.Fetcher(ctx, srcRepo.Name())
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	pusher, err := dstResolver.Pusher(ctx, dstRef.Name())
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	copier := &bundleCopier{
+		fetcher:     fetcher,
+		pusher:      pusher,
+		source:      srcRepo,
+		getChildren: images.ChildrenHandler(&imageContentProvider{fetcher}),
+		copied:      map[digest.Digest]struct{}{},
+	}
+	for _, d := range index.Manifests {
+		if err := copier.copy(ctx, d); err != nil {
+			return ocischemav1.Descriptor{}, fmt.Errorf("failed to copy bundle %q to %q: %w", srcRef, dstRef, err)
+		}
+	}
+
+	// Push the index last, under the destination tag, once all its manifests are present
+	logger.Debugf("Copying CNAB Index %s", indexDescriptor.Digest)
+	indexPusher, err := dstResolver.Pusher(ctx, reference.TagNameOnly(dstRef).String())
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	if err := copyDescriptor(ctx, fetcher, indexPusher, srcRepo, indexDescriptor); err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to copy bundle manifest %q to %q: %w", srcRef, dstRef, err)
+	}
+
+	logger.Debug("CNAB Bundle copied")
+	return indexDescriptor, nil
+}
+
+// bundleCopier copies descriptors and their children, depth first, so a manifest is only pushed once all the blobs
+// it references are present in the destination repository.
+type bundleCopier struct {
+	fetcher     remotes.Fetcher
+	pusher      remotes.Pusher
+	source      reference.Named
+	getChildren images.HandlerFunc
+	copied      map[digest.Digest]struct{}
+}
+
+func (c *bundleCopier) copy(ctx context.Context, desc ocischemav1.Descriptor) error {
+	if _, ok := c.copied[desc.Digest]; ok {
+		return nil
+	}
+	c.copied[desc.Digest] = struct{}{}
+	children, err := c.getChildren.Handle(ctx, desc)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := c.copy(ctx, child); err != nil {
+			return err
+		}
+	}
+	return copyDescriptor(ctx, c.fetcher, c.pusher, c.source, desc)
+}
+
+func copyDescriptor(ctx context.Context, fetcher remotes.Fetcher, pusher remotes.Pusher, source reference.Named, desc ocischemav1.Descriptor) error {
+	if isNonDistributable(desc) {
+		// Foreign layers are not stored in the registry
+		return nil
+	}
+	writer, err := pushWithMountFallback(ctx, pusher, source, desc)
+	if errors.Is(err, errdefs.ErrAlreadyExists) {
+		// Already present, or mounted from the source repository
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to push %s: %w", desc.Digest, err)
+	}
+	defer writer.Close()
+	reader, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", desc.Digest, err)
+	}
+	defer reader.Close()
+	if err := content.Copy(ctx, writer, reader, desc.Size, desc.Digest); err != nil && !errors.Is(err, errdefs.ErrAlreadyExists) {
+		return fmt.Errorf("failed to copy %s: %w", desc.Digest, err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func makeCopySource(t *testing.T) (contentFetcher, ocischemav1.Descriptor) {
+	t.Helper()
+	fetcher := contentFetcher{}
+
+	// An image with a config and a layer
+	imageConfig := fetcher.add([]byte("{}"), ocischemav1.MediaTypeImageConfig)
+	layer := fetcher.add([]byte("layer"), ocischemav1.MediaTypeImageLayerGzip)
+	imageManifest, err := json.Marshal(ocischemav1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    imageConfig,
+		Layers:    []ocischemav1.Descriptor{layer},
+	})
+	assert.NilError(t, err)
+	imageManifestDescriptor := fetcher.add(imageManifest, ocischemav1.MediaTypeImageManifest)
+	imageManifestDescriptor.Annotations = map[string]string{
+		converter.CNABDescriptorTypeAnnotation:          string(converter.CNABDescriptorTypeComponent),
+		converter.CNABDescriptorComponentNameAnnotation: "image-1",
+	}
+
+	// The bundle config
+	bundleConfig, err := converter.PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	fetcher.add(bundleConfig.ConfigBlob, bundleConfig.ConfigBlobDescriptor.MediaType)
+	configManifestDescriptor := fetcher.add(bundleConfig.Manifest, bundleConfig.ManifestDescriptor.MediaType)
+	configManifestDescriptor.Annotations = map[string]string{
+		converter.CNABDescriptorTypeAnnotation: string(converter.CNABDescriptorTypeConfig),
+	}
+
+	index, err := json.Marshal(ocischemav1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocischemav1.Descriptor{configManifestDescriptor, imageManifestDescriptor},
+	})
+	assert.NilError(t, err)
+	return fetcher, fetcher.add(index, ocischemav1.MediaTypeImageIndex)
+}
+
+func TestCopy(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	srcResolver := &mockResolver{
+		fetcher:             fetcher,
+		resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+	}
+	pusher := &mockPusher{}
+	dstResolver := &mockResolver{pusher: pusher}
+	srcRef, err := reference.ParseNamed("staging.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	dstRef, err := reference.ParseNamed("prod.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	descriptor, err := Copy(context.Background(), srcRef, dstRef, srcResolver, dstResolver)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, indexDescriptor, descriptor)
+
+	// Every payload is copied once, children first, with the same content
+	assert.Equal(t, len(fetcher), len(pusher.pushedDescriptors))
+	pushed := map[digest.Digest]struct{}{}
+	for i, d := range pusher.pushedDescriptors {
+		assert.Equal(t, string(fetcher[d.Digest]), pusher.buffers[i].String())
+		// The source repository is given as a hint for cross repository mounts of the blobs
+		if isManifest(d.MediaType) {
+			_, ok := d.Annotations["containerd.io/distribution.source.staging.registry"]
+			assert.Assert(t, !ok)
+		} else {
+			assert.Equal(t, "namespace/my-app", d.Annotations["containerd.io/distribution.source.staging.registry"])
+		}
+		pushed[d.Digest] = struct{}{}
+	}
+	assert.Equal(t, len(fetcher), len(pushed))
+	assert.Equal(t, indexDescriptor.Digest, pusher.pushedDescriptors[len(pusher.pushedDescriptors)-1].Digest)
+	assert.DeepEqual(t, []string{"prod.registry/namespace/my-app", "prod.registry/namespace/my-app:my-tag"}, dstResolver.pushedReferences)
+}
+
+func TestCopyMountsBlobsInTheSameRegistry(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	registry := newUploadRegistry(t)
+	// Serve the copy source from the namespace/source repository
+	var index ocischemav1.Index
+	assert.NilError(t, json.Unmarshal(fetcher[indexDescriptor.Digest], &index))
+	registry.addManifest("namespace/source", "my-tag", indexDescriptor.MediaType, fetcher[indexDescriptor.Digest])
+	var blobs []digest.Digest
+	for _, d := range index.Manifests {
+		registry.addManifest("namespace/source", d.Digest.String(), d.MediaType, fetcher[d.Digest])
+		var manifest ocischemav1.Manifest
+		assert.NilError(t, json.Unmarshal(fetcher[d.Digest], &manifest))
+		for _, blob := range append([]ocischemav1.Descriptor{manifest.Config}, manifest.Layers...) {
+			blobs = append(blobs, registry.addBlob("namespace/source", fetcher[blob.Digest]))
+		}
+	}
+	resolver := registry.resolver()
+	srcRef, err := reference.ParseNamed(registry.host() + "/namespace/source:my-tag")
+	assert.NilError(t, err)
+	dstRef, err := reference.ParseNamed(registry.host() + "/namespace/target:my-tag")
+	assert.NilError(t, err)
+
+	descriptor, err := Copy(context.Background(), srcRef, dstRef, resolver, resolver)
+	assert.NilError(t, err)
+	assert.Equal(t, indexDescriptor.Digest, descriptor.Digest)
+	// Every blob is mounted from the path of the source repository instead of being uploaded
+	var expected []mountRequest
+	for _, d := range blobs {
+		expected = append(expected, mountRequest{Repository: "namespace/target", From: "namespace/source", Digest: d})
+		assert.Assert(t, registry.hasBlob("namespace/target", d))
+	}
+	assert.DeepEqual(t, expected, registry.mounts)
+	assert.Equal(t, 0, len(registry.uploads))
+}
+
+func TestCopySkipsExistingBlobs(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	srcResolver := &mockResolver{
+		fetcher:             fetcher,
+		resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+	}
+	// Every blob but the index is already present, or mounted
+	errs := make([]error, len(fetcher))
+	for i := 0; i < len(fetcher)-1; i++ {
+		errs[i] = errdefs.ErrAlreadyExists
+	}
+	pusher := newMockPusher(errs)
+	dstResolver := &mockResolver{pusher: pusher}
+	srcRef, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	dstRef, err := reference.ParseNamed("my.registry/namespace/my-other-app:my-tag")
+	assert.NilError(t, err)
+
+	_, err = Copy(context.Background(), srcRef, dstRef, srcResolver, dstResolver)
+	assert.NilError(t, err)
+	for i := 0; i < len(fetcher)-1; i++ {
+		assert.Equal(t, 0, pusher.buffers[i].Len())
+	}
+	assert.Equal(t, string(fetcher[indexDescriptor.Digest]), pusher.buffers[len(fetcher)-1].String())
+}
+
+func TestCopySkipsNonDistributableLayers(t *testing.T) {
+	fetcher, _ := makeCopySource(t)
+	// A Windows image with a foreign base layer, and a non-distributable layer, none of them in the registry
+	imageConfig := fetcher.add([]byte(`{"os":"windows"}`), ocischemav1.MediaTypeImageConfig)
+	foreignLayer := ocischemav1.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		Size:      42,
+		URLs:      []string{"https://mcr.microsoft.com/v2/windows/servercore/blobs/sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341"},
+	}
+	nonDistributableLayer := ocischemav1.Descriptor{
+		MediaType: ocischemav1.MediaTypeImageLayerNonDistributableGzip,
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0342",
+		Size:      42,
+	}
+	layer := fetcher.add([]byte("windows layer"), ocischemav1.MediaTypeImageLayerGzip)
+	imageManifest, err := json.Marshal(ocischemav1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    imageConfig,
+		Layers:    []ocischemav1.Descriptor{foreignLayer, nonDistributableLayer, layer},
+	})
+	assert.NilError(t, err)
+	imageManifestDescriptor := fetcher.add(imageManifest, ocischemav1.MediaTypeImageManifest)
+	bundleConfig, err := converter.PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	configManifestDescriptor := bundleConfig.ManifestDescriptor
+	configManifestDescriptor.Annotations = map[string]string{
+		converter.CNABDescriptorTypeAnnotation: string(converter.CNABDescriptorTypeConfig),
+	}
+	index, err := json.Marshal(ocischemav1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocischemav1.Descriptor{configManifestDescriptor, imageManifestDescriptor},
+	})
+	assert.NilError(t, err)
+	indexDescriptor := fetcher.add(index, ocischemav1.MediaTypeImageIndex)
+
+	srcResolver := &mockResolver{fetcher: fetcher, resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor}}
+	pusher := &mockPusher{}
+	srcRef, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	dstRef, err := reference.ParseNamed("my.registry/namespace/my-other-app:my-tag")
+	assert.NilError(t, err)
+
+	_, err = Copy(context.Background(), srcRef, dstRef, srcResolver, &mockResolver{pusher: pusher})
+	assert.NilError(t, err)
+	var pushed []digest.Digest
+	for i, d := range pusher.pushedDescriptors {
+		pushed = append(pushed, d.Digest)
+		assert.Check(t, d.Digest != foreignLayer.Digest && d.Digest != nonDistributableLayer.Digest, d.MediaType)
+		// The manifest is copied unchanged, keeping the URLs of the foreign layer
+		if d.Digest == imageManifestDescriptor.Digest {
+			assert.Equal(t, string(imageManifest), pusher.buffers[i].String())
+		}
+	}
+	assert.Assert(t, containsDigest(pushed, layer.Digest))
+}
+
+func TestCopyNotABundle(t *testing.T) {
+	fetcher := contentFetcher{}
+	index, err := json.Marshal(ocischemav1.Index{Versioned: specs.Versioned{SchemaVersion: 2}})
+	assert.NilError(t, err)
+	srcResolver := &mockResolver{
+		fetcher:             fetcher,
+		resolvedDescriptors: []ocischemav1.Descriptor{fetcher.add(index, ocischemav1.MediaTypeImageIndex)},
+	}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	_, err = Copy(context.Background(), ref, ref, srcResolver, &mockResolver{pusher: &mockPusher{}})
+	assert.Check(t, errors.Is(err, converter.ErrBundleConfigNotFound))
+}
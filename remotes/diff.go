@@ -0,0 +1,174 @@
+package remotes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// BundleDiff describes the changes between two pushed bundles.
+// Images are keyed by their name in the bundle, invocation images by their position, like "invocationImages[0]".
+type BundleDiff struct {
+	// AddedImages are the names of the images only referenced by the second bundle
+	AddedImages []string `json:"addedImages,omitempty"`
+	// RemovedImages are the names of the images only referenced by the first bundle
+	RemovedImages []string `json:"removedImages,omitempty"`
+	// RetaggedImages are the images with the same content but a different reference
+	RetaggedImages []ImageChange `json:"retaggedImages,omitempty"`
+	// ChangedImages are the images with a different content
+	ChangedImages []ImageChange `json:"changedImages,omitempty"`
+	// ChangedFields are the top level bundle fields, other than the images, which differ
+	ChangedFields []string `json:"changedFields,omitempty"`
+}
+
+// ImageChange describes an image referenced by both bundles with a different reference or content
+type ImageChange struct {
+	// Name is the name of the image in the bundle
+	Name string `json:"name"`
+	// Before is the image reference in the first bundle
+	Before string `json:"before"`
+	// After is the image reference in the second bundle
+	After string `json:"after"`
+	// BeforeDigest is the digest of the pushed image of the first bundle
+	BeforeDigest digest.Digest `json:"beforeDigest,omitempty"`
+	// AfterDigest is the digest of the pushed image of the second bundle
+	AfterDigest digest.Digest `json:"afterDigest,omitempty"`
+}
+
+// IsEmpty returns true if both bundles are identical
+func (d *BundleDiff) IsEmpty() bool {
+	return len(d.AddedImages) == 0 && len(d.RemovedImages) == 0 && len(d.RetaggedImages) == 0 &&
+		len(d.ChangedImages) == 0 && len(d.ChangedFields) == 0
+}
+
+// ConfigChanged returns true if the bundle configs differ in another field than the images
+func (d *BundleDiff) ConfigChanged() bool {
+	return len(d.ChangedFields) > 0
+}
+
+// Diff pulls the bundles pushed at refA and refB, and describes what changed from the first to the second one.
+// An image pushed with the same digest under a different reference is reported as retagged, not as changed.
+// The bundles are only compared, not run, so they are pulled without the cnab-go bundle validation.
+func Diff(ctx context.Context, refA, refB reference.Named, resolver remotes.Resolver) (*BundleDiff, error) {
+	bundleA, relocationMapA, _, err := PullWithOptions(ctx, refA, resolver, WithoutBundleValidation())
+	if err != nil {
+		return nil, err
+	}
+	bundleB, relocationMapB, _, err := PullWithOptions(ctx, refB, resolver, WithoutBundleValidation())
+	if err != nil {
+		return nil, err
+	}
+	imagesA := diffImages(bundleA, relocationMapA)
+	imagesB := diffImages(bundleB, relocationMapB)
+
+	result := &BundleDiff{}
+	for _, name := range sortedDiffImageNames(imagesA) {
+		a := imagesA[name]
+		b, ok := imagesB[name]
+		switch {
+		case !ok:
+			result.RemovedImages = append(result.RemovedImages, name)
+		case a.digest != b.digest:
+			result.ChangedImages = append(result.ChangedImages, ImageChange{Name: name, Before: a.image, After: b.image, BeforeDigest: a.digest, AfterDigest: b.digest})
+		case a.image != b.image:
+			result.RetaggedImages = append(result.RetaggedImages, ImageChange{Name: name, Before: a.image, After: b.image, BeforeDigest: a.digest, AfterDigest: b.digest})
+		}
+	}
+	for _, name := range sortedDiffImageNames(imagesB) {
+		if _, ok := imagesA[name]; !ok {
+			result.AddedImages = append(result.AddedImages, name)
+		}
+	}
+	result.ChangedFields, err = changedFields(bundleA, bundleB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %q and %q: %s", refA, refB, err)
+	}
+	return result, nil
+}
+
+type diffImage struct {
+	image  string
+	digest digest.Digest
+}
+
+// diffImages returns the images of a pulled bundle with the digest they were pushed with, falling back to the digest
+// of the bundle when the relocation map does not resolve them
+func diffImages(b *bundle.Bundle, relocationMap relocation.ImageRelocationMap) map[string]diffImage {
+	images := make(map[string]diffImage, len(b.Images)+len(b.InvocationImages))
+	add := func(name string, img bundle.BaseImage) {
+		dgst := digest.Digest(img.Digest)
+		if relocated, err := reference.ParseNormalizedNamed(relocationMap[img.Image]); err == nil {
+			if digested, ok := relocated.(reference.Digested); ok {
+				dgst = digested.Digest()
+			}
+		}
+		images[name] = diffImage{image: img.Image, digest: dgst}
+	}
+	for i, img := range b.InvocationImages {
+		add(fmt.Sprintf("invocationImages[%d]", i), img.BaseImage)
+	}
+	for name, img := range b.Images {
+		add(name, img.BaseImage)
+	}
+	return images
+}
+
+// changedFields returns the sorted top level fields of the bundles, other than the images, with different values
+func changedFields(a, b *bundle.Bundle) ([]string, error) {
+	fieldsA, err := bundleFields(a)
+	if err != nil {
+		return nil, err
+	}
+	fieldsB, err := bundleFields(b)
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]struct{}{}
+	for k, v := range fieldsA {
+		if !bytes.Equal(v, fieldsB[k]) {
+			changed[k] = struct{}{}
+		}
+	}
+	for k, v := range fieldsB {
+		if !bytes.Equal(v, fieldsA[k]) {
+			changed[k] = struct{}{}
+		}
+	}
+	var result []string
+	for k := range changed {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func bundleFields(b *bundle.Bundle) (map[string]json.RawMessage, error) {
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "images")
+	delete(fields, "invocationImages")
+	return fields, nil
+}
+
+func sortedDiffImageNames(images map[string]diffImage) []string {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,88 @@
+package remotes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/distribution/reference"
+	"gotest.tools/v3/assert"
+)
+
+func TestDiff(t *testing.T) {
+	registry := newMemoryRegistry()
+	refA, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	refB, err := reference.ParseNamed("my.registry/namespace/my-app:v2")
+	assert.NilError(t, err)
+
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), refA, registry, false)
+	assert.NilError(t, err)
+
+	// Retag image-1, replace another-image with new-image, rebuild the invocation image and change the description
+	b := tests.MakeTestBundle()
+	b.Description = "new description"
+	image1 := b.Images["image-1"]
+	image1.Image = "my.registry/namespace/image-1:v2"
+	b.Images["image-1"] = image1
+	newImage := b.Images["another-image"]
+	newImage.Image = "my.registry/namespace/new-image"
+	delete(b.Images, "another-image")
+	b.Images["new-image"] = newImage
+	b.InvocationImages[0].Digest = "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0344"
+	relocationMap := tests.MakeRelocationMap()
+	relocationMap["my.registry/namespace/image-1:v2"] = relocationMap["my.registry/namespace/image-1"]
+	relocationMap["my.registry/namespace/new-image"] = relocationMap["my.registry/namespace/another-image"]
+	relocationMap["my.registry/namespace/my-app-invoc"] = "my.registry/namespace/my-app@sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0344"
+	_, err = Push(context.Background(), b, relocationMap, refB, registry, false)
+	assert.NilError(t, err)
+
+	diff, err := Diff(context.Background(), refA, refB, registry)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, &BundleDiff{
+		AddedImages:   []string{"new-image"},
+		RemovedImages: []string{"another-image"},
+		RetaggedImages: []ImageChange{{
+			Name:         "image-1",
+			Before:       "my.registry/namespace/image-1",
+			After:        "my.registry/namespace/image-1:v2",
+			BeforeDigest: "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+			AfterDigest:  "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		}},
+		ChangedImages: []ImageChange{{
+			Name:         "invocationImages[0]",
+			Before:       "my.registry/namespace/my-app-invoc",
+			After:        "my.registry/namespace/my-app-invoc",
+			BeforeDigest: "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0343",
+			AfterDigest:  "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0344",
+		}},
+		ChangedFields: []string{"description"},
+	}, diff)
+	assert.Check(t, diff.ConfigChanged())
+	assert.Check(t, !diff.IsEmpty())
+}
+
+func TestDiffIdenticalBundles(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, false)
+	assert.NilError(t, err)
+
+	diff, err := Diff(context.Background(), ref, ref, registry)
+	assert.NilError(t, err)
+	assert.Check(t, diff.IsEmpty(), diff)
+	assert.Check(t, !diff.ConfigChanged())
+}
+
+func TestDiffFieldsAddedOrRemoved(t *testing.T) {
+	a := tests.MakeTestBundle()
+	b := tests.MakeTestBundle()
+	b.Credentials = nil
+	b.Outputs = map[string]bundle.Output{"output": {Definition: "output"}}
+
+	changed, err := changedFields(a, b)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"credentials", "outputs"}, changed)
+}
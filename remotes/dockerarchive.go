@@ -0,0 +1,276 @@
+package remotes
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischema "github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerArchiveManifestFile is the file listing the images of a docker save archive
+const dockerArchiveManifestFile = "manifest.json"
+
+// MissingArchiveImagesError is returned by LoadDockerArchive when images of the bundle are not in the archive
+type MissingArchiveImagesError struct {
+	// Images are the missing image references of the bundle, sorted
+	Images []string
+}
+
+func (e *MissingArchiveImagesError) Error() string {
+	return fmt.Sprintf("images missing from the docker archive: %s", strings.Join(e.Images, ", "))
+}
+
+// LoadDockerArchive loads the images of a `docker save` tar archive into the content store: the invocation image and
+// the component images of the bundle, found by their names among the repository tags of the archive, are written as
+// OCI image manifests with their configs and layers. The bundle is then patched with the digest, the media type and
+// the size of the loaded manifests, and the returned relocation map references them in the ref repository, so the
+// bundle can be pushed with PushToStore to the same store, without any registry. The other images of the archive are
+// ignored. Nothing is loaded if images of the bundle are missing from the archive: it fails with a
+// MissingArchiveImagesError listing all of them.
+func LoadDockerArchive(ctx context.Context, r io.Reader, b *bundle.Bundle, ref reference.Named, store content.Ingester) (relocation.ImageRelocationMap, error) {
+	logger := log.G(ctx)
+	logger.Debugf("Loading the images of bundle %s from a docker archive", ref)
+	if len(b.InvocationImages) != 1 {
+		return nil, fmt.Errorf("only one invocation image supported for bundle %q", ref)
+	}
+
+	archive, err := readDockerArchive(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read docker archive: %w", err)
+	}
+	defer archive.close()
+
+	// Check that every image of the bundle is in the archive before loading any of them
+	baseImages := []*bundle.BaseImage{&b.InvocationImages[0].BaseImage}
+	components := map[string]*bundle.Image{}
+	for _, name := range sortedImageNames(b.Images) {
+		image := b.Images[name]
+		components[name] = &image
+		baseImages = append(baseImages, &image.BaseImage)
+	}
+	var missing []string
+	for _, baseImage := range baseImages {
+		if _, ok := archive.images[dockerArchiveTag(baseImage.Image)]; !ok {
+			missing = append(missing, baseImage.Image)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, &MissingArchiveImagesError{Images: missing}
+	}
+
+	relocationMap := relocation.ImageRelocationMap{}
+	loaded := map[string]ocischemav1.Descriptor{}
+	for _, baseImage := range baseImages {
+		tag := dockerArchiveTag(baseImage.Image)
+		d, ok := loaded[tag]
+		if !ok {
+			logger.Debugf("Loading image %s", baseImage.Image)
+			if d, err = archive.load(ctx, store, archive.images[tag]); err != nil {
+				return nil, fmt.Errorf("failed to load image %q from the docker archive: %w", baseImage.Image, err)
+			}
+			loaded[tag] = d
+		}
+		newRef, err := reference.WithDigest(reference.TrimNamed(ref), d.Digest)
+		if err != nil {
+			return nil, err
+		}
+		relocationMap[baseImage.Image] = newRef.String()
+		baseImage.Digest = d.Digest.String()
+		baseImage.MediaType = d.MediaType
+		baseImage.Size = uint64(d.Size)
+	}
+	for name, image := range components {
+		b.Images[name] = *image
+	}
+	logger.Debug("Images loaded")
+	return relocationMap, nil
+}
+
+// dockerArchiveTag returns the normalized tagged reference an image is listed with in a docker archive, or the image
+// itself if it is not a valid reference
+func dockerArchiveTag(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+// dockerArchiveImage is an image listed in the manifest.json of a docker save archive, its config and layers being
+// the names of files of the archive
+type dockerArchiveImage struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// dockerArchiveFile is a file of a docker archive, spooled to a temporary directory
+type dockerArchiveFile struct {
+	path   string
+	digest digest.Digest
+	size   int64
+}
+
+// dockerArchive holds the files of a docker archive, spooled to a temporary directory, and its images by normalized
+// tagged reference
+type dockerArchive struct {
+	dir    string
+	files  map[string]dockerArchiveFile
+	images map[string]dockerArchiveImage
+}
+
+func readDockerArchive(r io.Reader) (*dockerArchive, error) {
+	dir, err := os.MkdirTemp("", "cnab-docker-archive-")
+	if err != nil {
+		return nil, err
+	}
+	archive := &dockerArchive{dir: dir, files: map[string]dockerArchiveFile{}, images: map[string]dockerArchiveImage{}}
+	if err := archive.read(r); err != nil {
+		archive.close()
+		return nil, err
+	}
+	return archive, nil
+}
+
+func (a *dockerArchive) read(r io.Reader) error {
+	// Identical layers may be saved once and linked from the other images
+	links := map[string]string{}
+	var manifest []byte
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(header.Name)
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if name == dockerArchiveManifestFile {
+				if manifest, err = io.ReadAll(tr); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := a.add(name, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), header.Linkname)
+		}
+	}
+	for name, target := range links {
+		if file, ok := a.files[target]; ok {
+			a.files[name] = file
+		}
+	}
+	if manifest == nil {
+		return fmt.Errorf("no %s in the archive, it is not a docker save archive", dockerArchiveManifestFile)
+	}
+	var images []dockerArchiveImage
+	if err := json.Unmarshal(manifest, &images); err != nil {
+		return fmt.Errorf("invalid %s: %w", dockerArchiveManifestFile, err)
+	}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			a.images[dockerArchiveTag(tag)] = image
+		}
+	}
+	return nil
+}
+
+func (a *dockerArchive) add(name string, r io.Reader) error {
+	file, err := os.CreateTemp(a.dir, "file-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(file, digester.Hash()), r)
+	if err != nil {
+		return err
+	}
+	a.files[name] = dockerArchiveFile{path: file.Name(), digest: digester.Digest(), size: size}
+	return nil
+}
+
+// load writes the config and the layers of the image to the store, then its OCI image manifest, and returns the
+// descriptor of the manifest
+func (a *dockerArchive) load(ctx context.Context, store content.Ingester, image dockerArchiveImage) (ocischemav1.Descriptor, error) {
+	config, err := a.write(ctx, store, image.Config, ocischemav1.MediaTypeImageConfig)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	manifest := ocischemav1.Manifest{
+		Versioned: ocischema.Versioned{SchemaVersion: 2},
+		MediaType: ocischemav1.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocischemav1.Descriptor{},
+	}
+	for _, name := range image.Layers {
+		layer, err := a.write(ctx, store, name, "")
+		if err != nil {
+			return ocischemav1.Descriptor{}, err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	d := ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+	if err := content.WriteBlob(ctx, store, remotes.MakeRefKey(ctx, d), bytes.NewReader(payload), d); err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to write image manifest: %w", err)
+	}
+	return d, nil
+}
+
+// write writes a file of the archive to the store, with the media type of a gzip or an uncompressed layer if
+// mediaType is empty, and returns its descriptor
+func (a *dockerArchive) write(ctx context.Context, store content.Ingester, name, mediaType string) (ocischemav1.Descriptor, error) {
+	file, ok := a.files[path.Clean(name)]
+	if !ok {
+		return ocischemav1.Descriptor{}, fmt.Errorf("file %s is not in the archive", name)
+	}
+	f, err := os.Open(file.path)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	if mediaType == "" {
+		mediaType = ocischemav1.MediaTypeImageLayer
+		if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			mediaType = ocischemav1.MediaTypeImageLayerGzip
+		}
+	}
+	d := ocischemav1.Descriptor{MediaType: mediaType, Digest: file.digest, Size: file.size}
+	if err := content.WriteBlob(ctx, store, remotes.MakeRefKey(ctx, d), reader, d); err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return d, nil
+}
+
+func (a *dockerArchive) close() {
+	os.RemoveAll(a.dir)
+}
@@ -0,0 +1,147 @@
+package remotes
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+// makeDockerArchive writes a docker save archive of images tagged with the given references, sharing a layer linked
+// from the second image on, like docker does for identical layers
+func makeDockerArchive(t *testing.T, tags ...string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	writeFile := func(name string, payload []byte) {
+		assert.NilError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(payload))}))
+		_, err := tw.Write(payload)
+		assert.NilError(t, err)
+	}
+	var images []dockerArchiveImage
+	for i, tag := range tags {
+		config := []byte(`{"architecture":"amd64","os":"linux","image":"` + tag + `"}`)
+		configName := digest.FromBytes(config).Encoded() + ".json"
+		writeFile(configName, config)
+		layerName := digest.FromString(tag).Encoded() + "/layer.tar"
+		writeFile(layerName, []byte("layer of "+tag))
+		if i == 0 {
+			writeFile("shared/layer.tar", []byte("shared layer"))
+		} else {
+			sharedName := digest.FromString(tag).Encoded() + "-shared/layer.tar"
+			assert.NilError(t, tw.WriteHeader(&tar.Header{Name: sharedName, Typeflag: tar.TypeSymlink, Linkname: "../shared/layer.tar"}))
+		}
+		layers := []string{"shared/layer.tar", layerName}
+		if i > 0 {
+			layers[0] = digest.FromString(tag).Encoded() + "-shared/layer.tar"
+		}
+		images = append(images, dockerArchiveImage{Config: configName, RepoTags: []string{tag}, Layers: layers})
+	}
+	manifest, err := json.Marshal(images)
+	assert.NilError(t, err)
+	writeFile(dockerArchiveManifestFile, manifest)
+	assert.NilError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestLoadDockerArchive(t *testing.T) {
+	ctx := context.Background()
+	store, err := local.NewStore(t.TempDir())
+	assert.NilError(t, err)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	archive := makeDockerArchive(t, "my.registry/namespace/my-app-invoc", "my.registry/namespace/image-1:latest",
+		"my.registry/namespace/another-image:latest", "unrelated:latest")
+
+	b := tests.MakeTestBundle()
+	relocationMap, err := LoadDockerArchive(ctx, bytes.NewReader(archive), b, ref, store)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(relocationMap))
+
+	// The bundle references the loaded manifests, with their configs and layers in the store
+	var layers []digest.Digest
+	for _, baseImage := range []struct{ Image, Digest, MediaType string }{
+		{b.InvocationImages[0].Image, b.InvocationImages[0].Digest, b.InvocationImages[0].MediaType},
+		{b.Images["image-1"].Image, b.Images["image-1"].Digest, b.Images["image-1"].MediaType},
+		{b.Images["another-image"].Image, b.Images["another-image"].Digest, b.Images["another-image"].MediaType},
+	} {
+		assert.Equal(t, ocischemav1.MediaTypeImageManifest, baseImage.MediaType)
+		assert.Equal(t, "my.registry/namespace/my-app@"+baseImage.Digest, relocationMap[baseImage.Image])
+		payload, err := content.ReadBlob(ctx, store, ocischemav1.Descriptor{Digest: digest.Digest(baseImage.Digest)})
+		assert.NilError(t, err)
+		var manifest ocischemav1.Manifest
+		assert.NilError(t, json.Unmarshal(payload, &manifest))
+		_, err = content.ReadBlob(ctx, store, manifest.Config)
+		assert.NilError(t, err)
+		assert.Equal(t, 2, len(manifest.Layers))
+		for _, layer := range manifest.Layers {
+			assert.Equal(t, ocischemav1.MediaTypeImageLayer, layer.MediaType)
+			_, err = content.ReadBlob(ctx, store, layer)
+			assert.NilError(t, err)
+			layers = append(layers, layer.Digest)
+		}
+	}
+	assert.Equal(t, digest.FromString("shared layer"), layers[0])
+	assert.Equal(t, layers[0], layers[2])
+	assert.Equal(t, layers[0], layers[4])
+
+	// The bundle is ready to be pushed to the store
+	descriptor, err := PushToStore(ctx, b, relocationMap, ref, store)
+	assert.NilError(t, err)
+	indexPayload, err := content.ReadBlob(ctx, store, descriptor)
+	assert.NilError(t, err)
+	var index ocischemav1.Index
+	assert.NilError(t, json.Unmarshal(indexPayload, &index))
+	for _, d := range index.Manifests[1:] {
+		_, err := content.ReadBlob(ctx, store, d)
+		assert.NilError(t, err, d.Annotations[converter.CNABDescriptorTypeAnnotation])
+	}
+}
+
+func TestLoadDockerArchiveWithMissingImages(t *testing.T) {
+	ctx := context.Background()
+	store, err := local.NewStore(t.TempDir())
+	assert.NilError(t, err)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	archive := makeDockerArchive(t, "my.registry/namespace/image-1:other-tag", "my.registry/namespace/another-image")
+
+	b := tests.MakeTestBundle()
+	_, err = LoadDockerArchive(ctx, bytes.NewReader(archive), b, ref, store)
+	var missingErr *MissingArchiveImagesError
+	assert.Assert(t, errors.As(err, &missingErr))
+	assert.DeepEqual(t, []string{"my.registry/namespace/image-1", "my.registry/namespace/my-app-invoc"}, missingErr.Images)
+	assert.ErrorContains(t, err, "images missing from the docker archive: my.registry/namespace/image-1, my.registry/namespace/my-app-invoc")
+
+	// Nothing was loaded, and the bundle is unchanged
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+	_, err = content.ReadBlob(ctx, store, ocischemav1.Descriptor{Digest: digest.FromString("shared layer")})
+	assert.Assert(t, errdefs.IsNotFound(err), err)
+
+	_, err = LoadDockerArchive(ctx, bytes.NewReader(makeArchiveWithoutManifest(t)), b, ref, store)
+	assert.ErrorContains(t, err, "no manifest.json in the archive")
+}
+
+// makeArchiveWithoutManifest writes a tar archive without manifest.json
+func makeArchiveWithoutManifest(t *testing.T) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "oci-layout", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}))
+	_, err := tw.Write([]byte("{}"))
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+	return buf.Bytes()
+}
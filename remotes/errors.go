@@ -0,0 +1,177 @@
+package remotes
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PushStage identifies which object of a bundle a Push operation was pushing
+type PushStage string
+
+const (
+	// PushStageConfigBlob is the stage pushing the bundle config blob
+	PushStageConfigBlob = PushStage("config blob")
+	// PushStageConfigManifest is the stage pushing the image manifest wrapping the bundle config
+	PushStageConfigManifest = PushStage("config manifest")
+	// PushStageIndex is the stage pushing the bundle index
+	PushStageIndex = PushStage("index")
+	// PushStageInvocationImageIndex is the stage pushing the index of a multi-architecture invocation image, with
+	// WithMultiArchInvocationImage
+	PushStageInvocationImageIndex = PushStage("invocation image index")
+)
+
+// PushError is returned when a payload of a bundle could not be pushed
+type PushError struct {
+	// Stage is the stage which failed
+	Stage PushStage
+	// Descriptor is the descriptor of the payload which could not be pushed
+	Descriptor ocischemav1.Descriptor
+	// Err is the underlying error
+	Err error
+}
+
+func (e *PushError) Error() string {
+	return fmt.Sprintf("failed to push %s %s: %s", e.Stage, e.Descriptor.Digest, e.Err)
+}
+
+func (e *PushError) Unwrap() error {
+	return e.Err
+}
+
+// DigestMismatchAfterPushError is returned by a push with WithVerifyAfterPush when the pushed reference does not
+// resolve to the digest of the pushed index, like with registries serializing manifests again
+type DigestMismatchAfterPushError struct {
+	// Reference is the pushed reference
+	Reference string
+	// Expected is the digest of the pushed index
+	Expected digest.Digest
+	// Actual is the digest the reference resolves to
+	Actual digest.Digest
+}
+
+func (e *DigestMismatchAfterPushError) Error() string {
+	return fmt.Sprintf("pushed bundle manifest %q resolves to %s instead of %s", e.Reference, e.Actual, e.Expected)
+}
+
+// TagDigestMismatchError is returned by a pull with WithVerifyTagMatchesDigest when the tag of the pulled reference
+// no longer points at its digest
+type TagDigestMismatchError struct {
+	// Reference is the pulled reference, with both a tag and a digest
+	Reference string
+	// Expected is the digest of the pulled reference
+	Expected digest.Digest
+	// Actual is the digest the tag resolves to
+	Actual digest.Digest
+}
+
+func (e *TagDigestMismatchError) Error() string {
+	return fmt.Sprintf("tag of bundle manifest %q points at %s instead of %s", e.Reference, e.Actual, e.Expected)
+}
+
+// MissingTagError is returned by a push to a reference with neither a tag nor a digest, like a bare repository name,
+// unless WithDefaultLatestTag is set
+type MissingTagError struct {
+	// Reference is the pushed reference
+	Reference string
+}
+
+func (e *MissingTagError) Error() string {
+	return fmt.Sprintf("reference %q has neither a tag nor a digest, the bundle push target is ambiguous", e.Reference)
+}
+
+// FallbackDisabledError is returned when a push fails and the payload could have been pushed again in a more
+// compatible format, if fallbacks were allowed
+type FallbackDisabledError struct {
+	// Fallback describes the format the push would have been retried with
+	Fallback string
+	// Err is the error of the push in the preferred format
+	Err error
+}
+
+func (e *FallbackDisabledError) Error() string {
+	return fmt.Sprintf("%s (fallbacks are disabled, the push would have been retried with %s)", e.Err, e.Fallback)
+}
+
+func (e *FallbackDisabledError) Unwrap() error {
+	return e.Err
+}
+
+// MissingReferencedImagesError is returned by a push with WithCheckReferencedImages when images referenced by the index
+// are not present in the target repository
+type MissingReferencedImagesError struct {
+	// Reference is the pushed reference
+	Reference string
+	// Descriptors are the index descriptors of the missing images
+	Descriptors []ocischemav1.Descriptor
+}
+
+func (e *MissingReferencedImagesError) Error() string {
+	images := make([]string, len(e.Descriptors))
+	for i, d := range e.Descriptors {
+		images[i] = d.Digest.String()
+		if name, ok := d.Annotations[converter.CNABDescriptorComponentNameAnnotation]; ok {
+			images[i] = fmt.Sprintf("%s (%s)", name, d.Digest)
+		} else if d.Annotations[converter.CNABDescriptorTypeAnnotation] == converter.CNABDescriptorTypeInvocation {
+			images[i] = fmt.Sprintf("invocation image (%s)", d.Digest)
+		}
+	}
+	return fmt.Sprintf("images referenced by bundle manifest %q are missing in the repository: %s", e.Reference, strings.Join(images, ", "))
+}
+
+// UnsupportedDigestAlgorithmError is returned by a push with WithDigestAlgorithm when the registry rejects a payload
+// digested with the chosen algorithm
+type UnsupportedDigestAlgorithmError struct {
+	// Algorithm is the digest algorithm rejected by the registry
+	Algorithm digest.Algorithm
+	// Err is the error returned by the registry
+	Err error
+}
+
+func (e *UnsupportedDigestAlgorithmError) Error() string {
+	return fmt.Sprintf("registry rejected the %s digest, it may not support this digest algorithm: %s", e.Algorithm, e.Err)
+}
+
+func (e *UnsupportedDigestAlgorithmError) Unwrap() error {
+	return e.Err
+}
+
+// ContentDigestMismatchError is returned when a registry response to a request by digest reports another digest in
+// its Docker-Content-Digest header, like a misconfigured caching proxy serving other content
+type ContentDigestMismatchError struct {
+	// URL is the URL of the request
+	URL string
+	// Expected is the requested digest
+	Expected digest.Digest
+	// Actual is the digest reported by the registry
+	Actual digest.Digest
+}
+
+func (e *ContentDigestMismatchError) Error() string {
+	return fmt.Sprintf("registry reported content digest %s for %s, expected %s", e.Actual, e.URL, e.Expected)
+}
+
+// IndexLimitExceededError is returned by a push when the index exceeds the limits set by WithIndexLimits. Nothing more
+// is pushed once a limit is exceeded.
+type IndexLimitExceededError struct {
+	// Reference is the pushed reference
+	Reference string
+	// Manifests is the number of manifest entries of the index
+	Manifests int
+	// MaxManifests is the maximum number of manifest entries
+	MaxManifests int
+	// Size is the marshaled size of the index, zero if it has too many entries to be marshaled
+	Size int64
+	// MaxSize is the maximum marshaled size of the index
+	MaxSize int64
+}
+
+func (e *IndexLimitExceededError) Error() string {
+	if e.Size == 0 {
+		return fmt.Sprintf("bundle manifest %q has %d manifest entries, more than the limit of %d", e.Reference, e.Manifests, e.MaxManifests)
+	}
+	return fmt.Sprintf("bundle manifest %q size of %d bytes exceeds the limit of %d bytes", e.Reference, e.Size, e.MaxSize)
+}
@@ -0,0 +1,219 @@
+package remotes
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// layoutBlobsDir is the directory of the blobs in an oci-layout
+	layoutBlobsDir = "blobs"
+	// layoutIndexFile is the file of the index referencing the manifests of an oci-layout
+	layoutIndexFile = "index.json"
+)
+
+// exportConfig defines the input required for an Export operation
+type exportConfig struct {
+	maxConcurrentJobs int
+}
+
+// ExportOption is a helper for configuring an Export
+type ExportOption func(*exportConfig) error
+
+// WithExportParallelism changes the max number of blobs fetched concurrently.
+// A value lower or equal to zero keeps the default, bounded by GOMAXPROCS.
+func WithExportParallelism(maxConcurrentJobs int) ExportOption {
+	return func(cfg *exportConfig) error {
+		if maxConcurrentJobs > 0 {
+			cfg.maxConcurrentJobs = maxConcurrentJobs
+		}
+		return nil
+	}
+}
+
+// Export writes the bundle pushed at ref to w as an oci-layout tar archive, which can be imported elsewhere, for
+// instance with "skopeo copy oci-archive:...". The archive contains every descriptor visited by Walk, including the
+// bundle config manifest and blob, and the layers of the images, under blobs/<algorithm>/<encoded digest>. Its
+// index.json references the bundle index, annotated with the tag of ref if it has one.
+// Foreign layers, not stored in the registry, are left out.
+// The blobs are fetched concurrently to a temporary directory, the first failure canceling the other fetches, then
+// written sorted by digest, so exporting the same bundle always yields the same archive. index.json is written last.
+func Export(ctx context.Context, ref reference.Named, resolver remotes.Resolver, w io.Writer, options ...ExportOption) error {
+	log.G(ctx).Debugf("Exporting CNAB Bundle %s", ref)
+	cfg := exportConfig{maxConcurrentJobs: runtime.GOMAXPROCS(0)}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return err
+		}
+	}
+	fetcher, err := resolver.Fetcher(withMutedContext(ctx), ref.Name())
+	if err != nil {
+		return err
+	}
+	var (
+		indexDescriptor *ocischemav1.Descriptor
+		blobs           []ocischemav1.Descriptor
+	)
+	if err := Walk(ctx, ref, resolver, func(desc ocischemav1.Descriptor) error {
+		if indexDescriptor == nil {
+			indexDescriptor = &desc
+		}
+		if isNonDistributable(desc) {
+			return nil
+		}
+		if err := desc.Digest.Validate(); err != nil {
+			return err
+		}
+		blobs = append(blobs, desc)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to export bundle %q: %w", ref, err)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Digest < blobs[j].Digest })
+
+	spool, err := os.MkdirTemp("", "cnab-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(spool)
+	files := make([]string, len(blobs))
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(cfg.maxConcurrentJobs)
+	for i, desc := range blobs {
+		i, desc := i, desc
+		group.Go(func() error {
+			name, err := spoolBlob(groupCtx, fetcher, spool, desc)
+			files[i] = name
+			return err
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("failed to export bundle %q: %w", ref, err)
+	}
+
+	archive := &layoutWriter{tw: tar.NewWriter(w), dirs: map[string]struct{}{}}
+	layout, err := json.Marshal(ocischemav1.ImageLayout{Version: ocischemav1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := archive.writeFile(ocischemav1.ImageLayoutFile, layout); err != nil {
+		return fmt.Errorf("failed to export bundle %q: %w", ref, err)
+	}
+	for i, desc := range blobs {
+		if err := archive.writeBlob(desc, files[i]); err != nil {
+			return fmt.Errorf("failed to export bundle %q: %w", ref, err)
+		}
+	}
+
+	root := *indexDescriptor
+	if tagged, ok := ref.(reference.Tagged); ok {
+		root.Annotations = map[string]string{ocischemav1.AnnotationRefName: tagged.Tag()}
+	}
+	index, err := json.Marshal(ocischemav1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocischemav1.MediaTypeImageIndex,
+		Manifests: []ocischemav1.Descriptor{root},
+	})
+	if err != nil {
+		return err
+	}
+	if err := archive.writeFile(layoutIndexFile, index); err != nil {
+		return fmt.Errorf("failed to export bundle %q: %w", ref, err)
+	}
+	return archive.tw.Close()
+}
+
+// spoolBlob fetches a blob to a file of dir, verifying its content, and returns the file name
+func spoolBlob(ctx context.Context, fetcher remotes.Fetcher, dir string, desc ocischemav1.Descriptor) (string, error) {
+	reader, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s: %w", desc.Digest, err)
+	}
+	defer reader.Close()
+	file, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	// Verify the content while spooling it, the archive is useless with a corrupted blob
+	verifier := desc.Digest.Verifier()
+	if _, err := io.CopyN(io.MultiWriter(file, verifier), reader, desc.Size); err != nil {
+		return "", fmt.Errorf("failed to export %s: %w", desc.Digest, err)
+	}
+	if !verifier.Verified() {
+		return "", fmt.Errorf("failed to export %s: content does not match its digest", desc.Digest)
+	}
+	return file.Name(), nil
+}
+
+// layoutWriter writes the files of an oci-layout to a tar stream, adding the parent directories of the blobs once
+type layoutWriter struct {
+	tw   *tar.Writer
+	dirs map[string]struct{}
+}
+
+func (l *layoutWriter) writeFile(name string, payload []byte) error {
+	if err := l.tw.WriteHeader(layoutHeader(name, int64(len(payload)))); err != nil {
+		return err
+	}
+	_, err := l.tw.Write(payload)
+	return err
+}
+
+func (l *layoutWriter) writeBlob(desc ocischemav1.Descriptor, file string) error {
+	dir := path.Join(layoutBlobsDir, desc.Digest.Algorithm().String())
+	if err := l.writeDir(layoutBlobsDir); err != nil {
+		return err
+	}
+	if err := l.writeDir(dir); err != nil {
+		return err
+	}
+	reader, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := l.tw.WriteHeader(layoutHeader(path.Join(dir, desc.Digest.Encoded()), desc.Size)); err != nil {
+		return err
+	}
+	_, err = io.CopyN(l.tw, reader, desc.Size)
+	return err
+}
+
+func (l *layoutWriter) writeDir(name string) error {
+	if _, ok := l.dirs[name]; ok {
+		return nil
+	}
+	l.dirs[name] = struct{}{}
+	return l.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	})
+}
+
+func layoutHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+	}
+}
@@ -0,0 +1,191 @@
+package remotes
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestExport(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	resolver := &mockResolver{fetcher: fetcher, resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor}}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	var archive bytes.Buffer
+	assert.NilError(t, Export(context.Background(), ref, resolver, &archive))
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(&archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		assert.NilError(t, err)
+		files[header.Name] = content
+	}
+
+	assert.Equal(t, `{"imageLayoutVersion":"1.0.0"}`, string(files["oci-layout"]))
+	var index ocischemav1.Index
+	assert.NilError(t, json.Unmarshal(files["index.json"], &index))
+	assert.Equal(t, 1, len(index.Manifests))
+	assert.Equal(t, indexDescriptor.Digest, index.Manifests[0].Digest)
+	assert.Equal(t, "my-tag", index.Manifests[0].Annotations[ocischemav1.AnnotationRefName])
+	// Every blob is exported, including the bundle config, and nothing else
+	assert.Equal(t, len(fetcher)+2, len(files))
+	for d, payload := range fetcher {
+		assert.DeepEqual(t, payload, files["blobs/sha256/"+d.Encoded()])
+	}
+}
+
+func TestExportCorruptedBlob(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	for d, payload := range fetcher {
+		if string(payload) == "layer" {
+			fetcher[d] = []byte("LAYER")
+		}
+	}
+	resolver := &mockResolver{fetcher: fetcher, resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor}}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	err = Export(context.Background(), ref, resolver, io.Discard)
+	assert.ErrorContains(t, err, "content does not match its digest")
+}
+
+// makeMultiImageSource returns the content of a bundle with several images sharing a layer
+func makeMultiImageSource(t *testing.T, images int) (contentFetcher, ocischemav1.Descriptor) {
+	t.Helper()
+	fetcher := contentFetcher{}
+	bundleConfig, err := converter.PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	fetcher.add(bundleConfig.ConfigBlob, bundleConfig.ConfigBlobDescriptor.MediaType)
+	configManifestDescriptor := fetcher.add(bundleConfig.Manifest, bundleConfig.ManifestDescriptor.MediaType)
+	configManifestDescriptor.Annotations = map[string]string{
+		converter.CNABDescriptorTypeAnnotation: string(converter.CNABDescriptorTypeConfig),
+	}
+	manifests := []ocischemav1.Descriptor{configManifestDescriptor}
+	shared := fetcher.add([]byte("shared layer"), ocischemav1.MediaTypeImageLayerGzip)
+	for i := 0; i < images; i++ {
+		imageConfig := fetcher.add([]byte(fmt.Sprintf(`{"image":%d}`, i)), ocischemav1.MediaTypeImageConfig)
+		layer := fetcher.add([]byte(fmt.Sprintf("layer %d", i)), ocischemav1.MediaTypeImageLayerGzip)
+		imageManifest, err := json.Marshal(ocischemav1.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config:    imageConfig,
+			Layers:    []ocischemav1.Descriptor{shared, layer},
+		})
+		assert.NilError(t, err)
+		imageManifestDescriptor := fetcher.add(imageManifest, ocischemav1.MediaTypeImageManifest)
+		imageManifestDescriptor.Annotations = map[string]string{
+			converter.CNABDescriptorTypeAnnotation:          string(converter.CNABDescriptorTypeComponent),
+			converter.CNABDescriptorComponentNameAnnotation: fmt.Sprintf("image-%d", i),
+		}
+		manifests = append(manifests, imageManifestDescriptor)
+	}
+	index, err := json.Marshal(ocischemav1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: manifests,
+	})
+	assert.NilError(t, err)
+	return fetcher, fetcher.add(index, ocischemav1.MediaTypeImageIndex)
+}
+
+func TestExportMultiImageBundleConcurrently(t *testing.T) {
+	fetcher, indexDescriptor := makeMultiImageSource(t, 5)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	export := func() []byte {
+		var archive bytes.Buffer
+		resolver := &mockResolver{fetcher: fetcher, resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor}}
+		assert.NilError(t, Export(context.Background(), ref, resolver, &archive, WithExportParallelism(3)))
+		return archive.Bytes()
+	}
+	archive := export()
+	// The archive is reproducible
+	assert.DeepEqual(t, archive, export())
+
+	var names []string
+	var blobs []string
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		names = append(names, header.Name)
+		if header.Typeflag != tar.TypeReg || header.Name == "oci-layout" || header.Name == "index.json" {
+			continue
+		}
+		blobs = append(blobs, header.Name)
+		// Every blob matches its digest
+		content, err := io.ReadAll(tr)
+		assert.NilError(t, err)
+		assert.Equal(t, "blobs/sha256/"+digest.FromBytes(content).Encoded(), header.Name)
+	}
+	assert.Equal(t, "oci-layout", names[0])
+	assert.Equal(t, "index.json", names[len(names)-1])
+	// Every blob is exported once, sorted by digest
+	assert.Equal(t, len(fetcher), len(blobs))
+	assert.Assert(t, sort.StringsAreSorted(blobs))
+
+	// The archive can be imported
+	dst, err := reference.ParseNamed("other.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	registry := newMemoryRegistry()
+	descriptor, err := Import(context.Background(), bytes.NewReader(archive), dst, registry)
+	assert.NilError(t, err)
+	assert.Equal(t, indexDescriptor.Digest, descriptor.Digest)
+	for d, payload := range fetcher {
+		assert.DeepEqual(t, payload, registry.content[d])
+	}
+}
+
+func TestExportCancelsFetchesOnFailure(t *testing.T) {
+	fetcher, indexDescriptor := makeMultiImageSource(t, 5)
+	failing := digest.FromString("layer 2")
+	resolver := &mockResolver{
+		fetcher: remotes.FetcherFunc(func(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+			// The manifests are fetched by the walk, before the blobs
+			if desc.MediaType != ocischemav1.MediaTypeImageLayerGzip {
+				return fetcher.Fetch(ctx, desc)
+			}
+			if desc.Digest == failing {
+				return nil, errors.New("fetch failed")
+			}
+			// Only returns once another fetch failed
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}),
+		resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+	}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	var archive bytes.Buffer
+	err = Export(context.Background(), ref, resolver, &archive, WithExportParallelism(20))
+	assert.ErrorContains(t, err, "fetch failed")
+	// Nothing is written when a fetch fails
+	assert.Equal(t, 0, archive.Len())
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 
 	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/converter"
 	"github.com/cnabio/cnab-to-oci/relocation"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
@@ -19,6 +20,7 @@ import (
 
 // FixupBundle checks that all the references are present in the referenced repository, otherwise it will mount all
 // the manifests to that repository. The bundle is then patched with the new digested references.
+// With WithContinueOnError, the relocation map of the images fixed up successfully is returned along with the error.
 func FixupBundle(ctx context.Context, b *bundle.Bundle, ref reference.Named, resolver remotes.Resolver, opts ...FixupOption) (relocation.ImageRelocationMap, error) {
 	logger := log.G(ctx)
 	logger.Debugf("Fixing up bundle %s", ref)
@@ -53,17 +55,43 @@ func FixupBundle(ctx context.Context, b *bundle.Bundle, ref reference.Named, res
 		return nil, err
 	}
 	// Fixup images
-	for name, original := range b.Images {
+	var errs *multierror.Error
+	for _, name := range sortedImageNames(b.Images) {
+		original := b.Images[name]
 		if err := fixupImage(ctx, name, &original.BaseImage, relocationMap, cfg, events, cfg.componentImagePlatformFilter); err != nil {
-			return nil, err
+			if !cfg.continueOnError {
+				return nil, err
+			}
+			errs = multierror.Append(errs, &ImageFixupError{Name: name, Image: original.Image, Err: err})
+			continue
 		}
 		b.Images[name] = original
 	}
+	if errs != nil {
+		return relocationMap, errs
+	}
 
 	logger.Debug("Bundle fixed")
 	return relocationMap, nil
 }
 
+// ImageFixupError reports a component image failing to be fixed up, when the fixup continues on errors
+type ImageFixupError struct {
+	// Name is the component name of the image in the bundle
+	Name string
+	// Image is the image reference in the bundle
+	Image string
+	Err   error
+}
+
+func (e *ImageFixupError) Error() string {
+	return fmt.Sprintf("failed to fixup image %q for component %q: %s", e.Image, e.Name, e.Err)
+}
+
+func (e *ImageFixupError) Unwrap() error {
+	return e.Err
+}
+
 func fixupImage(
 	ctx context.Context,
 	name string,
@@ -73,6 +101,12 @@ func fixupImage(
 	events chan<- FixupEvent,
 	platformFilter platforms.Matcher) error {
 
+	// Images hosted at a URL are referenced by the index as foreign descriptors, not copied to the repository
+	if converter.IsForeignImage(baseImage.Image) {
+		log.G(ctx).Debugf("Skipping image %q hosted at a URL", baseImage.Image)
+		return nil
+	}
+
 	// Fixup the base image, using the relocated base image if available
 	sourceImage := *baseImage
 	if relocatedBaseImage, ok := relocationMap[baseImage.Image]; ok {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"os"
 	"testing"
@@ -726,3 +727,38 @@ func (f bytesFetcher) Fetch(_ context.Context, _ ocischemav1.Descriptor) (io.Rea
 	reader := bytes.NewReader(f)
 	return io.NopCloser(reader), nil
 }
+
+func TestFixupBundleWithContinueOnError(t *testing.T) {
+	registry := newMemoryRegistry()
+	for _, tag := range []string{"invoc", "image-1"} {
+		d := registry.content.add([]byte(tag+" manifest"), ocischemav1.MediaTypeImageManifest)
+		registry.descriptors[d.Digest] = d
+		registry.tags["my.registry/namespace/my-app:"+tag] = d.Digest
+	}
+	b := &bundle.Bundle{
+		SchemaVersion:    "v1.0.0",
+		InvocationImages: []bundle.InvocationImage{{BaseImage: bundle.BaseImage{Image: "my.registry/namespace/my-app:invoc"}}},
+		Images: map[string]bundle.Image{
+			"image-1": {BaseImage: bundle.BaseImage{Image: "my.registry/namespace/my-app:image-1"}},
+			"missing": {BaseImage: bundle.BaseImage{Image: "my.registry/namespace/my-app:missing"}},
+		},
+		Name:    "my-app",
+		Version: "0.1.0",
+	}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app")
+	assert.NilError(t, err)
+
+	// By default the first failure aborts the fixup
+	_, err = FixupBundle(context.TODO(), b, ref, registry, WithAutoBundleUpdate())
+	assert.ErrorContains(t, err, "my.registry/namespace/my-app:missing")
+
+	relocationMap, err := FixupBundle(context.TODO(), b, ref, registry, WithAutoBundleUpdate(), WithContinueOnError())
+	var fixupErr *ImageFixupError
+	assert.Assert(t, errors.As(err, &fixupErr), err)
+	assert.Equal(t, "missing", fixupErr.Name)
+	assert.Equal(t, "my.registry/namespace/my-app:missing", fixupErr.Image)
+	_, ok := relocationMap["my.registry/namespace/my-app:image-1"]
+	assert.Check(t, ok)
+	_, ok = relocationMap["my.registry/namespace/my-app:missing"]
+	assert.Check(t, !ok)
+}
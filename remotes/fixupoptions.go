@@ -35,6 +35,7 @@ type fixupConfig struct {
 	pushImages                    bool
 	imageClient                   internal.ImageClient
 	pushOut                       io.Writer
+	continueOnError               bool
 }
 
 // FixupOption is a helper for configuring a FixupBundle
@@ -147,6 +148,16 @@ func WithPushImages(imageClient internal.ImageClient, out io.Writer) FixupOption
 	}
 }
 
+// WithContinueOnError keeps fixing up the remaining component images when one of them fails, instead of aborting the
+// fixup. Each failure is then reported as an ImageFixupError, and the returned relocation map only contains the images
+// fixed up successfully. A failure of the invocation image still aborts the fixup.
+func WithContinueOnError() FixupOption {
+	return func(cfg *fixupConfig) error {
+		cfg.continueOnError = true
+		return nil
+	}
+}
+
 // WithRelocationMap stores a previously generated relocation map. This map will be used to copy or mount images
 // based on local images but already pushed on a registry.
 // This way if a bundle is pulled on a machine that doesn't contain the images, when the bundle is pushed and images
@@ -0,0 +1,207 @@
+package remotes
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Import reads an oci-layout tar archive, like the ones written by Export, and pushes the bundle it contains to ref:
+// the bundle config, every image manifest referenced by the index with its layers, and finally the index itself.
+// The bundle index is the index of the archive index.json referencing a bundle config. If the archive contains
+// several bundles, the one annotated with the tag of ref is pushed. The digest of every blob is verified while reading
+// the archive, which is spooled to a temporary directory.
+func Import(ctx context.Context, r io.Reader, ref reference.Named, resolver remotes.Resolver) (ocischemav1.Descriptor, error) {
+	logger := log.G(ctx)
+	logger.Debugf("Importing CNAB Bundle to %s", ref)
+
+	store, err := readLayoutArchive(r)
+	if err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to read bundle archive: %w", err)
+	}
+	defer store.close()
+	index, indexDescriptor, err := store.bundleIndex(ref)
+	if err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to read bundle archive: %w", err)
+	}
+
+	ctx = withMutedContext(ctx)
+	pusher, err := resolver.Pusher(ctx, ref.Name())
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	copier := &bundleCopier{
+		fetcher:     store,
+		pusher:      pusher,
+		getChildren: images.ChildrenHandler(&imageContentProvider{store}),
+		copied:      map[digest.Digest]struct{}{},
+	}
+	for _, d := range index.Manifests {
+		if err := copier.copy(ctx, d); err != nil {
+			return ocischemav1.Descriptor{}, fmt.Errorf("failed to import bundle to %q: %w", ref, err)
+		}
+	}
+
+	// Push the index last, under the tag, once all its manifests are present
+	logger.Debugf("Importing CNAB Index %s", indexDescriptor.Digest)
+	indexPusher, err := resolver.Pusher(ctx, reference.TagNameOnly(ref).String())
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	if err := copyDescriptor(ctx, store, indexPusher, nil, indexDescriptor); err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to import bundle manifest to %q: %w", ref, err)
+	}
+
+	logger.Debug("CNAB Bundle imported")
+	return indexDescriptor, nil
+}
+
+// layoutStore is a fetcher of the blobs of an oci-layout archive, spooled to a temporary directory
+type layoutStore struct {
+	dir   string
+	index []byte
+	blobs map[digest.Digest]string
+}
+
+func readLayoutArchive(r io.Reader) (*layoutStore, error) {
+	dir, err := os.MkdirTemp("", "cnab-import-")
+	if err != nil {
+		return nil, err
+	}
+	store := &layoutStore{dir: dir, blobs: map[digest.Digest]string{}}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			store.close()
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := store.add(path.Clean(header.Name), tr); err != nil {
+			store.close()
+			return nil, err
+		}
+	}
+	if store.index == nil {
+		store.close()
+		return nil, fmt.Errorf("no %s in the archive", layoutIndexFile)
+	}
+	return store, nil
+}
+
+func (s *layoutStore) add(name string, r io.Reader) error {
+	if name == layoutIndexFile {
+		index, err := io.ReadAll(r)
+		s.index = index
+		return err
+	}
+	if !strings.HasPrefix(name, layoutBlobsDir+"/") {
+		return nil
+	}
+	algorithm, encoded := path.Split(strings.TrimPrefix(name, layoutBlobsDir+"/"))
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(strings.TrimSuffix(algorithm, "/")), encoded)
+	if err := dgst.Validate(); err != nil {
+		return fmt.Errorf("invalid blob %s: %w", name, err)
+	}
+	file, err := os.CreateTemp(s.dir, "blob-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(io.MultiWriter(file, verifier), r); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s does not match its digest", name)
+	}
+	s.blobs[dgst] = file.Name()
+	return nil
+}
+
+// bundleIndex returns the bundle index referenced by index.json, picking the one annotated with the tag of ref if
+// there are several
+func (s *layoutStore) bundleIndex(ref reference.Named) (ocischemav1.Index, ocischemav1.Descriptor, error) {
+	var root ocischemav1.Index
+	if err := json.Unmarshal(s.index, &root); err != nil {
+		return ocischemav1.Index{}, ocischemav1.Descriptor{}, fmt.Errorf("invalid %s: %w", layoutIndexFile, err)
+	}
+	var tag string
+	if tagged, ok := ref.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	var (
+		bundles     []ocischemav1.Descriptor
+		bundleIndex ocischemav1.Index
+	)
+	for _, d := range root.Manifests {
+		if !images.IsIndexType(d.MediaType) {
+			continue
+		}
+		payload, err := s.read(d.Digest)
+		if err != nil {
+			return ocischemav1.Index{}, ocischemav1.Descriptor{}, err
+		}
+		var index ocischemav1.Index
+		if err := json.Unmarshal(payload, &index); err != nil {
+			return ocischemav1.Index{}, ocischemav1.Descriptor{}, fmt.Errorf("invalid index %s: %w", d.Digest, err)
+		}
+		if !converter.IsCNABIndex(index) {
+			continue
+		}
+		if name, ok := d.Annotations[ocischemav1.AnnotationRefName]; ok && name == tag {
+			return index, d, nil
+		}
+		bundles = append(bundles, d)
+		bundleIndex = index
+	}
+	switch len(bundles) {
+	case 0:
+		return ocischemav1.Index{}, ocischemav1.Descriptor{}, errors.New("no CNAB bundle in the archive")
+	case 1:
+		return bundleIndex, bundles[0], nil
+	default:
+		return ocischemav1.Index{}, ocischemav1.Descriptor{}, fmt.Errorf("%d CNAB bundles in the archive, none of them tagged %q", len(bundles), tag)
+	}
+}
+
+func (s *layoutStore) read(dgst digest.Digest) ([]byte, error) {
+	rc, err := s.Fetch(context.Background(), ocischemav1.Descriptor{Digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (s *layoutStore) Fetch(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+	name, ok := s.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s is not in the archive: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	return os.Open(name)
+}
+
+func (s *layoutStore) close() {
+	os.RemoveAll(s.dir)
+}
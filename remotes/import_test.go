@@ -0,0 +1,84 @@
+package remotes
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestImportExportedBundle(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	src, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	var archive bytes.Buffer
+	assert.NilError(t, Export(context.Background(), src, &mockResolver{fetcher: fetcher, resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor}}, &archive))
+
+	dst, err := reference.ParseNamed("other.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	registry := newMemoryRegistry()
+	descriptor, err := Import(context.Background(), &archive, dst, registry)
+	assert.NilError(t, err)
+	assert.Equal(t, indexDescriptor.Digest, descriptor.Digest)
+	assert.Equal(t, indexDescriptor.Digest, registry.tags[dst.String()])
+	// Every blob is pushed, including the layers
+	for d, payload := range fetcher {
+		assert.DeepEqual(t, payload, registry.content[d])
+	}
+	b, _, _, err := PullWithOptions(context.Background(), dst, registry, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+}
+
+func TestImportVerifiesDigests(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	var archive bytes.Buffer
+	assert.NilError(t, Export(context.Background(), ref, &mockResolver{fetcher: fetcher, resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor}}, &archive))
+
+	// Corrupt the layer blob
+	var corrupted bytes.Buffer
+	tr, tw := tar.NewReader(&archive), tar.NewWriter(&corrupted)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		content, err := io.ReadAll(tr)
+		assert.NilError(t, err)
+		if string(content) == "layer" {
+			content = []byte("LAYER")
+		}
+		assert.NilError(t, tw.WriteHeader(header))
+		_, err = tw.Write(content)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tw.Close())
+
+	_, err = Import(context.Background(), &corrupted, ref, newMemoryRegistry())
+	assert.ErrorContains(t, err, "blobs/sha256/"+digest.FromString("layer").Encoded()+" does not match its digest")
+}
+
+func TestImportWithoutBundle(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	index := []byte(`{"schemaVersion":2,"manifests":[]}`)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "index.json", Size: int64(len(index)), Mode: 0644}))
+	_, err := tw.Write(index)
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	_, err = Import(context.Background(), &archive, ref, newMemoryRegistry())
+	assert.ErrorContains(t, err, "no CNAB bundle in the archive")
+}
@@ -0,0 +1,153 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cnabio/cnab-go/schema"
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DetailLevel controls how much of a bundle Inspect fetches
+type DetailLevel int
+
+const (
+	// DetailLevelIndex only fetches the bundle index
+	DetailLevelIndex DetailLevel = iota
+	// DetailLevelConfig also fetches the bundle config manifest and blob, to read the bundle schema version
+	DetailLevelConfig
+	// DetailLevelContent also fetches every image manifest, to sum the sizes of their configs and layers
+	DetailLevelContent
+)
+
+// BundleInfo summarizes a pushed bundle
+type BundleInfo struct {
+	// Digest is the digest of the bundle index
+	Digest digest.Digest `json:"digest"`
+	// MediaType is the media type of the bundle index, converter.CNABIndexMediaType or
+	// converter.CNABManifestListMediaType
+	MediaType string `json:"mediaType"`
+	// SchemaVersion is the bundle schema version, only read from DetailLevelConfig
+	SchemaVersion schema.Version `json:"schemaVersion,omitempty"`
+	// Images is the number of images of the bundle, its invocation image included
+	Images int `json:"images"`
+	// ImageMediaTypes are the distinct media types of the image manifests, sorted
+	ImageMediaTypes []string `json:"imageMediaTypes,omitempty"`
+	// TotalSize is the size of the index and of the manifests it references. From DetailLevelConfig, it includes the
+	// bundle config blob, and from DetailLevelContent everything the image manifests reference, each blob once.
+	TotalSize int64 `json:"totalSize"`
+	// Annotations are the annotations of the bundle index
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Packaging is converter.CNABPackagingThin, converter.CNABPackagingThick, or empty if the bundle was pushed
+	// without it
+	Packaging string `json:"packaging,omitempty"`
+}
+
+// inspectConfig defines the input required for an Inspect operation
+type inspectConfig struct {
+	detailLevel DetailLevel
+}
+
+// InspectOption is a helper for configuring an Inspect
+type InspectOption func(*inspectConfig) error
+
+// WithDetailLevel sets how much of the bundle Inspect fetches, DetailLevelConfig by default
+func WithDetailLevel(level DetailLevel) InspectOption {
+	return func(cfg *inspectConfig) error {
+		if level < DetailLevelIndex || level > DetailLevelContent {
+			return fmt.Errorf("invalid detail level %d", level)
+		}
+		cfg.detailLevel = level
+		return nil
+	}
+}
+
+// Inspect summarizes the bundle pushed at ref without pulling it: the bundle config is never unmarshaled as a
+// bundle, and depending on the detail level only the index is fetched. It fails like Pull if ref is not a bundle.
+func Inspect(ctx context.Context, ref reference.Named, resolver remotes.Resolver, options ...InspectOption) (*BundleInfo, error) {
+	cfg := inspectConfig{detailLevel: DetailLevelConfig}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	log.G(ctx).Debugf("Inspecting CNAB Bundle %s", ref)
+	index, indexDescriptor, err := getIndex(ctx, ref, resolver)
+	if err != nil {
+		return nil, err
+	}
+	configManifestDescriptor, err := getConfigManifestDescriptor(ctx, ref, index)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &BundleInfo{
+		Digest:      indexDescriptor.Digest,
+		MediaType:   indexDescriptor.MediaType,
+		TotalSize:   indexDescriptor.Size,
+		Annotations: index.Annotations,
+		Packaging:   converter.GetBundlePackaging(index),
+	}
+	mediaTypes := map[string]struct{}{}
+	for _, d := range index.Manifests {
+		info.TotalSize += d.Size
+		switch d.Annotations[converter.CNABDescriptorTypeAnnotation] {
+		case converter.CNABDescriptorTypeInvocation, converter.CNABDescriptorTypeComponent:
+			info.Images++
+			mediaTypes[d.MediaType] = struct{}{}
+		}
+	}
+	for mediaType := range mediaTypes {
+		info.ImageMediaTypes = append(info.ImageMediaTypes, mediaType)
+	}
+	sort.Strings(info.ImageMediaTypes)
+	if cfg.detailLevel == DetailLevelIndex {
+		return info, nil
+	}
+
+	repoOnly, err := reference.ParseNormalizedNamed(ref.Name())
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest reference name %q: %s", ref, err)
+	}
+	manifest, _, err := getConfigManifest(ctx, ref, repoOnly, resolver, configManifestDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	_, configPayload, err := getBundleConfigPayload(ctx, ref, repoOnly, resolver, manifest, 0)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		SchemaVersion schema.Version `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(configPayload, &header); err != nil {
+		return nil, fmt.Errorf("failed to inspect bundle %q: invalid bundle config with media type %q: %s", ref, converter.GetBundleConfigBlobDescriptor(manifest).MediaType, err)
+	}
+	info.SchemaVersion = header.SchemaVersion
+	if cfg.detailLevel == DetailLevelConfig {
+		// A config blob referenced directly by the index is already counted
+		if !converter.IsBundleConfigBlob(configManifestDescriptor) {
+			info.TotalSize += manifest.Config.Size
+			if config := converter.GetBundleConfigBlobDescriptor(manifest); config.Digest != manifest.Config.Digest {
+				info.TotalSize += config.Size
+			}
+		}
+		return info, nil
+	}
+
+	info.TotalSize = 0
+	if err := walkIndex(ctx, ref, resolver, index, indexDescriptor, func(d ocischemav1.Descriptor) error {
+		info.TotalSize += d.Size
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to inspect bundle %q: %w", ref, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,62 @@
+package remotes
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestInspect(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	var totalSize int64
+	for _, payload := range fetcher {
+		totalSize += int64(len(payload))
+	}
+
+	testCases := []struct {
+		name          string
+		level         DetailLevel
+		fetches       int
+		schemaVersion string
+		totalSize     int64
+	}{
+		{name: "index", level: DetailLevelIndex, fetches: 1},
+		{name: "config", level: DetailLevelConfig, fetches: 3, schemaVersion: "v1.0.0"},
+		// The walk fetches the bundle config manifest again
+		{name: "content", level: DetailLevelContent, fetches: 5, schemaVersion: "v1.0.0", totalSize: totalSize},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var fetched []digest.Digest
+			resolver := &mockResolver{
+				fetcher: remotes.FetcherFunc(func(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+					fetched = append(fetched, desc.Digest)
+					return fetcher.Fetch(ctx, desc)
+				}),
+				resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+			}
+			info, err := Inspect(context.Background(), ref, resolver, WithDetailLevel(tc.level))
+			assert.NilError(t, err)
+			assert.Equal(t, tc.fetches, len(fetched))
+			assert.Equal(t, indexDescriptor.Digest, info.Digest)
+			assert.Equal(t, ocischemav1.MediaTypeImageIndex, info.MediaType)
+			assert.Equal(t, 1, info.Images)
+			assert.DeepEqual(t, []string{ocischemav1.MediaTypeImageManifest}, info.ImageMediaTypes)
+			assert.Equal(t, tc.schemaVersion, string(info.SchemaVersion))
+			if tc.totalSize != 0 {
+				assert.Equal(t, tc.totalSize, info.TotalSize)
+			}
+		})
+	}
+
+	_, err = Inspect(context.Background(), ref, &mockResolver{}, WithDetailLevel(DetailLevelContent+1))
+	assert.ErrorContains(t, err, "invalid detail level")
+}
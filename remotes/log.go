@@ -4,22 +4,102 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"regexp"
 
 	"github.com/containerd/containerd/log"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// maxLoggedPayloadSize is the size above which logged payloads are truncated
+	maxLoggedPayloadSize = 4096
+	redactedValue        = "[REDACTED]"
+)
+
+// SensitiveKeyPattern matches the keys, like annotation names, whose values are redacted from the debug logs.
+// It can be replaced to redact other keys, and must be set before any push or pull.
+var SensitiveKeyPattern = regexp.MustCompile(`(?i)token|password|secret`)
+
 func logPayload(logger *logrus.Entry, payload interface{}) {
-	buf, err := json.MarshalIndent(payload, "", "  ")
+	if !logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	buf, err := json.Marshal(payload)
 	if err != nil {
 		return
 	}
+	// Redact a generic copy of the payload, leaving the pushed content untouched
+	var redacted interface{}
+	if err := json.Unmarshal(buf, &redacted); err != nil {
+		return
+	}
+	buf, err = json.MarshalIndent(redact(redacted), "", "  ")
+	if err != nil {
+		return
+	}
+	if len(buf) > maxLoggedPayloadSize {
+		logger.Debugf("%s... (%d bytes truncated)", buf[:maxLoggedPayloadSize], len(buf)-maxLoggedPayloadSize)
+		return
+	}
 	logger.Debug(string(buf))
 }
 
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if SensitiveKeyPattern.MatchString(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redact(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redact(child)
+		}
+	}
+	return value
+}
+
+const (
+	// logFieldReference is the log field of the pushed reference
+	logFieldReference = "reference"
+	// logFieldStage is the log field of the push stage, one of the PushStage values
+	logFieldStage = "stage"
+	// logFieldDigest is the log field of the digest of the pushed payload
+	logFieldDigest = "digest"
+	// logFieldIndexDigest is the log field of the digest of the pushed index, once known
+	logFieldIndexDigest = "indexDigest"
+)
+
+// withLogField returns a context whose logger adds the field to every entry
+func withLogField(ctx context.Context, key string, value interface{}) context.Context {
+	return log.WithLogger(ctx, log.G(ctx).WithField(key, value))
+}
+
+type verboseLogsKey struct{}
+
+// WithVerboseLogs returns a context in which the transport logs of the containerd resolver, like its HTTP requests, are
+// passed through to the context logger instead of being muted, for diagnosing registry specific failures. It applies to
+// every push, pull, copy or fixup run with the returned context.
+func WithVerboseLogs(ctx context.Context) context.Context {
+	return context.WithValue(ctx, verboseLogsKey{}, true)
+}
+
+func isVerbose(ctx context.Context) bool {
+	verbose, _ := ctx.Value(verboseLogsKey{}).(bool)
+	return verbose
+}
+
+// withMutedContext silences the logs of the resolver, keeping the fields of the context logger, unless the context was
+// created with WithVerboseLogs
 func withMutedContext(ctx context.Context) context.Context {
+	if isVerbose(ctx) {
+		return ctx
+	}
 	logger := logrus.New()
 	logger.SetLevel(logrus.FatalLevel)
 	logger.SetOutput(io.Discard)
-	return log.WithLogger(ctx, logrus.NewEntry(logger))
+	return log.WithLogger(ctx, logrus.NewEntry(logger).WithFields(log.G(ctx).Data))
 }
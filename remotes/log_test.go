@@ -0,0 +1,100 @@
+package remotes
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/log"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+)
+
+func newCapturingLogger() (*logrus.Entry, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	logger.SetOutput(out)
+	return logrus.NewEntry(logger), out
+}
+
+func TestLogPayloadRedactsSensitiveAnnotations(t *testing.T) {
+	logger, out := newCapturingLogger()
+	descriptor := ocischemav1.Descriptor{
+		MediaType: ocischemav1.MediaTypeImageManifest,
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		Annotations: map[string]string{
+			"io.example.registry-token": "hunter2",
+			"io.example.Password":       "hunter3",
+			"io.example.name":           "my-app",
+		},
+	}
+
+	logPayload(logger, descriptor)
+	assert.Check(t, !strings.Contains(out.String(), "hunter2"), out.String())
+	assert.Check(t, !strings.Contains(out.String(), "hunter3"), out.String())
+	assert.Check(t, strings.Contains(out.String(), "my-app"), out.String())
+	assert.Check(t, strings.Contains(out.String(), redactedValue), out.String())
+	// The logged payload is untouched
+	assert.Equal(t, "hunter2", descriptor.Annotations["io.example.registry-token"])
+}
+
+func TestLogPayloadTruncatesLargePayloads(t *testing.T) {
+	logger, out := newCapturingLogger()
+
+	logPayload(logger, strings.Repeat("a", 2*maxLoggedPayloadSize))
+	assert.Check(t, strings.Contains(out.String(), "bytes truncated"), out.String())
+	assert.Check(t, out.Len() < 2*maxLoggedPayloadSize)
+}
+
+func TestPushLogsCarryFields(t *testing.T) {
+	logger, out := newCapturingLogger()
+	ctx := log.WithLogger(context.Background(), logger)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	_, err = Push(ctx, tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: &mockPusher{}}, false)
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for _, line := range lines {
+		assert.Check(t, strings.Contains(line, "reference=\"my.registry/namespace/my-app:my-tag\""), line)
+	}
+	contains := func(substrings ...string) bool {
+		for _, line := range lines {
+			found := true
+			for _, s := range substrings {
+				found = found && strings.Contains(line, s)
+			}
+			if found {
+				return true
+			}
+		}
+		return false
+	}
+	assert.Check(t, contains(`stage="config blob"`))
+	assert.Check(t, contains(`stage="config manifest"`))
+	assert.Check(t, contains("stage=index", `indexDigest="`+tests.BundleDigest.String()))
+	assert.Check(t, contains("CNAB Bundle pushed", `indexDigest="`+tests.BundleDigest.String()))
+}
+
+func TestMutedContextKeepsFields(t *testing.T) {
+	logger, out := newCapturingLogger()
+	ctx := withLogField(log.WithLogger(context.Background(), logger), logFieldReference, "my-ref")
+
+	muted := log.G(withMutedContext(ctx))
+	muted.Debug("muted")
+	assert.Equal(t, "my-ref", muted.Data[logFieldReference])
+	assert.Equal(t, 0, out.Len())
+}
+
+func TestVerboseContextIsNotMuted(t *testing.T) {
+	logger, out := newCapturingLogger()
+	ctx := WithVerboseLogs(log.WithLogger(context.Background(), logger))
+
+	log.G(withMutedContext(ctx)).Debug("do request")
+	assert.Check(t, strings.Contains(out.String(), "do request"), out.String())
+}
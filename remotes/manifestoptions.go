@@ -0,0 +1,88 @@
+package remotes
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// WithAnnotations adds annotations to the index, merging them with the existing ones.
+// Annotations already set with the same keys are overridden.
+func WithAnnotations(annotations map[string]string) ManifestOption {
+	return func(ix *ocischemav1.Index) error {
+		if len(annotations) == 0 {
+			return nil
+		}
+		if ix.Annotations == nil {
+			ix.Annotations = make(map[string]string, len(annotations))
+		}
+		for k, v := range annotations {
+			ix.Annotations[k] = v
+		}
+		return nil
+	}
+}
+
+// WithCreatedAnnotation sets the org.opencontainers.image.created annotation of the index, formatted as RFC 3339
+func WithCreatedAnnotation(created time.Time) ManifestOption {
+	return WithAnnotations(map[string]string{
+		ocischemav1.AnnotationCreated: created.UTC().Format(time.RFC3339),
+	})
+}
+
+// WithPlatformFilter removes the index descriptors not matching any of the given platforms.
+// Descriptors without platform are kept.
+func WithPlatformFilter(supportedPlatforms []ocischemav1.Platform) ManifestOption {
+	return func(ix *ocischemav1.Index) error {
+		if len(supportedPlatforms) == 0 {
+			return nil
+		}
+		return converter.FilterIndexByPlatform(ix, supportedPlatforms)
+	}
+}
+
+// WithMediaType sets the media type of the index, and of its pushed descriptor. The index is pushed as a Docker
+// manifest list with converter.CNABManifestListMediaType, or as an OCI index only with converter.CNABIndexMediaType,
+// without fallback to the other format. Other media types are rejected, as they would not match the payload.
+func WithMediaType(mediaType string) ManifestOption {
+	return func(ix *ocischemav1.Index) error {
+		switch mediaType {
+		case converter.CNABIndexMediaType, converter.CNABManifestListMediaType:
+			ix.MediaType = mediaType
+			return nil
+		default:
+			return fmt.Errorf("unsupported index media type %q, expected %q or %q", mediaType, converter.CNABIndexMediaType, converter.CNABManifestListMediaType)
+		}
+	}
+}
+
+// WithSchemaVersion sets the schemaVersion of the index, converter.OCIIndexSchemaVersion by default.
+// Both the OCI index and the Docker manifest list are pushed with this version.
+func WithSchemaVersion(version int) ManifestOption {
+	return func(ix *ocischemav1.Index) error {
+		if version < 1 {
+			return fmt.Errorf("invalid index schema version %d", version)
+		}
+		ix.SchemaVersion = version
+		return nil
+	}
+}
+
+// WithSpecVersionAnnotation sets the converter.OCISpecVersionAnnotation of the index to the version of the OCI image
+// specification it is built with, for clients requiring an explicit version
+func WithSpecVersionAnnotation() ManifestOption {
+	return WithAnnotations(map[string]string{
+		converter.OCISpecVersionAnnotation: specs.Version,
+	})
+}
+
+// WithExtraDescriptors appends the descriptors to the index manifests, like the manifest of an auxiliary artifact
+// pushed to the same repository. They are kept in the Docker manifest list fallback. See converter.AppendDescriptors.
+func WithExtraDescriptors(descriptors ...ocischemav1.Descriptor) ManifestOption {
+	return func(ix *ocischemav1.Index) error {
+		return converter.AppendDescriptors(ix, descriptors...)
+	}
+}
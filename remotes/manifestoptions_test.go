@@ -0,0 +1,140 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestWithAnnotations(t *testing.T) {
+	// A nil annotations map is initialized
+	ix := &ocischemav1.Index{}
+	assert.NilError(t, WithAnnotations(map[string]string{"key": "value"})(ix))
+	assert.DeepEqual(t, map[string]string{"key": "value"}, ix.Annotations)
+
+	// Annotations are merged with the existing ones
+	ix = &ocischemav1.Index{Annotations: map[string]string{"existing": "value"}}
+	created := time.Date(2019, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	for _, opt := range []ManifestOption{WithCreatedAnnotation(created), WithAnnotations(map[string]string{"key": "value"})} {
+		assert.NilError(t, opt(ix))
+	}
+	assert.DeepEqual(t, map[string]string{
+		"existing":                    "value",
+		"key":                         "value",
+		ocischemav1.AnnotationCreated: "2019-01-02T02:04:05Z",
+	}, ix.Annotations)
+}
+
+func TestWithMediaType(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	push := func(pusher *mockPusher, options ...PushOption) (ocischemav1.Descriptor, error) {
+		return PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher}, options...)
+	}
+
+	// The descriptor and the payload media types match
+	for _, mediaType := range []string{converter.CNABIndexMediaType, converter.CNABManifestListMediaType} {
+		pusher := &mockPusher{}
+		descriptor, err := push(pusher, WithManifestOptions(WithMediaType(mediaType)))
+		assert.NilError(t, err)
+		assert.Equal(t, mediaType, descriptor.MediaType)
+		var payload struct {
+			MediaType string `json:"mediaType"`
+		}
+		assert.NilError(t, json.Unmarshal(pusher.buffers[len(pusher.buffers)-1].Bytes(), &payload))
+		assert.Equal(t, mediaType, payload.MediaType)
+	}
+
+	// An OCI index cannot be pushed as a manifest list
+	_, err = push(&mockPusher{}, WithDockerManifestList(), WithManifestOptions(WithMediaType(converter.CNABIndexMediaType)))
+	assert.ErrorContains(t, err, `media type "application/vnd.oci.image.index.v1+json" does not match a Docker manifest list`)
+
+	// Nor can it fall back to a manifest list
+	pusher := newMockPusher([]error{nil, nil, errors.New("unsupported"), nil})
+	_, err = push(pusher, WithAllowFallbacks(true), WithManifestOptions(WithMediaType(converter.CNABIndexMediaType)))
+	assert.ErrorContains(t, err, "unsupported")
+	assert.Equal(t, 3, len(pusher.pushedDescriptors))
+
+	_, err = push(&mockPusher{}, WithManifestOptions(WithMediaType(ocischemav1.MediaTypeImageManifest)))
+	assert.ErrorContains(t, err, `unsupported index media type "application/vnd.oci.image.manifest.v1+json"`)
+}
+
+func TestIndexSchemaVersion(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	resetSchemaVersion := func(ix *ocischemav1.Index) error {
+		ix.SchemaVersion = 0
+		return nil
+	}
+
+	testCases := []struct {
+		name            string
+		manifestOptions []ManifestOption
+		expected        int
+	}{
+		{name: "default", expected: converter.OCIIndexSchemaVersion},
+		{name: "unset", manifestOptions: []ManifestOption{resetSchemaVersion}, expected: converter.OCIIndexSchemaVersion},
+		{name: "custom", manifestOptions: []ManifestOption{WithSchemaVersion(3)}, expected: 3},
+	}
+	for _, tc := range testCases {
+		for _, mediaType := range []string{converter.CNABIndexMediaType, converter.CNABManifestListMediaType} {
+			t.Run(tc.name+" "+mediaType, func(t *testing.T) {
+				pusher := &mockPusher{}
+				options := append(tc.manifestOptions, WithMediaType(mediaType))
+				_, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref,
+					&mockResolver{pusher: pusher}, WithManifestOptions(options...))
+				assert.NilError(t, err)
+				var payload struct {
+					SchemaVersion *int `json:"schemaVersion"`
+				}
+				assert.NilError(t, json.Unmarshal(pusher.buffers[len(pusher.buffers)-1].Bytes(), &payload))
+				assert.Assert(t, payload.SchemaVersion != nil)
+				assert.Equal(t, tc.expected, *payload.SchemaVersion)
+			})
+		}
+	}
+
+	assert.ErrorContains(t, WithSchemaVersion(0)(&ocischemav1.Index{}), "invalid index schema version 0")
+}
+
+func TestWithSpecVersionAnnotation(t *testing.T) {
+	ix := &ocischemav1.Index{}
+	assert.NilError(t, WithSpecVersionAnnotation()(ix))
+	assert.Equal(t, specs.Version, ix.Annotations[converter.OCISpecVersionAnnotation])
+}
+
+func TestWithExtraDescriptors(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	policy := ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: digest.FromString("policy"), Size: 6}
+
+	for _, mediaType := range []string{converter.CNABIndexMediaType, converter.CNABManifestListMediaType} {
+		t.Run(mediaType, func(t *testing.T) {
+			registry := newMemoryRegistry()
+			_, err := Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, false,
+				WithExtraDescriptors(policy), WithMediaType(mediaType))
+			assert.NilError(t, err)
+			var index ocischemav1.Index
+			assert.NilError(t, json.Unmarshal(registry.content[registry.tags[ref.String()]], &index))
+			extra := index.Manifests[len(index.Manifests)-1]
+			assert.Equal(t, policy.Digest, extra.Digest)
+			assert.Equal(t, converter.CNABDescriptorTypeExtra, extra.Annotations[converter.CNABDescriptorTypeAnnotation])
+
+			// The extra descriptor is ignored when pulling the bundle
+			b, relocationMap, _, err := PullWithOptions(context.Background(), ref, registry, WithoutBundleValidation())
+			assert.NilError(t, err)
+			assert.DeepEqual(t, tests.MakeTestBundle(), b)
+			assert.Equal(t, len(tests.MakeRelocationMap()), len(relocationMap))
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package remotes
+
+import "time"
+
+// MetricsCollector records the metrics of the pushes and the pulls, to alert on their latency or failure rate.
+// This package does not depend on a metrics library: implement MetricsCollector with an adapter registering
+// Prometheus collectors, like histograms with the MetricsDurationBuckets, and counters of the successes and failures
+// counted by whether err is nil. Payloads may be pushed concurrently, so implementations must be safe for concurrent
+// use.
+type MetricsCollector interface {
+	// ObservePush records the duration of a whole push to the registry host, err being the error failing it, if any
+	ObservePush(host string, duration time.Duration, err error)
+	// ObservePushStage records the duration of a stage of a push to the registry host: the push of the config blob,
+	// of the config manifest or of the index. A stage pushed with a fallback is observed once per attempted format.
+	ObservePushStage(host string, stage PushStage, duration time.Duration, err error)
+	// ObservePushRetry counts a retry of a payload push to the registry host after a transient error
+	ObservePushRetry(host string)
+	// AddInFlightPushes adds delta, 1 when a push starts or -1 when it ends, to the pushes in flight to the host
+	AddInFlightPushes(host string, delta int)
+	// ObservePull records the duration of a whole pull from the registry host, err being the error failing it, if any
+	ObservePull(host string, duration time.Duration, err error)
+}
+
+// MetricsDurationBuckets are exponential histogram buckets suited to the push and pull durations, in seconds, from
+// 50 milliseconds to about 100 seconds
+var MetricsDurationBuckets = []float64{0.05, 0.1, 0.2, 0.4, 0.8, 1.6, 3.2, 6.4, 12.8, 25.6, 51.2, 102.4}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObservePush(string, time.Duration, error)                 {}
+func (noopMetrics) ObservePushStage(string, PushStage, time.Duration, error) {}
+func (noopMetrics) ObservePushRetry(string)                                  {}
+func (noopMetrics) AddInFlightPushes(string, int)                            {}
+func (noopMetrics) ObservePull(string, time.Duration, error)                 {}
@@ -0,0 +1,112 @@
+package remotes
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+type recordingMetrics struct {
+	mut         sync.Mutex
+	pushes      []error
+	stages      []PushStage
+	stageErrors []error
+	retries     map[string]int
+	inFlight    map[string]int
+	maxInFlight int
+	pulls       []error
+	hosts       map[string]struct{}
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{retries: map[string]int{}, inFlight: map[string]int{}, hosts: map[string]struct{}{}}
+}
+
+func (m *recordingMetrics) ObservePush(host string, duration time.Duration, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.hosts[host] = struct{}{}
+	m.pushes = append(m.pushes, err)
+}
+
+func (m *recordingMetrics) ObservePushStage(host string, stage PushStage, duration time.Duration, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.hosts[host] = struct{}{}
+	m.stages = append(m.stages, stage)
+	m.stageErrors = append(m.stageErrors, err)
+}
+
+func (m *recordingMetrics) ObservePushRetry(host string) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.retries[host]++
+}
+
+func (m *recordingMetrics) AddInFlightPushes(host string, delta int) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.inFlight[host] += delta
+	if m.inFlight[host] > m.maxInFlight {
+		m.maxInFlight = m.inFlight[host]
+	}
+}
+
+func (m *recordingMetrics) ObservePull(host string, duration time.Duration, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.hosts[host] = struct{}{}
+	m.pulls = append(m.pulls, err)
+}
+
+func TestPushAndPullMetrics(t *testing.T) {
+	registry := newMemoryRegistry()
+	// The first push of the config blob fails with a transient error
+	failed := false
+	registry.pushErr = func(_ string, d ocischemav1.Descriptor) error {
+		if !failed {
+			failed = true
+			return remoteserrors.ErrUnexpectedStatus{Status: "503 Service Unavailable", StatusCode: http.StatusServiceUnavailable}
+		}
+		return nil
+	}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	metrics := newRecordingMetrics()
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithMetrics(metrics), WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []error{nil}, metrics.pushes)
+	assert.DeepEqual(t, []PushStage{PushStageConfigBlob, PushStageConfigManifest, PushStageIndex}, metrics.stages)
+	assert.DeepEqual(t, []error{nil, nil, nil}, metrics.stageErrors)
+	assert.DeepEqual(t, map[string]int{"my.registry": 1}, metrics.retries)
+	assert.Equal(t, 1, metrics.maxInFlight)
+	assert.DeepEqual(t, map[string]int{"my.registry": 0}, metrics.inFlight)
+
+	// A failed push is observed with its error
+	registry.pushErr = func(_ string, d ocischemav1.Descriptor) error {
+		return remoteserrors.ErrUnexpectedStatus{Status: "403 Forbidden", StatusCode: http.StatusForbidden}
+	}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithMetrics(metrics), WithAllowFallbacks(false))
+	assert.Assert(t, err != nil)
+	assert.Equal(t, 2, len(metrics.pushes))
+	assert.Assert(t, metrics.pushes[1] != nil)
+	assert.Equal(t, PushStageConfigBlob, metrics.stages[3])
+	assert.Assert(t, metrics.stageErrors[3] != nil)
+	assert.DeepEqual(t, map[string]int{"my.registry": 0}, metrics.inFlight)
+
+	_, _, _, err = PullWithOptions(context.Background(), ref, registry, WithPullMetrics(metrics), WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []error{nil}, metrics.pulls)
+	assert.DeepEqual(t, map[string]struct{}{"my.registry": {}}, metrics.hosts)
+}
@@ -0,0 +1,118 @@
+package remotes
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// mirrorResolver is a resolver reading from the mirrors of a registry before the registry itself
+type mirrorResolver struct {
+	resolver remotes.Resolver
+	mirrors  map[string][]string
+}
+
+// NewMirrorResolver wraps a resolver to resolve and fetch the references of a registry from its mirrors first, in
+// order, like pull-through caches, before falling back to the registry itself. The mirrors are keyed by registry
+// host, like "docker.io". A read falls through to the next host only on transient errors, like connection failures
+// and 5xx responses: authentication failures and missing content are returned right away.
+// Pushes are always sent to the registry itself.
+func NewMirrorResolver(resolver remotes.Resolver, mirrors map[string][]string) remotes.Resolver {
+	return &mirrorResolver{resolver: resolver, mirrors: mirrors}
+}
+
+func (r *mirrorResolver) Resolve(ctx context.Context, ref string) (string, ocischemav1.Descriptor, error) {
+	var desc ocischemav1.Descriptor
+	err := r.failover(ctx, ref, func(hostRef string) error {
+		var err error
+		_, desc, err = r.resolver.Resolve(ctx, hostRef)
+		return err
+	})
+	if err != nil {
+		return "", ocischemav1.Descriptor{}, err
+	}
+	// Keep the original name, the fetcher fails over the same way
+	return ref, desc, nil
+}
+
+func (r *mirrorResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	if _, ok := r.mirrorRefs(ref); !ok {
+		return r.resolver.Fetcher(ctx, ref)
+	}
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+		var rc io.ReadCloser
+		err := r.failover(ctx, ref, func(hostRef string) error {
+			fetcher, err := r.resolver.Fetcher(ctx, hostRef)
+			if err != nil {
+				return err
+			}
+			// The docker fetcher only sends the request on the first read, so it is opened here to fail over on its errors
+			rc, err = openFetch(ctx, fetcher, desc)
+			return err
+		})
+		return rc, err
+	}), nil
+}
+
+func (r *mirrorResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return r.resolver.Pusher(ctx, ref)
+}
+
+// ListTags lists the tags from the registry itself, as mirrors may only know the tags they cached
+func (r *mirrorResolver) ListTags(ctx context.Context, repository string) ([]string, error) {
+	return listTags(ctx, r.resolver, repository)
+}
+
+// ListReferrers lists the referrers from the registry itself, as mirrors may not know the referrers pushed since
+func (r *mirrorResolver) ListReferrers(ctx context.Context, repository string, subject digest.Digest) ([]Referrer, error) {
+	return listRegistryReferrers(ctx, r.resolver, repository, subject)
+}
+
+// failover runs do with the reference rewritten for each mirror, then with the original reference, until it does not
+// fail with a transient error
+func (r *mirrorResolver) failover(ctx context.Context, ref string, do func(hostRef string) error) error {
+	refs, ok := r.mirrorRefs(ref)
+	if !ok {
+		return do(ref)
+	}
+	var err error
+	for _, hostRef := range refs {
+		err = do(hostRef)
+		if err == nil || !isTransientError(err) {
+			return err
+		}
+		log.G(ctx).Debugf("Failed to read %s, trying the next host: %s", hostRef, err)
+	}
+	return err
+}
+
+// mirrorRefs returns the reference rewritten for each mirror of its registry, followed by the reference itself.
+// It returns false if the registry has no mirror.
+func (r *mirrorResolver) mirrorRefs(ref string) ([]string, bool) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, false
+	}
+	mirrors := r.mirrors[reference.Domain(named)]
+	if len(mirrors) == 0 {
+		return nil, false
+	}
+	var suffix string
+	if tagged, ok := named.(reference.Tagged); ok {
+		suffix = ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		suffix += "@" + digested.Digest().String()
+	}
+	refs := make([]string, 0, len(mirrors)+1)
+	for _, mirror := range mirrors {
+		refs = append(refs, fmt.Sprintf("%s/%s%s", mirror, reference.Path(named), suffix))
+	}
+	return append(refs, ref), true
+}
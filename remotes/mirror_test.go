@@ -0,0 +1,199 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+	"testing"
+	"testing/iotest"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/remotes"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+// Mock remotes.Resolver interface dispatching the references to a resolver per registry host
+type hostResolver map[string]remotes.Resolver
+
+func (r hostResolver) resolver(ref string) (remotes.Resolver, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+	resolver, ok := r[reference.Domain(named)]
+	if !ok {
+		return nil, fmt.Errorf("unexpected host for %s", ref)
+	}
+	return resolver, nil
+}
+
+func (r hostResolver) Resolve(ctx context.Context, ref string) (string, ocischemav1.Descriptor, error) {
+	resolver, err := r.resolver(ref)
+	if err != nil {
+		return "", ocischemav1.Descriptor{}, err
+	}
+	return resolver.Resolve(ctx, ref)
+}
+
+func (r hostResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	resolver, err := r.resolver(ref)
+	if err != nil {
+		return nil, err
+	}
+	return resolver.Fetcher(ctx, ref)
+}
+
+func (r hostResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	resolver, err := r.resolver(ref)
+	if err != nil {
+		return nil, err
+	}
+	return resolver.Pusher(ctx, ref)
+}
+
+// Mock remotes.Resolver interface failing all the operations
+type failingResolver struct {
+	err error
+}
+
+func (r failingResolver) Resolve(context.Context, string) (string, ocischemav1.Descriptor, error) {
+	return "", ocischemav1.Descriptor{}, r.err
+}
+
+func (r failingResolver) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return nil, r.err
+}
+
+func (r failingResolver) Pusher(context.Context, string) (remotes.Pusher, error) {
+	return nil, r.err
+}
+
+// Mock remotes.Resolver interface failing to resolve, and fetching readers failing on their first read, like the
+// docker fetcher only sending its request on the first read
+type readFailingResolver struct {
+	failingResolver
+}
+
+func (r readFailingResolver) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(context.Context, ocischemav1.Descriptor) (io.ReadCloser, error) {
+		return io.NopCloser(iotest.ErrReader(r.err)), nil
+	}), nil
+}
+
+func TestMirrorResolver(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	mirrorRef, err := reference.ParseNamed("my.mirror/namespace/my-app:v1")
+	assert.NilError(t, err)
+	registry := newMemoryRegistry()
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, false)
+	assert.NilError(t, err)
+	mirror := newMemoryRegistry()
+	mirrorRelocationMap, err := relocateToRepository(tests.MakeRelocationMap(), mirrorRef)
+	assert.NilError(t, err)
+	_, err = Push(context.Background(), tests.MakeTestBundle(), mirrorRelocationMap, mirrorRef, mirror, false)
+	assert.NilError(t, err)
+
+	connectionRefused := fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED)
+	unauthorized := remoteserrors.ErrUnexpectedStatus{Status: "401 Unauthorized", StatusCode: http.StatusUnauthorized}
+	testCases := []struct {
+		name          string
+		resolvers     hostResolver
+		expectedError string
+	}{
+		{
+			name:      "read from the mirror",
+			resolvers: hostResolver{"my.mirror": mirror, "my.registry": failingResolver{err: connectionRefused}},
+		},
+		{
+			name:      "fall back to the registry when the mirror is down",
+			resolvers: hostResolver{"my.unreachable": failingResolver{err: connectionRefused}, "my.mirror": mirror, "my.registry": registry},
+		},
+		{
+			name:      "fall back to the registry on 5xx responses",
+			resolvers: hostResolver{"my.unreachable": failingResolver{err: remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusBadGateway}}, "my.mirror": failingResolver{err: connectionRefused}, "my.registry": registry},
+		},
+		{
+			name:      "fall back to the next mirror when the fetch fails on read",
+			resolvers: hostResolver{"my.unreachable": readFailingResolver{failingResolver{err: connectionRefused}}, "my.mirror": mirror, "my.registry": registry},
+		},
+		{
+			name:      "fall back to the registry when the fetch fails on read",
+			resolvers: hostResolver{"my.mirror": readFailingResolver{failingResolver{err: remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusBadGateway}}}, "my.registry": registry},
+		},
+		{
+			name:          "no fallback on authentication failures",
+			resolvers:     hostResolver{"my.unreachable": failingResolver{err: unauthorized}, "my.mirror": mirror, "my.registry": registry},
+			expectedError: "401 Unauthorized",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mirrors := []string{"my.mirror"}
+			if _, ok := tc.resolvers["my.unreachable"]; ok {
+				mirrors = []string{"my.unreachable", "my.mirror"}
+			}
+			resolver := NewMirrorResolver(tc.resolvers, map[string][]string{"my.registry": mirrors})
+			b, _, _, err := PullWithOptions(context.Background(), ref, resolver, WithoutBundleValidation())
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, tests.MakeTestBundle(), b)
+		})
+	}
+}
+
+func TestMirrorResolverPushesToTheRegistry(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	registry := newMemoryRegistry()
+	resolver := NewMirrorResolver(hostResolver{"my.mirror": failingResolver{err: errors.New("read-only mirror")}, "my.registry": registry},
+		map[string][]string{"my.registry": {"my.mirror"}})
+
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver, false)
+	assert.NilError(t, err)
+	_, ok := registry.tags[ref.String()]
+	assert.Check(t, ok)
+}
+
+func TestMultiPush(t *testing.T) {
+	first, err := reference.ParseNamed("first.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	second, err := reference.ParseNamed("second.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	third, err := reference.ParseNamed("third.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	firstRegistry, thirdRegistry := newMemoryRegistry(), newMemoryRegistry()
+	resolver := hostResolver{
+		"first.registry":  firstRegistry,
+		"second.registry": failingResolver{err: errors.New("registry down")},
+		"third.registry":  thirdRegistry,
+	}
+
+	results, err := MultiPush(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), []reference.Named{first, second, third}, resolver)
+	assert.ErrorContains(t, err, `failed to push "second.registry/namespace/my-app:v1"`)
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, first, results[0].Ref)
+	assert.NilError(t, results[0].Err)
+	assert.Equal(t, firstRegistry.tags[first.String()], results[0].Result.Index.Digest)
+	assert.Equal(t, second, results[1].Ref)
+	assert.ErrorContains(t, results[1].Err, "registry down")
+	assert.Check(t, results[1].Result == nil)
+	assert.Equal(t, third, results[2].Ref)
+	assert.NilError(t, results[2].Err)
+	assert.Equal(t, thirdRegistry.tags[third.String()], results[2].Result.Index.Digest)
+
+	// The pushed bundles reference the images in their own repository
+	_, relocationMap, _, err := PullWithOptions(context.Background(), third, resolver, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.Equal(t, "third.registry/namespace/my-app@sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		relocationMap["my.registry/namespace/image-1"])
+}
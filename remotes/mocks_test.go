@@ -5,8 +5,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
 	"github.com/docker/docker/api/types"
 	"github.com/opencontainers/go-digest"
@@ -17,8 +21,9 @@ import (
 type mockResolver struct {
 	resolvedDescriptors []ocischemav1.Descriptor
 	pushedReferences    []string
-	pusher              *mockPusher
-	fetcher             *mockFetcher
+	pusher              remotes.Pusher
+	fetcher             remotes.Fetcher
+	mut                 sync.Mutex
 }
 
 func (r *mockResolver) Resolve(_ context.Context, ref string) (string, ocischemav1.Descriptor, error) {
@@ -33,6 +38,8 @@ func (r *mockResolver) Fetcher(_ context.Context, ref string) (remotes.Fetcher,
 	return r.fetcher, nil
 }
 func (r *mockResolver) Pusher(_ context.Context, ref string) (remotes.Pusher, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
 	r.pushedReferences = append(r.pushedReferences, ref)
 	return r.pusher, nil
 }
@@ -42,6 +49,7 @@ type mockPusher struct {
 	pushedDescriptors []ocischemav1.Descriptor
 	buffers           []*bytes.Buffer
 	returnErrorValues []error
+	mut               sync.Mutex
 }
 
 func newMockPusher(ret []error) *mockPusher {
@@ -53,6 +61,8 @@ func newMockPusher(ret []error) *mockPusher {
 }
 
 func (p *mockPusher) Push(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
 	p.pushedDescriptors = append(p.pushedDescriptors, d)
 	buf := &bytes.Buffer{}
 	p.buffers = append(p.buffers, buf)
@@ -95,6 +105,23 @@ func (f *mockFetcher) Fetch(ctx context.Context, desc ocischemav1.Descriptor) (i
 	return rc, nil
 }
 
+// Mock remotes.Fetcher interface serving payloads by digest
+type contentFetcher map[digest.Digest][]byte
+
+func (f contentFetcher) add(payload []byte, mediaType string) ocischemav1.Descriptor {
+	d := digest.FromBytes(payload)
+	f[d] = payload
+	return ocischemav1.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(payload))}
+}
+
+func (f contentFetcher) Fetch(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+	payload, ok := f[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(payload)), nil
+}
+
 type mockReadCloser struct {
 }
 
@@ -123,3 +150,194 @@ func (c *mockImageClient) ImageTag(ctx context.Context, image, ref string) error
 	c.taggedImages[image] = ref
 	return nil
 }
+
+// Mock remotes.Pusher interface delegating to a function
+type funcPusher func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error)
+
+func (f funcPusher) Push(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+	return f(ctx, d)
+}
+
+// Mock remotes.Pusher interface failing a number of times before delegating to an other pusher
+type flakyPusher struct {
+	remotes.Pusher
+	failures int
+	err      error
+	attempts int
+	mut      sync.Mutex
+}
+
+func (p *flakyPusher) Push(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+	p.mut.Lock()
+	p.attempts++
+	fail := p.attempts <= p.failures
+	p.mut.Unlock()
+	if fail {
+		return nil, p.err
+	}
+	return p.Pusher.Push(ctx, d)
+}
+
+// Mock content.Writer interface running a callback on each write, and recording commits
+type callbackWriter struct {
+	mockWriter
+	onWrite   func(p []byte)
+	committed bool
+}
+
+func (w *callbackWriter) Write(p []byte) (int, error) {
+	w.onWrite(p)
+	return w.mockWriter.Write(p)
+}
+
+func (w *callbackWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	w.committed = true
+	return nil
+}
+
+// Mock content.Writer interface failing once in the middle of a write, and reporting its offset when resumable
+type interruptedWriter struct {
+	mockWriter
+	buf       *bytes.Buffer
+	failAfter int
+	failed    bool
+	resumable bool
+}
+
+func newInterruptedWriter(failAfter int, resumable bool) *interruptedWriter {
+	buf := &bytes.Buffer{}
+	return &interruptedWriter{
+		mockWriter: mockWriter{WriteCloser: nopWriteCloser{Buffer: buf}},
+		buf:        buf,
+		failAfter:  failAfter,
+		resumable:  resumable,
+	}
+}
+
+func (w *interruptedWriter) Write(p []byte) (int, error) {
+	if !w.failed && len(p) > w.failAfter {
+		w.failed = true
+		n, _ := w.buf.Write(p[:w.failAfter])
+		return n, syscall.ECONNRESET
+	}
+	return w.buf.Write(p)
+}
+
+func (w *interruptedWriter) Status() (content.Status, error) {
+	if !w.resumable {
+		return content.Status{}, nil
+	}
+	return content.Status{Offset: int64(w.buf.Len())}, nil
+}
+
+// Mock remotes.Resolver interface storing the pushed content in memory, by digest and by tag
+type memoryRegistry struct {
+	content     contentFetcher
+	descriptors map[digest.Digest]ocischemav1.Descriptor
+	tags        map[string]digest.Digest
+	pushErr     func(ref string, d ocischemav1.Descriptor) error
+	mut         sync.Mutex
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{
+		content:     contentFetcher{},
+		descriptors: map[digest.Digest]ocischemav1.Descriptor{},
+		tags:        map[string]digest.Digest{},
+	}
+}
+
+func (r *memoryRegistry) Resolve(_ context.Context, ref string) (string, ocischemav1.Descriptor, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	d, ok := r.tags[ref]
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		d, ok = digest.Digest(ref[i+1:]), true
+	}
+	if desc, found := r.descriptors[d]; ok && found {
+		return ref, desc, nil
+	}
+	return "", ocischemav1.Descriptor{}, fmt.Errorf("%s: %w", ref, errdefs.ErrNotFound)
+}
+
+func (r *memoryRegistry) Fetcher(_ context.Context, ref string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+		r.mut.Lock()
+		defer r.mut.Unlock()
+		return r.content.Fetch(ctx, desc)
+	}), nil
+}
+
+func (r *memoryRegistry) Pusher(_ context.Context, ref string) (remotes.Pusher, error) {
+	return funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+		if r.pushErr != nil {
+			if err := r.pushErr(ref, d); err != nil {
+				return nil, err
+			}
+		}
+		buf := &bytes.Buffer{}
+		return &memoryWriter{mockWriter: mockWriter{WriteCloser: nopWriteCloser{Buffer: buf}}, buf: buf, commit: func() {
+			r.mut.Lock()
+			defer r.mut.Unlock()
+			r.content[d.Digest] = buf.Bytes()
+			r.descriptors[d.Digest] = ocischemav1.Descriptor{MediaType: d.MediaType, Digest: d.Digest, Size: d.Size}
+			if !strings.Contains(ref, "@") && strings.LastIndex(ref, ":") > strings.LastIndex(ref, "/") {
+				r.tags[ref] = d.Digest
+			}
+		}}, nil
+	}), nil
+}
+
+// Mock content.Writer interface running a callback on commit
+type memoryWriter struct {
+	mockWriter
+	buf    *bytes.Buffer
+	commit func()
+}
+
+func (w *memoryWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if actual := expected.Algorithm().FromBytes(w.buf.Bytes()); actual != expected {
+		return fmt.Errorf("unexpected commit digest %s, expected %s", actual, expected)
+	}
+	w.commit()
+	return nil
+}
+
+// recordingTracer records the spans it starts, with the name of their parent span
+type recordingTracer struct {
+	mut   sync.Mutex
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	name       string
+	parent     string
+	attributes map[string]interface{}
+	ended      bool
+	err        error
+}
+
+type recordingSpanKey struct{}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, attributes ...TraceAttribute) (context.Context, Span) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	span := &recordingSpan{name: name, attributes: map[string]interface{}{}}
+	if parent, ok := ctx.Value(recordingSpanKey{}).(*recordingSpan); ok {
+		span.parent = parent.name
+	}
+	span.SetAttributes(attributes...)
+	r.spans = append(r.spans, span)
+	return context.WithValue(ctx, recordingSpanKey{}, span), span
+}
+
+func (s *recordingSpan) SetAttributes(attributes ...TraceAttribute) {
+	for _, a := range attributes {
+		s.attributes[a.Key] = a.Value
+	}
+}
+
+func (s *recordingSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
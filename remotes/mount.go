@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes"
 	"github.com/docker/distribution/reference"
 	"github.com/opencontainers/go-digest"
@@ -17,9 +19,12 @@ import (
 )
 
 const (
-	// labelDistributionSource describes the source blob comes from.
+	// AnnotationDistributionSource is the prefix of the descriptor annotation naming the repositories a blob can be
+	// mounted from, suffixed with their registry host name, like "containerd.io/distribution.source.my.registry". Its value
+	// is a comma separated list of repository paths in that registry. A pushed payload annotated for the registry it is
+	// pushed to is mounted from the first of those repositories when possible, and uploaded otherwise.
 	// This label comes from containerd: https://github.com/containerd/containerd/blob/master/remotes/docker/handler.go#L35
-	labelDistributionSource = "containerd.io/distribution.source"
+	AnnotationDistributionSource = "containerd.io/distribution.source"
 )
 
 func newDescriptorCopier(ctx context.Context, resolver remotes.Resolver,
@@ -49,7 +54,7 @@ type descriptorCopier struct {
 func (h *descriptorCopier) Handle(ctx context.Context, desc *descriptorProgress) (retErr error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	if len(desc.URLs) > 0 {
+	if isNonDistributable(desc.Descriptor) {
 		desc.markDone()
 		desc.setAction("Skip (foreign layer)")
 		return nil
@@ -62,7 +67,7 @@ func (h *descriptorCopier) Handle(ctx context.Context, desc *descriptorProgress)
 		}
 		h.eventNotifier.reportProgress(retErr)
 	}()
-	writer, err := pushWithAnnotation(ctx, h.targetPusher, h.originalSource, desc.Descriptor)
+	writer, err := pushWithMountFallback(ctx, h.targetPusher, h.originalSource, desc.Descriptor)
 	if errors.Is(err, errdefs.ErrAlreadyExists) {
 		desc.markDone()
 		if strings.Contains(err.Error(), "mounted") {
@@ -92,13 +97,90 @@ func (h *descriptorCopier) Handle(ctx context.Context, desc *descriptorProgress)
 func pushWithAnnotation(ctx context.Context, pusher remotes.Pusher, ref reference.Named, desc ocischemav1.Descriptor) (content.Writer, error) {
 	// Add the distribution source annotation to help containerd
 	// mount instead of push when possible.
-	repo := fmt.Sprintf("%s.%s", labelDistributionSource, reference.Domain(ref))
-	desc.Annotations = map[string]string{
-		repo: reference.FamiliarName(ref),
+	annotations := make(map[string]string, len(desc.Annotations)+1)
+	for k, v := range desc.Annotations {
+		annotations[k] = v
 	}
+	annotations[distributionSourceKey(reference.Domain(ref))] = reference.Path(ref)
+	desc.Annotations = annotations
 	return pusher.Push(ctx, desc)
 }
 
+// pushWithMountFallback pushes the descriptor with a mount hint for the source repository, when known. If the pusher
+// fails to handle the hinted push, the descriptor is pushed again without it, to be uploaded normally. Only blobs can be
+// mounted, so manifests are always pushed without the hint.
+func pushWithMountFallback(ctx context.Context, pusher remotes.Pusher, source reference.Named, desc ocischemav1.Descriptor) (content.Writer, error) {
+	if source == nil || isManifest(desc.MediaType) {
+		return pusher.Push(ctx, desc)
+	}
+	writer, err := pushWithAnnotation(ctx, pusher, source, desc)
+	if err == nil || errors.Is(err, errdefs.ErrAlreadyExists) {
+		return writer, err
+	}
+	log.G(ctx).Debugf("Failed to push %s with a mount from %s, uploading it instead: %s", desc.Digest, source, err)
+	return pusher.Push(ctx, desc)
+}
+
+// distributionSourceMount returns the repository the AnnotationDistributionSource annotation of desc hints for the
+// registry of ref, or nil, along with desc stripped of that annotation so the upload fallback never mounts
+func distributionSourceMount(ref string, desc ocischemav1.Descriptor) (reference.Named, ocischemav1.Descriptor) {
+	target, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, desc
+	}
+	domain := reference.Domain(target)
+	key := distributionSourceKey(domain)
+	hint, ok := desc.Annotations[key]
+	if !ok {
+		return nil, desc
+	}
+	annotations := make(map[string]string, len(desc.Annotations)-1)
+	for k, v := range desc.Annotations {
+		if k != key {
+			annotations[k] = v
+		}
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	desc.Annotations = annotations
+	for _, repository := range strings.Split(hint, ",") {
+		source, err := reference.ParseNormalizedNamed(domain + "/" + strings.TrimSpace(repository))
+		if err == nil && source.Name() != target.Name() {
+			return source, desc
+		}
+	}
+	return nil, desc
+}
+
+// withRepositoryRefKey scopes the reference the docker pusher tracks the pushed descriptor with by the repository of
+// ref. That reference is the digest of the descriptor otherwise, shared by all the repositories pushed to with the same
+// resolver, so content already pushed to another repository would be skipped instead of being pushed or mounted.
+func withRepositoryRefKey(ctx context.Context, ref string, desc ocischemav1.Descriptor) context.Context {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ctx
+	}
+	return remotes.WithMediaTypeKeyPrefix(ctx, desc.MediaType, named.Name())
+}
+
+// distributionSourceKey returns the AnnotationDistributionSource annotation key of a registry domain. Like containerd,
+// the annotation is keyed by the registry host name, without its port.
+func distributionSourceKey(domain string) string {
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		host = h
+	}
+	return fmt.Sprintf("%s.%s", AnnotationDistributionSource, host)
+}
+
+// isNonDistributable returns true if the content is not stored in the registry, like a Windows base layer: foreign
+// layers with URLs, or layers with a non-distributable media type. Such content is never uploaded, and the manifests
+// keep referencing it unchanged.
+func isNonDistributable(desc ocischemav1.Descriptor) bool {
+	return len(desc.URLs) > 0 || images.IsNonDistributable(desc.MediaType)
+}
+
 func isManifest(mediaType string) bool {
 	return mediaType == images.MediaTypeDockerSchema1Manifest ||
 		mediaType == images.MediaTypeDockerSchema2Manifest ||
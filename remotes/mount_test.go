@@ -1,15 +1,25 @@
 package remotes
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"gotest.tools/v3/assert"
 )
@@ -54,7 +64,7 @@ func TestMountOnPush(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Testing if mount is called, mount API call is in the form of:
 		// POST http://<REGISTRY>/<REPO>/<IMAGE>/blobs/uploads?from=<REPO2>/<IMAGE2>
-		if strings.Contains(r.URL.EscapedPath(), "library/test/blobs/uploads/") && strings.Contains(r.URL.Query().Get("from"), "library/busybox") {
+		if strings.Contains(r.URL.EscapedPath(), "library/test/blobs/uploads/") && r.URL.Query().Get("from") == "library/busybox" {
 			hasMounted = true
 		}
 		// We don't really care what we send here.
@@ -73,10 +83,297 @@ func TestMountOnPush(t *testing.T) {
 	r, err := resolver.Pusher(context.TODO(), u.Hostname()+":"+u.Port()+"/library/test")
 	assert.NilError(t, err)
 
-	ref, err := reference.WithName(u.Hostname() + "/library/busybox")
+	// The source is on the same registry, port included
+	ref, err := reference.WithName(u.Host + "/library/busybox")
 	assert.NilError(t, err)
 
 	desc := ocischemav1.Descriptor{}
 	_, _ = pushWithAnnotation(context.TODO(), r, ref, desc)
 	assert.Equal(t, hasMounted, true)
 }
+
+func TestPushWithMountFallback(t *testing.T) {
+	source, err := reference.ParseNamed("my.registry/namespace/source")
+	assert.NilError(t, err)
+	var pushed []ocischemav1.Descriptor
+	// A pusher unable to handle the mount hint
+	pusher := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+		pushed = append(pushed, d)
+		if len(d.Annotations) > 0 {
+			return nil, errors.New("mount not supported")
+		}
+		return &mockWriter{WriteCloser: nopWriteCloser{Buffer: &bytes.Buffer{}}}, nil
+	})
+
+	_, err = pushWithMountFallback(context.Background(), pusher, source, ocischemav1.Descriptor{Digest: "sha256:abc"})
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(pushed))
+	assert.Equal(t, "namespace/source", pushed[0].Annotations["containerd.io/distribution.source.my.registry"])
+	assert.Equal(t, 0, len(pushed[1].Annotations))
+
+	// Without source, no mount is attempted
+	pushed = nil
+	_, err = pushWithMountFallback(context.Background(), pusher, nil, ocischemav1.Descriptor{Digest: "sha256:abc"})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(pushed))
+}
+
+func TestPushPayloadWithDistributionSourceAnnotation(t *testing.T) {
+	payload := []byte("payload")
+	descriptor := ocischemav1.Descriptor{
+		Digest: digest.FromBytes(payload),
+		Size:   int64(len(payload)),
+		Annotations: map[string]string{
+			"containerd.io/distribution.source.my.registry":    "namespace/my-app,namespace/source",
+			"containerd.io/distribution.source.other.registry": "namespace/other",
+		},
+	}
+	var pushed []ocischemav1.Descriptor
+	// A registry rejecting the mount
+	pusher := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+		pushed = append(pushed, d)
+		if _, ok := d.Annotations["containerd.io/distribution.source.my.registry"]; ok {
+			return nil, errors.New("mount rejected")
+		}
+		return &mockWriter{WriteCloser: nopWriteCloser{Buffer: &bytes.Buffer{}}}, nil
+	})
+	cfg, err := newPushConfig()
+	assert.NilError(t, err)
+
+	err = pushPayload(context.Background(), &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(pushed))
+	// The target repository itself is skipped
+	assert.Equal(t, "namespace/source", pushed[0].Annotations["containerd.io/distribution.source.my.registry"])
+	// The upload fallback does not mount, and keeps the annotations of the other registries
+	_, ok := pushed[1].Annotations["containerd.io/distribution.source.my.registry"]
+	assert.Assert(t, !ok)
+	assert.Equal(t, "namespace/other", pushed[1].Annotations["containerd.io/distribution.source.other.registry"])
+
+	// Without a hint for its registry, the descriptor is pushed as is
+	pushed = nil
+	accepting := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+		pushed = append(pushed, d)
+		return &mockWriter{WriteCloser: nopWriteCloser{Buffer: &bytes.Buffer{}}}, nil
+	})
+	err = pushPayload(context.Background(), &mockResolver{pusher: accepting}, "third.registry/namespace/my-app", cfg, descriptor, payload)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(pushed))
+	assert.DeepEqual(t, descriptor.Annotations, pushed[0].Annotations)
+}
+
+func TestPushPayloadMountsFromDistributionSource(t *testing.T) {
+	registry := newUploadRegistry(t)
+	payload := []byte("payload")
+	d := registry.addBlob("namespace/source", payload)
+	descriptor := ocischemav1.Descriptor{
+		MediaType: ocischemav1.MediaTypeImageLayer,
+		Digest:    d,
+		Size:      int64(len(payload)),
+		Annotations: map[string]string{
+			// Keyed by the host name of the registry, without its port
+			"containerd.io/distribution.source.127.0.0.1": "namespace/my-app,namespace/source",
+		},
+	}
+	cfg, err := newPushConfig()
+	assert.NilError(t, err)
+
+	err = pushPayload(context.Background(), registry.resolver(), registry.host()+"/namespace/my-app", cfg, descriptor, payload)
+	assert.NilError(t, err)
+	// The target repository itself is skipped, and the blob is mounted instead of uploaded
+	assert.DeepEqual(t, []mountRequest{{Repository: "namespace/my-app", From: "namespace/source", Digest: d}}, registry.mounts)
+	assert.Equal(t, 0, len(registry.uploads))
+	assert.Assert(t, registry.hasBlob("namespace/my-app", d))
+}
+
+// mountRequest is a cross repository mount requested from an uploadRegistry
+type mountRequest struct {
+	Repository string
+	From       string
+	Digest     digest.Digest
+}
+
+// uploadRegistry is a minimal registry serving the blob upload, cross repository mount and manifest push API over
+// plain HTTP, recording the uploaded blobs and the requested mounts
+type uploadRegistry struct {
+	*httptest.Server
+	mut         sync.Mutex
+	blobs       map[string]map[digest.Digest][]byte
+	manifests   map[string]map[string]ocischemav1.Descriptor
+	content     map[digest.Digest][]byte
+	uploads     []string
+	mounts      []mountRequest
+	inFlight    int
+	maxInFlight int
+	uploadDelay time.Duration
+	uploadID    int
+}
+
+func newUploadRegistry(t *testing.T) *uploadRegistry {
+	t.Helper()
+	r := &uploadRegistry{
+		blobs:     map[string]map[digest.Digest][]byte{},
+		manifests: map[string]map[string]ocischemav1.Descriptor{},
+		content:   map[digest.Digest][]byte{},
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// host returns the host:port of the registry, to prefix the pushed references with
+func (r *uploadRegistry) host() string {
+	return r.Listener.Addr().String()
+}
+
+func (r *uploadRegistry) resolver() remotes.Resolver {
+	return docker.NewResolver(docker.ResolverOptions{PlainHTTP: true})
+}
+
+func (r *uploadRegistry) addBlob(repository string, payload []byte) digest.Digest {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	d := digest.FromBytes(payload)
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = map[digest.Digest][]byte{}
+	}
+	r.blobs[repository][d] = payload
+	return d
+}
+
+func (r *uploadRegistry) addManifest(repository, tag string, mediaType string, payload []byte) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.putManifest(repository, tag, mediaType, payload)
+}
+
+func (r *uploadRegistry) putManifest(repository, ref string, mediaType string, payload []byte) ocischemav1.Descriptor {
+	desc := ocischemav1.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = map[string]ocischemav1.Descriptor{}
+	}
+	r.manifests[repository][ref] = desc
+	r.manifests[repository][desc.Digest.String()] = desc
+	r.content[desc.Digest] = payload
+	return desc
+}
+
+func (r *uploadRegistry) hasBlob(repository string, d digest.Digest) bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	_, ok := r.blobs[repository][d]
+	return ok
+}
+
+func (r *uploadRegistry) resetRequests() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.uploads, r.mounts, r.maxInFlight = nil, nil, 0
+}
+
+func (r *uploadRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if i := strings.Index(path, "/blobs/"); i > 0 {
+		r.serveBlob(w, req, path[:i], path[i+len("/blobs/"):])
+		return
+	}
+	if i := strings.Index(path, "/manifests/"); i > 0 {
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (r *uploadRegistry) serveBlob(w http.ResponseWriter, req *http.Request, repository, rest string) {
+	switch {
+	case req.Method == http.MethodPost && rest == "uploads/":
+		r.mut.Lock()
+		defer r.mut.Unlock()
+		query := req.URL.Query()
+		if mount := digest.Digest(query.Get("mount")); mount != "" {
+			r.mounts = append(r.mounts, mountRequest{Repository: repository, From: query.Get("from"), Digest: mount})
+			if payload, ok := r.blobs[query.Get("from")][mount]; ok {
+				if r.blobs[repository] == nil {
+					r.blobs[repository] = map[digest.Digest][]byte{}
+				}
+				r.blobs[repository][mount] = payload
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.uploadID++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repository, r.uploadID))
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPut && strings.HasPrefix(rest, "uploads/"):
+		r.mut.Lock()
+		r.inFlight++
+		if r.inFlight > r.maxInFlight {
+			r.maxInFlight = r.inFlight
+		}
+		r.mut.Unlock()
+		payload, err := io.ReadAll(req.Body)
+		time.Sleep(r.uploadDelay)
+		r.mut.Lock()
+		defer r.mut.Unlock()
+		r.inFlight--
+		d := digest.Digest(req.URL.Query().Get("digest"))
+		if err != nil || digest.FromBytes(payload) != d {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.blobs[repository] == nil {
+			r.blobs[repository] = map[digest.Digest][]byte{}
+		}
+		r.blobs[repository][d] = payload
+		r.uploads = append(r.uploads, repository+"@"+d.String())
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodHead || req.Method == http.MethodGet:
+		r.mut.Lock()
+		defer r.mut.Unlock()
+		payload, ok := r.blobs[repository][digest.Digest(rest)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(payload)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *uploadRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repository, ref string) {
+	// The body is streamed by the client while it fetches the content, so it is read before locking
+	payload, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	switch req.Method {
+	case http.MethodPut:
+		desc := r.putManifest(repository, ref, req.Header.Get("Content-Type"), payload)
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead, http.MethodGet:
+		desc, ok := r.manifests[repository][ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", desc.MediaType)
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.Header().Set("Content-Length", strconv.FormatInt(desc.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(r.content[desc.Digest])
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,75 @@
+package remotes
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/hashicorp/go-multierror"
+)
+
+// PinImageDigests resolves the current digest of every bundle image referenced by a tag, and updates the bundle image
+// digest, size and media type with the resolved ones. Images already pinned by a digest are left untouched.
+// The returned relocation map associates each resolved image to its digested reference. The images which cannot be
+// resolved are all reported in the returned multierror, the other images being updated anyway.
+func PinImageDigests(ctx context.Context, b *bundle.Bundle, resolver remotes.Resolver) (relocation.ImageRelocationMap, error) {
+	log.G(ctx).Debug("Pinning bundle image digests")
+	relocationMap := relocation.ImageRelocationMap{}
+	var result *multierror.Error
+	for i := range b.InvocationImages {
+		if err := pinImageDigest(ctx, &b.InvocationImages[i].BaseImage, relocationMap, resolver); err != nil {
+			result = multierror.Append(result, fmt.Errorf("failed to pin invocation image %q: %w", b.InvocationImages[i].Image, err))
+		}
+	}
+	for _, name := range sortedImageNames(b.Images) {
+		img := b.Images[name]
+		if err := pinImageDigest(ctx, &img.BaseImage, relocationMap, resolver); err != nil {
+			result = multierror.Append(result, fmt.Errorf("failed to pin image %q for service %q: %w", img.Image, name, err))
+			continue
+		}
+		b.Images[name] = img
+	}
+	return relocationMap, result.ErrorOrNil()
+}
+
+func pinImageDigest(ctx context.Context, baseImage *bundle.BaseImage, relocationMap relocation.ImageRelocationMap, resolver remotes.Resolver) error {
+	if baseImage.Digest != "" {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(baseImage.Image)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid reference: %w", baseImage.Image, err)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return nil
+	}
+	tagged := reference.TagNameOnly(named)
+	_, descriptor, err := resolver.Resolve(withMutedContext(ctx), tagged.String())
+	if err != nil {
+		return err
+	}
+	digested, err := reference.WithDigest(reference.TrimNamed(named), descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).Debugf("Pinned %s to %s", tagged, descriptor.Digest)
+	baseImage.Digest = descriptor.Digest.String()
+	baseImage.Size = uint64(descriptor.Size)
+	baseImage.MediaType = descriptor.MediaType
+	relocationMap[baseImage.Image] = reference.FamiliarString(digested)
+	return nil
+}
+
+func sortedImageNames(images map[string]bundle.Image) []string {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
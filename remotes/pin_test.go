@@ -0,0 +1,56 @@
+package remotes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/hashicorp/go-multierror"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestPinImageDigests(t *testing.T) {
+	registry := newMemoryRegistry()
+	invocation := registry.content.add([]byte("invocation manifest"), ocischemav1.MediaTypeImageManifest)
+	registry.descriptors[invocation.Digest] = invocation
+	registry.tags["my.registry/namespace/my-app-invoc:latest"] = invocation.Digest
+	component := registry.content.add([]byte("component manifest"), ocischemav1.MediaTypeImageIndex)
+	registry.descriptors[component.Digest] = component
+	registry.tags["my.registry/namespace/image-1:v1"] = component.Digest
+
+	pinned := bundle.BaseImage{
+		Image:     "my.registry/namespace/pinned:v1",
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+		Size:      42,
+		MediaType: ocischemav1.MediaTypeImageManifest,
+	}
+	b := &bundle.Bundle{
+		InvocationImages: []bundle.InvocationImage{{BaseImage: bundle.BaseImage{Image: "my.registry/namespace/my-app-invoc"}}},
+		Images: map[string]bundle.Image{
+			"image-1": {BaseImage: bundle.BaseImage{Image: "my.registry/namespace/image-1:v1"}},
+			"pinned":  {BaseImage: pinned},
+			"unknown": {BaseImage: bundle.BaseImage{Image: "my.registry/namespace/unknown:v1"}},
+			"invalid": {BaseImage: bundle.BaseImage{Image: "Not A Reference"}},
+		},
+	}
+
+	relocationMap, err := PinImageDigests(context.Background(), b, registry)
+	merr, ok := err.(*multierror.Error)
+	assert.Assert(t, ok, err)
+	assert.Equal(t, 2, len(merr.Errors), err)
+	assert.ErrorContains(t, merr.Errors[0], `failed to pin image "Not A Reference" for service "invalid"`)
+	assert.ErrorContains(t, merr.Errors[1], `failed to pin image "my.registry/namespace/unknown:v1" for service "unknown"`)
+
+	// Resolved images are updated anyway
+	assert.Equal(t, invocation.Digest.String(), b.InvocationImages[0].Digest)
+	assert.Equal(t, uint64(invocation.Size), b.InvocationImages[0].Size)
+	assert.Equal(t, ocischemav1.MediaTypeImageManifest, b.InvocationImages[0].MediaType)
+	assert.Equal(t, component.Digest.String(), b.Images["image-1"].Digest)
+	assert.Equal(t, ocischemav1.MediaTypeImageIndex, b.Images["image-1"].MediaType)
+	assert.DeepEqual(t, pinned, b.Images["pinned"].BaseImage)
+	assert.DeepEqual(t, map[string]string{
+		"my.registry/namespace/my-app-invoc": "my.registry/namespace/my-app-invoc@" + invocation.Digest.String(),
+		"my.registry/namespace/image-1:v1":   "my.registry/namespace/image-1@" + component.Digest.String(),
+	}, map[string]string(relocationMap))
+}
@@ -0,0 +1,161 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ManifestLister is implemented by the resolvers able to list all the manifests of a repository, tagged or not.
+// The distribution API only lists tags, so this relies on registry specific APIs.
+type ManifestLister interface {
+	ListManifests(ctx context.Context, repository string) ([]ocischemav1.Descriptor, error)
+}
+
+// ManifestDeleter is implemented by the resolvers able to delete a manifest, given its digested reference
+type ManifestDeleter interface {
+	DeleteManifest(ctx context.Context, ref string) error
+}
+
+// UnsupportedDeletionError is returned by Prune when the resolver or the registry does not support listing or deleting
+// manifests
+type UnsupportedDeletionError struct {
+	// Repository is the pruned repository
+	Repository string
+	// Err is the error returned by the registry, if it rejected the deletion
+	Err error
+}
+
+func (e *UnsupportedDeletionError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("manifest deletion is not supported in %q: %s", e.Repository, e.Err)
+	}
+	return fmt.Sprintf("manifest deletion is not supported in %q: the resolver cannot list and delete manifests", e.Repository)
+}
+
+func (e *UnsupportedDeletionError) Unwrap() error {
+	return e.Err
+}
+
+// Prune deletes the bundle indexes of the repository of ref which are neither tagged nor in keep, with their bundle
+// config manifests, like the indexes left untagged by pushing a bundle again under the same tag. Every index a tag of
+// the repository resolves to is kept, as well as the index ref currently resolves to, and nothing referenced by a kept
+// index is ever deleted. The registry garbage collection then frees the blobs only referenced by the deleted manifests.
+// The resolver must implement ManifestLister and ManifestDeleter, otherwise Prune fails with an
+// UnsupportedDeletionError. It must also implement TagLister: if the tags cannot be listed, Prune fails with the
+// error of ListTags, like an UnsupportedTagListingError, without deleting anything. It returns the digests of the
+// deleted manifests.
+func Prune(ctx context.Context, ref reference.Named, resolver remotes.Resolver, keep []digest.Digest) ([]digest.Digest, error) {
+	repository := ref.Name()
+	lister, canList := resolver.(ManifestLister)
+	deleter, canDelete := resolver.(ManifestDeleter)
+	if !canList || !canDelete {
+		return nil, &UnsupportedDeletionError{Repository: repository}
+	}
+	log.G(ctx).Debugf("Pruning CNAB Bundles of %s", repository)
+
+	kept := make(map[digest.Digest]struct{}, len(keep)+1)
+	for _, d := range keep {
+		kept[d] = struct{}{}
+	}
+	if _, current, err := resolver.Resolve(withMutedContext(ctx), ref.String()); err == nil {
+		kept[current.Digest] = struct{}{}
+	} else if !errors.Is(err, errdefs.ErrNotFound) {
+		return nil, fmt.Errorf("failed to resolve bundle manifest %q: %w", ref, err)
+	}
+	// The indexes still tagged are in use, whatever the tag
+	tags, err := listTags(ctx, resolver, repository)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		tagged := repository + ":" + tag
+		_, current, err := resolver.Resolve(withMutedContext(ctx), tagged)
+		if err != nil {
+			if errors.Is(err, errdefs.ErrNotFound) {
+				// Deleted since the listing
+				continue
+			}
+			return nil, fmt.Errorf("failed to resolve %q: %w", tagged, err)
+		}
+		kept[current.Digest] = struct{}{}
+	}
+
+	manifests, err := lister.ListManifests(ctx, repository)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the manifests of %q: %w", repository, err)
+	}
+	// Collect everything referenced by the kept indexes first, so it is never deleted
+	referenced := map[digest.Digest]struct{}{}
+	var pruned []ocischemav1.Index
+	var prunedDescriptors []ocischemav1.Descriptor
+	for _, d := range manifests {
+		if !images.IsIndexType(d.MediaType) {
+			continue
+		}
+		payload, err := pullPayload(ctx, resolver, repository, d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch index %s: %w", d.Digest, err)
+		}
+		index, err := converter.UnmarshalIndex(payload, d.MediaType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index %s: %w", d.Digest, err)
+		}
+		if !converter.IsCNABIndex(index) {
+			continue
+		}
+		if _, ok := kept[d.Digest]; ok {
+			for _, m := range index.Manifests {
+				referenced[m.Digest] = struct{}{}
+			}
+			continue
+		}
+		pruned = append(pruned, index)
+		prunedDescriptors = append(prunedDescriptors, d)
+	}
+
+	var deleted []digest.Digest
+	deleteManifest := func(d digest.Digest) error {
+		if _, ok := referenced[d]; ok {
+			return nil
+		}
+		referenced[d] = struct{}{}
+		manifestRef := fmt.Sprintf("%s@%s", repository, d)
+		log.G(ctx).Debugf("Deleting %s", manifestRef)
+		if err := deleter.DeleteManifest(withMutedContext(ctx), manifestRef); err != nil {
+			if errors.Is(err, errdefs.ErrNotFound) {
+				return nil
+			}
+			var statusErr remoteserrors.ErrUnexpectedStatus
+			if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusMethodNotAllowed {
+				return &UnsupportedDeletionError{Repository: repository, Err: err}
+			}
+			return fmt.Errorf("failed to delete %q: %w", manifestRef, err)
+		}
+		deleted = append(deleted, d)
+		return nil
+	}
+	for i, index := range pruned {
+		// Delete the index first, so a failure never leaves an index referencing a deleted manifest
+		if err := deleteManifest(prunedDescriptors[i].Digest); err != nil {
+			return deleted, err
+		}
+		if config, err := converter.GetBundleConfigManifestDescriptor(&index); err == nil {
+			if err := deleteManifest(config.Digest); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
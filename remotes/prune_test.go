@@ -0,0 +1,156 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/errdefs"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+// Mock remotes.Resolver interface listing the tags, and listing and deleting the manifests of a memory registry
+type pruningRegistry struct {
+	*memoryRegistry
+	deleteErr error
+	tagsErr   error
+}
+
+func (r *pruningRegistry) ListTags(_ context.Context, repository string) ([]string, error) {
+	if r.tagsErr != nil {
+		return nil, r.tagsErr
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	var tags []string
+	for ref := range r.tags {
+		if strings.HasPrefix(ref, repository+":") {
+			tags = append(tags, strings.TrimPrefix(ref, repository+":"))
+		}
+	}
+	return tags, nil
+}
+
+func (r *pruningRegistry) ListManifests(context.Context, string) ([]ocischemav1.Descriptor, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	var manifests []ocischemav1.Descriptor
+	for _, d := range r.descriptors {
+		manifests = append(manifests, d)
+	}
+	return manifests, nil
+}
+
+func (r *pruningRegistry) DeleteManifest(_ context.Context, ref string) error {
+	if r.deleteErr != nil {
+		return r.deleteErr
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return err
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	d := named.(reference.Digested).Digest()
+	if _, ok := r.descriptors[d]; !ok {
+		return fmt.Errorf("%s: %w", ref, errdefs.ErrNotFound)
+	}
+	delete(r.descriptors, d)
+	delete(r.content, d)
+	return nil
+}
+
+func TestPrune(t *testing.T) {
+	registry := &pruningRegistry{memoryRegistry: newMemoryRegistry()}
+	v1, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	v2, err := reference.ParseNamed("my.registry/namespace/my-app:v2")
+	assert.NilError(t, err)
+	push := func(ref reference.Named, description string, relocationMap map[string]string) *PushResult {
+		b := tests.MakeTestBundle()
+		b.Description = description
+		result, err := PushWithResult(context.Background(), b, relocationMap, ref, registry)
+		assert.NilError(t, err)
+		return result
+	}
+	// The orphaned index shares its bundle config with the retained one
+	orphaned := push(v1, "first", tests.MakeRelocationMap())
+	relocationMap := tests.MakeRelocationMap()
+	relocationMap["my.registry/namespace/image-1"] = "my.registry/namespace/my-app@sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0349"
+	retained := push(v2, "first", relocationMap)
+	assert.Equal(t, orphaned.ConfigManifest.Digest, retained.ConfigManifest.Digest)
+	// The other orphaned index has its own bundle config
+	otherOrphaned := push(v1, "second", tests.MakeRelocationMap())
+	current := push(v1, "third", tests.MakeRelocationMap())
+
+	// The retained index is kept as it is still tagged, without being in keep
+	deleted, err := Prune(context.Background(), v1, registry, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(deleted))
+	assert.Check(t, containsDigest(deleted, orphaned.Index.Digest))
+	assert.Check(t, containsDigest(deleted, otherOrphaned.Index.Digest))
+	assert.Check(t, containsDigest(deleted, otherOrphaned.ConfigManifest.Digest))
+	// The current and retained bundles can still be pulled
+	for _, ref := range []reference.Named{v1, v2} {
+		_, _, _, err := PullWithOptions(context.Background(), ref, registry, WithoutBundleValidation())
+		assert.NilError(t, err)
+	}
+	_, err = registry.content.Fetch(context.Background(), current.ConfigManifest)
+	assert.NilError(t, err)
+
+	// An untagged index in keep is kept
+	push(v1, "fourth", tests.MakeRelocationMap())
+	deleted, err = Prune(context.Background(), v1, registry, []digest.Digest{current.Index.Digest})
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(deleted))
+	_, err = registry.content.Fetch(context.Background(), current.Index)
+	assert.NilError(t, err)
+}
+
+func containsDigest(digests []digest.Digest, d digest.Digest) bool {
+	for _, candidate := range digests {
+		if candidate == d {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPruneUnsupported(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	_, err = Prune(context.Background(), ref, newMemoryRegistry(), nil)
+	var unsupported *UnsupportedDeletionError
+	assert.Assert(t, errors.As(err, &unsupported), err)
+	assert.Equal(t, "my.registry/namespace/my-app", unsupported.Repository)
+
+	// The registry may reject deletions
+	registry := &pruningRegistry{memoryRegistry: newMemoryRegistry(), deleteErr: remoteserrors.ErrUnexpectedStatus{Status: "405 Method Not Allowed", StatusCode: http.StatusMethodNotAllowed}}
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, false)
+	assert.NilError(t, err)
+	_, err = Prune(context.Background(), ref, registry, nil)
+	assert.NilError(t, err)
+	// Pushing again under the same tag leaves the first index untagged
+	b := tests.MakeTestBundle()
+	b.Description = "second"
+	_, err = Push(context.Background(), b, tests.MakeRelocationMap(), ref, registry, false)
+	assert.NilError(t, err)
+	_, err = Prune(context.Background(), ref, registry, nil)
+	assert.Assert(t, errors.As(err, &unsupported), err)
+	assert.ErrorContains(t, err, "405 Method Not Allowed")
+
+	// Nothing is deleted if the tags cannot be listed
+	registry.deleteErr = nil
+	registry.tagsErr = &UnsupportedTagListingError{Repository: "my.registry/namespace/my-app"}
+	_, err = Prune(context.Background(), ref, registry, nil)
+	var unsupportedTags *UnsupportedTagListingError
+	assert.Assert(t, errors.As(err, &unsupportedTags), err)
+}
@@ -6,12 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-go/schema"
 	"github.com/cnabio/cnab-to-oci/converter"
 	"github.com/cnabio/cnab-to-oci/relocation"
 	"github.com/containerd/containerd/errdefs"
-	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes"
 	"github.com/docker/cli/opts"
@@ -21,57 +23,243 @@ import (
 	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// Pull pulls a bundle from an OCI Image Index manifest
+// Pull pulls a bundle from an OCI Image Index manifest, or a Docker Manifest List.
+// If the index does not reference a bundle config, the returned error wraps converter.ErrBundleConfigNotFound.
+// If the bundle schema version is not supported, the returned error is an UnsupportedSchemaVersionError. The pulled
+// bundle is validated with the cnab-go bundle validation, unless WithoutBundleValidation is set.
 func Pull(ctx context.Context, ref reference.Named, resolver remotes.Resolver) (*bundle.Bundle, relocation.ImageRelocationMap, digest.Digest, error) {
+	return PullWithOptions(ctx, ref, resolver)
+}
+
+// PullWithOptions pulls a bundle like Pull, the pull being configured by the given options
+func PullWithOptions(ctx context.Context, ref reference.Named, resolver remotes.Resolver, options ...PullOption) (*bundle.Bundle, relocation.ImageRelocationMap, digest.Digest, error) {
 	log.G(ctx).Debugf("Pulling CNAB Bundle %s", ref)
-	index, descriptor, err := getIndex(ctx, ref, resolver)
+	cfg, err := newPullConfig(options...)
 	if err != nil {
 		return nil, nil, "", err
 	}
-	b, err := getBundle(ctx, ref, resolver, index)
+	start := time.Now()
+	ctx, span := cfg.tracer.Start(ctx, SpanPull, referenceAttribute(ref.String()))
+	b, relocationMap, dgst, err := pullWithConfig(ctx, ref, resolver, cfg)
+	if err == nil {
+		span.SetAttributes(TraceAttribute{Key: TraceAttributeDigest, Value: dgst.String()})
+	}
+	span.End(err)
+	cfg.metrics.ObservePull(reference.Domain(ref), time.Since(start), err)
+	return b, relocationMap, dgst, err
+}
+
+func pullWithConfig(ctx context.Context, ref reference.Named, resolver remotes.Resolver, cfg pullConfig) (*bundle.Bundle, relocation.ImageRelocationMap, digest.Digest, error) {
+	indexCtx, span := cfg.tracer.Start(ctx, SpanPullIndex, referenceAttribute(ref.String()))
+	index, descriptor, err := getIndex(indexCtx, ref, resolver)
+	if err == nil {
+		span.SetAttributes(descriptorAttributes(descriptor)...)
+	}
+	span.End(err)
 	if err != nil {
 		return nil, nil, "", err
 	}
-	relocationMap, err := converter.GenerateRelocationMap(&index, b, ref)
+	if cfg.verifyTag {
+		if err := verifyTagMatchesDigest(ctx, ref, resolver); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	configCtx, span := cfg.tracer.Start(ctx, SpanPullConfig, referenceAttribute(ref.String()))
+	b, err := getBundle(configCtx, ref, resolver, index, cfg)
+	span.End(err)
 	if err != nil {
 		return nil, nil, "", err
 	}
+	relocationMap, err := getRelocationMap(ctx, &index, b, ref)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if cfg.localizeImage != nil {
+		if relocationMap, err = localizeImages(b, relocationMap, cfg.localizeImage); err != nil {
+			return nil, nil, "", fmt.Errorf("failed to localize the images of bundle %q: %w", ref, err)
+		}
+	}
+	if cfg.invocationImageManifests != nil {
+		manifests, err := getInvocationImageManifests(ctx, ref, resolver, &index)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		*cfg.invocationImageManifests = manifests
+	}
+	if cfg.referrers != nil {
+		referrers, err := discoverReferrers(ctx, resolver, ref, descriptor)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("failed to list the referrers of %q: %w", ref, err)
+		}
+		*cfg.referrers = referrers
+	}
 
 	log.G(ctx).Debugf("Digest: %s", descriptor.Digest)
 	return b, relocationMap, descriptor.Digest, nil
 }
 
+// getRelocationMap reads the relocation map from the image name annotations of the index, if it was pushed with
+// WithImageNameAnnotations, and generates it from the bundle images otherwise
+func getRelocationMap(ctx context.Context, index *ocischemav1.Index, b *bundle.Bundle, ref reference.Named) (relocation.ImageRelocationMap, error) {
+	relocationMap, missing, err := converter.RelocationMapFromAnnotations(index, ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(relocationMap) == 0 {
+		return converter.GenerateRelocationMap(index, b, ref)
+	}
+	for _, d := range missing {
+		log.G(ctx).Warnf("Image %s has no %s annotation, leaving it out of the relocation map", d.Digest, converter.CNABDescriptorImageNameAnnotation)
+	}
+	return relocationMap, nil
+}
+
+// localizeImages rewrites the image references of the bundle, and the images and relocated references of the
+// relocation map, with the transform
+func localizeImages(b *bundle.Bundle, relocationMap relocation.ImageRelocationMap, localize converter.ImageReferenceTransform) (relocation.ImageRelocationMap, error) {
+	for i := range b.InvocationImages {
+		image, err := converter.TransformImageReference(b.InvocationImages[i].Image, localize)
+		if err != nil {
+			return nil, err
+		}
+		b.InvocationImages[i].Image = image
+	}
+	for name, img := range b.Images {
+		image, err := converter.TransformImageReference(img.Image, localize)
+		if err != nil {
+			return nil, err
+		}
+		img.Image = image
+		b.Images[name] = img
+	}
+	localized := make(relocation.ImageRelocationMap, len(relocationMap))
+	for image, relocated := range relocationMap {
+		localImage, err := converter.TransformImageReference(image, localize)
+		if err != nil {
+			return nil, err
+		}
+		localRelocated, err := converter.TransformImageReference(relocated, localize)
+		if err != nil {
+			return nil, err
+		}
+		localized[localImage] = localRelocated
+	}
+	return localized, nil
+}
+
+// getInvocationImageManifests fetches the index of a multi-architecture invocation image, if the bundle index
+// references one, and returns its manifests
+func getInvocationImageManifests(ctx context.Context, ref reference.Named, resolver remotes.Resolver, index *ocischemav1.Index) ([]ocischemav1.Descriptor, error) {
+	descriptor, ok := converter.GetInvocationImageIndexDescriptor(index)
+	if !ok {
+		return nil, nil
+	}
+	log.G(ctx).Debugf("Fetching invocation image index %s", descriptor.Digest)
+	invocationRef, err := reference.WithDigest(reference.TrimNamed(ref), descriptor.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invocation image index reference %q: %s", ref, err)
+	}
+	payload, err := pullPayload(ctx, resolver, invocationRef.String(), descriptor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull invocation image index of %q: %w", ref, err)
+	}
+	var invocationIndex ocischemav1.Index
+	if err := json.Unmarshal(payload, &invocationIndex); err != nil {
+		return nil, fmt.Errorf("failed to pull invocation image index of %q: %s", ref, err)
+	}
+	return invocationIndex.Manifests, nil
+}
+
+// verifyTagMatchesDigest resolves the tag of a reference with both a tag and a digest, checking it still points at the
+// digest
+func verifyTagMatchesDigest(ctx context.Context, ref reference.Named, resolver remotes.Resolver) error {
+	tagged, isTagged := ref.(reference.Tagged)
+	digested, isDigested := ref.(reference.Digested)
+	if !isTagged || !isDigested {
+		return nil
+	}
+	tagRef, err := reference.WithTag(reference.TrimNamed(ref), tagged.Tag())
+	if err != nil {
+		return err
+	}
+	log.G(ctx).Debugf("Verifying %s points at %s", tagRef, digested.Digest())
+	_, tagDescriptor, err := resolver.Resolve(withMutedContext(ctx), tagRef.String())
+	if err != nil {
+		return fmt.Errorf("failed to resolve bundle manifest %q: %w", tagRef, err)
+	}
+	if tagDescriptor.Digest != digested.Digest() {
+		return &TagDigestMismatchError{Reference: ref.String(), Expected: digested.Digest(), Actual: tagDescriptor.Digest}
+	}
+	return nil
+}
+
+// PullBundlePackaging fetches only the index of a bundle and returns its converter.CNABPackagingAnnotation value,
+// converter.CNABPackagingThin or converter.CNABPackagingThick, or an empty string if the bundle was pushed without it.
+func PullBundlePackaging(ctx context.Context, ref reference.Named, resolver remotes.Resolver) (string, error) {
+	index, _, err := getIndex(ctx, ref, resolver)
+	if err != nil {
+		return "", err
+	}
+	if !converter.IsCNABIndex(index) {
+		return "", fmt.Errorf("failed to read the packaging of %q: %w", ref, converter.ErrBundleConfigNotFound)
+	}
+	return converter.GetBundlePackaging(index), nil
+}
+
+// PullArtifactType fetches only the index of a bundle and returns its artifactType field, as set by WithArtifactType,
+// or an empty string if the bundle was pushed without it
+func PullArtifactType(ctx context.Context, ref reference.Named, resolver remotes.Resolver) (string, error) {
+	indexPayload, _, err := getIndexPayload(ctx, ref, resolver)
+	if err != nil {
+		return "", err
+	}
+	artifactType, err := converter.GetArtifactType(indexPayload)
+	if err != nil {
+		return "", fmt.Errorf("failed to pull bundle manifest %q: %s", ref, err)
+	}
+	return artifactType, nil
+}
+
 func getIndex(ctx context.Context, ref auth.Scope, resolver remotes.Resolver) (ocischemav1.Index, ocischemav1.Descriptor, error) {
+	indexPayload, indexDescriptor, err := getIndexPayload(ctx, ref, resolver)
+	if err != nil {
+		return ocischemav1.Index{}, ocischemav1.Descriptor{}, err
+	}
+	index, err := converter.UnmarshalIndex(indexPayload, indexDescriptor.MediaType)
+	if err != nil {
+		return ocischemav1.Index{}, ocischemav1.Descriptor{}, fmt.Errorf("failed to pull bundle manifest %q: %s", ref, err)
+	}
+	logPayload(log.G(ctx), index)
+
+	return index, indexDescriptor, nil
+}
+
+func getIndexPayload(ctx context.Context, ref auth.Scope, resolver remotes.Resolver) ([]byte, ocischemav1.Descriptor, error) {
 	logger := log.G(ctx)
 
 	logger.Debug("Getting OCI Index Descriptor")
 	resolvedRef, indexDescriptor, err := resolver.Resolve(withMutedContext(ctx), ref.String())
 	if err != nil {
 		if errors.Is(err, errdefs.ErrNotFound) {
-			return ocischemav1.Index{}, ocischemav1.Descriptor{}, err
+			return nil, ocischemav1.Descriptor{}, err
 		}
-		return ocischemav1.Index{}, ocischemav1.Descriptor{}, fmt.Errorf("failed to resolve bundle manifest %q: %s", ref, err)
+		return nil, ocischemav1.Descriptor{}, fmt.Errorf("failed to resolve bundle manifest %q: %s", ref, err)
 	}
-	if indexDescriptor.MediaType != ocischemav1.MediaTypeImageIndex && indexDescriptor.MediaType != images.MediaTypeDockerSchema2ManifestList {
-		return ocischemav1.Index{}, ocischemav1.Descriptor{}, fmt.Errorf("invalid media type %q for bundle manifest", indexDescriptor.MediaType)
+	if indexDescriptor.MediaType != converter.CNABIndexMediaType && indexDescriptor.MediaType != converter.CNABManifestListMediaType {
+		return nil, ocischemav1.Descriptor{}, fmt.Errorf("invalid media type %q for bundle manifest %q, expected %q or %q", indexDescriptor.MediaType, ref,
+			converter.CNABIndexMediaType, converter.CNABManifestListMediaType)
 	}
 	logPayload(logger, indexDescriptor)
 
 	logger.Debugf("Fetching OCI Index %s", indexDescriptor.Digest)
 	indexPayload, err := pullPayload(ctx, resolver, resolvedRef, indexDescriptor)
 	if err != nil {
-		return ocischemav1.Index{}, ocischemav1.Descriptor{}, fmt.Errorf("failed to pull bundle manifest %q: %s", ref, err)
-	}
-	var index ocischemav1.Index
-	if err := json.Unmarshal(indexPayload, &index); err != nil {
-		return ocischemav1.Index{}, ocischemav1.Descriptor{}, fmt.Errorf("failed to pull bundle manifest %q: %s", ref, err)
+		return nil, ocischemav1.Descriptor{}, fmt.Errorf("failed to pull bundle manifest %q: %w", ref, err)
 	}
-	logPayload(logger, index)
-
-	return index, indexDescriptor, nil
+	return indexPayload, indexDescriptor, nil
 }
 
-func getBundle(ctx context.Context, ref opts.NamedOption, resolver remotes.Resolver, index ocischemav1.Index) (*bundle.Bundle, error) {
+func getBundle(ctx context.Context, ref opts.NamedOption, resolver remotes.Resolver, index ocischemav1.Index, cfg pullConfig) (*bundle.Bundle, error) {
 	repoOnly, err := reference.ParseNormalizedNamed(ref.Name())
 	if err != nil {
 		return nil, fmt.Errorf("invalid bundle manifest reference name %q: %s", ref, err)
@@ -84,13 +272,38 @@ func getBundle(ctx context.Context, ref opts.NamedOption, resolver remotes.Resol
 		return nil, err
 	}
 
-	manifest, err := getConfigManifest(ctx, ref, repoOnly, resolver, configManifestDescriptor)
+	manifest, manifestPayload, err := getConfigManifest(ctx, ref, repoOnly, resolver, configManifestDescriptor)
 	if err != nil {
 		return nil, err
 	}
 
 	// Pull now the bundle itself
-	return getBundleConfig(ctx, ref, repoOnly, resolver, manifest)
+	b, configBlob, err := getBundleConfig(ctx, ref, repoOnly, resolver, manifest, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.pulledConfig != nil {
+		pulled := converter.PreparedBundleConfig{
+			ConfigBlob:           configBlob,
+			ConfigBlobDescriptor: converter.GetBundleConfigBlobDescriptor(manifest),
+		}
+		// A config blob referenced directly by the index has no manifest
+		if manifestPayload != nil {
+			pulled.Manifest = manifestPayload
+			pulled.ManifestDescriptor = ocischemav1.Descriptor{
+				MediaType: configManifestDescriptor.MediaType,
+				Digest:    configManifestDescriptor.Digest,
+				Size:      configManifestDescriptor.Size,
+			}
+		}
+		if manifest.Config.Digest != pulled.ConfigBlobDescriptor.Digest {
+			// The empty config of an artifact manifest is well known, and not fetched
+			pulled.EmptyConfigBlob = []byte("{}")
+			pulled.EmptyConfigBlobDescriptor = manifest.Config
+		}
+		*cfg.pulledConfig = pulled
+	}
+	return b, nil
 }
 
 func getConfigManifestDescriptor(ctx context.Context, ref opts.NamedOption, index ocischemav1.Index) (ocischemav1.Descriptor, error) {
@@ -99,60 +312,133 @@ func getConfigManifestDescriptor(ctx context.Context, ref opts.NamedOption, inde
 	logger.Debug("Getting Bundle Config Manifest Descriptor")
 	configManifestDescriptor, err := converter.GetBundleConfigManifestDescriptor(&index)
 	if err != nil {
-		return ocischemav1.Descriptor{}, fmt.Errorf("failed to get bundle config manifest from %q: %s", ref, err)
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to get bundle config manifest from %q: %w", ref, err)
 	}
 	logPayload(logger, configManifestDescriptor)
 
 	return configManifestDescriptor, nil
 }
 
-func getConfigManifest(ctx context.Context, ref opts.NamedOption, repoOnly reference.Named, resolver remotes.Resolver, configManifestDescriptor ocischemav1.Descriptor) (ocischemav1.Manifest, error) {
+// getConfigManifest returns the bundle config manifest and its payload, or a manifest referencing the config blob as
+// its config without payload if the index references the config blob directly
+func getConfigManifest(ctx context.Context, ref opts.NamedOption, repoOnly reference.Named, resolver remotes.Resolver, configManifestDescriptor ocischemav1.Descriptor) (ocischemav1.Manifest, []byte, error) {
 	logger := log.G(ctx)
+	if converter.IsBundleConfigBlob(configManifestDescriptor) {
+		logger.Debugf("Bundle Config %s is referenced without manifest", configManifestDescriptor.Digest)
+		return ocischemav1.Manifest{Config: ocischemav1.Descriptor{
+			MediaType: configManifestDescriptor.MediaType,
+			Digest:    configManifestDescriptor.Digest,
+			Size:      configManifestDescriptor.Size,
+		}}, nil, nil
+	}
 
 	logger.Debugf("Getting Bundle Config Manifest %s", configManifestDescriptor.Digest)
 	configManifestRef, err := reference.WithDigest(repoOnly, configManifestDescriptor.Digest)
 	if err != nil {
-		return ocischemav1.Manifest{}, fmt.Errorf("invalid bundle config manifest reference name %q: %s", ref, err)
+		return ocischemav1.Manifest{}, nil, fmt.Errorf("invalid bundle config manifest reference name %q: %s", ref, err)
 	}
 	configManifestPayload, err := pullPayload(ctx, resolver, configManifestRef.String(), configManifestDescriptor)
 	if err != nil {
-		return ocischemav1.Manifest{}, fmt.Errorf("failed to pull bundle config manifest %q: %s", ref, err)
+		return ocischemav1.Manifest{}, nil, fmt.Errorf("failed to pull bundle config manifest %q: %w", ref, err)
 	}
 	var manifest ocischemav1.Manifest
 	if err := json.Unmarshal(configManifestPayload, &manifest); err != nil {
-		return ocischemav1.Manifest{}, err
+		return ocischemav1.Manifest{}, nil, err
 	}
 	logPayload(logger, manifest)
 
-	return manifest, err
+	return manifest, configManifestPayload, err
 }
 
-func getBundleConfig(ctx context.Context, ref opts.NamedOption, repoOnly reference.Named, resolver remotes.Resolver, manifest ocischemav1.Manifest) (*bundle.Bundle, error) {
+// getBundleConfig returns the bundle of the bundle config manifest, along with the config blob as fetched
+func getBundleConfig(ctx context.Context, ref opts.NamedOption, repoOnly reference.Named, resolver remotes.Resolver, manifest ocischemav1.Manifest, cfg pullConfig) (*bundle.Bundle, []byte, error) {
 	logger := log.G(ctx)
 
-	logger.Debugf("Fetching Bundle %s", manifest.Config.Digest)
-	configRef, err := reference.WithDigest(repoOnly, manifest.Config.Digest)
-	if err != nil {
-		return nil, fmt.Errorf("invalid bundle reference name %q: %s", ref, err)
-	}
-	configPayload, err := pullPayload(ctx, resolver, configRef.String(), ocischemav1.Descriptor{
-		Digest:    manifest.Config.Digest,
-		MediaType: manifest.Config.MediaType,
-		Size:      manifest.Config.Size,
-	})
+	config := converter.GetBundleConfigBlobDescriptor(manifest)
+	logger.Debugf("Fetching Bundle %s", config.Digest)
+	configBlob, configPayload, err := getBundleConfigPayload(ctx, ref, repoOnly, resolver, manifest, cfg.maxConfigSize)
 	if err != nil {
-		return nil, fmt.Errorf("failed to pull bundle %q: %s", ref, err)
+		return nil, nil, err
 	}
 	var b bundle.Bundle
 	if err := json.Unmarshal(configPayload, &b); err != nil {
-		return nil, fmt.Errorf("failed to pull bundle %q: %s", ref, err)
+		return nil, nil, fmt.Errorf("failed to pull bundle %q: invalid bundle config with media type %q: %s", ref, config.MediaType, err)
 	}
 	logPayload(logger, b)
+	if err := checkSchemaVersion(b.SchemaVersion, config.MediaType); err != nil {
+		return nil, nil, fmt.Errorf("failed to pull bundle %q: %w", ref, err)
+	}
+	if cfg.validateBundle {
+		if err := b.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("failed to pull bundle %q: invalid bundle config with media type %q: %w", ref, config.MediaType, err)
+		}
+	}
+
+	return &b, configBlob, nil
+}
+
+// getBundleConfigPayload fetches the bundle config blob of the bundle config manifest, and returns it as fetched,
+// verified against its digest, and decompressed up to maxConfigSize bytes
+func getBundleConfigPayload(ctx context.Context, ref opts.NamedOption, repoOnly reference.Named, resolver remotes.Resolver, manifest ocischemav1.Manifest,
+	maxConfigSize int64) ([]byte, []byte, error) {
+	config := converter.GetBundleConfigBlobDescriptor(manifest)
+	configRef, err := reference.WithDigest(repoOnly, config.Digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid bundle reference name %q: %s", ref, err)
+	}
+	configBlob, err := pullPayload(ctx, resolver, configRef.String(), ocischemav1.Descriptor{
+		Digest:    config.Digest,
+		MediaType: config.MediaType,
+		Size:      config.Size,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to pull bundle %q: %w", ref, err)
+	}
+	configPayload, err := converter.DecompressConfig(config.MediaType, configBlob, maxConfigSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to pull bundle %q: %w", ref, err)
+	}
+	return configBlob, configPayload, nil
+}
 
-	return &b, nil
+// UnsupportedSchemaVersionError is returned when pulling a bundle with a schema version that is not supported: not a
+// semantic version, of another major version than the supported one, or of a newer minor version
+type UnsupportedSchemaVersionError struct {
+	// Found is the schema version of the pulled bundle
+	Found schema.Version
+	// Expected is the newest supported schema version, of the only supported major version
+	Expected schema.Version
+	// MediaType is the media type of the pulled bundle config
+	MediaType string
+}
+
+func (e *UnsupportedSchemaVersionError) Error() string {
+	return fmt.Sprintf("unsupported bundle schema version %q in config with media type %q, the newest supported version is %q", e.Found, e.MediaType, e.Expected)
+}
+
+// checkSchemaVersion rejects a schema version which is not a semantic version, of another major version than the
+// supported one, or of a newer minor version
+func checkSchemaVersion(found schema.Version, mediaType string) error {
+	expected := bundle.GetDefaultSchemaVersion()
+	foundVersion, err := semver.NewVersion(string(found))
+	if err != nil {
+		return &UnsupportedSchemaVersionError{Found: found, Expected: expected, MediaType: mediaType}
+	}
+	expectedVersion, err := semver.NewVersion(string(expected))
+	if err != nil {
+		return err
+	}
+	if foundVersion.Major() != expectedVersion.Major() ||
+		foundVersion.Minor() > expectedVersion.Minor() {
+		return &UnsupportedSchemaVersionError{Found: found, Expected: expected, MediaType: mediaType}
+	}
+	return nil
 }
 
 func pullPayload(ctx context.Context, resolver remotes.Resolver, reference string, descriptor ocischemav1.Descriptor) ([]byte, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %w", descriptor.Digest, err)
+	}
 	ctx = withMutedContext(ctx)
 	fetcher, err := resolver.Fetcher(ctx, reference)
 	if err != nil {
@@ -164,6 +450,14 @@ func pullPayload(ctx context.Context, resolver remotes.Resolver, reference strin
 	}
 	defer reader.Close()
 
-	result, err := io.ReadAll(reader)
-	return result, err
+	// Compute the digest while reading, to detect corrupted content served by the registry
+	digester := descriptor.Digest.Algorithm().Digester()
+	result, err := io.ReadAll(io.TeeReader(reader, digester.Hash()))
+	if err != nil {
+		return nil, err
+	}
+	if actual := digester.Digest(); actual != descriptor.Digest {
+		return nil, fmt.Errorf("content digest mismatch: expected %s got %s", descriptor.Digest, actual)
+	}
+	return result, nil
 }
@@ -4,74 +4,138 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-go/schema"
+	"github.com/cnabio/cnab-to-oci/converter"
 	"github.com/cnabio/cnab-to-oci/tests"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"gotest.tools/v3/assert"
 )
 
 func TestPull(t *testing.T) {
-	index := tests.MakeTestOCIIndex()
-	bufBundleManifest, err := json.Marshal(index)
+	b := tests.MakeTestBundle()
+	buffers, indexDescriptor, err := makePullPayloads(*tests.MakeTestOCIIndex(), "application/vnd.docker.container.image.v1+json", b)
+	assert.NilError(t, err)
+	resolver := &mockResolver{
+		fetcher:             &mockFetcher{indexBuffers: buffers},
+		resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+	}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
 	assert.NilError(t, err)
 
-	bundleConfigManifestDescriptor := []byte(`{
-   "schemaVersion": 2,
-   "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
-   "config": {
-      "mediaType": "application/vnd.docker.container.image.v1+json",
-      "size": 315,
-      "digest": "sha256:e2337974e94637d3fab7004f87501e605b08bca3adf9ecd356909a9329da128a"
-   },
-   "layers": null
-}`)
+	// Pull the CNAB and get the bundle
+	b, rm, digest, err := PullWithOptions(context.Background(), ref, resolver, WithoutBundleValidation())
+	assert.NilError(t, err)
+	expectedBundle := tests.MakeTestBundle()
+	assert.DeepEqual(t, expectedBundle, b)
 
-	b := tests.MakeTestBundle()
-	bufBundle, err := json.Marshal(b)
+	expectedRelocationMap := tests.MakeRelocationMap()
+	assert.DeepEqual(t, expectedRelocationMap, rm)
+
+	assert.Equal(t, indexDescriptor.Digest, digest, "incorrect digest pulled")
+}
+
+func TestPullNotABundle(t *testing.T) {
+	index := tests.MakeTestOCIIndex()
+	// Drop the bundle config descriptor
+	index.Manifests = index.Manifests[1:]
+	bufIndex, err := json.Marshal(index)
 	assert.NilError(t, err)
 
-	fetcher := &mockFetcher{indexBuffers: []*bytes.Buffer{
-		// Bundle index
-		bytes.NewBuffer(bufBundleManifest),
-		// Bundle config manifest
-		bytes.NewBuffer(bundleConfigManifestDescriptor),
-		// Bundle config
-		bytes.NewBuffer(bufBundle),
-	}}
 	resolver := &mockResolver{
-		fetcher: fetcher,
+		fetcher: &mockFetcher{indexBuffers: []*bytes.Buffer{bytes.NewBuffer(bufIndex)}},
 		resolvedDescriptors: []ocischemav1.Descriptor{
-			// Bundle index descriptor
 			{
 				MediaType: ocischemav1.MediaTypeImageIndex,
-				Digest:    tests.BundleDigest,
-			},
-			// Bundle config manifest descriptor
-			{
-				MediaType: ocischemav1.MediaTypeDescriptor,
-				Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
+				Digest:    digest.FromBytes(bufIndex),
+				Size:      int64(len(bufIndex)),
 			},
-			// Bundle config descriptor
-			{MediaType: ocischemav1.MediaTypeImageIndex},
 		},
 	}
 	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
 	assert.NilError(t, err)
 
-	// Pull the CNAB and get the bundle
-	b, rm, digest, err := Pull(context.Background(), ref, resolver)
+	_, _, _, err = Pull(context.Background(), ref, resolver)
+	assert.Check(t, errors.Is(err, converter.ErrBundleConfigNotFound))
+}
+
+func TestPullUnsupportedSchemaVersion(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
 	assert.NilError(t, err)
-	expectedBundle := tests.MakeTestBundle()
-	assert.DeepEqual(t, expectedBundle, b)
+	for _, version := range []schema.Version{"v2.0.0", "v1.9.0", "v0.9.0", "not-a-version"} {
+		b := tests.MakeTestBundle()
+		b.SchemaVersion = version
+		buffers, indexDescriptor, err := makePullPayloads(*tests.MakeTestOCIIndex(), converter.CNABConfigMediaType, b)
+		assert.NilError(t, err)
+		resolver := &mockResolver{
+			fetcher:             &mockFetcher{indexBuffers: buffers},
+			resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+		}
 
-	expectedRelocationMap := tests.MakeRelocationMap()
-	assert.DeepEqual(t, expectedRelocationMap, rm)
+		_, _, _, err = Pull(context.Background(), ref, resolver)
+		var versionErr *UnsupportedSchemaVersionError
+		assert.Assert(t, errors.As(err, &versionErr), err)
+		assert.Equal(t, version, versionErr.Found)
+		assert.Equal(t, bundle.GetDefaultSchemaVersion(), versionErr.Expected)
+		assert.Equal(t, converter.CNABConfigMediaType, versionErr.MediaType)
+	}
+}
+
+func TestPullWithBundleValidation(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	pull := func(b *bundle.Bundle, options ...PullOption) error {
+		buffers, indexDescriptor, err := makePullPayloads(*tests.MakeTestOCIIndex(), converter.CNABConfigMediaType, b)
+		assert.NilError(t, err)
+		resolver := &mockResolver{
+			fetcher:             &mockFetcher{indexBuffers: buffers},
+			resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+		}
+		_, _, _, err = PullWithOptions(context.Background(), ref, resolver, options...)
+		return err
+	}
+
+	// Bundles are validated by default: the invocation image of the test bundle has no tag
+	err = pull(tests.MakeTestBundle())
+	assert.ErrorContains(t, err, "tag is required")
+	assert.ErrorContains(t, err, converter.CNABConfigMediaType)
+	assert.ErrorContains(t, pull(tests.MakeTestBundle(), WithoutBundleValidation(), WithBundleValidation()), "tag is required")
+	assert.NilError(t, pull(tests.MakeTestBundle(), WithoutBundleValidation()))
+
+	b := tests.MakeTestBundle()
+	b.InvocationImages[0].Image = "my.registry/namespace/my-app-invoc:0.1.0"
+	b.Parameters = nil
+	assert.NilError(t, pull(b))
+}
+
+func TestPullDetectsCorruptedPayloads(t *testing.T) {
+	for i, name := range []string{"index", "config manifest", "config"} {
+		t.Run(name, func(t *testing.T) {
+			buffers, indexDescriptor, err := makePullPayloads(*tests.MakeTestOCIIndex(), ocischemav1.MediaTypeImageConfig, tests.MakeTestBundle())
+			assert.NilError(t, err)
+			// Flip the last byte of the payload, as a corrupted registry would
+			corrupted := buffers[i].Bytes()
+			corrupted[len(corrupted)-1] ^= 0xff
+			resolver := &mockResolver{
+				fetcher:             &mockFetcher{indexBuffers: buffers},
+				resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+			}
+			ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+			assert.NilError(t, err)
 
-	assert.Equal(t, tests.BundleDigest, digest, "incorrect digest pulled")
+			_, _, _, err = Pull(context.Background(), ref, resolver)
+			assert.ErrorContains(t, err, "content digest mismatch: expected sha256:")
+		})
+	}
 }
 
 // nolint: lll
@@ -83,8 +147,9 @@ func ExamplePull() {
 		panic(err)
 	}
 
-	// Pull the CNAB, get the bundle and the associated relocation map
-	resultBundle, relocationMap, _, err := Pull(context.Background(), ref, resolver)
+	// Pull the CNAB, get the bundle and the associated relocation map. The invocation image of the example bundle has
+	// no tag, which the default bundle validation rejects.
+	resultBundle, relocationMap, _, err := PullWithOptions(context.Background(), ref, resolver, WithoutBundleValidation())
 	if err != nil {
 		panic(err)
 	}
@@ -142,56 +207,332 @@ const (
     "org.opencontainers.image.version": "0.1.0"
   }
 }`
-
-	bundleConfigManifestDescriptor = `{
-   "schemaVersion": 2,
-   "config": {
-      "mediaType": "application/vnd.cnab.config.v1+json",
-      "size": 315,
-      "digest": "sha256:e2337974e94637d3fab7004f87501e605b08bca3adf9ecd356909a9329da128a"
-   },
-   "layers": null
-}`
 )
 
 func createExampleResolver() *mockResolver {
-	b := tests.MakeTestBundle()
-	bufBundleConfig, err := json.Marshal(b)
+	var index ocischemav1.Index
+	if err := json.Unmarshal([]byte(bufBundleManifest), &index); err != nil {
+		panic(err)
+	}
+	buffers, indexDescriptor, err := makePullPayloads(index, "application/vnd.cnab.config.v1+json", tests.MakeTestBundle())
 	if err != nil {
 		panic(err)
 	}
-	buf := []*bytes.Buffer{
-		// Bundle index
-		bytes.NewBuffer([]byte(bufBundleManifest)),
-		// Bundle config manifest
-		bytes.NewBuffer([]byte(bundleConfigManifestDescriptor)),
-		// Bundle config
+	return &mockResolver{
+		pusher:              &mockPusher{},
+		fetcher:             &mockFetcher{indexBuffers: buffers},
+		resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+	}
+}
+
+// makePullPayloads returns the index, bundle config manifest and bundle config payloads, in the order they are
+// fetched by Pull, with digests matching their content. The bundle config descriptor of the index is updated
+// accordingly.
+func makePullPayloads(index ocischemav1.Index, configMediaType string, b *bundle.Bundle) ([]*bytes.Buffer, ocischemav1.Descriptor, error) {
+	bufBundleConfig, err := json.Marshal(b)
+	if err != nil {
+		return nil, ocischemav1.Descriptor{}, err
+	}
+	configManifest := ocischemav1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: ocischemav1.Descriptor{
+			MediaType: configMediaType,
+			Digest:    digest.FromBytes(bufBundleConfig),
+			Size:      int64(len(bufBundleConfig)),
+		},
+	}
+	bufConfigManifest, err := json.Marshal(configManifest)
+	if err != nil {
+		return nil, ocischemav1.Descriptor{}, err
+	}
+	manifests := make([]ocischemav1.Descriptor, len(index.Manifests))
+	copy(manifests, index.Manifests)
+	for i, m := range manifests {
+		if m.Annotations[converter.CNABDescriptorTypeAnnotation] == string(converter.CNABDescriptorTypeConfig) {
+			manifests[i].Digest = digest.FromBytes(bufConfigManifest)
+			manifests[i].Size = int64(len(bufConfigManifest))
+		}
+	}
+	index.Manifests = manifests
+	bufIndex, err := json.Marshal(index)
+	if err != nil {
+		return nil, ocischemav1.Descriptor{}, err
+	}
+	return []*bytes.Buffer{
+		bytes.NewBuffer(bufIndex),
+		bytes.NewBuffer(bufConfigManifest),
 		bytes.NewBuffer(bufBundleConfig),
+	}, ocischemav1.Descriptor{
+		MediaType: ocischemav1.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(bufIndex),
+		Size:      int64(len(bufIndex)),
+	}, nil
+}
+
+func TestPullWithVerifyTagMatchesDigest(t *testing.T) {
+	registry := newMemoryRegistry()
+	tagged, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	pushed, err := Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), tagged, registry, false)
+	assert.NilError(t, err)
+	pinned, err := reference.ParseNamed("my.registry/namespace/my-app:v1@" + pushed.Digest.String())
+	assert.NilError(t, err)
+
+	// The tag points at the digest
+	_, _, dgst, err := PullWithOptions(context.Background(), pinned, registry, WithVerifyTagMatchesDigest(), WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.Equal(t, pushed.Digest, dgst)
+
+	// The tag moved to another bundle
+	b := tests.MakeTestBundle()
+	b.Description = "moved"
+	moved, err := Push(context.Background(), b, tests.MakeRelocationMap(), tagged, registry, false)
+	assert.NilError(t, err)
+	_, _, _, err = PullWithOptions(context.Background(), pinned, registry, WithVerifyTagMatchesDigest(), WithoutBundleValidation())
+	var mismatch *TagDigestMismatchError
+	assert.Assert(t, errors.As(err, &mismatch), err)
+	assert.Equal(t, pinned.String(), mismatch.Reference)
+	assert.Equal(t, pushed.Digest, mismatch.Expected)
+	assert.Equal(t, moved.Digest, mismatch.Actual)
+
+	// Without the option, the bundle is pulled by digest
+	_, _, dgst, err = PullWithOptions(context.Background(), pinned, registry, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.Equal(t, pushed.Digest, dgst)
+
+	// The check is skipped for references without a digest
+	_, _, dgst, err = PullWithOptions(context.Background(), tagged, registry, WithVerifyTagMatchesDigest(), WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.Equal(t, moved.Digest, dgst)
+}
+
+func TestPullIndexFormats(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	rejectOCIIndex := func(_ string, d ocischemav1.Descriptor) error {
+		if d.MediaType == ocischemav1.MediaTypeImageIndex {
+			return errors.New("unsupported media type")
+		}
+		return nil
 	}
-	fetcher := &mockFetcher{indexBuffers: buf}
-	pusher := &mockPusher{}
-	return &mockResolver{
-		pusher:  pusher,
-		fetcher: fetcher,
-		resolvedDescriptors: []ocischemav1.Descriptor{
-			// Bundle index descriptor
-			{
-				MediaType: ocischemav1.MediaTypeImageIndex,
-				Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
-				Size:      int64(len(bufBundleManifest)),
-			},
-			// Bundle config manifest descriptor
-			{
-				MediaType: ocischemav1.MediaTypeDescriptor,
-				Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
-				Size:      int64(len(bundleConfigManifestDescriptor)),
-			},
-			// Bundle config descriptor
-			{
-				MediaType: ocischemav1.MediaTypeImageConfig,
-				Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341",
-				Size:      int64(len(bufBundleConfig)),
-			},
+
+	testCases := []struct {
+		name              string
+		pushErr           func(string, ocischemav1.Descriptor) error
+		options           []PushOption
+		expectedMediaType string
+	}{
+		{name: "OCI index", expectedMediaType: converter.CNABIndexMediaType},
+		{name: "Docker manifest list fallback", pushErr: rejectOCIIndex, options: []PushOption{WithAllowFallbacks(true)}, expectedMediaType: converter.CNABManifestListMediaType},
+		{name: "Docker manifest list", options: []PushOption{WithDockerManifestList()}, expectedMediaType: converter.CNABManifestListMediaType},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := newMemoryRegistry()
+			registry.pushErr = tc.pushErr
+			descriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, tc.options...)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.expectedMediaType, descriptor.MediaType)
+
+			b, relocationMap, dgst, err := PullWithOptions(context.Background(), ref, registry, WithoutBundleValidation())
+			assert.NilError(t, err)
+			assert.DeepEqual(t, tests.MakeTestBundle(), b)
+			assert.DeepEqual(t, tests.MakeRelocationMap(), relocationMap)
+			assert.Equal(t, descriptor.Digest, dgst)
+		})
+	}
+}
+
+func TestPullUnsupportedIndexMediaType(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	resolver := &mockResolver{resolvedDescriptors: []ocischemav1.Descriptor{{MediaType: ocischemav1.MediaTypeImageManifest, Digest: tests.BundleDigest}}}
+
+	_, _, _, err = Pull(context.Background(), ref, resolver)
+	assert.ErrorContains(t, err, `invalid media type "application/vnd.oci.image.manifest.v1+json" for bundle manifest "my.registry/namespace/my-app:my-tag"`)
+}
+
+func TestPullWithTracer(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	registry := newMemoryRegistry()
+	indexDescriptor, err := Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, false)
+	assert.NilError(t, err)
+
+	tracer := &recordingTracer{}
+	_, _, _, err = PullWithOptions(context.Background(), ref, registry, WithPullTracer(tracer), WithoutBundleValidation())
+	assert.NilError(t, err)
+	var names []string
+	for _, span := range tracer.spans {
+		assert.Assert(t, span.ended, span.name)
+		names = append(names, span.parent+">"+span.name)
+	}
+	assert.DeepEqual(t, []string{">" + SpanPull, SpanPull + ">" + SpanPullIndex, SpanPull + ">" + SpanPullConfig}, names)
+	assert.Equal(t, indexDescriptor.Digest.String(), tracer.spans[0].attributes[TraceAttributeDigest])
+	assert.Equal(t, indexDescriptor.Size, tracer.spans[1].attributes[TraceAttributeSize])
+}
+
+func TestPullWithPulledBundleConfig(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithPrepareOptions(converter.WithConfigCompression(false)))
+	assert.NilError(t, err)
+
+	var config converter.PreparedBundleConfig
+	b, _, _, err := PullWithOptions(context.Background(), ref, registry, WithPulledBundleConfig(&config), WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+	// The config blob is the compressed one, as pushed
+	assert.Assert(t, strings.HasSuffix(config.ConfigBlobDescriptor.MediaType, "+gzip"), config.ConfigBlobDescriptor.MediaType)
+	assert.Equal(t, config.ConfigBlobDescriptor.Digest, digest.FromBytes(config.ConfigBlob))
+	assert.DeepEqual(t, registry.content[config.ConfigBlobDescriptor.Digest], config.ConfigBlob)
+	assert.Equal(t, config.ManifestDescriptor.Digest, digest.FromBytes(config.Manifest))
+	assert.Assert(t, config.Fallback == nil)
+
+	// Pushing it back reproduces the same digests
+	other := newMemoryRegistry()
+	otherRef, err := reference.ParseNamed("other.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	descriptor, err := PushPreparedBundleConfig(context.Background(), &config, otherRef, other, false)
+	assert.NilError(t, err)
+	assert.Equal(t, config.ManifestDescriptor.Digest, descriptor.Digest)
+	assert.DeepEqual(t, config.ConfigBlob, other.content[config.ConfigBlobDescriptor.Digest])
+}
+
+func TestPullRelocationMapFromImageNameAnnotations(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	_, pushedRelocationMap, err := PushWithRelocationMap(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithImageNameAnnotations())
+	assert.NilError(t, err)
+
+	_, pulledRelocationMap, _, err := PullWithOptions(context.Background(), ref, registry, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pushedRelocationMap, pulledRelocationMap)
+
+	// The map is read from the index alone, skipping the images without the annotation
+	index, _, err := getIndex(context.Background(), ref, registry)
+	assert.NilError(t, err)
+	skipped := index.Manifests[1].Annotations[converter.CNABDescriptorImageNameAnnotation]
+	delete(index.Manifests[1].Annotations, converter.CNABDescriptorImageNameAnnotation)
+	relocationMap, err := getRelocationMap(context.Background(), &index, &bundle.Bundle{}, ref)
+	assert.NilError(t, err)
+	delete(pushedRelocationMap, skipped)
+	assert.DeepEqual(t, pushedRelocationMap, relocationMap)
+}
+
+func TestPullMultiArchInvocationImage(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	manifests := []ocischemav1.Descriptor{
+		{
+			MediaType: ocischemav1.MediaTypeImageManifest,
+			Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0345",
+			Size:      506,
+			Platform:  &ocischemav1.Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			MediaType: ocischemav1.MediaTypeImageManifest,
+			Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0346",
+			Size:      507,
+			Platform:  &ocischemav1.Platform{OS: "linux", Architecture: "arm64"},
 		},
 	}
+	_, pushedRelocationMap, err := PushWithRelocationMap(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithMultiArchInvocationImage(manifests...))
+	assert.NilError(t, err)
+
+	// The bundle index references the nested index of the invocation image
+	index, _, err := getIndex(context.Background(), ref, registry)
+	assert.NilError(t, err)
+	invocationImageIndex, ok := converter.GetInvocationImageIndexDescriptor(&index)
+	assert.Assert(t, ok)
+	assert.Equal(t, ocischemav1.MediaTypeImageIndex, invocationImageIndex.MediaType)
+	assert.Equal(t, "my.registry/namespace/my-app@"+invocationImageIndex.Digest.String(), pushedRelocationMap["my.registry/namespace/my-app-invoc"])
+
+	var pulledManifests []ocischemav1.Descriptor
+	_, pulledRelocationMap, _, err := PullWithOptions(context.Background(), ref, registry, WithPulledInvocationImageManifests(&pulledManifests), WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, manifests, pulledManifests)
+	assert.DeepEqual(t, pushedRelocationMap, pulledRelocationMap)
+
+	// A bundle without a multi-architecture invocation image has no manifests
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry)
+	assert.NilError(t, err)
+	_, _, _, err = PullWithOptions(context.Background(), ref, registry, WithPulledInvocationImageManifests(&pulledManifests), WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.Assert(t, pulledManifests == nil)
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithMultiArchInvocationImage())
+	assert.ErrorContains(t, err, "requires at least one architecture")
+}
+
+func TestPullWithLocalizedImages(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, false)
+	assert.NilError(t, err)
+
+	toLocal := WithLocalizedImages(func(original reference.Named) (reference.Named, error) {
+		local, err := reference.ParseNamed("localhost:5000/" + reference.Path(original))
+		if err != nil {
+			return nil, err
+		}
+		if digested, ok := original.(reference.Digested); ok {
+			return reference.WithDigest(local, digested.Digest())
+		}
+		return local, nil
+	})
+	b, relocationMap, _, err := PullWithOptions(context.Background(), ref, registry, toLocal, WithoutBundleValidation())
+	assert.NilError(t, err)
+
+	// The images are rewritten, with the same digests
+	expected := tests.MakeTestBundle()
+	expected.InvocationImages[0].Image = "localhost:5000/namespace/my-app-invoc"
+	for name, img := range expected.Images {
+		img.Image = strings.Replace(img.Image, "my.registry", "localhost:5000", 1)
+		expected.Images[name] = img
+	}
+	assert.DeepEqual(t, expected, b)
+	expectedMap := make(map[string]string)
+	for image, relocated := range tests.MakeRelocationMap() {
+		expectedMap[strings.Replace(image, "my.registry", "localhost:5000", 1)] = strings.Replace(relocated, "my.registry", "localhost:5000", 1)
+	}
+	assert.DeepEqual(t, expectedMap, map[string]string(relocationMap))
+	assert.Equal(t, "localhost:5000/namespace/my-app@"+b.Images["image-1"].Digest, relocationMap[b.Images["image-1"].Image])
+
+	// The digests must be preserved
+	dropDigest := WithLocalizedImages(func(original reference.Named) (reference.Named, error) {
+		return reference.TrimNamed(original), nil
+	})
+	_, _, _, err = PullWithOptions(context.Background(), ref, registry, dropDigest, WithoutBundleValidation())
+	assert.ErrorContains(t, err, `failed to localize the images of bundle "my.registry/namespace/my-app:v1"`)
+	assert.ErrorContains(t, err, "differs")
+
+	_, _, _, err = PullWithOptions(context.Background(), ref, registry, WithLocalizedImages(nil), WithoutBundleValidation())
+	assert.ErrorContains(t, err, "image localization transform must not be nil")
+}
+
+func TestPullBundleWithForeignImage(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	b := tests.MakeTestBundle()
+	foreign := b.Images["another-image"]
+	foreign.Image = "https://cdn.example.com/images/another-image/manifest.json"
+	b.Images["another-image"] = foreign
+	relocationMap := tests.MakeRelocationMap()
+	delete(relocationMap, "my.registry/namespace/another-image")
+	_, err = Push(context.Background(), b, relocationMap, ref, registry, false)
+	assert.NilError(t, err)
+
+	pulled, pulledRelocationMap, _, err := PullWithOptions(context.Background(), ref, registry, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, b, pulled)
+	assert.DeepEqual(t, relocationMap, pulledRelocationMap)
 }
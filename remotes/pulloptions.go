@@ -0,0 +1,143 @@
+package remotes
+
+import (
+	"errors"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pullConfig defines the input required for a Pull operation
+type pullConfig struct {
+	validateBundle           bool
+	verifyTag                bool
+	tracer                   Tracer
+	metrics                  MetricsCollector
+	pulledConfig             *converter.PreparedBundleConfig
+	invocationImageManifests *[]ocischemav1.Descriptor
+	referrers                *[]Referrer
+	localizeImage            converter.ImageReferenceTransform
+	maxConfigSize            int64
+}
+
+// PullOption is a helper for configuring a Pull
+type PullOption func(*pullConfig) error
+
+func newPullConfig(options ...PullOption) (pullConfig, error) {
+	cfg := pullConfig{validateBundle: true, tracer: noopTracer{}, metrics: noopMetrics{}}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return pullConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// WithBundleValidation validates the pulled bundle with the cnab-go bundle validation, failing the pull if the
+// bundle is not valid, for instance if its invocation image has no tag. Bundles are validated by default, this option
+// only reverts a WithoutBundleValidation.
+func WithBundleValidation() PullOption {
+	return func(cfg *pullConfig) error {
+		cfg.validateBundle = true
+		return nil
+	}
+}
+
+// WithoutBundleValidation skips the cnab-go bundle validation of the pulled bundle, to pull bundles it rejects, like
+// bundles whose invocation image has no tag. The schema version of the bundle is still checked.
+func WithoutBundleValidation() PullOption {
+	return func(cfg *pullConfig) error {
+		cfg.validateBundle = false
+		return nil
+	}
+}
+
+// WithVerifyTagMatchesDigest fails the pull with a TagDigestMismatchError when the reference has both a tag and a
+// digest, like "my-app:v1@sha256:...", and the tag no longer points at the digest the bundle is pulled by.
+// This costs an extra round trip, and is skipped for references without a tag or a digest.
+func WithVerifyTagMatchesDigest() PullOption {
+	return func(cfg *pullConfig) error {
+		cfg.verifyTag = true
+		return nil
+	}
+}
+
+// WithMaxDecompressedConfigSize fails the pull of a compressed config blob with a converter.SizeLimitExceededError once
+// it decompresses to more than the given size, instead of converter.DefaultMaxDecompressedConfigSize.
+func WithMaxDecompressedConfigSize(size int64) PullOption {
+	return func(cfg *pullConfig) error {
+		if size <= 0 {
+			return errors.New("max decompressed config size must be positive")
+		}
+		cfg.maxConfigSize = size
+		return nil
+	}
+}
+
+// WithPullTracer specifies a tracer creating a span around the pull, the fetch of its index and the fetch of its
+// bundle config. A nil tracer is ignored.
+func WithPullTracer(tracer Tracer) PullOption {
+	return func(cfg *pullConfig) error {
+		if tracer != nil {
+			cfg.tracer = tracer
+		}
+		return nil
+	}
+}
+
+// WithPullMetrics specifies a collector recording the duration of the pull. A nil collector is ignored.
+func WithPullMetrics(collector MetricsCollector) PullOption {
+	return func(cfg *pullConfig) error {
+		if collector != nil {
+			cfg.metrics = collector
+		}
+		return nil
+	}
+}
+
+// WithPulledBundleConfig sets config to the bundle config manifest and blob of the pulled bundle, byte for byte as
+// fetched and verified against their digests, compressed if the blob was pushed compressed. Pushing it back with
+// PushPreparedBundleConfig reproduces the same digests, where marshaling the pulled bundle again may not, like for a
+// signed bundle pinned by digest. config is only set when the pull succeeds, without fallback.
+func WithPulledBundleConfig(config *converter.PreparedBundleConfig) PullOption {
+	return func(cfg *pullConfig) error {
+		cfg.pulledConfig = config
+		return nil
+	}
+}
+
+// WithPulledInvocationImageManifests sets manifests to the per-architecture manifests of the invocation image of a
+// bundle pushed with WithMultiArchInvocationImage, read from the index nested in the bundle index, or to nil if the
+// invocation image is not a multi-architecture one. manifests is only set when the pull succeeds.
+func WithPulledInvocationImageManifests(manifests *[]ocischemav1.Descriptor) PullOption {
+	return func(cfg *pullConfig) error {
+		cfg.invocationImageManifests = manifests
+		return nil
+	}
+}
+
+// WithPulledReferrers sets referrers to the referrers of the pulled bundle index, like its signatures or SBOMs, listed
+// with the referrers API of the registry, or from the referrers tag schema index AttachReferrer maintains if the
+// registry does not support the API. It is set to nil if the bundle has no referrers, including when the registry
+// supports neither. This costs an extra request or two. referrers is only set when the pull succeeds.
+func WithPulledReferrers(referrers *[]Referrer) PullOption {
+	return func(cfg *pullConfig) error {
+		cfg.referrers = referrers
+		return nil
+	}
+}
+
+// WithLocalizedImages rewrites the invocation and component image references of the pulled bundle, and both the
+// images and the relocated references of its relocation map, with the localize transform, for instance to point to a
+// local registry for offline use. This is the mirror of converter.WithImageReferenceTransform on the push side. The
+// references are rewritten once the bundle and its relocation map are pulled and verified against the index, and
+// the pull fails if the transform does not preserve the digest of a digested reference.
+func WithLocalizedImages(localize converter.ImageReferenceTransform) PullOption {
+	return func(cfg *pullConfig) error {
+		if localize == nil {
+			return errors.New("image localization transform must not be nil")
+		}
+		cfg.localizeImage = localize
+		return nil
+	}
+}
@@ -1,22 +1,27 @@
 package remotes
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/cnabio/cnab-go/bundle"
 	"github.com/cnabio/cnab-to-oci/converter"
 	"github.com/cnabio/cnab-to-oci/internal"
 	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
-	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
 	"github.com/docker/cli/cli/config"
 	"github.com/docker/cli/cli/config/credentials"
 	configtypes "github.com/docker/cli/cli/config/types"
@@ -25,13 +30,31 @@ import (
 	registrytypes "github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/registry"
+	"github.com/hashicorp/go-multierror"
 	"github.com/opencontainers/go-digest"
 	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
 )
 
 // ManifestOption is a callback used to customize a manifest before pushing it
 type ManifestOption func(*ocischemav1.Index) error
 
+// PushResult summarizes the descriptors committed by a push
+type PushResult struct {
+	// Index is the descriptor of the pushed index, as returned by Push
+	Index ocischemav1.Descriptor `json:"index"`
+	// ConfigManifest is the descriptor of the pushed bundle config manifest, which may be a fallback format
+	ConfigManifest ocischemav1.Descriptor `json:"configManifest"`
+	// Manifests are the descriptors referenced by the index
+	Manifests []ocischemav1.Descriptor `json:"manifests"`
+	// SkippedImages are the names of the component images left out of the index, with WithForce
+	SkippedImages []string `json:"skippedImages,omitempty"`
+	// Unchanged is true if nothing was pushed with WithSkipIfUnchanged, the reference already pointing at the index
+	Unchanged bool `json:"unchanged,omitempty"`
+	// TotalSize is the total size of the content referenced by the index, with WithTotalSize
+	TotalSize int64 `json:"totalSize,omitempty"`
+}
+
 // Push pushes a bundle as an OCI Image Index manifest
 func Push(ctx context.Context,
 	b *bundle.Bundle,
@@ -40,51 +63,525 @@ func Push(ctx context.Context,
 	resolver remotes.Resolver,
 	allowFallbacks bool,
 	options ...ManifestOption) (ocischemav1.Descriptor, error) {
-	log.G(ctx).Debugf("Pushing CNAB Bundle %s", ref)
+	return PushWithOptions(ctx, b, relocationMap, ref, resolver, WithAllowFallbacks(allowFallbacks), WithManifestOptions(options...))
+}
 
-	confManifestDescriptor, err := pushConfig(ctx, b, ref, resolver, allowFallbacks)
+// PushWithOptions pushes a bundle as an OCI Image Index manifest, the push being configured by the given options
+func PushWithOptions(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	options ...PushOption) (ocischemav1.Descriptor, error) {
+	result, _, err := push(ctx, b, relocationMap, ref, resolver, options...)
 	if err != nil {
 		return ocischemav1.Descriptor{}, err
 	}
+	return result.Index, nil
+}
+
+// PushWithResult pushes a bundle as an OCI Image Index manifest, and returns a summary of the pushed descriptors
+func PushWithResult(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	options ...PushOption) (*PushResult, error) {
+	result, _, err := push(ctx, b, relocationMap, ref, resolver, options...)
+	return result, err
+}
 
-	indexDescriptor, err := pushIndex(ctx, b, relocationMap, ref, resolver, allowFallbacks, confManifestDescriptor, options...)
+// PushWithRelocationMap pushes a bundle as an OCI Image Index manifest, and returns the relocation map of the pushed
+// bundle. This map associates the original image names of the bundle to the digested references pushed under the
+// ref repository, as Pull would return it.
+func PushWithRelocationMap(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	options ...PushOption) (ocischemav1.Descriptor, relocation.ImageRelocationMap, error) {
+	cfg, err := newPushConfig(options...)
+	if err != nil {
+		return ocischemav1.Descriptor{}, nil, err
+	}
+	ref, relocationMap, err = normalizeReference(ref, relocationMap, cfg)
+	if err != nil {
+		return ocischemav1.Descriptor{}, nil, err
+	}
+	result, ix, err := pushNormalized(ctx, b, relocationMap, ref, resolver, cfg)
+	if err != nil {
+		return ocischemav1.Descriptor{}, nil, err
+	}
+	pushedRelocationMap, err := converter.GenerateRelocationMap(ix, b, ref, cfg.convertOptions...)
+	if err != nil {
+		return ocischemav1.Descriptor{}, nil, err
+	}
+	return result.Index, pushedRelocationMap, nil
+}
+
+// MultiPushResult is the result of the push of a bundle to one of the references given to MultiPush or PushBatch
+type MultiPushResult struct {
+	// Ref is the reference the bundle was pushed to
+	Ref reference.Named
+	// Result summarizes the pushed descriptors, nil if the push failed
+	Result *PushResult
+	// Err is the error which failed the push, if any
+	Err error
+}
+
+// MultiPush pushes the same bundle to each of the given references, like registries of an HA deployment, and returns
+// the result of each push in the same order. A failed push does not stop the others: the returned error aggregates
+// the errors of all the failed pushes. The relocated images are referenced by digest in each target repository, so
+// they must already be available there, like after a FixupBundle to each of them.
+func MultiPush(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	refs []reference.Named,
+	resolver remotes.Resolver,
+	options ...PushOption) ([]MultiPushResult, error) {
+	results := make([]MultiPushResult, len(refs))
+	var errs *multierror.Error
+	for i, ref := range refs {
+		var result *PushResult
+		targetRelocationMap, err := relocateToRepository(relocationMap, ref)
+		if err == nil {
+			result, _, err = push(ctx, b, targetRelocationMap, ref, resolver, options...)
+		}
+		results[i] = MultiPushResult{Ref: ref, Result: result, Err: err}
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed to push %q: %w", ref, err))
+		}
+	}
+	return results, errs.ErrorOrNil()
+}
+
+// BundleWithRef is a bundle pushed by PushBatch, with its relocation map and its target reference
+type BundleWithRef struct {
+	Bundle        *bundle.Bundle
+	RelocationMap relocation.ImageRelocationMap
+	Ref           reference.Named
+}
+
+// PushBatch pushes a family of bundles, in order, and returns the result of each push in the same order. The content
+// shared by the bundles, like a common config blob, is pushed once per repository: the bundles share an in-memory
+// BlobCache, unless the options set one. A config blob already pushed to another repository of the same registry is
+// mounted from it with WithCrossRepositoryMount, with an upload fallback.
+// Like with MultiPush, a failed push does not stop the others: the returned error aggregates all the errors.
+func PushBatch(ctx context.Context, bundles []BundleWithRef, resolver remotes.Resolver, options ...PushOption) ([]MultiPushResult, error) {
+	cfg, err := newPushConfig(options...)
+	if err != nil {
+		return nil, err
+	}
+	batchOptions := []PushOption{WithBlobCache(NewMemoryBlobCache())}
+	// The repositories each config blob was pushed to, keyed by registry host
+	pushedConfigs := map[digest.Digest]map[string]reference.Named{}
+	results := make([]MultiPushResult, len(bundles))
+	var errs *multierror.Error
+	for i, item := range bundles {
+		configDigest, _, err := converter.BundleConfigDigest(item.Bundle, cfg.prepareOptions...)
+		var result *PushResult
+		if err == nil {
+			pushOptions := batchOptions
+			host := reference.Domain(item.Ref)
+			if source, ok := pushedConfigs[configDigest][host]; ok && source.Name() != item.Ref.Name() {
+				pushOptions = append(pushOptions, WithCrossRepositoryMount(source))
+			}
+			// The options of the caller come last, so they can override the batch ones
+			result, _, err = push(ctx, item.Bundle, item.RelocationMap, item.Ref, resolver, append(pushOptions, options...)...)
+		}
+		results[i] = MultiPushResult{Ref: item.Ref, Result: result, Err: err}
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("failed to push %q: %w", item.Ref, err))
+			continue
+		}
+		if !cfg.dryRun {
+			if pushedConfigs[configDigest] == nil {
+				pushedConfigs[configDigest] = map[string]reference.Named{}
+			}
+			if _, ok := pushedConfigs[configDigest][reference.Domain(item.Ref)]; !ok {
+				pushedConfigs[configDigest][reference.Domain(item.Ref)] = reference.TrimNamed(item.Ref)
+			}
+		}
+	}
+	return results, errs.ErrorOrNil()
+}
+
+// relocateToRepository returns the relocation map with the digested relocated images moved to the repository of ref
+func relocateToRepository(relocationMap relocation.ImageRelocationMap, ref reference.Named) (relocation.ImageRelocationMap, error) {
+	result := make(relocation.ImageRelocationMap, len(relocationMap))
+	for image, relocated := range relocationMap {
+		named, err := reference.ParseNormalizedNamed(relocated)
+		if err != nil {
+			return nil, fmt.Errorf("image %q is not a valid image reference: %w", relocated, err)
+		}
+		digested, ok := named.(reference.Digested)
+		if !ok {
+			return nil, fmt.Errorf("image %q is not referenced by digest", relocated)
+		}
+		target, err := reference.WithDigest(reference.TrimNamed(ref), digested.Digest())
+		if err != nil {
+			return nil, err
+		}
+		result[image] = target.String()
+	}
+	return result, nil
+}
+
+// PushBundleConfig pushes only the bundle config blob and manifest, without the index, and returns the descriptor of
+// the config manifest. It can be used to reference the config from an index pushed separately. With allowFallbacks,
+// the same fallback formats are tried as with Push.
+func PushBundleConfig(ctx context.Context,
+	b *bundle.Bundle,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	allowFallbacks bool) (ocischemav1.Descriptor, error) {
+	bundleConfig, err := converter.PrepareForPush(b)
 	if err != nil {
 		return ocischemav1.Descriptor{}, err
 	}
+	return PushPreparedBundleConfig(ctx, bundleConfig, ref, resolver, allowFallbacks)
+}
 
-	log.G(ctx).Debug("CNAB Bundle pushed")
-	return indexDescriptor, nil
+// PushPreparedBundleConfig pushes a bundle config prepared with converter.PrepareForPush, without the index, and
+// returns the descriptor of the pushed config manifest. With allowFallbacks, the fallbacks of the prepared config are
+// tried like with PushBundleConfig.
+func PushPreparedBundleConfig(ctx context.Context,
+	bundleConfig *converter.PreparedBundleConfig,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	allowFallbacks bool) (ocischemav1.Descriptor, error) {
+	cfg, err := newPushConfig(WithAllowFallbacks(allowFallbacks))
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	ctx = withLogField(ctx, logFieldReference, ref.String())
+	ctx, err = WithRepositoryScope(ctx, ref, true)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	confManifestDescriptor, err := pushBundleConfig(ctx, resolver, ref.Name(), bundleConfig, cfg)
+	if err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("error while pushing bundle config manifest of %q: %w", ref, err)
+	}
+	return confManifestDescriptor, nil
+}
+
+func push(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	options ...PushOption) (*PushResult, *ocischemav1.Index, error) {
+	cfg, err := newPushConfig(options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref, relocationMap, err = normalizeReference(ref, relocationMap, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pushNormalized(ctx, b, relocationMap, ref, resolver, cfg)
+}
+
+// normalizeReference applies the normalizer of WithReferenceNormalizer to ref, moving the relocated images to the
+// normalized repository if it differs, then checks the normalized reference has a tag or a digest
+func normalizeReference(ref reference.Named, relocationMap relocation.ImageRelocationMap, cfg pushConfig) (reference.Named, relocation.ImageRelocationMap, error) {
+	ref, relocationMap, err := applyNormalizer(ref, relocationMap, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reference.IsNameOnly(ref) {
+		if !cfg.defaultLatestTag {
+			return nil, nil, &MissingTagError{Reference: ref.String()}
+		}
+		ref = reference.TagNameOnly(ref)
+	}
+	return ref, relocationMap, nil
+}
+
+func applyNormalizer(ref reference.Named, relocationMap relocation.ImageRelocationMap, cfg pushConfig) (reference.Named, relocation.ImageRelocationMap, error) {
+	if cfg.normalizer == nil {
+		return ref, relocationMap, nil
+	}
+	normalized, err := cfg.normalizer(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to normalize reference %q: %w", ref, err)
+	}
+	if normalized == nil {
+		return nil, nil, fmt.Errorf("failed to normalize reference %q: the normalizer returned no reference", ref)
+	}
+	if normalized.Name() == ref.Name() {
+		return normalized, relocationMap, nil
+	}
+	relocationMap, err = relocateToRepository(relocationMap, normalized)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to relocate the images of %q to %q: %w", ref, normalized, err)
+	}
+	return normalized, relocationMap, nil
+}
+
+func pushNormalized(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	cfg pushConfig) (*PushResult, *ocischemav1.Index, error) {
+	ctx = withLogField(ctx, logFieldReference, ref.String())
+	log.G(ctx).Debugf("Pushing CNAB Bundle %s", ref)
+
+	host := reference.Domain(ref)
+	cfg.metrics.AddInFlightPushes(host, 1)
+	defer cfg.metrics.AddInFlightPushes(host, -1)
+	start := time.Now()
+	ctx, span := cfg.tracer.Start(ctx, SpanPush, referenceAttribute(ref.String()))
+	result, ix, err := pushWithConfig(ctx, b, relocationMap, ref, resolver, cfg)
+	if err == nil {
+		span.SetAttributes(descriptorAttributes(result.Index)...)
+	}
+	span.End(err)
+	cfg.metrics.ObservePush(host, time.Since(start), err)
+	return result, ix, err
+}
+
+func pushWithConfig(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	cfg pushConfig) (*PushResult, *ocischemav1.Index, error) {
+	ctx, err := WithRepositoryScope(ctx, ref, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.strictValidation {
+		if err := converter.ValidateBundleForPush(b); err != nil {
+			return nil, nil, fmt.Errorf("invalid bundle %q: %w", ref, err)
+		}
+	}
+
+	if cfg.skipIfUnchanged && !cfg.dryRun {
+		result, ix, unchanged, err := checkUnchanged(ctx, b, relocationMap, ref, resolver, cfg)
+		if err != nil || unchanged {
+			return result, ix, err
+		}
+	}
+	return pushBundle(ctx, b, relocationMap, ref, resolver, cfg)
+}
+
+// checkUnchanged computes the index a push would commit without pushing anything, and returns true if the reference
+// already resolves to it
+func checkUnchanged(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	cfg pushConfig) (*PushResult, *ocischemav1.Index, bool, error) {
+	var indexPayload bytes.Buffer
+	dryRunCfg := cfg
+	dryRunCfg.dryRun = true
+	dryRunCfg.checkImages = false
+	dryRunCfg.indexWriter = &indexPayload
+	result, ix, err := pushBundle(ctx, b, relocationMap, ref, resolver, dryRunCfg)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	_, existing, err := resolver.Resolve(withMutedContext(ctx), ref.String())
+	if err != nil {
+		log.G(ctx).Debugf("Failed to resolve %s, pushing the bundle: %s", ref, err)
+		return nil, nil, false, nil
+	}
+	if existing.Digest != result.Index.Digest {
+		log.G(ctx).Debugf("%s resolves to %s instead of %s, pushing the bundle", ref, existing.Digest, result.Index.Digest)
+		return nil, nil, false, nil
+	}
+	log.G(ctx).Debugf("%s is unchanged, skipping the push", ref)
+	if err := copyIndexPayload(cfg, ref, indexPayload.Bytes()); err != nil {
+		return nil, nil, false, err
+	}
+	result.Unchanged = true
+	return result, ix, true, nil
+}
+
+func pushBundle(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	resolver remotes.Resolver,
+	cfg pushConfig) (*PushResult, *ocischemav1.Index, error) {
+	var (
+		confManifestDescriptor ocischemav1.Descriptor
+		bundleConfig           *converter.PreparedBundleConfig
+		invocationImageIndex   *descriptorPayload
+	)
+	// The invocation image index does not depend on the bundle config, so they are pushed concurrently, bounded by the
+	// configured parallelism
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(cfg.maxConcurrentJobs)
+	group.Go(func() error {
+		var err error
+		confManifestDescriptor, bundleConfig, err = pushConfigManifest(groupCtx, b, ref, resolver, cfg)
+		return err
+	})
+	if len(cfg.invocationImages) > 0 {
+		group.Go(func() error {
+			descriptor, payload, err := pushInvocationImageIndex(groupCtx, ref, resolver, cfg)
+			invocationImageIndex = &descriptorPayload{descriptor: descriptor, payload: payload}
+			return err
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, nil, err
+	}
+
+	indexDescriptor, ix, err := pushIndex(ctx, b, relocationMap, ref, resolver, cfg, confManifestDescriptor, bundleConfig, invocationImageIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	totalSize, err := converter.GetBundleTotalSize(*ix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.verifyAfterPush && !cfg.dryRun {
+		if err := verifyPushedIndex(ctx, ref, resolver, indexDescriptor); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	log.G(ctx).WithField(logFieldIndexDigest, indexDescriptor.Digest).Debug("CNAB Bundle pushed")
+	return &PushResult{
+		Index:          indexDescriptor,
+		ConfigManifest: confManifestDescriptor,
+		Manifests:      ix.Manifests,
+		SkippedImages:  skippedImages(b, ix),
+		TotalSize:      totalSize,
+	}, ix, nil
+}
+
+// verifyPushedIndex resolves the pushed reference again, checking the registry stored the pushed index unchanged
+func verifyPushedIndex(ctx context.Context, ref reference.Named, resolver remotes.Resolver, indexDescriptor ocischemav1.Descriptor) error {
+	log.G(ctx).Debugf("Verifying the digest of %s", ref)
+	_, resolved, err := resolver.Resolve(withMutedContext(ctx), ref.String())
+	if err != nil {
+		return fmt.Errorf("failed to verify pushed bundle manifest %q: %w", ref, err)
+	}
+	if resolved.Digest != indexDescriptor.Digest {
+		return &DigestMismatchAfterPushError{Reference: ref.String(), Expected: indexDescriptor.Digest, Actual: resolved.Digest}
+	}
+	return nil
+}
+
+// skippedImages returns the names of the component images of the bundle not referenced by the index
+func skippedImages(b *bundle.Bundle, ix *ocischemav1.Index) []string {
+	indexed := map[string]struct{}{}
+	for _, d := range ix.Manifests {
+		if d.Annotations[converter.CNABDescriptorTypeAnnotation] == converter.CNABDescriptorTypeComponent {
+			indexed[d.Annotations[converter.CNABDescriptorComponentNameAnnotation]] = struct{}{}
+		}
+	}
+	var skipped []string
+	for _, name := range sortedImageNames(b.Images) {
+		if _, ok := indexed[name]; !ok {
+			skipped = append(skipped, name)
+		}
+	}
+	return skipped
 }
 
-func pushConfig(ctx context.Context,
+func pushConfigManifest(ctx context.Context,
 	b *bundle.Bundle,
 	ref reference.Named, //nolint:interfacer
 	resolver remotes.Resolver,
-	allowFallbacks bool) (ocischemav1.Descriptor, error) {
+	cfg pushConfig) (ocischemav1.Descriptor, *converter.PreparedBundleConfig, error) {
 	logger := log.G(ctx)
 	logger.Debugf("Pushing CNAB Bundle Config")
 
-	bundleConfig, err := converter.PrepareForPush(b)
+	_, span := cfg.tracer.Start(ctx, SpanPrepareConfig, referenceAttribute(ref.String()))
+	bundleConfig, err := converter.PrepareForPush(b, cfg.prepareOptions...)
+	if err == nil {
+		span.SetAttributes(descriptorAttributes(bundleConfig.ConfigBlobDescriptor)...)
+	}
+	span.End(err)
 	if err != nil {
-		return ocischemav1.Descriptor{}, err
+		return ocischemav1.Descriptor{}, nil, fmt.Errorf("failed to prepare bundle config of %q: %w", ref, err)
 	}
-	confManifestDescriptor, err := pushBundleConfig(ctx, resolver, ref.Name(), bundleConfig, allowFallbacks)
+	confManifestDescriptor, err := pushBundleConfig(ctx, resolver, ref.Name(), bundleConfig, cfg)
 	if err != nil {
-		return ocischemav1.Descriptor{}, fmt.Errorf("error while pushing bundle config manifest: %s", err)
+		return ocischemav1.Descriptor{}, nil, fmt.Errorf("error while pushing bundle config manifest of %q: %w", ref, err)
 	}
 
 	logger.Debug("CNAB Bundle Config pushed")
-	return confManifestDescriptor, nil
+	return confManifestDescriptor, bundleConfig, nil
 }
 
-func pushIndex(ctx context.Context, b *bundle.Bundle, relocationMap relocation.ImageRelocationMap, ref reference.Named, resolver remotes.Resolver, allowFallbacks bool,
-	confManifestDescriptor ocischemav1.Descriptor, options ...ManifestOption) (ocischemav1.Descriptor, error) {
+func pushIndex(ctx context.Context, b *bundle.Bundle, relocationMap relocation.ImageRelocationMap, ref reference.Named, resolver remotes.Resolver, cfg pushConfig,
+	confManifestDescriptor ocischemav1.Descriptor, bundleConfig *converter.PreparedBundleConfig, invocationImageIndex *descriptorPayload) (ocischemav1.Descriptor, *ocischemav1.Index, error) {
+	start := time.Now()
+	ctx, span := cfg.tracer.Start(ctx, SpanPushIndex, referenceAttribute(ref.String()))
+	indexDescriptor, ix, err := pushIndexManifest(ctx, b, relocationMap, ref, resolver, cfg, confManifestDescriptor, bundleConfig, invocationImageIndex)
+	if err == nil {
+		span.SetAttributes(descriptorAttributes(indexDescriptor)...)
+	}
+	span.End(err)
+	cfg.metrics.ObservePushStage(reference.Domain(ref), PushStageIndex, time.Since(start), err)
+	return indexDescriptor, ix, err
+}
+
+func pushIndexManifest(ctx context.Context, b *bundle.Bundle, relocationMap relocation.ImageRelocationMap, ref reference.Named, resolver remotes.Resolver,
+	cfg pushConfig, confManifestDescriptor ocischemav1.Descriptor, bundleConfig *converter.PreparedBundleConfig, invocationImageIndex *descriptorPayload) (ocischemav1.Descriptor, *ocischemav1.Index, error) {
+	ctx = withLogField(ctx, logFieldStage, PushStageIndex)
 	logger := log.G(ctx)
 	logger.Debug("Pushing CNAB Index")
 
-	indexDescriptor, indexPayload, err := prepareIndex(b, relocationMap, ref, confManifestDescriptor, options...)
+	// The payloads pushed so far, which are not in the registry during a dry run
+	pushedPayloads := bundleConfigPayloads(bundleConfig)
+	if invocationImageIndex != nil {
+		pushedPayloads[invocationImageIndex.descriptor.Digest] = invocationImageIndex.payload
+		cfg.convertOptions = append(cfg.convertOptions[:len(cfg.convertOptions):len(cfg.convertOptions)], converter.WithInvocationImageIndex(invocationImageIndex.descriptor))
+	}
+	ix, err := convertIndexAndApplyOptions(b, relocationMap, ref, confManifestDescriptor, cfg)
 	if err != nil {
-		return ocischemav1.Descriptor{}, err
+		return ocischemav1.Descriptor{}, nil, err
+	}
+	if cfg.directConfigBlob {
+		if err := checkDirectConfigBlob(ix, ref, confManifestDescriptor); err != nil {
+			return ocischemav1.Descriptor{}, nil, err
+		}
+	}
+	if cfg.totalSize {
+		totalSize, err := computeTotalSize(ctx, ref, resolver, ix, pushedPayloads)
+		if err != nil {
+			return ocischemav1.Descriptor{}, nil, err
+		}
+		logger.Debugf("Total size of the bundle: %d bytes", totalSize)
+		if err := WithAnnotations(map[string]string{converter.CNABTotalSizeAnnotation: strconv.FormatInt(totalSize, 10)})(ix); err != nil {
+			return ocischemav1.Descriptor{}, nil, err
+		}
+	}
+	if cfg.strictValidation {
+		if err := converter.ValidateOCIIndex(ix); err != nil {
+			return ocischemav1.Descriptor{}, nil, fmt.Errorf("invalid bundle manifest %q: %w", ref, err)
+		}
+	}
+	if cfg.checkImages {
+		if err := checkReferencedImages(ctx, ix, ref, resolver); err != nil {
+			return ocischemav1.Descriptor{}, nil, err
+		}
+	}
+	if cfg.manifestList || ix.MediaType == converter.CNABManifestListMediaType {
+		indexDescriptor, err := pushDockerManifestList(ctx, ix, ref, resolver, cfg)
+		if err != nil {
+			return ocischemav1.Descriptor{}, nil, err
+		}
+		return indexDescriptor, ix, nil
+	}
+	indexDescriptor, indexPayload, err := prepareIndex(ix, ref, cfg)
+	if err != nil {
+		return ocischemav1.Descriptor{}, nil, err
+	}
+	ctx = withLogField(ctx, logFieldIndexDigest, indexDescriptor.Digest)
+	logger = log.G(ctx)
+	if err := converter.CheckSizeLimit("index", indexDescriptor.Size, cfg.maxManifestSize); err != nil {
+		return ocischemav1.Descriptor{}, nil, fmt.Errorf("invalid bundle manifest %q: %w", ref, err)
 	}
 	// Push the bundle index
 	logger.Debug("Trying to push OCI Index")
@@ -92,159 +589,532 @@ func pushIndex(ctx context.Context, b *bundle.Bundle, relocationMap relocation.I
 	logger.Debug("OCI Index Descriptor")
 	logPayload(logger, indexDescriptor)
 
-	if err := pushPayload(ctx, resolver, ref.String(), indexDescriptor, indexPayload); err != nil {
-		if !allowFallbacks {
+	if err := pushPayload(ctx, resolver, ref.String(), cfg, indexDescriptor, indexPayload); err != nil {
+		err = fmt.Errorf("error while pushing bundle manifest %q: %w", ref, &PushError{Stage: PushStageIndex, Descriptor: indexDescriptor, Err: err})
+		if ix.MediaType == converter.CNABIndexMediaType {
 			logger.Debug("Not using fallbacks, giving up")
-			return ocischemav1.Descriptor{}, err
+			return ocischemav1.Descriptor{}, nil, err
+		}
+		if !cfg.allowFallbacks {
+			logger.Debugf("Failed to push OCI Index, fallbacks are disabled: not trying %s", manifestListFallback)
+			return ocischemav1.Descriptor{}, nil, &FallbackDisabledError{Fallback: manifestListFallback, Err: err}
 		}
 		logger.Debugf("Unable to push OCI Index: %v", err)
 		// retry with a docker manifestlist
-		return pushDockerManifestList(ctx, b, relocationMap, ref, resolver, confManifestDescriptor, options...)
+		indexDescriptor, err := pushDockerManifestList(ctx, ix, ref, resolver, cfg)
+		if err != nil {
+			return ocischemav1.Descriptor{}, nil, err
+		}
+		return indexDescriptor, ix, nil
 	}
 
+	if err := copyIndexPayload(cfg, ref, indexPayload); err != nil {
+		return ocischemav1.Descriptor{}, nil, err
+	}
 	logger.Debugf("CNAB Index pushed")
-	return indexDescriptor, nil
+	return indexDescriptor, ix, nil
 }
 
-func pushDockerManifestList(ctx context.Context, b *bundle.Bundle, relocationMap relocation.ImageRelocationMap, ref reference.Named, resolver remotes.Resolver,
-	confManifestDescriptor ocischemav1.Descriptor, options ...ManifestOption) (ocischemav1.Descriptor, error) {
-	logger := log.G(ctx)
+// pushInvocationImageIndex pushes the index nesting the manifests of a multi-architecture invocation image, before the
+// bundle index referencing it
+func pushInvocationImageIndex(ctx context.Context, ref reference.Named, resolver remotes.Resolver, cfg pushConfig) (ocischemav1.Descriptor, []byte, error) {
+	payload, descriptor, err := converter.MakeInvocationImageIndex(cfg.invocationImages)
+	if err != nil {
+		return ocischemav1.Descriptor{}, nil, fmt.Errorf("invalid invocation image of %q: %w", ref, err)
+	}
+	descriptor.Digest = cfg.digestAlgorithm.FromBytes(payload)
+	logger := log.G(withLogField(ctx, logFieldStage, PushStageInvocationImageIndex))
+	logger.Debugf("Pushing invocation image index with %d architectures", len(cfg.invocationImages))
+	logPayload(logger, descriptor)
+	if err := pushPayload(ctx, resolver, ref.Name(), cfg, descriptor, payload); err != nil {
+		return ocischemav1.Descriptor{}, nil, fmt.Errorf("error while pushing invocation image index of %q: %w", ref, &PushError{Stage: PushStageInvocationImageIndex, Descriptor: descriptor, Err: err})
+	}
+	return descriptor, payload, nil
+}
 
-	indexDescriptor, indexPayload, err := prepareIndexNonOCI(b, relocationMap, ref, confManifestDescriptor, options...)
+// bundleConfigPayloads returns the payloads of the bundle config and of its fallbacks, keyed by digest
+func bundleConfigPayloads(bundleConfig *converter.PreparedBundleConfig) map[digest.Digest][]byte {
+	payloads := map[digest.Digest][]byte{}
+	for _, c := range bundleConfig.Formats() {
+		payloads[c.ManifestDescriptor.Digest] = c.Manifest
+		payloads[c.ConfigBlobDescriptor.Digest] = c.ConfigBlob
+		if c.EmptyConfigBlob != nil {
+			payloads[c.EmptyConfigBlobDescriptor.Digest] = c.EmptyConfigBlob
+		}
+	}
+	return payloads
+}
+
+// computeTotalSize sums the sizes of the descriptors of the index and of everything they reference, like the configs
+// and the layers of the image manifests, each digest once. Only the manifests are fetched, the pushed payloads from
+// memory. The images hosted at a URL are not stored in the registry, so they are not counted.
+func computeTotalSize(ctx context.Context, ref reference.Named, resolver remotes.Resolver, ix *ocischemav1.Index, pushedPayloads map[digest.Digest][]byte) (int64, error) {
+	ctx = withMutedContext(ctx)
+	fetcher, err := resolver.Fetcher(ctx, ref.Name())
+	if err != nil {
+		return 0, err
+	}
+	manifests := make([]ocischemav1.Descriptor, 0, len(ix.Manifests))
+	for _, d := range ix.Manifests {
+		if len(d.URLs) == 0 {
+			manifests = append(manifests, d)
+		}
+	}
+	var total int64
+	if err := walkDescriptors(ctx, &payloadFetcher{payloads: pushedPayloads, fetcher: fetcher}, map[digest.Digest]struct{}{}, func(d ocischemav1.Descriptor) error {
+		total += d.Size
+		return nil
+	}, manifests...); err != nil {
+		return 0, fmt.Errorf("failed to compute the total size of %q: %w", ref, err)
+	}
+	return total, nil
+}
+
+// payloadFetcher fetches the payloads it holds from memory, and the other descriptors with the fetcher
+type payloadFetcher struct {
+	payloads map[digest.Digest][]byte
+	fetcher  remotes.Fetcher
+}
+
+func (f *payloadFetcher) Fetch(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+	if payload, ok := f.payloads[desc.Digest]; ok {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
+	return f.fetcher.Fetch(ctx, desc)
+}
+
+// checkReferencedImages resolves the images referenced by the index in the target repository, and returns a
+// MissingReferencedImagesError listing the missing ones. The images hosted at a URL are not expected in the repository.
+func checkReferencedImages(ctx context.Context, ix *ocischemav1.Index, ref reference.Named, resolver remotes.Resolver) error {
+	var missing []ocischemav1.Descriptor
+	for _, d := range ix.Manifests {
+		if d.Annotations[converter.CNABDescriptorTypeAnnotation] == converter.CNABDescriptorTypeConfig || len(d.URLs) > 0 {
+			continue
+		}
+		imageRef := fmt.Sprintf("%s@%s", ref.Name(), d.Digest)
+		log.G(ctx).Debugf("Checking %s exists", imageRef)
+		if _, _, err := resolver.Resolve(withMutedContext(ctx), imageRef); err != nil {
+			if !errors.Is(err, errdefs.ErrNotFound) {
+				return fmt.Errorf("failed to check image %q: %w", imageRef, err)
+			}
+			missing = append(missing, d)
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingReferencedImagesError{Reference: ref.String(), Descriptors: missing}
+	}
+	return nil
+}
+
+func pushDockerManifestList(ctx context.Context, ix *ocischemav1.Index, ref reference.Named, resolver remotes.Resolver, cfg pushConfig) (ocischemav1.Descriptor, error) {
+	indexDescriptor, indexPayload, err := prepareIndexNonOCI(ix, ref, cfg)
 	if err != nil {
 		return ocischemav1.Descriptor{}, err
 	}
-	logger.Debug("Trying to push Index with Manifest list as fallback")
+	ctx = withLogField(ctx, logFieldIndexDigest, indexDescriptor.Digest)
+	logger := log.G(ctx)
+	if err := converter.CheckSizeLimit("manifest list", indexDescriptor.Size, cfg.maxManifestSize); err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("invalid bundle manifest %q: %w", ref, err)
+	}
+	logger.Debug("Trying to push Index with Manifest list")
 	logger.Debug(string(indexPayload))
 	logger.Debug("Manifest list Descriptor")
 	logPayload(logger, indexDescriptor)
 
 	if err := pushPayload(ctx,
 		resolver, ref.String(),
+		cfg,
 		indexDescriptor,
 		indexPayload); err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("error while pushing bundle manifest %q: %w", ref, &PushError{Stage: PushStageIndex, Descriptor: indexDescriptor, Err: err})
+	}
+	if err := copyIndexPayload(cfg, ref, indexPayload); err != nil {
 		return ocischemav1.Descriptor{}, err
 	}
 	return indexDescriptor, nil
 }
 
-func prepareIndex(b *bundle.Bundle,
-	relocationMap relocation.ImageRelocationMap,
-	ref reference.Named,
-	confDescriptor ocischemav1.Descriptor,
-	options ...ManifestOption) (ocischemav1.Descriptor, []byte, error) {
-	ix, err := convertIndexAndApplyOptions(b, relocationMap, ref, confDescriptor, options...)
-	if err != nil {
+// copyIndexPayload writes the pushed index payload to the writer set with WithIndexWriter, if any
+func copyIndexPayload(cfg pushConfig, ref reference.Named, indexPayload []byte) error {
+	if cfg.indexWriter == nil {
+		return nil
+	}
+	if _, err := cfg.indexWriter.Write(indexPayload); err != nil {
+		return fmt.Errorf("failed to write bundle manifest %q: %w", ref, err)
+	}
+	return nil
+}
+
+func prepareIndex(ix *ocischemav1.Index, ref reference.Named, cfg pushConfig) (ocischemav1.Descriptor, []byte, error) {
+	if err := checkIndexManifests(ix, ref, cfg); err != nil {
 		return ocischemav1.Descriptor{}, nil, err
 	}
-	indexPayload, err := json.Marshal(ix)
+	indexPayload, indexDescriptor, err := converter.MarshalOCIIndex(ix, cfg.artifactType, cfg.indexMarshalOptions...)
 	if err != nil {
-		return ocischemav1.Descriptor{}, nil, fmt.Errorf("invalid bundle manifest %q: %s", ref, err)
+		return ocischemav1.Descriptor{}, nil, fmt.Errorf("invalid bundle manifest %q: %w", ref, err)
 	}
-	indexDescriptor := ocischemav1.Descriptor{
-		Digest:    digest.FromBytes(indexPayload),
-		MediaType: ocischemav1.MediaTypeImageIndex,
-		Size:      int64(len(indexPayload)),
+	if err := checkIndexSize(ix, indexDescriptor, ref, cfg); err != nil {
+		return ocischemav1.Descriptor{}, nil, err
 	}
+	indexDescriptor.Digest = cfg.digestAlgorithm.FromBytes(indexPayload)
 	return indexDescriptor, indexPayload, nil
 }
 
-type ociIndexWrapper struct {
-	ocischemav1.Index
-	MediaType string `json:"mediaType,omitempty"`
+// checkIndexManifests checks the number of manifest entries of the index before marshaling it
+func checkIndexManifests(ix *ocischemav1.Index, ref reference.Named, cfg pushConfig) error {
+	if cfg.maxIndexManifests > 0 && len(ix.Manifests) > cfg.maxIndexManifests {
+		return &IndexLimitExceededError{Reference: ref.String(), Manifests: len(ix.Manifests), MaxManifests: cfg.maxIndexManifests, MaxSize: cfg.maxIndexSize}
+	}
+	return nil
+}
+
+// checkIndexSize checks the marshaled size of the index
+func checkIndexSize(ix *ocischemav1.Index, indexDescriptor ocischemav1.Descriptor, ref reference.Named, cfg pushConfig) error {
+	if cfg.maxIndexSize > 0 && indexDescriptor.Size > cfg.maxIndexSize {
+		return &IndexLimitExceededError{Reference: ref.String(), Manifests: len(ix.Manifests), MaxManifests: cfg.maxIndexManifests,
+			Size: indexDescriptor.Size, MaxSize: cfg.maxIndexSize}
+	}
+	return nil
 }
 
 func convertIndexAndApplyOptions(b *bundle.Bundle,
 	relocationMap relocation.ImageRelocationMap,
 	ref reference.Named,
 	confDescriptor ocischemav1.Descriptor,
-	options ...ManifestOption) (*ocischemav1.Index, error) {
-	ix, err := converter.ConvertBundleToOCIIndex(b, ref, confDescriptor, relocationMap)
+	cfg pushConfig) (*ocischemav1.Index, error) {
+	ix, err := converter.ConvertBundleToOCIIndex(b, ref, confDescriptor, relocationMap, cfg.convertOptions...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to convert bundle %q: %w", ref, err)
 	}
-	for _, opts := range options {
+	for _, opts := range cfg.manifestOptions {
 		if err := opts(ix); err != nil {
-			return nil, fmt.Errorf("failed to prepare bundle manifest %q: %s", ref, err)
+			return nil, fmt.Errorf("failed to prepare bundle manifest %q: %w", ref, err)
+		}
+	}
+	for i, d := range ix.Manifests {
+		if ix.Manifests[i], err = cfg.mutateDescriptor(d); err != nil {
+			return nil, fmt.Errorf("failed to prepare bundle manifest %q: %w", ref, err)
 		}
 	}
 	return ix, nil
 }
 
-func prepareIndexNonOCI(b *bundle.Bundle,
-	relocationMap relocation.ImageRelocationMap,
-	ref reference.Named,
-	confDescriptor ocischemav1.Descriptor,
-	options ...ManifestOption) (ocischemav1.Descriptor, []byte, error) {
-	ix, err := convertIndexAndApplyOptions(b, relocationMap, ref, confDescriptor, options...)
-	if err != nil {
+func prepareIndexNonOCI(ix *ocischemav1.Index, ref reference.Named, cfg pushConfig) (ocischemav1.Descriptor, []byte, error) {
+	if err := checkIndexManifests(ix, ref, cfg); err != nil {
 		return ocischemav1.Descriptor{}, nil, err
 	}
-	w := &ociIndexWrapper{Index: *ix, MediaType: images.MediaTypeDockerSchema2ManifestList}
-	w.SchemaVersion = 2
-	indexPayload, err := json.Marshal(w)
+	indexPayload, indexDescriptor, err := converter.MarshalDockerManifestList(ix, cfg.artifactType, cfg.indexMarshalOptions...)
 	if err != nil {
-		return ocischemav1.Descriptor{}, nil, fmt.Errorf("invalid bundle manifest %q: %s", ref, err)
+		return ocischemav1.Descriptor{}, nil, fmt.Errorf("invalid bundle manifest %q: %w", ref, err)
 	}
-	indexDescriptor := ocischemav1.Descriptor{
-		Digest:    digest.FromBytes(indexPayload),
-		MediaType: images.MediaTypeDockerSchema2ManifestList,
-		Size:      int64(len(indexPayload)),
+	if err := checkIndexSize(ix, indexDescriptor, ref, cfg); err != nil {
+		return ocischemav1.Descriptor{}, nil, err
 	}
+	indexDescriptor.Digest = cfg.digestAlgorithm.FromBytes(indexPayload)
 	return indexDescriptor, indexPayload, nil
 }
 
-func pushPayload(ctx context.Context, resolver remotes.Resolver, reference string, descriptor ocischemav1.Descriptor, payload []byte) error {
+func pushPayload(ctx context.Context, resolver remotes.Resolver, reference string, cfg pushConfig, descriptor ocischemav1.Descriptor, payload []byte) error {
+	ctx = withLogField(ctx, logFieldDigest, descriptor.Digest)
+	descriptor, err := cfg.mutateDescriptor(descriptor)
+	if err != nil {
+		return err
+	}
+	if cfg.dryRun {
+		log.G(ctx).Debugf("Dry run, skipping push of %s to %s", descriptor.Digest, reference)
+		return nil
+	}
+	repository, cacheable := cacheRepository(reference)
+	cacheable = cacheable && cfg.blobCache != nil
+	if cacheable && cfg.blobCache.Has(repository, descriptor.Digest) {
+		log.G(ctx).Debugf("Skipping push of %s to %s, already pushed", descriptor.Digest, reference)
+		cfg.progressTracker.OnBlobStart(descriptor)
+		cfg.progressTracker.OnBlobComplete(descriptor)
+		return nil
+	}
+	cfg.progressTracker.OnBlobStart(descriptor)
+	host := registryHost(reference)
+	attempt := func() error {
+		if cfg.rateLimiter == nil {
+			return pushPayloadOnce(ctx, resolver, reference, cfg, descriptor, payload)
+		}
+		if err := cfg.rateLimiter.Wait(ctx, host); err != nil {
+			return err
+		}
+		err := pushPayloadOnce(ctx, resolver, reference, cfg, descriptor, payload)
+		cfg.rateLimiter.observe(host, err)
+		return err
+	}
+	attempts := 0
+	if err := withRetry(ctx, cfg.retryPolicy, func() error {
+		if attempts++; attempts > 1 {
+			cfg.metrics.ObservePushRetry(host)
+		}
+		return withCredentialRefresh(ctx, cfg.credentialRefresher, host, attempt)
+	}); err != nil {
+		if descriptor.Digest.Algorithm() != digest.Canonical && isDigestRejectedError(err) {
+			return &UnsupportedDigestAlgorithmError{Algorithm: descriptor.Digest.Algorithm(), Err: err}
+		}
+		return err
+	}
+	if cacheable {
+		cfg.blobCache.Put(repository, descriptor.Digest)
+	}
+	return nil
+}
+
+// isDigestRejectedError returns true if the registry rejected the pushed payload because of its digest, like with a
+// DIGEST_INVALID error
+func isDigestRejectedError(err error) bool {
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	return bytes.Contains(bytes.ToLower(statusErr.Body), []byte("digest"))
+}
+
+func pushPayloadOnce(ctx context.Context, resolver remotes.Resolver, reference string, cfg pushConfig, descriptor ocischemav1.Descriptor, payload []byte) error {
 	ctx = withMutedContext(ctx)
+	ctx = withRepositoryRefKey(ctx, reference, descriptor)
 	pusher, err := resolver.Pusher(ctx, reference)
 	if err != nil {
 		return err
 	}
-	writer, err := pusher.Push(ctx, descriptor)
+	// Only blobs can be mounted: manifests are always pushed as they are. The configured mount source takes precedence
+	// over a distribution source annotated on the descriptor.
+	source, pushed := distributionSourceMount(reference, descriptor)
+	if cfg.mountSource != nil {
+		source = cfg.mountSource
+	}
+	if isManifest(descriptor.MediaType) {
+		source, pushed = nil, descriptor
+	}
+	writer, err := pushWithMountFallback(ctx, pusher, source, pushed)
 	if err != nil {
 		if errors.Is(err, errdefs.ErrAlreadyExists) {
+			cfg.progressTracker.OnBlobComplete(descriptor)
 			return nil
 		}
 		return err
 	}
 	defer writer.Close()
-	if _, err := writer.Write(payload); err != nil {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("push of %s interrupted before writing: %w", descriptor.Digest, err)
+	}
+	n, err := writePayload(ctx, writer, descriptor, payload, cfg.chunkSize, cfg.retryPolicy)
+	if err != nil {
 		if errors.Is(err, errdefs.ErrAlreadyExists) {
+			cfg.progressTracker.OnBlobComplete(descriptor)
 			return nil
 		}
 		return err
 	}
-	err = writer.Commit(ctx, descriptor.Size, descriptor.Digest)
-	if errors.Is(err, errdefs.ErrAlreadyExists) {
-		return nil
+	reportProgress(cfg.progressTracker, writer, descriptor, n)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("push of %s interrupted before commit: %w", descriptor.Digest, err)
+	}
+	// Payloads found already present are not audited, whether the pusher, the write or the commit reports them
+	if err := writer.Commit(ctx, descriptor.Size, descriptor.Digest); err != nil {
+		if errors.Is(err, errdefs.ErrAlreadyExists) {
+			cfg.progressTracker.OnBlobComplete(descriptor)
+			return nil
+		}
+		return err
+	}
+	if cfg.audit != nil {
+		cfg.audit(AuditEvent{Reference: reference, Descriptor: descriptor, Time: time.Now().UTC()})
+	}
+	cfg.progressTracker.OnBlobComplete(descriptor)
+	return nil
+}
+
+// writePayload writes the payload, in chunks of at most chunkSize bytes if it is larger, resuming from the offset
+// reported by the writer status after a transient failure, within the limits of the retry policy. When the writer does
+// not report a usable offset, the error is returned so the whole push is restarted.
+func writePayload(ctx context.Context, writer content.Writer, descriptor ocischemav1.Descriptor, payload []byte, chunkSize int, policy RetryPolicy) (int64, error) {
+	var offset int64
+	for attempt := 1; ; attempt++ {
+		n, err := writeChunks(writer, payload[offset:], chunkSize)
+		if err == nil {
+			return offset + n, nil
+		}
+		if attempt >= policy.MaxAttempts || !isTransientError(err) {
+			return 0, err
+		}
+		status, statusErr := writer.Status()
+		if statusErr != nil || status.Offset <= 0 || status.Offset > int64(len(payload)) {
+			return 0, err
+		}
+		offset = status.Offset
+		delay := policy.delay(attempt)
+		log.G(ctx).Debugf("Write of %s failed with a transient error, resuming at offset %d in %s: %s", descriptor.Digest, offset, delay, err)
+		if err := sleep(ctx, delay); err != nil {
+			return 0, err
+		}
 	}
-	return err
 }
 
-func pushBundleConfig(ctx context.Context, resolver remotes.Resolver, reference string, bundleConfig *converter.PreparedBundleConfig, allowFallbacks bool) (ocischemav1.Descriptor, error) {
-	if d, err := pushBundleConfigDescriptor(ctx, "Config", resolver, reference,
-		bundleConfig.ConfigBlobDescriptor, bundleConfig.ConfigBlob, bundleConfig.Fallback, allowFallbacks); err != nil {
+// writeChunks writes the payload in a single write if it fits in chunkSize, or if chunkSize is not positive. Otherwise
+// the payload is written in chunkSize writes, so the writer can flush them to the registry as they come.
+func writeChunks(writer io.Writer, payload []byte, chunkSize int) (int64, error) {
+	if chunkSize <= 0 || len(payload) <= chunkSize {
+		return writeFull(writer, payload)
+	}
+	var written int64
+	for len(payload) > 0 {
+		chunk := payload
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		n, err := writeFull(writer, chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		payload = payload[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFull writes the remaining bytes again after a short write, and fails with io.ErrShortWrite if a write makes
+// no progress without error, instead of committing truncated content
+func writeFull(writer io.Writer, payload []byte) (int64, error) {
+	var written int64
+	for len(payload) > 0 {
+		n, err := writer.Write(payload)
+		if n < 0 || n > len(payload) {
+			return written, fmt.Errorf("invalid write count %d for %d bytes", n, len(payload))
+		}
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, fmt.Errorf("write stopped after %d bytes: %w", written, io.ErrShortWrite)
+		}
+		payload = payload[n:]
+	}
+	return written, nil
+}
+
+// reportProgress notifies the tracker with the offset reported by the writer, or with the written bytes count if
+// the writer does not report it
+func reportProgress(tracker ProgressTracker, writer content.Writer, descriptor ocischemav1.Descriptor, written int64) {
+	offset := written
+	if status, err := writer.Status(); err == nil && status.Offset > 0 {
+		offset = status.Offset
+	}
+	tracker.OnBlobProgress(descriptor, offset)
+}
+
+// descriptorPayload is a payload to push along with its descriptor
+type descriptorPayload struct {
+	descriptor ocischemav1.Descriptor
+	payload    []byte
+}
+
+// pushPayloads pushes payloads not depending on each other concurrently, bounded by the configured parallelism.
+// The first failure cancels the pushes still in flight, and is returned as a PushError.
+func pushPayloads(ctx context.Context, resolver remotes.Resolver, reference string, cfg pushConfig, stage PushStage, payloads ...descriptorPayload) error {
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(cfg.maxConcurrentJobs)
+	for _, p := range payloads {
+		p := p
+		group.Go(func() error {
+			if err := pushPayload(ctx, resolver, reference, cfg, p.descriptor, p.payload); err != nil {
+				return &PushError{Stage: stage, Descriptor: p.descriptor, Err: err}
+			}
+			return nil
+		})
+	}
+	return group.Wait()
+}
+
+func pushBundleConfig(ctx context.Context, resolver remotes.Resolver, reference string, bundleConfig *converter.PreparedBundleConfig, cfg pushConfig) (ocischemav1.Descriptor, error) {
+	if cfg.directConfigBlob {
+		return pushDirectConfigBlob(ctx, resolver, reference, bundleConfig, cfg)
+	}
+	// The config blob must be present before pushing the manifest referencing it
+	blobs := []descriptorPayload{{descriptor: bundleConfig.ConfigBlobDescriptor, payload: bundleConfig.ConfigBlob}}
+	if bundleConfig.EmptyConfigBlob != nil {
+		blobs = append(blobs, descriptorPayload{descriptor: bundleConfig.EmptyConfigBlobDescriptor, payload: bundleConfig.EmptyConfigBlob})
+	}
+	// Once the fallback is pushed instead, the manifest of this format is never pushed
+	if d, fellBack, err := pushBundleConfigDescriptors(ctx, "Config", PushStageConfigBlob, resolver, reference, cfg, bundleConfig.Fallback, blobs...); err != nil || fellBack {
 		return d, err
 	}
-	return pushBundleConfigDescriptor(ctx, "Config Manifest", resolver, reference,
-		bundleConfig.ManifestDescriptor, bundleConfig.Manifest, bundleConfig.Fallback, allowFallbacks)
+	d, _, err := pushBundleConfigDescriptors(ctx, "Config Manifest", PushStageConfigManifest, resolver, reference, cfg, bundleConfig.Fallback,
+		descriptorPayload{descriptor: bundleConfig.ManifestDescriptor, payload: bundleConfig.Manifest})
+	return d, err
 }
 
-func pushBundleConfigDescriptor(ctx context.Context, name string, resolver remotes.Resolver, reference string,
-	descriptor ocischemav1.Descriptor, payload []byte, fallback *converter.PreparedBundleConfig, allowFallbacks bool) (ocischemav1.Descriptor, error) {
-	logger := log.G(ctx)
+// pushDirectConfigBlob only pushes the config blob, referenced by the index without config manifest
+func pushDirectConfigBlob(ctx context.Context, resolver remotes.Resolver, reference string, bundleConfig *converter.PreparedBundleConfig, cfg pushConfig) (ocischemav1.Descriptor, error) {
+	if bundleConfig.EmptyConfigBlob != nil {
+		return ocischemav1.Descriptor{}, errors.New("a bundle config prepared as an artifact manifest cannot be pushed as a direct config blob")
+	}
+	if !converter.IsBundleConfigBlob(bundleConfig.ConfigBlobDescriptor) {
+		return ocischemav1.Descriptor{}, fmt.Errorf("a bundle config blob with media type %q cannot be referenced directly by the index", bundleConfig.ConfigBlobDescriptor.MediaType)
+	}
+	d, _, err := pushBundleConfigDescriptors(ctx, "Config", PushStageConfigBlob, resolver, reference, cfg, nil,
+		descriptorPayload{descriptor: bundleConfig.ConfigBlobDescriptor, payload: bundleConfig.ConfigBlob})
+	return d, err
+}
+
+// checkDirectConfigBlob checks that the index references the pushed config blob as its bundle config, unchanged by the
+// manifest options and the descriptor mutator
+func checkDirectConfigBlob(ix *ocischemav1.Index, ref reference.Named, confDescriptor ocischemav1.Descriptor) error {
+	d, err := converter.GetBundleConfigManifestDescriptor(ix)
+	if err != nil {
+		return fmt.Errorf("invalid bundle manifest %q: %w", ref, err)
+	}
+	if d.Digest != confDescriptor.Digest || d.MediaType != confDescriptor.MediaType || d.Size != confDescriptor.Size {
+		return fmt.Errorf("invalid bundle manifest %q: the bundle config descriptor %s does not reference the pushed config blob %s", ref, d.Digest, confDescriptor.Digest)
+	}
+	return nil
+}
+
+// pushBundleConfigDescriptors pushes the payloads of a bundle config stage and returns the descriptor of the last one,
+// or the descriptor of the fallback config manifest if the fallback was pushed instead
+func pushBundleConfigDescriptors(ctx context.Context, name string, stage PushStage, resolver remotes.Resolver, reference string, cfg pushConfig,
+	fallback *converter.PreparedBundleConfig, payloads ...descriptorPayload) (ocischemav1.Descriptor, bool, error) {
+	stageCtx := withLogField(ctx, logFieldStage, stage)
+	logger := log.G(stageCtx)
 	logger.Debugf("Trying to push CNAB Bundle %s", name)
 	logger.Debugf("CNAB Bundle %s Descriptor", name)
-	logPayload(logger, descriptor)
+	for _, p := range payloads {
+		logPayload(logger, p.descriptor)
+	}
 
-	if err := pushPayload(ctx, resolver, reference, descriptor, payload); err != nil {
-		if allowFallbacks && fallback != nil {
-			logger.Debugf("Failed to push CNAB Bundle %s, trying with a fallback method", name)
-			return pushBundleConfig(ctx, resolver, reference, fallback, allowFallbacks)
+	// A fallback is traced by spans of its own, after the span of the failed attempt
+	spanAttributes := append([]TraceAttribute{referenceAttribute(reference)}, descriptorAttributes(payloads[len(payloads)-1].descriptor)...)
+	start := time.Now()
+	spanCtx, span := cfg.tracer.Start(stageCtx, stageSpanName(stage), spanAttributes...)
+	err := pushPayloads(spanCtx, resolver, reference, cfg, stage, payloads...)
+	span.End(err)
+	cfg.metrics.ObservePushStage(registryHost(reference), stage, time.Since(start), err)
+	if err != nil {
+		if fallback == nil {
+			return ocischemav1.Descriptor{}, false, err
 		}
-		return ocischemav1.Descriptor{}, err
+		if !cfg.allowFallbacks {
+			description := describeConfigFallback(fallback)
+			logger.Debugf("Failed to push CNAB Bundle %s, fallbacks are disabled: not trying %s", name, description)
+			return ocischemav1.Descriptor{}, false, &FallbackDisabledError{Fallback: description, Err: err}
+		}
+		logger.Debugf("Failed to push CNAB Bundle %s, trying with a fallback method", name)
+		d, err := pushBundleConfig(ctx, resolver, reference, fallback, cfg)
+		return d, true, err
 	}
-	return descriptor, nil
+	return payloads[len(payloads)-1].descriptor, false, nil
+}
+
+// manifestListFallback describes the fallback format of the index
+const manifestListFallback = "a Docker manifest list"
+
+// describeConfigFallback describes the format of a bundle config fallback
+func describeConfigFallback(fallback *converter.PreparedBundleConfig) string {
+	return fmt.Sprintf("a %s config in a %s manifest", fallback.ConfigBlobDescriptor.MediaType, fallback.ManifestDescriptor.MediaType)
 }
 
 func pushTaggedImage(ctx context.Context, imageClient internal.ImageClient, targetRef reference.Named, out io.Writer) error {
@@ -1,17 +1,28 @@
 package remotes
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cnabio/cnab-go/bundle"
 	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/relocation"
 	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"gotest.tools/v3/assert"
 )
@@ -139,6 +150,923 @@ func TestFallbackConfigManifest(t *testing.T) {
 	assert.Equal(t, expectedConfigManifest, pusher.buffers[3].String())
 }
 
+func TestPushBundleConfig(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	descriptor, err := PushBundleConfig(context.Background(), tests.MakeTestBundle(), ref, resolver, false)
+	assert.NilError(t, err)
+	// Only the config blob and the config manifest are pushed
+	assert.Equal(t, len(pusher.pushedDescriptors), 2)
+	assert.DeepEqual(t, pusher.pushedDescriptors[1], descriptor)
+	assert.Equal(t, ocischemav1.MediaTypeImageManifest, descriptor.MediaType)
+}
+
+func TestPushBundleConfigWithFallbacks(t *testing.T) {
+	pusher := newMockPusher([]error{errors.New("1"), errors.New("2"), nil, nil})
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	_, err = PushBundleConfig(context.Background(), tests.MakeTestBundle(), ref, resolver, false)
+	assert.ErrorContains(t, err, "1")
+
+	// Same fallbacks as Push
+	pusher = newMockPusher([]error{errors.New("1"), errors.New("2"), nil, nil, nil, nil})
+	resolver = &mockResolver{pusher: pusher}
+	descriptor, err := PushBundleConfig(context.Background(), tests.MakeTestBundle(), ref, resolver, true)
+	assert.NilError(t, err)
+	assert.Equal(t, expectedConfigManifest, pusher.buffers[3].String())
+	assert.DeepEqual(t, pusher.pushedDescriptors[len(pusher.pushedDescriptors)-1], descriptor)
+}
+
+func TestPushPreparedBundleConfig(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	prepared, err := converter.PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+
+	// The fallback is pushed when the first manifest is rejected
+	pusher := newMockPusher([]error{nil, errors.New("1"), nil, nil})
+	descriptor, err := PushPreparedBundleConfig(context.Background(), prepared, ref, &mockResolver{pusher: pusher}, true)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, prepared.Fallback.ManifestDescriptor, descriptor)
+	assert.DeepEqual(t, prepared.ConfigBlob, pusher.buffers[0].Bytes())
+	assert.DeepEqual(t, prepared.Fallback.ConfigBlob, pusher.buffers[2].Bytes())
+	assert.DeepEqual(t, prepared.Fallback.Manifest, pusher.buffers[3].Bytes())
+}
+
+func TestPushWithRelocationMapRoundTrip(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	b := tests.MakeTestBundle()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	descriptor, pushedRelocationMap, err := PushWithRelocationMap(context.Background(), b, tests.MakeRelocationMap(), ref, resolver,
+		WithAllowFallbacks(true))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeRelocationMap(), pushedRelocationMap)
+
+	// Pull back what was pushed: the index, the config manifest and the config blob
+	resolver.fetcher = &mockFetcher{indexBuffers: []*bytes.Buffer{pusher.buffers[2], pusher.buffers[1], pusher.buffers[0]}}
+	resolver.resolvedDescriptors = []ocischemav1.Descriptor{descriptor}
+	pulledBundle, pulledRelocationMap, _, err := PullWithOptions(context.Background(), ref, resolver, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pushedRelocationMap, pulledRelocationMap)
+
+	// Every image is resolved by the relocation map
+	for _, img := range pulledBundle.InvocationImages {
+		assert.Check(t, pushedRelocationMap[img.Image] != "", img.Image)
+	}
+	for _, img := range pulledBundle.Images {
+		assert.Check(t, pushedRelocationMap[img.Image] != "", img.Image)
+	}
+}
+
+func TestPushWithConfigCompressionRoundTrip(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	descriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithPrepareOptions(converter.WithConfigCompression(true)))
+	assert.NilError(t, err)
+	assert.Equal(t, "application/vnd.cnab.config.v1+json+zstd", pusher.pushedDescriptors[0].MediaType)
+
+	// The pulled config is decompressed
+	fetcher := func() *mockFetcher {
+		return &mockFetcher{indexBuffers: []*bytes.Buffer{
+			bytes.NewBuffer(pusher.buffers[2].Bytes()), bytes.NewBuffer(pusher.buffers[1].Bytes()), bytes.NewBuffer(pusher.buffers[0].Bytes()),
+		}}
+	}
+	resolver.fetcher = fetcher()
+	resolver.resolvedDescriptors = []ocischemav1.Descriptor{descriptor}
+	pulledBundle, _, _, err := PullWithOptions(context.Background(), ref, resolver, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), pulledBundle)
+
+	// A config decompressing to more than the limit is rejected
+	resolver.fetcher = fetcher()
+	resolver.resolvedDescriptors = []ocischemav1.Descriptor{descriptor}
+	_, _, _, err = PullWithOptions(context.Background(), ref, resolver, WithoutBundleValidation(), WithMaxDecompressedConfigSize(16))
+	var sizeErr *converter.SizeLimitExceededError
+	assert.Assert(t, errors.As(err, &sizeErr), err)
+	assert.Equal(t, int64(16), sizeErr.Limit)
+}
+
+func TestPushWithBundlePackagingRoundTrip(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	descriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithBundlePackaging(converter.CNABPackagingThick))
+	assert.NilError(t, err)
+
+	resolver.fetcher = &mockFetcher{indexBuffers: []*bytes.Buffer{pusher.buffers[2]}}
+	resolver.resolvedDescriptors = []ocischemav1.Descriptor{descriptor}
+	packaging, err := PullBundlePackaging(context.Background(), ref, resolver)
+	assert.NilError(t, err)
+	assert.Equal(t, converter.CNABPackagingThick, packaging)
+
+	// Without the option, the index has no packaging annotation
+	pusher = &mockPusher{}
+	resolver = &mockResolver{pusher: pusher}
+	descriptor, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver, true)
+	assert.NilError(t, err)
+
+	resolver.fetcher = &mockFetcher{indexBuffers: []*bytes.Buffer{pusher.buffers[2]}}
+	resolver.resolvedDescriptors = []ocischemav1.Descriptor{descriptor}
+	packaging, err = PullBundlePackaging(context.Background(), ref, resolver)
+	assert.NilError(t, err)
+	assert.Equal(t, "", packaging)
+}
+
+func TestWithBundlePackagingRejectsUnknownValues(t *testing.T) {
+	_, err := newPushConfig(WithBundlePackaging("fat"))
+	assert.ErrorContains(t, err, `unsupported bundle packaging "fat"`)
+}
+
+func TestPushWithIndexWriter(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		name      string
+		pusher    *mockPusher
+		options   []PushOption
+		mediaType string
+	}{
+		{name: "oci index", pusher: &mockPusher{}, mediaType: converter.CNABIndexMediaType},
+		{name: "docker manifest list", pusher: &mockPusher{}, options: []PushOption{WithDockerManifestList()}, mediaType: converter.CNABManifestListMediaType},
+		{name: "fallback", pusher: newMockPusher([]error{nil, nil, errors.New("unsupported media type"), nil}), options: []PushOption{WithAllowFallbacks(true)}, mediaType: converter.CNABManifestListMediaType},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var written bytes.Buffer
+			descriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref,
+				&mockResolver{pusher: tc.pusher}, append(tc.options, WithIndexWriter(&written))...)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.mediaType, descriptor.MediaType)
+			assert.Equal(t, descriptor.Digest, digest.FromBytes(written.Bytes()))
+			assert.Equal(t, descriptor.Size, int64(written.Len()))
+		})
+	}
+}
+
+func TestPushWithVerifyAfterPush(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	expected, err := Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: &mockPusher{}}, false)
+	assert.NilError(t, err)
+
+	resolver := &mockResolver{pusher: &mockPusher{}, resolvedDescriptors: []ocischemav1.Descriptor{expected}}
+	descriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithVerifyAfterPush())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, expected, descriptor)
+	assert.Equal(t, 0, len(resolver.resolvedDescriptors))
+
+	// The registry serialized the index again
+	mutated := expected
+	mutated.Digest = digest.FromString("mutated")
+	resolver = &mockResolver{pusher: &mockPusher{}, resolvedDescriptors: []ocischemav1.Descriptor{mutated}}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithVerifyAfterPush())
+	var mismatch *DigestMismatchAfterPushError
+	assert.Assert(t, errors.As(err, &mismatch))
+	assert.Equal(t, expected.Digest, mismatch.Expected)
+	assert.Equal(t, mutated.Digest, mismatch.Actual)
+	assert.Equal(t, ref.String(), mismatch.Reference)
+}
+
+func TestPushWithCheckReferencedImages(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	push := func() error {
+		_, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+			WithCheckReferencedImages())
+		return err
+	}
+	addImage := func(dgst digest.Digest) {
+		registry.descriptors[dgst] = ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: dgst, Size: 42}
+	}
+
+	addImage("sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341")
+	err = push()
+	var missingErr *MissingReferencedImagesError
+	assert.Assert(t, errors.As(err, &missingErr))
+	assert.Equal(t, 2, len(missingErr.Descriptors))
+	assert.Error(t, err, `images referenced by bundle manifest "my.registry/namespace/my-app:my-tag" are missing in the repository: `+
+		`invocation image (sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0343), `+
+		`another-image (sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0342)`)
+	_, tagged := registry.tags[ref.String()]
+	assert.Check(t, !tagged, "the index should not be pushed")
+
+	addImage("sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0342")
+	addImage("sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0343")
+	assert.NilError(t, push())
+	_, tagged = registry.tags[ref.String()]
+	assert.Check(t, tagged)
+}
+
+func TestPushWithSkipIfUnchanged(t *testing.T) {
+	registry := newMemoryRegistry()
+	var pushed int
+	registry.pushErr = func(string, ocischemav1.Descriptor) error {
+		pushed++
+		return nil
+	}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	push := func(b *bundle.Bundle) *PushResult {
+		result, err := PushWithResult(context.Background(), b, tests.MakeRelocationMap(), ref, registry, WithSkipIfUnchanged())
+		assert.NilError(t, err)
+		return result
+	}
+
+	// The first push has nothing to compare to
+	first := push(tests.MakeTestBundle())
+	assert.Check(t, !first.Unchanged)
+	assert.Equal(t, 3, pushed)
+
+	// Pushing again the same bundle pushes nothing
+	var written bytes.Buffer
+	second, err := PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithSkipIfUnchanged(), WithIndexWriter(&written))
+	assert.NilError(t, err)
+	assert.Check(t, second.Unchanged)
+	assert.DeepEqual(t, first.Index, second.Index)
+	assert.DeepEqual(t, first.ConfigManifest, second.ConfigManifest)
+	assert.Equal(t, 3, pushed)
+	assert.Equal(t, first.Index.Digest, digest.FromBytes(written.Bytes()))
+
+	// A changed bundle is pushed
+	b := tests.MakeTestBundle()
+	b.Description = "changed"
+	third := push(b)
+	assert.Check(t, !third.Unchanged)
+	assert.Equal(t, 6, pushed)
+	assert.Equal(t, third.Index.Digest, registry.tags[ref.String()])
+}
+
+func TestPushWithArtifactType(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		name     string
+		options  []PushOption
+		expected string
+	}{
+		{name: "no artifact type", expected: ""},
+		{name: "default artifact type", options: []PushOption{WithArtifactType("")}, expected: converter.ArtifactTypeValue},
+		{name: "custom artifact type", options: []PushOption{WithArtifactType("application/vnd.example.bundle")}, expected: "application/vnd.example.bundle"},
+		{name: "manifest list", options: []PushOption{WithArtifactType(""), WithDockerManifestList()}, expected: converter.ArtifactTypeValue},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pusher := &mockPusher{}
+			resolver := &mockResolver{pusher: pusher}
+			descriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver, tc.options...)
+			assert.NilError(t, err)
+			indexPayload := pusher.buffers[len(pusher.buffers)-1]
+
+			var index struct {
+				ArtifactType *string           `json:"artifactType"`
+				Annotations  map[string]string `json:"annotations"`
+			}
+			assert.NilError(t, json.Unmarshal(indexPayload.Bytes(), &index))
+			if tc.expected == "" {
+				assert.Check(t, index.ArtifactType == nil)
+				assert.Equal(t, tests.BundleDigest, descriptor.Digest)
+			} else {
+				assert.Assert(t, index.ArtifactType != nil)
+				assert.Equal(t, tc.expected, *index.ArtifactType)
+				assert.Equal(t, tc.expected, index.Annotations[converter.ArtifactTypeAnnotation])
+			}
+
+			resolver.fetcher = &mockFetcher{indexBuffers: []*bytes.Buffer{indexPayload}}
+			resolver.resolvedDescriptors = []ocischemav1.Descriptor{descriptor}
+			artifactType, err := PullArtifactType(context.Background(), ref, resolver)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.expected, artifactType)
+		})
+	}
+}
+
+// chunkRecorder records the size of each write
+type chunkRecorder struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (r *chunkRecorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, len(p))
+	return r.Buffer.Write(p)
+}
+
+func (r *chunkRecorder) Close() error { return nil }
+
+func TestPushPayloadWithChunkSize(t *testing.T) {
+	testCases := []struct {
+		name           string
+		chunkSize      int
+		payloadSize    int
+		expectedWrites []int
+	}{
+		{name: "single write by default", chunkSize: 0, payloadSize: 25, expectedWrites: []int{25}},
+		{name: "single write for small payloads", chunkSize: 25, payloadSize: 25, expectedWrites: []int{25}},
+		{name: "chunked writes for large payloads", chunkSize: 10, payloadSize: 25, expectedWrites: []int{10, 10, 5}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &chunkRecorder{}
+			pusher := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+				return mockWriter{WriteCloser: recorder}, nil
+			})
+			payload := bytes.Repeat([]byte("x"), tc.payloadSize)
+			descriptor := ocischemav1.Descriptor{Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+			cfg, err := newPushConfig(WithChunkSize(tc.chunkSize))
+			assert.NilError(t, err)
+
+			assert.NilError(t, pushPayload(context.Background(), &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload))
+			assert.DeepEqual(t, tc.expectedWrites, recorder.writes)
+			assert.Equal(t, string(payload), recorder.String())
+		})
+	}
+}
+
+// shortWriter writes at most max bytes per write, without error, and nothing once stalled
+type shortWriter struct {
+	bytes.Buffer
+	max     int
+	stallAt int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.stallAt > 0 && w.Len() >= w.stallAt {
+		return 0, nil
+	}
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.Buffer.Write(p)
+}
+
+func (w *shortWriter) Close() error { return nil }
+
+func TestPushPayloadWithShortWrites(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 25)
+	descriptor := ocischemav1.Descriptor{Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+	for _, chunkSize := range []int{0, 10} {
+		// The remaining bytes are written again after each short write
+		writer := &shortWriter{max: 3}
+		pusher := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+			return mockWriter{WriteCloser: writer}, nil
+		})
+		cfg, err := newPushConfig(WithChunkSize(chunkSize))
+		assert.NilError(t, err)
+		assert.NilError(t, pushPayload(context.Background(), &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload))
+		assert.Equal(t, string(payload), writer.String())
+	}
+
+	// A writer making no progress without error fails the push before the commit
+	writer := &callbackWriter{mockWriter: mockWriter{WriteCloser: &shortWriter{max: 3, stallAt: 9}}, onWrite: func([]byte) {}}
+	pusher := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+		return writer, nil
+	})
+	cfg, err := newPushConfig()
+	assert.NilError(t, err)
+	err = pushPayload(context.Background(), &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload)
+	assert.Assert(t, errors.Is(err, io.ErrShortWrite), err)
+	assert.ErrorContains(t, err, "after 9 bytes")
+	assert.Assert(t, !writer.committed)
+}
+
+func TestPushWithConfigMediaType(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithPrepareOptions(converter.WithConfigMediaType("application/vnd.example.config.v1+json")))
+	assert.NilError(t, err)
+	assert.Equal(t, "application/vnd.example.config.v1+json", pusher.pushedDescriptors[0].MediaType)
+
+	// The pushed config manifest references the config blob with the custom media type
+	var manifest ocischemav1.Manifest
+	assert.NilError(t, json.Unmarshal(pusher.buffers[1].Bytes(), &manifest))
+	assert.Equal(t, "application/vnd.example.config.v1+json", manifest.Config.MediaType)
+	assert.Equal(t, pusher.pushedDescriptors[0].Digest, manifest.Config.Digest)
+}
+
+func TestPushWithConfigManifestAnnotations(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	annotations := map[string]string{"org.example.commit": "0123abc", "org.example.build-time": "2021-03-04T05:06:07Z"}
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithPrepareOptions(converter.WithConfigManifestAnnotations(annotations)))
+	assert.NilError(t, err)
+
+	// The pushed config manifest and its descriptor in the index are annotated
+	var manifest ocischemav1.Manifest
+	assert.NilError(t, json.Unmarshal(pusher.buffers[1].Bytes(), &manifest))
+	assert.DeepEqual(t, annotations, manifest.Annotations)
+	var index ocischemav1.Index
+	assert.NilError(t, json.Unmarshal(pusher.buffers[2].Bytes(), &index))
+	configDescriptor, err := converter.GetBundleConfigManifestDescriptor(&index)
+	assert.NilError(t, err)
+	assert.Equal(t, pusher.pushedDescriptors[1].Digest, configDescriptor.Digest)
+	assert.Equal(t, "0123abc", configDescriptor.Annotations["org.example.commit"])
+	assert.Equal(t, "2021-03-04T05:06:07Z", configDescriptor.Annotations["org.example.build-time"])
+}
+
+func TestPushWithCrossRepositoryMount(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	source, err := reference.ParseNamed("my.registry/staging/my-app")
+	assert.NilError(t, err)
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithCrossRepositoryMount(source))
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(pusher.pushedDescriptors))
+	// Only the config blob is hinted, the config manifest and the index are pushed as they are
+	assert.Equal(t, "staging/my-app", pusher.pushedDescriptors[0].Annotations["containerd.io/distribution.source.my.registry"])
+	for _, d := range pusher.pushedDescriptors[1:] {
+		_, ok := d.Annotations["containerd.io/distribution.source.my.registry"]
+		assert.Assert(t, !ok)
+	}
+}
+
+func TestPushWithCrossRepositoryMountToRegistry(t *testing.T) {
+	registry := newUploadRegistry(t)
+	resolver := registry.resolver()
+	source, err := reference.ParseNamed(registry.host() + "/namespace/source:v1")
+	assert.NilError(t, err)
+	target, err := reference.ParseNamed(registry.host() + "/namespace/target:v1")
+	assert.NilError(t, err)
+	b := tests.MakeTestBundle()
+	sourceRelocationMap, err := relocateToRepository(tests.MakeRelocationMap(), source)
+	assert.NilError(t, err)
+	_, err = PushWithOptions(context.Background(), b, sourceRelocationMap, source, resolver, WithAllowFallbacks(false))
+	assert.NilError(t, err)
+	registry.resetRequests()
+
+	targetRelocationMap, err := relocateToRepository(tests.MakeRelocationMap(), target)
+	assert.NilError(t, err)
+	_, err = PushWithOptions(context.Background(), b, targetRelocationMap, target, resolver, WithAllowFallbacks(false),
+		WithCrossRepositoryMount(reference.TrimNamed(source)))
+	assert.NilError(t, err)
+	// The config blob is mounted from the path of the source repository, without the registry host
+	configDigest, _, err := converter.BundleConfigDigest(b)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []mountRequest{{Repository: "namespace/target", From: "namespace/source", Digest: configDigest}}, registry.mounts)
+	assert.Equal(t, 0, len(registry.uploads))
+	assert.Assert(t, registry.hasBlob("namespace/target", configDigest))
+}
+
+func TestPushWithResult(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	result, err := PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver)
+	assert.NilError(t, err)
+	assert.Equal(t, tests.BundleDigest, result.Index.Digest)
+	assert.Equal(t, ocischemav1.MediaTypeImageIndex, result.Index.MediaType)
+	assert.Equal(t, pusher.pushedDescriptors[1].Digest, result.ConfigManifest.Digest)
+	assert.Equal(t, 4, len(result.Manifests))
+	assert.Equal(t, result.ConfigManifest.Digest, result.Manifests[0].Digest)
+
+	// Pushing the same bundle again gives the same summary
+	other, err := PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, result, other)
+}
+
+func TestPushWithForce(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	relocationMap := tests.MakeRelocationMap()
+	delete(relocationMap, "my.registry/namespace/another-image")
+
+	// The index is not committed when an image is missing
+	pusher := &mockPusher{}
+	_, err = PushWithResult(context.Background(), tests.MakeTestBundle(), relocationMap, ref, &mockResolver{pusher: pusher})
+	assert.ErrorContains(t, err, "not present in the relocation map")
+	for _, d := range pusher.pushedDescriptors {
+		assert.Check(t, d.MediaType != ocischemav1.MediaTypeImageIndex)
+	}
+
+	pusher = &mockPusher{}
+	result, err := PushWithResult(context.Background(), tests.MakeTestBundle(), relocationMap, ref, &mockResolver{pusher: pusher}, WithForce())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"another-image"}, result.SkippedImages)
+	assert.Equal(t, 3, len(result.Manifests))
+	assert.Equal(t, ocischemav1.MediaTypeImageIndex, pusher.pushedDescriptors[len(pusher.pushedDescriptors)-1].MediaType)
+
+	// The invocation image is always required
+	delete(relocationMap, "my.registry/namespace/my-app-invoc")
+	_, err = PushWithResult(context.Background(), tests.MakeTestBundle(), relocationMap, ref, &mockResolver{pusher: &mockPusher{}}, WithForce())
+	assert.ErrorContains(t, err, "invalid invocation image")
+}
+
+func TestPushWithStrictValidation(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	b := tests.MakeTestBundle()
+	b.InvocationImages[0].Image = ""
+
+	_, err = PushWithOptions(context.Background(), b, tests.MakeRelocationMap(), ref, resolver, WithStrictValidation())
+	assert.ErrorContains(t, err, "image reference is empty")
+	// Nothing was pushed
+	assert.Equal(t, 0, len(pusher.pushedDescriptors))
+}
+
+func TestPushWithStrictValidationOfTheIndex(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	invalidSize := WithManifestOptions(func(ix *ocischemav1.Index) error {
+		ix.Manifests[1].Size = -1
+		return nil
+	})
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver, WithStrictValidation(), invalidSize)
+	assert.ErrorContains(t, err, `invalid bundle manifest "my.registry/namespace/my-app:my-tag"`)
+	assert.ErrorContains(t, err, "negative size -1")
+	// Only the bundle config was pushed
+	assert.Equal(t, 2, len(pusher.pushedDescriptors))
+
+	// The registry is left to reject it otherwise
+	pusher = &mockPusher{}
+	resolver = &mockResolver{pusher: pusher}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver, invalidSize)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(pusher.pushedDescriptors))
+}
+
+func TestPushWithReferenceNormalizer(t *testing.T) {
+	registry := newMemoryRegistry()
+	var pushedRefs []string
+	registry.pushErr = func(ref string, _ ocischemav1.Descriptor) error {
+		pushedRefs = append(pushedRefs, ref)
+		return nil
+	}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	toMirror := WithReferenceNormalizer(func(ref reference.Named) (reference.Named, error) {
+		return reference.ParseNamed(strings.Replace(ref.String(), "my.registry/", "mirror.registry/", 1))
+	})
+
+	descriptor, relocationMap, err := PushWithRelocationMap(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, toMirror)
+	assert.NilError(t, err)
+	// The config and the index are pushed to the normalized reference
+	assert.Assert(t, len(pushedRefs) > 0)
+	for _, pushed := range pushedRefs {
+		assert.Check(t, strings.HasPrefix(pushed, "mirror.registry/namespace/my-app"), pushed)
+	}
+	assert.Equal(t, descriptor.Digest, registry.tags["mirror.registry/namespace/my-app:my-tag"])
+	_, tagged := registry.tags["my.registry/namespace/my-app:my-tag"]
+	assert.Assert(t, !tagged)
+	// The returned relocation map references the normalized repository
+	assert.Equal(t, len(tests.MakeRelocationMap()), len(relocationMap))
+	for image, relocated := range relocationMap {
+		assert.Equal(t, strings.Replace(tests.MakeRelocationMap()[image], "my.registry/", "mirror.registry/", 1), relocated)
+	}
+
+	// Normalization errors fail the push before anything is pushed
+	pushedRefs = nil
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithReferenceNormalizer(func(reference.Named) (reference.Named, error) { return nil, errors.New("not allowed") }))
+	assert.ErrorContains(t, err, `failed to normalize reference "my.registry/namespace/my-app:my-tag": not allowed`)
+	assert.Equal(t, 0, len(pushedRefs))
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithReferenceNormalizer(nil))
+	assert.ErrorContains(t, err, "reference normalizer cannot be nil")
+}
+
+func TestPushWithMaxManifestSize(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	// The config manifest fits, but not the index
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithMaxManifestSize(1000))
+	var sizeErr *converter.SizeLimitExceededError
+	assert.Assert(t, errors.As(err, &sizeErr), err)
+	assert.Equal(t, "index", sizeErr.Object)
+	assert.Equal(t, int64(1360), sizeErr.Size)
+	assert.Equal(t, 2, len(pusher.pushedDescriptors))
+}
+
+func TestPushDockerManifestList(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	optionCalls := 0
+	countCalls := func(*ocischemav1.Index) error {
+		optionCalls++
+		return nil
+	}
+
+	descriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithDockerManifestList(), WithManifestOptions(countCalls))
+	assert.NilError(t, err)
+	assert.Equal(t, images.MediaTypeDockerSchema2ManifestList, descriptor.MediaType)
+	// No OCI index was attempted
+	assert.Equal(t, 3, len(pusher.pushedDescriptors))
+	assert.Equal(t, images.MediaTypeDockerSchema2ManifestList, pusher.pushedDescriptors[2].MediaType)
+	assert.Equal(t, 1, optionCalls)
+}
+
+func TestPushDockerManifestListMatchesConverter(t *testing.T) {
+	pusher := &mockPusher{}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	result, err := PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher},
+		WithDockerManifestList())
+	assert.NilError(t, err)
+
+	payload, descriptor, err := converter.ConvertBundleToDockerManifestList(tests.MakeTestBundle(), ref, result.ConfigManifest, tests.MakeRelocationMap())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, result.Index, descriptor)
+	assert.Equal(t, string(payload), pusher.buffers[len(pusher.buffers)-1].String())
+}
+
+func TestPushErrors(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	// The config blob is rejected
+	pusher := newMockPusher([]error{errdefs.ErrInvalidArgument})
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher}, false)
+	var pushErr *PushError
+	assert.Assert(t, errors.As(err, &pushErr))
+	assert.Equal(t, PushStageConfigBlob, pushErr.Stage)
+	assert.Equal(t, converter.CNABConfigMediaType, pushErr.Descriptor.MediaType)
+	assert.Check(t, errors.Is(err, errdefs.ErrInvalidArgument))
+	assert.ErrorContains(t, err, `error while pushing bundle config manifest of "my.registry/namespace/my-app:my-tag": failed to push config blob`)
+
+	// The index is rejected
+	pusher = newMockPusher([]error{nil, nil, errdefs.ErrInvalidArgument})
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher}, false)
+	assert.Assert(t, errors.As(err, &pushErr))
+	assert.Equal(t, PushStageIndex, pushErr.Stage)
+	assert.Equal(t, tests.BundleDigest, pushErr.Descriptor.Digest)
+	assert.Check(t, errors.Is(err, errdefs.ErrInvalidArgument))
+	assert.ErrorContains(t, err, `error while pushing bundle manifest "my.registry/namespace/my-app:my-tag": failed to push index `+tests.BundleDigest.String())
+}
+
+func TestPushErrorsNameTheReference(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	// The bundle cannot be converted to an index
+	b := tests.MakeTestBundle()
+	b.InvocationImages = append(b.InvocationImages, b.InvocationImages[0])
+	_, err = Push(context.Background(), b, tests.MakeRelocationMap(), ref, newMemoryRegistry(), false)
+	assert.ErrorContains(t, err, `failed to convert bundle "my.registry/namespace/my-app:my-tag": only one invocation image supported`)
+
+	// A manifest option fails
+	optionErr := errors.New("rejected by the option")
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, newMemoryRegistry(),
+		WithManifestOptions(func(*ocischemav1.Index) error { return optionErr }))
+	assert.ErrorContains(t, err, `failed to prepare bundle manifest "my.registry/namespace/my-app:my-tag"`)
+	assert.Check(t, errors.Is(err, optionErr))
+
+	// The index exceeds the manifest size limit
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, newMemoryRegistry(),
+		WithMaxManifestSize(1000))
+	assert.ErrorContains(t, err, `invalid bundle manifest "my.registry/namespace/my-app:my-tag"`)
+	var limitErr *converter.SizeLimitExceededError
+	assert.Check(t, errors.As(err, &limitErr))
+}
+
+func TestPushWithoutFallbacksNamesTheFallback(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	// The config blob is rejected
+	pusher := newMockPusher([]error{errdefs.ErrInvalidArgument})
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher}, false)
+	var fallbackErr *FallbackDisabledError
+	assert.Assert(t, errors.As(err, &fallbackErr))
+	assert.Equal(t, "a application/vnd.oci.image.config.v1+json config in a application/vnd.oci.image.manifest.v1+json manifest", fallbackErr.Fallback)
+	assert.ErrorContains(t, err, "fallbacks are disabled, the push would have been retried with a application/vnd.oci.image.config.v1+json config")
+	var pushErr *PushError
+	assert.Assert(t, errors.As(err, &pushErr))
+	assert.Equal(t, PushStageConfigBlob, pushErr.Stage)
+	assert.Equal(t, 1, len(pusher.pushedDescriptors))
+
+	// The index is rejected
+	pusher = newMockPusher([]error{nil, nil, errdefs.ErrInvalidArgument})
+	_, err = Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher}, false)
+	assert.Assert(t, errors.As(err, &fallbackErr))
+	assert.Equal(t, "a Docker manifest list", fallbackErr.Fallback)
+	assert.Assert(t, errors.As(err, &pushErr))
+	assert.Equal(t, PushStageIndex, pushErr.Stage)
+	assert.Equal(t, 3, len(pusher.pushedDescriptors))
+}
+
+func TestPushDryRun(t *testing.T) {
+	pusher := funcPusher(func(context.Context, ocischemav1.Descriptor) (content.Writer, error) {
+		return nil, errors.New("nothing should be pushed during a dry run")
+	})
+	resolver := &mockResolver{pusher: pusher}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	descriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithDryRun(), WithAllowFallbacks(true))
+	assert.NilError(t, err)
+	// Same descriptor as a real push
+	assert.Equal(t, tests.BundleDigest, descriptor.Digest)
+	assert.Equal(t, ocischemav1.MediaTypeImageIndex, descriptor.MediaType)
+	assert.Equal(t, 0, len(resolver.pushedReferences))
+}
+
+func TestPushWithPushParallelism(t *testing.T) {
+	manifests := []ocischemav1.Descriptor{{
+		MediaType: ocischemav1.MediaTypeImageManifest,
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0345",
+		Size:      506,
+		Platform:  &ocischemav1.Platform{OS: "linux", Architecture: "amd64"},
+	}}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	maxInFlight := func(parallelism int, wait time.Duration) int {
+		var mut sync.Mutex
+		started, inFlight, maxInFlight := 0, 0, 0
+		// The first two pushes wait for each other to start, for at most the wait duration
+		pusher := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+			mut.Lock()
+			started++
+			first := started <= 2
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mut.Unlock()
+			for deadline := time.Now().Add(wait); first && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+				mut.Lock()
+				concurrent := started > 1
+				mut.Unlock()
+				if concurrent {
+					break
+				}
+			}
+			mut.Lock()
+			inFlight--
+			mut.Unlock()
+			return &mockWriter{WriteCloser: nopWriteCloser{Buffer: &bytes.Buffer{}}}, nil
+		})
+		_, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher},
+			WithPushParallelism(parallelism), WithMultiArchInvocationImage(manifests...))
+		assert.NilError(t, err)
+		return maxInFlight
+	}
+
+	// The config blob and the invocation image index are pushed concurrently
+	assert.Equal(t, 2, maxInFlight(2, 10*time.Second))
+	// One at a time without parallelism
+	assert.Equal(t, 1, maxInFlight(1, 10*time.Millisecond))
+}
+
+func TestPushPayloadsConcurrently(t *testing.T) {
+	existing := ocischemav1.Descriptor{Digest: digest.FromString("existing"), Size: 8}
+	failing := ocischemav1.Descriptor{Digest: digest.FromString("failing"), Size: 7}
+	blocking := ocischemav1.Descriptor{Digest: digest.FromString("blocking"), Size: 8}
+	pusher := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+		switch d.Digest {
+		case existing.Digest:
+			return nil, errdefs.ErrAlreadyExists
+		case failing.Digest:
+			return nil, errors.New("push failed")
+		default:
+			// Only returns once another push failed
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	})
+	resolver := &mockResolver{pusher: pusher}
+	cfg, err := newPushConfig(WithPushParallelism(3))
+	assert.NilError(t, err)
+
+	// Already existing payloads are considered as pushed
+	err = pushPayloads(context.Background(), resolver, "my.registry/namespace/my-app", cfg, PushStageConfigBlob,
+		descriptorPayload{descriptor: existing, payload: []byte("existing")})
+	assert.NilError(t, err)
+
+	// The first failure cancels the other pushes
+	err = pushPayloads(context.Background(), resolver, "my.registry/namespace/my-app", cfg, PushStageConfigBlob,
+		descriptorPayload{descriptor: existing, payload: []byte("existing")},
+		descriptorPayload{descriptor: blocking, payload: []byte("blocking")},
+		descriptorPayload{descriptor: failing, payload: []byte("failing")})
+	assert.ErrorContains(t, err, "push failed")
+}
+
+func TestPushPayloadHonorsCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	payload := []byte("payload")
+	descriptor := ocischemav1.Descriptor{Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+	// The writer is slow enough for the caller to cancel while it writes
+	writer := &callbackWriter{
+		mockWriter: mockWriter{WriteCloser: nopWriteCloser{Buffer: &bytes.Buffer{}}},
+		onWrite:    func([]byte) { cancel() },
+	}
+	pusher := funcPusher(func(context.Context, ocischemav1.Descriptor) (content.Writer, error) {
+		return writer, nil
+	})
+	cfg, err := newPushConfig()
+	assert.NilError(t, err)
+
+	err = pushPayload(ctx, &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload)
+	assert.Check(t, errors.Is(err, context.Canceled))
+	assert.ErrorContains(t, err, "interrupted before commit")
+	assert.Check(t, !writer.committed)
+
+	// An already cancelled context does not write anything
+	writer = &callbackWriter{
+		mockWriter: mockWriter{WriteCloser: nopWriteCloser{Buffer: &bytes.Buffer{}}},
+		onWrite:    func([]byte) { t.Fatal("unexpected write") },
+	}
+	err = pushPayload(ctx, &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload)
+	assert.Check(t, errors.Is(err, context.Canceled))
+}
+
+type recordingProgressTracker struct {
+	events []string
+	mut    sync.Mutex
+}
+
+func (r *recordingProgressTracker) record(format string, args ...interface{}) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingProgressTracker) OnBlobStart(desc ocischemav1.Descriptor) {
+	r.record("start %s", desc.MediaType)
+}
+
+func (r *recordingProgressTracker) OnBlobProgress(desc ocischemav1.Descriptor, offset int64) {
+	r.record("progress %s %d/%d", desc.MediaType, offset, desc.Size)
+}
+
+func (r *recordingProgressTracker) OnBlobComplete(desc ocischemav1.Descriptor) {
+	r.record("complete %s", desc.MediaType)
+}
+
+func TestPushWithProgressTracker(t *testing.T) {
+	pusher := &mockPusher{}
+	resolver := &mockResolver{pusher: pusher}
+	tracker := &recordingProgressTracker{}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithProgressTracker(tracker))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tracker.events, []string{
+		"start application/vnd.cnab.config.v1+json",
+		"progress application/vnd.cnab.config.v1+json 1596/1596",
+		"complete application/vnd.cnab.config.v1+json",
+		"start application/vnd.oci.image.manifest.v1+json",
+		"progress application/vnd.oci.image.manifest.v1+json 189/189",
+		"complete application/vnd.oci.image.manifest.v1+json",
+		"start application/vnd.oci.image.index.v1+json",
+		"progress application/vnd.oci.image.index.v1+json 1360/1360",
+		"complete application/vnd.oci.image.index.v1+json",
+	})
+
+	// A nil tracker is a no-op
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver,
+		WithProgressTracker(nil))
+	assert.NilError(t, err)
+}
+
 func oneLiner(s string) string {
 	return strings.Replace(strings.Replace(s, " ", "", -1), "\n", "", -1)
 }
@@ -175,3 +1103,578 @@ func ExamplePush() {
 func createExampleBundle() *bundle.Bundle {
 	return tests.MakeTestBundle()
 }
+
+func TestPushWithDigestAlgorithm(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	registry := newMemoryRegistry()
+	result, err := PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithDigestAlgorithm(digest.SHA512))
+	assert.NilError(t, err)
+	assert.Equal(t, digest.SHA512, result.Index.Digest.Algorithm())
+	assert.Equal(t, digest.SHA512, result.ConfigManifest.Digest.Algorithm())
+	for dgst := range registry.content {
+		assert.Equal(t, digest.SHA512, dgst.Algorithm())
+	}
+	b, _, _, err := PullWithOptions(context.Background(), ref, registry, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithDigestAlgorithm("md5"))
+	assert.ErrorContains(t, err, `unsupported digest algorithm "md5"`)
+}
+
+func TestPushWithRejectedDigestAlgorithm(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	rejected := remoteserrors.ErrUnexpectedStatus{
+		Status:     "400 Bad Request",
+		StatusCode: http.StatusBadRequest,
+		Body:       []byte(`{"errors":[{"code":"DIGEST_INVALID","message":"provided digest did not match uploaded content"}]}`),
+	}
+	pusher := newMockPusher([]error{rejected})
+	resolver := &mockResolver{pusher: pusher}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, resolver, WithDigestAlgorithm(digest.SHA512))
+	var digestErr *UnsupportedDigestAlgorithmError
+	assert.Assert(t, errors.As(err, &digestErr), err)
+	assert.Equal(t, digest.SHA512, digestErr.Algorithm)
+	assert.ErrorContains(t, err, "registry rejected the sha512 digest")
+}
+
+func TestPushWithTracer(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	tracer := &recordingTracer{}
+	result, err := PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, newMemoryRegistry(), WithTracer(tracer))
+	assert.NilError(t, err)
+
+	var names []string
+	for _, span := range tracer.spans {
+		assert.Assert(t, span.ended, span.name)
+		assert.NilError(t, span.err, span.name)
+		names = append(names, span.parent+">"+span.name)
+	}
+	assert.DeepEqual(t, []string{
+		">" + SpanPush,
+		SpanPush + ">" + SpanPrepareConfig,
+		SpanPush + ">" + SpanPushConfigBlob,
+		SpanPush + ">" + SpanPushConfigManifest,
+		SpanPush + ">" + SpanPushIndex,
+	}, names)
+	assert.Equal(t, ref.String(), tracer.spans[0].attributes[TraceAttributeReference])
+	assert.Equal(t, result.Index.Digest.String(), tracer.spans[0].attributes[TraceAttributeDigest])
+	assert.Equal(t, result.ConfigManifest.Digest.String(), tracer.spans[3].attributes[TraceAttributeDigest])
+	assert.Equal(t, result.ConfigManifest.Size, tracer.spans[3].attributes[TraceAttributeSize])
+	assert.Equal(t, result.Index.Size, tracer.spans[4].attributes[TraceAttributeSize])
+}
+
+func TestPushWithTracerRecordsFailures(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	registry := newMemoryRegistry()
+	registry.pushErr = func(_ string, d ocischemav1.Descriptor) error {
+		if d.MediaType == ocischemav1.MediaTypeImageIndex {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	tracer := &recordingTracer{}
+	_, err = PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithTracer(tracer))
+	assert.ErrorContains(t, err, "rejected")
+
+	last := tracer.spans[len(tracer.spans)-1]
+	assert.Equal(t, SpanPushIndex, last.name)
+	assert.ErrorContains(t, last.err, "rejected")
+	assert.ErrorContains(t, tracer.spans[0].err, "rejected")
+}
+
+func TestPushBatch(t *testing.T) {
+	registry := newMemoryRegistry()
+	var mut sync.Mutex
+	configPushes := map[string][]string{}
+	configDigest, _, err := converter.BundleConfigDigest(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	registry.pushErr = func(ref string, d ocischemav1.Descriptor) error {
+		if d.Digest == configDigest {
+			mut.Lock()
+			defer mut.Unlock()
+			configPushes[ref] = append(configPushes[ref], d.Annotations["containerd.io/distribution.source.my.registry"])
+		}
+		return nil
+	}
+	makeItem := func(ref string) BundleWithRef {
+		named, err := reference.ParseNamed(ref)
+		assert.NilError(t, err)
+		relocationMap, err := relocateToRepository(tests.MakeRelocationMap(), named)
+		assert.NilError(t, err)
+		return BundleWithRef{Bundle: tests.MakeTestBundle(), RelocationMap: relocationMap, Ref: named}
+	}
+
+	results, err := PushBatch(context.Background(), []BundleWithRef{
+		makeItem("my.registry/namespace/my-app:v1"),
+		makeItem("my.registry/namespace/my-app:v2"),
+		makeItem("my.registry/namespace/other-app:v1"),
+	}, registry)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(results))
+	for _, result := range results {
+		assert.NilError(t, result.Err)
+		assert.Assert(t, result.Result != nil)
+	}
+	// The config blob is pushed once per repository, mounted from the first repository in the other one
+	assert.DeepEqual(t, map[string][]string{
+		"my.registry/namespace/my-app":    {""},
+		"my.registry/namespace/other-app": {"namespace/my-app"},
+	}, configPushes)
+	assert.Equal(t, results[0].Result.Index.Digest, registry.tags["my.registry/namespace/my-app:v2"])
+}
+
+func TestPushBatchMountsConfigBlobInTheSameRegistry(t *testing.T) {
+	registry := newUploadRegistry(t)
+	configDigest, _, err := converter.BundleConfigDigest(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	makeItem := func(ref string) BundleWithRef {
+		named, err := reference.ParseNamed(registry.host() + ref)
+		assert.NilError(t, err)
+		relocationMap, err := relocateToRepository(tests.MakeRelocationMap(), named)
+		assert.NilError(t, err)
+		return BundleWithRef{Bundle: tests.MakeTestBundle(), RelocationMap: relocationMap, Ref: named}
+	}
+
+	_, err = PushBatch(context.Background(), []BundleWithRef{
+		makeItem("/namespace/my-app:v1"),
+		makeItem("/namespace/my-app:v2"),
+		makeItem("/namespace/other-app:v1"),
+	}, registry.resolver(), WithAllowFallbacks(false))
+	assert.NilError(t, err)
+	// The config blob is uploaded once, then mounted from the first repository into the other one
+	assert.DeepEqual(t, []string{"namespace/my-app@" + configDigest.String()}, registry.uploads)
+	assert.DeepEqual(t, []mountRequest{{Repository: "namespace/other-app", From: "namespace/my-app", Digest: configDigest}}, registry.mounts)
+	assert.Assert(t, registry.hasBlob("namespace/other-app", configDigest))
+}
+
+func TestPushBatchContinuesOnError(t *testing.T) {
+	registry := newMemoryRegistry()
+	registry.pushErr = func(ref string, d ocischemav1.Descriptor) error {
+		if strings.HasPrefix(ref, "my.registry/namespace/broken") {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	var items []BundleWithRef
+	for _, ref := range []string{"my.registry/namespace/broken:v1", "my.registry/namespace/my-app:v1"} {
+		named, err := reference.ParseNamed(ref)
+		assert.NilError(t, err)
+		items = append(items, BundleWithRef{Bundle: tests.MakeTestBundle(), RelocationMap: tests.MakeRelocationMap(), Ref: named})
+	}
+
+	results, err := PushBatch(context.Background(), items, registry)
+	assert.ErrorContains(t, err, `failed to push "my.registry/namespace/broken:v1"`)
+	assert.ErrorContains(t, results[0].Err, "rejected")
+	assert.NilError(t, results[1].Err)
+	assert.Assert(t, results[1].Result != nil)
+}
+
+func TestPushWithDescriptorMutator(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	registry := newMemoryRegistry()
+	var mut sync.Mutex
+	var pushedAnnotations []string
+	registry.pushErr = func(_ string, d ocischemav1.Descriptor) error {
+		mut.Lock()
+		defer mut.Unlock()
+		pushedAnnotations = append(pushedAnnotations, d.Annotations["io.example.mutated"])
+		return nil
+	}
+	mutator := func(d *ocischemav1.Descriptor) error {
+		if d.Annotations[converter.CNABDescriptorTypeAnnotation] == converter.CNABDescriptorTypeInvocation {
+			d.URLs = append(d.URLs, "https://my.cdn/invocation")
+		}
+		if d.Annotations == nil {
+			d.Annotations = map[string]string{}
+		}
+		d.Annotations["io.example.mutated"] = "true"
+		return nil
+	}
+	result, err := PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithDescriptorMutator(mutator))
+	assert.NilError(t, err)
+
+	var ix ocischemav1.Index
+	assert.NilError(t, json.Unmarshal(registry.content[result.Index.Digest], &ix))
+	for _, d := range ix.Manifests {
+		assert.Equal(t, "true", d.Annotations["io.example.mutated"])
+		if d.Annotations[converter.CNABDescriptorTypeAnnotation] == converter.CNABDescriptorTypeInvocation {
+			assert.DeepEqual(t, []string{"https://my.cdn/invocation"}, d.URLs)
+		} else {
+			assert.Equal(t, 0, len(d.URLs))
+		}
+	}
+	// The config blob, the config manifest and the index are pushed with the mutated descriptors
+	assert.DeepEqual(t, []string{"true", "true", "true"}, pushedAnnotations)
+}
+
+func TestPushWithDescriptorMutatorChangingTheDigest(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	mutator := func(d *ocischemav1.Descriptor) error {
+		d.Size++
+		return nil
+	}
+	_, err = PushWithResult(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, newMemoryRegistry(), WithDescriptorMutator(mutator))
+	assert.ErrorContains(t, err, "descriptor mutator changed the digest, size or media type of descriptor")
+}
+
+func TestPushWithIndexLimits(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	b := tests.MakeTestBundle()
+	relocationMap := tests.MakeRelocationMap()
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("image-%d", i+2)
+		image := b.Images["image-1"]
+		image.Image = "my.registry/namespace/" + name
+		b.Images[name] = image
+		relocationMap[image.Image] = relocationMap["my.registry/namespace/image-1"]
+	}
+	registry := newMemoryRegistry()
+
+	_, err = PushWithResult(context.Background(), b, relocationMap, ref, registry, WithIndexLimits(10, 0))
+	var limitErr *IndexLimitExceededError
+	assert.Assert(t, errors.As(err, &limitErr), err)
+	assert.Equal(t, 24, limitErr.Manifests)
+	assert.Equal(t, int64(0), limitErr.Size)
+	assert.ErrorContains(t, err, "has 24 manifest entries, more than the limit of 10")
+	_, ok := registry.tags[ref.String()]
+	assert.Assert(t, !ok, "the index must not be pushed")
+
+	_, err = PushWithResult(context.Background(), b, relocationMap, ref, registry, WithIndexLimits(0, 1024), WithDockerManifestList())
+	assert.Assert(t, errors.As(err, &limitErr), err)
+	assert.Assert(t, limitErr.Size > 1024)
+	_, ok = registry.tags[ref.String()]
+	assert.Assert(t, !ok, "the index must not be pushed")
+
+	// The default limits are generous
+	_, err = PushWithResult(context.Background(), b, relocationMap, ref, registry)
+	assert.NilError(t, err)
+}
+
+func TestPushWithArtifactManifest(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithArtifactManifest())
+	assert.NilError(t, err)
+
+	var config converter.PreparedBundleConfig
+	b, _, _, err := PullWithOptions(context.Background(), ref, registry, WithPulledBundleConfig(&config), WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+	var manifest map[string]interface{}
+	assert.NilError(t, json.Unmarshal(config.Manifest, &manifest))
+	assert.Equal(t, converter.CNABConfigMediaType, manifest["artifactType"])
+	// The empty config is pushed along with the bundle config
+	assert.Equal(t, "{}", string(registry.content[config.EmptyConfigBlobDescriptor.Digest]))
+	assert.Equal(t, "{}", string(config.EmptyConfigBlob))
+
+	// Registries rejecting it get the usual config manifest
+	registry = newMemoryRegistry()
+	registry.pushErr = func(_ string, d ocischemav1.Descriptor) error {
+		if d.MediaType == converter.EmptyJSONMediaType {
+			return errors.New("unsupported media type")
+		}
+		return nil
+	}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithArtifactManifest(), WithAllowFallbacks(true))
+	assert.NilError(t, err)
+	b, _, _, err = PullWithOptions(context.Background(), ref, registry, WithPulledBundleConfig(&config), WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+	assert.Assert(t, config.EmptyConfigBlob == nil)
+}
+
+func TestPushBundleWithForeignImage(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	b := tests.MakeTestBundle()
+	relocationMap := relocation.ImageRelocationMap{}
+	var imagesSize int64
+	setImage := func(i int, image *bundle.BaseImage) {
+		imageConfig := registry.content.add([]byte(fmt.Sprintf(`{"image":%d}`, i)), ocischemav1.MediaTypeImageConfig)
+		layer := registry.content.add([]byte(fmt.Sprintf("layer %d", i)), ocischemav1.MediaTypeImageLayerGzip)
+		manifest := ocischemav1.Manifest{Config: imageConfig, Layers: []ocischemav1.Descriptor{layer}}
+		manifest.SchemaVersion = 2
+		payload, err := json.Marshal(manifest)
+		assert.NilError(t, err)
+		d := registry.content.add(payload, ocischemav1.MediaTypeImageManifest)
+		registry.descriptors[d.Digest] = d
+		image.MediaType, image.Digest, image.Size = d.MediaType, d.Digest.String(), uint64(d.Size)
+		relocationMap[image.Image] = "my.registry/namespace/my-app@" + d.Digest.String()
+		imagesSize += d.Size + imageConfig.Size + layer.Size
+	}
+	setImage(0, &b.InvocationImages[0].BaseImage)
+	image := b.Images["image-1"]
+	setImage(1, &image.BaseImage)
+	b.Images["image-1"] = image
+	// another-image is hosted at a URL, neither in the registry nor in the relocation map
+	foreign := b.Images["another-image"]
+	foreign.Image = "https://cdn.example.com/images/another-image/manifest.json"
+	b.Images["another-image"] = foreign
+
+	result, err := PushWithResult(context.Background(), b, relocationMap, ref, registry,
+		WithStrictValidation(), WithTotalSize(), WithCheckReferencedImages())
+	assert.NilError(t, err)
+	// The foreign image is not stored in the registry, so it is not counted
+	index, _, err := getIndex(context.Background(), ref, registry)
+	assert.NilError(t, err)
+	configManifest, _, err := getConfigManifest(context.Background(), ref, ref, registry, index.Manifests[0])
+	assert.NilError(t, err)
+	assert.Equal(t, imagesSize+index.Manifests[0].Size+configManifest.Config.Size, result.TotalSize)
+
+	statuses, err := CheckBundleImages(context.Background(), b, relocationMap, registry, WithStrictImageCheck())
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(statuses))
+}
+
+func TestPushWithTotalSize(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	// The images share a layer
+	b := tests.MakeTestBundle()
+	relocationMap := relocation.ImageRelocationMap{}
+	shared := registry.content.add([]byte("shared layer"), ocischemav1.MediaTypeImageLayerGzip)
+	var imagesSize int64
+	setImage := func(i int, image *bundle.BaseImage) {
+		imageConfig := registry.content.add([]byte(fmt.Sprintf(`{"image":%d}`, i)), ocischemav1.MediaTypeImageConfig)
+		layer := registry.content.add([]byte(fmt.Sprintf("layer %d", i)), ocischemav1.MediaTypeImageLayerGzip)
+		manifest := ocischemav1.Manifest{Config: imageConfig, Layers: []ocischemav1.Descriptor{shared, layer}}
+		manifest.SchemaVersion = 2
+		payload, err := json.Marshal(manifest)
+		assert.NilError(t, err)
+		d := registry.content.add(payload, ocischemav1.MediaTypeImageManifest)
+		image.MediaType, image.Digest, image.Size = d.MediaType, d.Digest.String(), uint64(d.Size)
+		relocationMap[image.Image] = "my.registry/namespace/my-app@" + d.Digest.String()
+		imagesSize += d.Size + imageConfig.Size + layer.Size
+	}
+	setImage(0, &b.InvocationImages[0].BaseImage)
+	for i, name := range []string{"another-image", "image-1"} {
+		image := b.Images[name]
+		setImage(i+1, &image.BaseImage)
+		b.Images[name] = image
+	}
+	imagesSize += shared.Size
+
+	result, err := PushWithResult(context.Background(), b, relocationMap, ref, registry, WithTotalSize())
+	assert.NilError(t, err)
+	index, _, err := getIndex(context.Background(), ref, registry)
+	assert.NilError(t, err)
+	configManifest, _, err := getConfigManifest(context.Background(), ref, ref, registry, index.Manifests[0])
+	assert.NilError(t, err)
+	expected := imagesSize + index.Manifests[0].Size + configManifest.Config.Size
+	assert.Equal(t, expected, result.TotalSize)
+	assert.Equal(t, fmt.Sprint(expected), index.Annotations[converter.CNABTotalSizeAnnotation])
+	size, err := converter.GetBundleTotalSize(index)
+	assert.NilError(t, err)
+	assert.Equal(t, expected, size)
+
+	// The size is only computed on demand
+	result, err = PushWithResult(context.Background(), b, relocationMap, ref, registry)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(0), result.TotalSize)
+	index, _, err = getIndex(context.Background(), ref, registry)
+	assert.NilError(t, err)
+	_, ok := index.Annotations[converter.CNABTotalSizeAnnotation]
+	assert.Assert(t, !ok)
+}
+
+func TestPushWithIndexMarshaler(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	annotations := WithAnnotations(map[string]string{"io.cnab.description": "<build> & <push>"})
+
+	pushed, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithManifestOptions(annotations), WithIndexMarshaler(converter.CanonicalJSONMarshal))
+	assert.NilError(t, err)
+	payload := registry.content[pushed.Digest]
+	canonical, err := converter.CanonicalJSONMarshal(json.RawMessage(payload))
+	assert.NilError(t, err)
+	assert.Equal(t, string(canonical), string(payload))
+
+	// The digest is reproducible, and differs from the default marshaling
+	again, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithManifestOptions(annotations), WithIndexMarshaler(converter.CanonicalJSONMarshal))
+	assert.NilError(t, err)
+	assert.Equal(t, pushed.Digest, again.Digest)
+	plain, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry,
+		WithManifestOptions(annotations))
+	assert.NilError(t, err)
+	assert.Assert(t, plain.Digest != pushed.Digest)
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithIndexMarshaler(nil))
+	assert.ErrorContains(t, err, "the index marshaler must not be nil")
+}
+
+func TestPushWithDirectConfigBlob(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	var pushed []ocischemav1.Descriptor
+	registry.pushErr = func(_ string, d ocischemav1.Descriptor) error {
+		pushed = append(pushed, d)
+		return nil
+	}
+
+	indexDescriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithDirectConfigBlob())
+	assert.NilError(t, err)
+
+	// Only the config blob and the index are pushed, the index referencing the blob
+	bundleConfig, err := converter.PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(pushed))
+	assert.Equal(t, bundleConfig.ConfigBlobDescriptor.Digest, pushed[0].Digest)
+	assert.Equal(t, indexDescriptor.Digest, pushed[1].Digest)
+	index, _, err := getIndex(context.Background(), ref, registry)
+	assert.NilError(t, err)
+	configDescriptor, err := converter.GetBundleConfigManifestDescriptor(&index)
+	assert.NilError(t, err)
+	assert.Equal(t, bundleConfig.ConfigBlobDescriptor.MediaType, configDescriptor.MediaType)
+	assert.Assert(t, converter.IsBundleConfigBlob(configDescriptor))
+
+	// The bundle is pulled and inspected like any other
+	b, relocationMap, _, err := PullWithOptions(context.Background(), ref, registry, WithoutBundleValidation())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tests.MakeTestBundle(), b)
+	assert.DeepEqual(t, tests.MakeRelocationMap(), relocationMap)
+	info, err := Inspect(context.Background(), ref, registry)
+	assert.NilError(t, err)
+	assert.Equal(t, indexDescriptor.Size+sumSizes(index.Manifests), info.TotalSize)
+
+	// The config must be a blob the index references unchanged
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithDirectConfigBlob(), WithArtifactManifest())
+	assert.ErrorContains(t, err, "cannot be pushed as a direct config blob")
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithDirectConfigBlob(),
+		WithManifestOptions(func(ix *ocischemav1.Index) error {
+			ix.Manifests[0].Size++
+			return nil
+		}))
+	assert.ErrorContains(t, err, "does not reference the pushed config blob")
+}
+
+func sumSizes(descriptors []ocischemav1.Descriptor) int64 {
+	var size int64
+	for _, d := range descriptors {
+		size += d.Size
+	}
+	return size
+}
+
+func TestPushWithAuditCallback(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	var events []AuditEvent
+	audit := WithAuditCallback(func(event AuditEvent) {
+		events = append(events, event)
+	})
+
+	before := time.Now()
+	indexDescriptor, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, audit)
+	assert.NilError(t, err)
+	bundleConfig, err := converter.PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "my.registry/namespace/my-app", events[0].Reference)
+	assert.DeepEqual(t, bundleConfig.ConfigBlobDescriptor, events[0].Descriptor)
+	assert.Equal(t, "my.registry/namespace/my-app", events[1].Reference)
+	assert.DeepEqual(t, bundleConfig.ManifestDescriptor, events[1].Descriptor)
+	assert.Equal(t, "my.registry/namespace/my-app:my-tag", events[2].Reference)
+	assert.DeepEqual(t, indexDescriptor, events[2].Descriptor)
+	for _, event := range events {
+		assert.Assert(t, !event.Time.Before(before.Truncate(time.Second)))
+		assert.Equal(t, time.UTC, event.Time.Location())
+	}
+
+	// Nothing is reported without commit
+	events = nil
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, audit, WithDryRun())
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(events))
+
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, WithAuditCallback(nil))
+	assert.ErrorContains(t, err, "the audit callback must not be nil")
+}
+
+// alreadyPresentWriter is a content.Writer finding the payload already present when writing it, or when committing it
+type alreadyPresentWriter struct {
+	mockWriter
+	onCommit bool
+}
+
+func (w alreadyPresentWriter) Write(p []byte) (int, error) {
+	if w.onCommit {
+		return len(p), nil
+	}
+	return 0, errdefs.ErrAlreadyExists
+}
+
+func (w alreadyPresentWriter) Commit(context.Context, int64, digest.Digest, ...content.Opt) error {
+	return errdefs.ErrAlreadyExists
+}
+
+func TestPushWithAuditCallbackSkipsExistingPayloads(t *testing.T) {
+	var events []AuditEvent
+	cfg, err := newPushConfig(WithAuditCallback(func(event AuditEvent) {
+		events = append(events, event)
+	}))
+	assert.NilError(t, err)
+	payload := []byte("payload")
+	descriptor := ocischemav1.Descriptor{Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+	// Found already present when starting the push, when writing it, and when committing it
+	for _, pusher := range []funcPusher{
+		func(context.Context, ocischemav1.Descriptor) (content.Writer, error) {
+			return nil, errdefs.ErrAlreadyExists
+		},
+		func(context.Context, ocischemav1.Descriptor) (content.Writer, error) {
+			return alreadyPresentWriter{mockWriter: mockWriter{WriteCloser: nopWriteCloser{Buffer: &bytes.Buffer{}}}}, nil
+		},
+		func(context.Context, ocischemav1.Descriptor) (content.Writer, error) {
+			return alreadyPresentWriter{mockWriter: mockWriter{WriteCloser: nopWriteCloser{Buffer: &bytes.Buffer{}}}, onCommit: true}, nil
+		},
+	} {
+		err := pushPayload(context.Background(), &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload)
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, 0, len(events))
+}
+
+func TestPushRequiresTagOrDigest(t *testing.T) {
+	bare, err := reference.ParseNamed("my.registry/namespace/my-app")
+	assert.NilError(t, err)
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), bare, newMemoryRegistry())
+	var missingTagErr *MissingTagError
+	assert.Assert(t, errors.As(err, &missingTagErr))
+	assert.Equal(t, "my.registry/namespace/my-app", missingTagErr.Reference)
+	assert.ErrorContains(t, err, `reference "my.registry/namespace/my-app" has neither a tag nor a digest`)
+
+	// The latest tag is only used on demand
+	registry := newMemoryRegistry()
+	pushed, err := PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), bare, registry, WithDefaultLatestTag())
+	assert.NilError(t, err)
+	assert.Equal(t, pushed.Digest, registry.tags["my.registry/namespace/my-app:latest"])
+
+	tagged, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), tagged, registry)
+	assert.NilError(t, err)
+	assert.Equal(t, pushed.Digest, registry.tags["my.registry/namespace/my-app:my-tag"])
+
+	digested, err := reference.ParseNamed("my.registry/namespace/my-app@" + pushed.Digest.String())
+	assert.NilError(t, err)
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), digested, registry)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(registry.tags))
+}
@@ -0,0 +1,543 @@
+package remotes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pushConfig defines the input required for a Push operation
+type pushConfig struct {
+	allowFallbacks      bool
+	manifestOptions     []ManifestOption
+	maxConcurrentJobs   int
+	progressTracker     ProgressTracker
+	retryPolicy         RetryPolicy
+	dryRun              bool
+	manifestList        bool
+	prepareOptions      []converter.PrepareOption
+	mountSource         reference.Named
+	strictValidation    bool
+	convertOptions      []converter.ConvertOption
+	maxManifestSize     int64
+	blobCache           BlobCache
+	rateLimiter         *RateLimiter
+	chunkSize           int
+	indexWriter         io.Writer
+	verifyAfterPush     bool
+	checkImages         bool
+	skipIfUnchanged     bool
+	artifactType        string
+	digestAlgorithm     digest.Algorithm
+	tracer              Tracer
+	metrics             MetricsCollector
+	mutators            []DescriptorMutator
+	maxIndexManifests   int
+	maxIndexSize        int64
+	normalizer          ReferenceNormalizer
+	defaultLatestTag    bool
+	invocationImages    []ocischemav1.Descriptor
+	credentialRefresher CredentialRefresher
+	totalSize           bool
+	indexMarshalOptions []converter.MarshalOption
+	directConfigBlob    bool
+	audit               AuditFunc
+}
+
+// PushOption is a helper for configuring a Push
+type PushOption func(*pushConfig) error
+
+func newPushConfig(options ...PushOption) (pushConfig, error) {
+	cfg := pushConfig{
+		maxConcurrentJobs: runtime.GOMAXPROCS(0),
+		progressTracker:   noopProgressTracker{},
+		retryPolicy:       noRetryPolicy,
+		digestAlgorithm:   digest.Canonical,
+		tracer:            noopTracer{},
+		metrics:           noopMetrics{},
+		maxIndexManifests: DefaultMaxIndexManifests,
+		maxIndexSize:      DefaultMaxIndexSize,
+	}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return pushConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// WithAllowFallbacks enables automatic compatibility fallbacks for registries without support for custom media type,
+// or OCI manifests. When fallbacks are disabled, a payload rejected in the preferred format fails the push right away
+// with a FallbackDisabledError naming the fallback format which would have been tried.
+func WithAllowFallbacks(allowFallbacks bool) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.allowFallbacks = allowFallbacks
+		return nil
+	}
+}
+
+// WithManifestOptions specifies callbacks used to customize the index manifest before pushing it
+func WithManifestOptions(options ...ManifestOption) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.manifestOptions = append(cfg.manifestOptions, options...)
+		return nil
+	}
+}
+
+// WithPushParallelism changes the max number of payloads pushed concurrently: the bundle config blob, along with the
+// empty config blob of an artifact manifest, and the invocation image index of WithMultiArchInvocationImage. Payloads
+// depending on each other (the config manifest after its blobs, the index manifest always last) are still pushed in
+// order.
+// A value lower or equal to zero keeps the default, bounded by GOMAXPROCS.
+func WithPushParallelism(maxConcurrentJobs int) PushOption {
+	return func(cfg *pushConfig) error {
+		if maxConcurrentJobs > 0 {
+			cfg.maxConcurrentJobs = maxConcurrentJobs
+		}
+		return nil
+	}
+}
+
+// WithProgressTracker specifies a tracker notified of the progress of each pushed payload.
+// A nil tracker is ignored.
+func WithProgressTracker(tracker ProgressTracker) PushOption {
+	return func(cfg *pushConfig) error {
+		if tracker != nil {
+			cfg.progressTracker = tracker
+		}
+		return nil
+	}
+}
+
+// WithTracer specifies a tracer creating a span around the push and each of its stages: the preparation of the config,
+// the push of the config blob, of the config manifest and of the index. A nil tracer is ignored.
+func WithTracer(tracer Tracer) PushOption {
+	return func(cfg *pushConfig) error {
+		if tracer != nil {
+			cfg.tracer = tracer
+		}
+		return nil
+	}
+}
+
+// WithMetrics specifies a collector recording the duration of the push and of each of its stages, the retries of its
+// payloads, and the pushes in flight. A nil collector is ignored.
+func WithMetrics(collector MetricsCollector) PushOption {
+	return func(cfg *pushConfig) error {
+		if collector != nil {
+			cfg.metrics = collector
+		}
+		return nil
+	}
+}
+
+// DescriptorMutator modifies a descriptor right before it is pushed, or referenced by the index. It may change the
+// annotations, the URLs and the platform of the descriptor, but not its digest, size or media type.
+type DescriptorMutator func(*ocischemav1.Descriptor) error
+
+// WithDescriptorMutator applies the mutator to each descriptor referenced by the index, like the invocation and
+// component images, and to each pushed payload descriptor, for instance to add the URLs of non-distributable
+// content. The push fails if the mutator changes the digest, the size or the media type of a descriptor.
+func WithDescriptorMutator(mutator DescriptorMutator) PushOption {
+	return func(cfg *pushConfig) error {
+		if mutator == nil {
+			return errors.New("descriptor mutator cannot be nil")
+		}
+		cfg.mutators = append(cfg.mutators, mutator)
+		return nil
+	}
+}
+
+// WithMultiArchInvocationImage pushes the per-architecture manifests of the invocation image, already in the target
+// repository like after a FixupBundle of each architecture, nested in an index referenced by the bundle index instead
+// of the relocated invocation image, so the bundle runs on each of the architectures. Pull returns the manifests with
+// WithPulledInvocationImageManifests. See converter.MakeInvocationImageIndex.
+func WithMultiArchInvocationImage(manifests ...ocischemav1.Descriptor) PushOption {
+	return func(cfg *pushConfig) error {
+		if len(manifests) == 0 {
+			return errors.New("a multi-architecture invocation image requires at least one architecture")
+		}
+		cfg.invocationImages = append([]ocischemav1.Descriptor(nil), manifests...)
+		return nil
+	}
+}
+
+// ReferenceNormalizer rewrites the reference a bundle is pushed to, like to enforce a naming policy
+type ReferenceNormalizer func(reference.Named) (reference.Named, error)
+
+// WithReferenceNormalizer applies the normalizer once to the reference given to the push, before pushing anything.
+// The normalized reference is used for the bundle config, the index and the returned relocation map. If it is in
+// another repository, the digested images of the relocation map are moved to it, like with MultiPush.
+func WithReferenceNormalizer(normalizer ReferenceNormalizer) PushOption {
+	return func(cfg *pushConfig) error {
+		if normalizer == nil {
+			return errors.New("reference normalizer cannot be nil")
+		}
+		cfg.normalizer = normalizer
+		return nil
+	}
+}
+
+// WithDefaultLatestTag pushes the bundle under the "latest" tag when the reference has neither a tag nor a digest,
+// like a bare repository name, instead of failing the push with a MissingTagError
+func WithDefaultLatestTag() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.defaultLatestTag = true
+		return nil
+	}
+}
+
+// mutateDescriptor returns the descriptor modified by the mutators, checking they did not change its identity
+func (cfg pushConfig) mutateDescriptor(desc ocischemav1.Descriptor) (ocischemav1.Descriptor, error) {
+	if len(cfg.mutators) == 0 {
+		return desc, nil
+	}
+	mutated := desc
+	// The mutators must not modify the maps and slices shared with the original descriptor
+	if desc.Annotations != nil {
+		mutated.Annotations = make(map[string]string, len(desc.Annotations))
+		for k, v := range desc.Annotations {
+			mutated.Annotations[k] = v
+		}
+	}
+	mutated.URLs = append([]string(nil), desc.URLs...)
+	if desc.Platform != nil {
+		platform := *desc.Platform
+		platform.OSFeatures = append([]string(nil), desc.Platform.OSFeatures...)
+		mutated.Platform = &platform
+	}
+	for _, mutator := range cfg.mutators {
+		if err := mutator(&mutated); err != nil {
+			return ocischemav1.Descriptor{}, fmt.Errorf("failed to mutate descriptor %s: %w", desc.Digest, err)
+		}
+	}
+	if mutated.Digest != desc.Digest || mutated.Size != desc.Size || mutated.MediaType != desc.MediaType {
+		return ocischemav1.Descriptor{}, fmt.Errorf("descriptor mutator changed the digest, size or media type of descriptor %s", desc.Digest)
+	}
+	return mutated, nil
+}
+
+// WithAuditCallback calls audit after each successful commit of a pushed payload, the config blob, the config
+// manifest and the index, with the reference, the descriptor and the time of the commit, for an append-only record of
+// what was pushed where. Unlike the progress tracker, it is only called once the registry durably stored the payload:
+// payloads found already present, when starting the push, writing or committing it, skipped by the blob cache or by a
+// dry run are not reported. Payloads are pushed concurrently, so audit must be safe for concurrent use.
+func WithAuditCallback(audit AuditFunc) PushOption {
+	return func(cfg *pushConfig) error {
+		if audit == nil {
+			return errors.New("the audit callback must not be nil")
+		}
+		cfg.audit = audit
+		return nil
+	}
+}
+
+// WithDirectConfigBlob only pushes the bundle config blob, referenced directly by the index instead of through a
+// config manifest, for one object less in the registry. Pull and Inspect read such bundles, but older versions do not,
+// and the registry must accept an index referencing a blob. The config is pushed in its first format, without
+// fallback, and the push fails if the bundle config is prepared as an artifact manifest, or if the manifest options or
+// the descriptor mutator change the config descriptor of the index.
+func WithDirectConfigBlob() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.directConfigBlob = true
+		return nil
+	}
+}
+
+// WithIndexMarshaler marshals the bundle index with marshal instead of json.Marshal, like
+// converter.CanonicalJSONMarshal for an index digest reproducible and verifiable by the signing tools canonicalizing
+// the payload
+func WithIndexMarshaler(marshal converter.JSONMarshaler) PushOption {
+	return func(cfg *pushConfig) error {
+		if marshal == nil {
+			return errors.New("the index marshaler must not be nil")
+		}
+		cfg.indexMarshalOptions = []converter.MarshalOption{converter.WithJSONMarshaler(marshal)}
+		return nil
+	}
+}
+
+// WithTotalSize computes the total size of the content referenced by the index, the bundle config and every image
+// manifest with its config and layers, each blob shared by several images counted once, and sets it as the
+// converter.CNABTotalSizeAnnotation of the index and in PushResult.TotalSize. The image manifests are fetched from the
+// target repository to read the sizes of their layers, so this costs a request for each of them.
+func WithTotalSize() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.totalSize = true
+		return nil
+	}
+}
+
+// WithCredentialRefresher calls refresher when the registry rejects the credentials in the middle of a push, with a
+// 401 or 403 response, like when a short-lived token expires during the push of a large bundle, then pushes the
+// rejected payload again once. This is independent of WithRetryPolicy: a refresh does not count as an attempt, and a
+// payload still rejected after the refresh fails the push.
+func WithCredentialRefresher(refresher CredentialRefresher) PushOption {
+	return func(cfg *pushConfig) error {
+		if refresher == nil {
+			return errors.New("credential refresher cannot be nil")
+		}
+		cfg.credentialRefresher = refresher
+		return nil
+	}
+}
+
+// WithRetryPolicy retries each payload push failing with a transient error (network timeouts, connection resets, 429
+// and 5xx registry responses), waiting for an exponential backoff delay with jitter between attempts.
+// Payloads already existing in the registry are never retried.
+func WithRetryPolicy(policy RetryPolicy) PushOption {
+	return func(cfg *pushConfig) error {
+		if policy.MaxAttempts < 1 {
+			return errors.New("invalid retry policy: max attempts must be at least 1")
+		}
+		if policy.BaseDelay < 0 || policy.MaxDelay < 0 {
+			return errors.New("invalid retry policy: delays cannot be negative")
+		}
+		cfg.retryPolicy = policy
+		return nil
+	}
+}
+
+// WithDryRun computes the descriptors of the bundle config and of the index without pushing anything to the
+// registry. The returned descriptors are the ones a real push would commit.
+func WithDryRun() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.dryRun = true
+		return nil
+	}
+}
+
+// WithDockerManifestList pushes the index as a Docker manifest list right away, instead of trying an OCI index first.
+// This avoids a round-trip bound to fail on registries rejecting the OCI index media type.
+func WithDockerManifestList() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.manifestList = true
+		return nil
+	}
+}
+
+// WithPrepareOptions specifies options used to prepare the bundle config before pushing it, like a custom config
+// media type
+func WithPrepareOptions(options ...converter.PrepareOption) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.prepareOptions = append(cfg.prepareOptions, options...)
+		return nil
+	}
+}
+
+// WithCrossRepositoryMount hints the pusher that the pushed blobs, like the bundle config, may already be present in
+// the source repository, so registries supporting it can mount them instead of uploading them again, like when
+// promoting a bundle between two repositories of the same registry. Blobs are uploaded normally when the mount is not
+// possible, and manifests are always pushed. A nil source is ignored.
+// The image layers are not pushed by Push: FixupBundle mounts them from the repositories of the relocation map, and
+// Copy from the source repository.
+func WithCrossRepositoryMount(source reference.Named) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.mountSource = source
+		return nil
+	}
+}
+
+// WithStrictValidation validates all the images of the bundle before pushing anything, reporting every invalid image
+// reference or media type at once instead of failing after the bundle config has been pushed. The generated index is
+// also validated with converter.ValidateOCIIndex before being pushed.
+func WithStrictValidation() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.strictValidation = true
+		return nil
+	}
+}
+
+// WithConvertOptions specifies options used to convert the bundle to an index, like an image reference transform
+func WithConvertOptions(options ...converter.ConvertOption) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.convertOptions = append(cfg.convertOptions, options...)
+		return nil
+	}
+}
+
+// WithMaxManifestSize fails the push with a converter.SizeLimitExceededError before uploading the config manifest or
+// the index if they are larger than the given size, for registries limiting the manifest size. Zero means no limit.
+func WithMaxManifestSize(size int64) PushOption {
+	return func(cfg *pushConfig) error {
+		if size < 0 {
+			return errors.New("max manifest size cannot be negative")
+		}
+		cfg.maxManifestSize = size
+		cfg.prepareOptions = append(cfg.prepareOptions, converter.WithMaxManifestSize(size))
+		return nil
+	}
+}
+
+const (
+	// DefaultMaxIndexManifests is the default maximum number of manifest entries of a pushed index
+	DefaultMaxIndexManifests = 10000
+	// DefaultMaxIndexSize is the default maximum marshaled size of a pushed index, in bytes
+	DefaultMaxIndexSize = 32 << 20
+)
+
+// WithIndexLimits fails the push with an IndexLimitExceededError before pushing the index if it has more than
+// maxManifests manifest entries, checked before marshaling it, or if it is larger than maxSize once marshaled. This
+// guards services pushing untrusted bundles against runaway indexes. Zero means no limit. The limits default to
+// DefaultMaxIndexManifests and DefaultMaxIndexSize.
+func WithIndexLimits(maxManifests int, maxSize int64) PushOption {
+	return func(cfg *pushConfig) error {
+		if maxManifests < 0 || maxSize < 0 {
+			return errors.New("index limits cannot be negative")
+		}
+		cfg.maxIndexManifests = maxManifests
+		cfg.maxIndexSize = maxSize
+		return nil
+	}
+}
+
+// WithForce commits the index even if some component images are missing from the relocation map, like after a
+// FixupBundle with WithContinueOnError reporting failed images. The missing images are left out of the index and
+// reported in PushResult.SkippedImages. Without it, the push fails before committing the index.
+func WithForce() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.convertOptions = append(cfg.convertOptions, converter.WithSkipMissingImages())
+		return nil
+	}
+}
+
+// WithImageNameAnnotations annotates each image descriptor of the index with the bundle image name it was relocated
+// from, so Pull reads the relocation map back from the index. See converter.WithImageNameAnnotations.
+func WithImageNameAnnotations() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.convertOptions = append(cfg.convertOptions, converter.WithImageNameAnnotations())
+		return nil
+	}
+}
+
+// WithBlobCache skips pushing the content the cache knows to already exist in the target repository, and records the
+// pushed content in the cache. The index is always pushed, as its tag must be updated.
+// A nil cache is ignored.
+func WithBlobCache(cache BlobCache) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.blobCache = cache
+		return nil
+	}
+}
+
+// WithRateLimiter throttles the payload pushes to each registry host with the given limiter, which can be shared by
+// multiple pushes to keep them all under the registry limits.
+// A nil limiter is ignored.
+func WithRateLimiter(limiter *RateLimiter) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.rateLimiter = limiter
+		return nil
+	}
+}
+
+// WithChunkSize writes the payloads larger than size in chunks of size bytes, instead of a single write, for
+// registries requiring chunked uploads of large blobs. Smaller payloads are still written at once.
+// A value lower or equal to zero keeps the single write.
+func WithChunkSize(size int) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.chunkSize = size
+		return nil
+	}
+}
+
+// WithBundlePackaging sets the converter.CNABPackagingAnnotation of the index to converter.CNABPackagingThin or
+// converter.CNABPackagingThick, so consumers know whether the bundle images are exported alongside it without pulling
+// it. Without it, the index has no packaging annotation.
+func WithBundlePackaging(packaging string) PushOption {
+	return func(cfg *pushConfig) error {
+		if packaging != converter.CNABPackagingThin && packaging != converter.CNABPackagingThick {
+			return fmt.Errorf("unsupported bundle packaging %q, expected %q or %q", packaging, converter.CNABPackagingThin, converter.CNABPackagingThick)
+		}
+		cfg.manifestOptions = append(cfg.manifestOptions, WithAnnotations(map[string]string{
+			converter.CNABPackagingAnnotation: packaging,
+		}))
+		return nil
+	}
+}
+
+// WithIndexWriter writes the exact index payload committed to the registry to the given writer once it is pushed, so
+// its digest matches the returned descriptor, for signing or archiving it without marshaling it again. With
+// fallbacks, the payload is the one of the format finally pushed. A nil writer is ignored.
+func WithIndexWriter(w io.Writer) PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.indexWriter = w
+		return nil
+	}
+}
+
+// WithVerifyAfterPush resolves the pushed reference once the index is committed, failing with a
+// DigestMismatchAfterPushError if the registry does not return the digest of the pushed index, which would break
+// digest-pinned deployments. This costs an extra round trip, and is skipped with WithDryRun.
+func WithVerifyAfterPush() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.verifyAfterPush = true
+		return nil
+	}
+}
+
+// WithCheckReferencedImages resolves each image referenced by the index in the target repository before pushing the
+// index, failing with a MissingReferencedImagesError listing the missing ones, instead of a "manifest unknown" error
+// at deploy time. It costs a request per image, and can be left out when the images were just pushed.
+func WithCheckReferencedImages() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.checkImages = true
+		return nil
+	}
+}
+
+// WithSkipIfUnchanged computes the index the push would commit, and skips the push when the reference already points
+// at it, so pushing the same bundle again is a single resolve request. The result is then marked as
+// PushResult.Unchanged. A reference pointing at a fallback format is pushed again.
+func WithSkipIfUnchanged() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.skipIfUnchanged = true
+		return nil
+	}
+}
+
+// WithArtifactType sets the artifactType field of the pushed index, so generic OCI tooling can classify the bundle,
+// and the converter.ArtifactTypeAnnotation to the same value. An empty artifact type defaults to
+// converter.ArtifactTypeValue. Without it, the index has no artifactType field.
+func WithArtifactType(artifactType string) PushOption {
+	return func(cfg *pushConfig) error {
+		if artifactType == "" {
+			artifactType = converter.ArtifactTypeValue
+		}
+		cfg.artifactType = artifactType
+		cfg.manifestOptions = append(cfg.manifestOptions, WithAnnotations(map[string]string{
+			converter.ArtifactTypeAnnotation: artifactType,
+		}))
+		return nil
+	}
+}
+
+// WithArtifactManifest pushes the bundle config as an artifact manifest, with the CNAB config media type as its
+// artifactType, the empty JSON blob as its config and the bundle config blob as its only layer, instead of a manifest
+// referencing the bundle config blob as its config. The usual config manifests are pushed to registries rejecting it,
+// if fallbacks are allowed.
+func WithArtifactManifest() PushOption {
+	return func(cfg *pushConfig) error {
+		cfg.prepareOptions = append(cfg.prepareOptions, converter.WithArtifactManifest())
+		return nil
+	}
+}
+
+// WithDigestAlgorithm computes the digests of the config blob, the config manifest and the index with the given
+// algorithm, like digest.SHA512, instead of SHA-256. A payload rejected by the registry because of its digest fails
+// the push with an UnsupportedDigestAlgorithmError. The digests of the bundle images are left unchanged.
+func WithDigestAlgorithm(algorithm digest.Algorithm) PushOption {
+	return func(cfg *pushConfig) error {
+		if !algorithm.Available() {
+			return fmt.Errorf("unsupported digest algorithm %q", algorithm)
+		}
+		cfg.digestAlgorithm = algorithm
+		cfg.prepareOptions = append(cfg.prepareOptions, converter.WithDigestAlgorithm(algorithm))
+		return nil
+	}
+}
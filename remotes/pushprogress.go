@@ -0,0 +1,22 @@
+package remotes
+
+import (
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ProgressTracker is notified of the progress of each payload pushed by a Push operation.
+// Payloads may be pushed concurrently, so implementations must be safe for concurrent use.
+type ProgressTracker interface {
+	// OnBlobStart is called once before writing a payload, however many times its push is retried
+	OnBlobStart(desc ocischemav1.Descriptor)
+	// OnBlobProgress is called with the current offset of the payload being written
+	OnBlobProgress(desc ocischemav1.Descriptor, offset int64)
+	// OnBlobComplete is called once a payload is committed, or already present in the registry
+	OnBlobComplete(desc ocischemav1.Descriptor)
+}
+
+type noopProgressTracker struct{}
+
+func (noopProgressTracker) OnBlobStart(ocischemav1.Descriptor)           {}
+func (noopProgressTracker) OnBlobProgress(ocischemav1.Descriptor, int64) {}
+func (noopProgressTracker) OnBlobComplete(ocischemav1.Descriptor)        {}
@@ -0,0 +1,141 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateLimitBaseDelay = time.Second
+	rateLimitMaxDelay  = time.Minute
+)
+
+// RateLimiter limits the rate of the payload pushes sent to each registry host, and can be shared by concurrent
+// pushes. When a registry answers with 429 Too Many Requests, the following pushes to that host are delayed for an
+// exponential backoff delay, or for the delay of the Retry-After response header when the resolver is created with
+// the same limiter in ResolverOptions.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+	hosts map[string]*hostRateLimiter
+	mut   sync.Mutex
+}
+
+type hostRateLimiter struct {
+	limiter     *rate.Limiter
+	pausedUntil time.Time
+	backoffs    int
+}
+
+// NewRateLimiter creates a RateLimiter allowing limit requests per second to each registry host, with bursts of up
+// to burst requests
+func NewRateLimiter(limit rate.Limit, burst int) *RateLimiter {
+	return &RateLimiter{
+		limit: limit,
+		burst: burst,
+		hosts: map[string]*hostRateLimiter{},
+	}
+}
+
+func (l *RateLimiter) host(host string) *hostRateLimiter {
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostRateLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// Wait blocks until a request to the registry host is allowed, or returns the context error if it is done first
+func (l *RateLimiter) Wait(ctx context.Context, host string) error {
+	l.mut.Lock()
+	h := l.host(host)
+	delay := time.Until(h.pausedUntil)
+	l.mut.Unlock()
+	if delay > 0 {
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+	return h.limiter.Wait(ctx)
+}
+
+// Throttle delays the next requests to the registry host for the given delay. A zero delay uses an exponential
+// backoff delay, doubled for each consecutive call until a request succeeds.
+func (l *RateLimiter) Throttle(host string, delay time.Duration) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	h := l.host(host)
+	if delay <= 0 {
+		delay = rateLimitBaseDelay << h.backoffs
+		if delay <= 0 || delay > rateLimitMaxDelay {
+			delay = rateLimitMaxDelay
+		} else {
+			h.backoffs++
+		}
+	}
+	if until := time.Now().Add(delay); until.After(h.pausedUntil) {
+		h.pausedUntil = until
+	}
+}
+
+// observe throttles the registry host if the request was rate limited, and resets its backoff if it succeeded
+func (l *RateLimiter) observe(host string, err error) {
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	switch {
+	case err == nil:
+		l.mut.Lock()
+		l.host(host).backoffs = 0
+		l.mut.Unlock()
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		l.Throttle(host, 0)
+	}
+}
+
+// registryHost returns the registry host of the reference, used to key the rate limits
+func registryHost(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(named)
+}
+
+// rateLimitTransport throttles the registry host for the delay of the Retry-After header of 429 responses
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *RateLimiter
+	host    string
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			t.limiter.Throttle(t.host, delay)
+		}
+	}
+	return resp, err
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
@@ -0,0 +1,100 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	"golang.org/x/time/rate"
+	"gotest.tools/v3/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	delay, ok := parseRetryAfter("3")
+	assert.Check(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+
+	delay, ok = parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.Check(t, ok)
+	assert.Check(t, delay > 58*time.Second && delay <= time.Minute, delay)
+
+	for _, value := range []string{"", "-1", "soon"} {
+		_, ok = parseRetryAfter(value)
+		assert.Check(t, !ok, value)
+	}
+}
+
+func TestRateLimiterThrottlesHost(t *testing.T) {
+	limiter := NewRateLimiter(rate.Inf, 1)
+	limiter.Throttle("my.registry", 50*time.Millisecond)
+
+	start := time.Now()
+	assert.NilError(t, limiter.Wait(context.Background(), "other.registry"))
+	assert.Check(t, time.Since(start) < 50*time.Millisecond)
+	assert.NilError(t, limiter.Wait(context.Background(), "my.registry"))
+	assert.Check(t, time.Since(start) >= 50*time.Millisecond)
+
+	// Waiting is canceled with the context
+	limiter.Throttle("my.registry", time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Check(t, errors.Is(limiter.Wait(ctx, "my.registry"), context.Canceled))
+}
+
+func TestRateLimiterBacksOffExponentially(t *testing.T) {
+	limiter := NewRateLimiter(rate.Inf, 1)
+	tooManyRequests := remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusTooManyRequests}
+	pausedFor := func() time.Duration {
+		limiter.mut.Lock()
+		defer limiter.mut.Unlock()
+		return time.Until(limiter.host("my.registry").pausedUntil)
+	}
+
+	limiter.observe("my.registry", tooManyRequests)
+	assert.Check(t, pausedFor() > 900*time.Millisecond && pausedFor() <= time.Second)
+	limiter.observe("my.registry", tooManyRequests)
+	assert.Check(t, pausedFor() > 1900*time.Millisecond && pausedFor() <= 2*time.Second)
+
+	// A success resets the backoff, other errors are ignored
+	limiter.observe("my.registry", nil)
+	limiter.observe("my.registry", remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusNotFound})
+	limiter.mut.Lock()
+	assert.Equal(t, 0, limiter.host("my.registry").backoffs)
+	limiter.mut.Unlock()
+}
+
+func TestResolverThrottlesOnRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	limiter := NewRateLimiter(rate.Inf, 1)
+
+	_, _, err := NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}, RateLimiter: limiter}).Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+	assert.Check(t, err != nil)
+	limiter.mut.Lock()
+	defer limiter.mut.Unlock()
+	paused := time.Until(limiter.host(host).pausedUntil)
+	assert.Check(t, paused > 29*time.Second && paused <= 30*time.Second, paused)
+}
+
+func TestPushWithRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(rate.Inf, 1)
+	limiter.Throttle("my.registry", 50*time.Millisecond)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	start := time.Now()
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: &mockPusher{}}, WithRateLimiter(limiter))
+	assert.NilError(t, err)
+	assert.Check(t, time.Since(start) >= 50*time.Millisecond)
+}
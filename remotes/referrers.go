@@ -0,0 +1,274 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischema "github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// mediaTypeEmptyJSON is the media type of the empty config blob of artifact manifests
+	mediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+)
+
+// ErrReferrersUnsupported is returned when the registry rejects manifests referencing a subject
+var ErrReferrersUnsupported = errors.New("referrers are not supported by the registry")
+
+// Referrer is the descriptor of an artifact manifest referencing a subject, like a signature or an SBOM
+type Referrer struct {
+	ocischemav1.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// referrerManifest is an OCI image manifest with the artifact type and subject fields of the image spec v1.1
+type referrerManifest struct {
+	ocischema.Versioned
+	MediaType    string                   `json:"mediaType"`
+	ArtifactType string                   `json:"artifactType"`
+	Config       ocischemav1.Descriptor   `json:"config"`
+	Layers       []ocischemav1.Descriptor `json:"layers"`
+	Subject      *ocischemav1.Descriptor  `json:"subject,omitempty"`
+}
+
+// referrersIndex is the index listing the referrers of a subject, as returned by the referrers API
+type referrersIndex struct {
+	ocischema.Versioned
+	MediaType string     `json:"mediaType"`
+	Manifests []Referrer `json:"manifests"`
+}
+
+// AttachReferrer pushes an artifact manifest of the given artifact type, with the already pushed artifact blob as its
+// only layer and the bundle index referenced by subjectRef as its subject. This links signatures or SBOMs to the
+// bundle. The referrer is also added to the referrers tag schema index, so it can be listed on registries without
+// referrers API.
+// If the registry rejects the artifact manifest, the returned error wraps ErrReferrersUnsupported.
+func AttachReferrer(ctx context.Context, resolver remotes.Resolver, subjectRef reference.Named, artifact ocischemav1.Descriptor, artifactType string) (Referrer, error) {
+	logger := log.G(ctx)
+	logger.Debugf("Attaching %s referrer to %s", artifactType, subjectRef)
+	ctx, err := WithRepositoryScope(ctx, subjectRef, true)
+	if err != nil {
+		return Referrer{}, err
+	}
+	subject, err := resolveSubject(ctx, resolver, subjectRef)
+	if err != nil {
+		return Referrer{}, err
+	}
+	cfg, err := newPushConfig()
+	if err != nil {
+		return Referrer{}, err
+	}
+
+	emptyConfig := []byte("{}")
+	config := ocischemav1.Descriptor{MediaType: mediaTypeEmptyJSON, Digest: digest.FromBytes(emptyConfig), Size: int64(len(emptyConfig))}
+	if err := pushPayload(ctx, resolver, subjectRef.Name(), cfg, config, emptyConfig); err != nil {
+		return Referrer{}, fmt.Errorf("failed to push referrer config: %w", err)
+	}
+	manifest, err := json.Marshal(referrerManifest{
+		Versioned:    ocischema.Versioned{SchemaVersion: 2},
+		MediaType:    ocischemav1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       config,
+		Layers:       []ocischemav1.Descriptor{artifact},
+		Subject:      &ocischemav1.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size},
+	})
+	if err != nil {
+		return Referrer{}, err
+	}
+	referrer := Referrer{
+		Descriptor:   ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))},
+		ArtifactType: artifactType,
+	}
+	manifestRef, err := reference.WithDigest(reference.TrimNamed(subjectRef), referrer.Digest)
+	if err != nil {
+		return Referrer{}, err
+	}
+	logPayload(logger, referrer)
+	if err := pushPayload(ctx, resolver, manifestRef.String(), cfg, referrer.Descriptor, manifest); err != nil {
+		if isManifestRejected(err) {
+			return Referrer{}, fmt.Errorf("failed to push referrer manifest: %w: %s", ErrReferrersUnsupported, err)
+		}
+		return Referrer{}, fmt.Errorf("failed to push referrer manifest: %w", err)
+	}
+
+	// Add the referrer to the referrers tag schema index
+	referrers, err := listReferrers(ctx, resolver, subjectRef, subject)
+	if err != nil {
+		return Referrer{}, err
+	}
+	for _, r := range referrers {
+		if r.Digest == referrer.Digest {
+			return referrer, nil
+		}
+	}
+	index, err := json.Marshal(referrersIndex{
+		Versioned: ocischema.Versioned{SchemaVersion: 2},
+		MediaType: ocischemav1.MediaTypeImageIndex,
+		Manifests: append(referrers, referrer),
+	})
+	if err != nil {
+		return Referrer{}, err
+	}
+	tagRef, err := referrersTag(subjectRef, subject)
+	if err != nil {
+		return Referrer{}, err
+	}
+	indexDescriptor := ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageIndex, Digest: digest.FromBytes(index), Size: int64(len(index))}
+	if err := pushPayload(ctx, resolver, tagRef.String(), cfg, indexDescriptor, index); err != nil {
+		return Referrer{}, fmt.Errorf("failed to push referrers index %q: %w", tagRef, err)
+	}
+	return referrer, nil
+}
+
+// ListReferrers returns the referrers of the bundle index referenced by subjectRef, from the referrers tag schema
+// index. Only the referrers of the given artifact type are returned, unless it is empty.
+func ListReferrers(ctx context.Context, resolver remotes.Resolver, subjectRef reference.Named, artifactType string) ([]Referrer, error) {
+	subject, err := resolveSubject(ctx, resolver, subjectRef)
+	if err != nil {
+		return nil, err
+	}
+	referrers, err := listReferrers(ctx, resolver, subjectRef, subject)
+	if err != nil {
+		return nil, err
+	}
+	if artifactType == "" {
+		return referrers, nil
+	}
+	var result []Referrer
+	for _, r := range referrers {
+		if r.ArtifactType == artifactType {
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+// ReferrersLister is implemented by the resolvers able to list the referrers of a subject with the referrers API of
+// the registry, given the name of its repository, like the resolvers created by NewResolver and CreateResolver. The
+// returned error wraps ErrReferrersUnsupported if the registry does not support the API.
+type ReferrersLister interface {
+	ListReferrers(ctx context.Context, repository string, subject digest.Digest) ([]Referrer, error)
+}
+
+// discoverReferrers returns the referrers of the subject with the referrers API, or from the referrers tag schema
+// index if the resolver or the registry does not support the API. It returns no referrers if there is neither.
+func discoverReferrers(ctx context.Context, resolver remotes.Resolver, subjectRef reference.Named, subject ocischemav1.Descriptor) ([]Referrer, error) {
+	referrers, err := listRegistryReferrers(ctx, resolver, subjectRef.Name(), subject.Digest)
+	if err == nil {
+		return referrers, nil
+	}
+	if !errors.Is(err, ErrReferrersUnsupported) {
+		return nil, err
+	}
+	log.G(ctx).Debugf("Falling back to the referrers tag schema of %s: %s", subjectRef, err)
+	return listReferrers(ctx, resolver, subjectRef, subject)
+}
+
+// listRegistryReferrers lists the referrers of the subject with the referrers API if the resolver is a
+// ReferrersLister
+func listRegistryReferrers(ctx context.Context, resolver remotes.Resolver, repository string, subject digest.Digest) ([]Referrer, error) {
+	lister, ok := resolver.(ReferrersLister)
+	if !ok {
+		return nil, fmt.Errorf("the resolver cannot list referrers: %w", ErrReferrersUnsupported)
+	}
+	return lister.ListReferrers(ctx, repository, subject)
+}
+
+func (r *multiRegistryResolver) ListReferrers(ctx context.Context, repository string, subject digest.Digest) ([]Referrer, error) {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := r.configureHosts()(reference.Domain(named))
+	if err != nil {
+		return nil, err
+	}
+	host := hosts[0]
+	next := &url.URL{Scheme: host.Scheme, Host: host.Host, Path: fmt.Sprintf("%s/%s/referrers/%s", host.Path, reference.Path(named), subject)}
+	var referrers []Referrer
+	for next != nil {
+		var page referrersIndex
+		if next, err = getReferrersPage(ctx, host, next, &page); err != nil {
+			return nil, fmt.Errorf("failed to list the referrers of %s in %q: %w", subject, repository, err)
+		}
+		referrers = append(referrers, page.Manifests...)
+	}
+	return referrers, nil
+}
+
+// getReferrersPage fetches a page of the referrers index and returns the URL of the next page, if any. Registries
+// without referrers API answer with a 404, as the API returns an empty index for unknown subjects.
+func getReferrersPage(ctx context.Context, host docker.RegistryHost, u *url.URL, page *referrersIndex) (*url.URL, error) {
+	resp, err := getAuthorized(ctx, host, u, ocischemav1.MediaTypeImageIndex)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, fmt.Errorf("%w: %s", ErrReferrersUnsupported, remoteserrors.NewUnexpectedStatusErr(resp))
+	default:
+		return nil, remoteserrors.NewUnexpectedStatusErr(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+		return nil, fmt.Errorf("invalid referrers index: %w", err)
+	}
+	return nextPage(u, resp.Header.Get("Link")), nil
+}
+
+func resolveSubject(ctx context.Context, resolver remotes.Resolver, subjectRef reference.Named) (ocischemav1.Descriptor, error) {
+	_, subject, err := resolver.Resolve(withMutedContext(ctx), subjectRef.String())
+	if err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to resolve referrers subject %q: %w", subjectRef, err)
+	}
+	return subject, nil
+}
+
+func listReferrers(ctx context.Context, resolver remotes.Resolver, subjectRef reference.Named, subject ocischemav1.Descriptor) ([]Referrer, error) {
+	tagRef, err := referrersTag(subjectRef, subject)
+	if err != nil {
+		return nil, err
+	}
+	_, indexDescriptor, err := resolver.Resolve(withMutedContext(ctx), tagRef.String())
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve referrers index %q: %w", tagRef, err)
+	}
+	payload, err := pullPayload(ctx, resolver, tagRef.String(), indexDescriptor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull referrers index %q: %w", tagRef, err)
+	}
+	var index referrersIndex
+	if err := json.Unmarshal(payload, &index); err != nil {
+		return nil, fmt.Errorf("failed to pull referrers index %q: %w", tagRef, err)
+	}
+	return index.Manifests, nil
+}
+
+// referrersTag returns the reference of the referrers tag schema index of the subject: its digest algorithm and
+// encoded value separated by a dash
+func referrersTag(subjectRef reference.Named, subject ocischemav1.Descriptor) (reference.NamedTagged, error) {
+	return reference.WithTag(reference.TrimNamed(subjectRef), fmt.Sprintf("%s-%s", subject.Digest.Algorithm(), subject.Digest.Encoded()))
+}
+
+// isManifestRejected returns true when the registry rejected the manifest as invalid or of an unsupported media type
+func isManifestRejected(err error) bool {
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	return errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusBadRequest || statusErr.StatusCode == http.StatusUnsupportedMediaType)
+}
@@ -0,0 +1,161 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func newReferrersRegistry(t *testing.T) (*memoryRegistry, reference.Named, ocischemav1.Descriptor) {
+	t.Helper()
+	registry := newMemoryRegistry()
+	subject := registry.content.add([]byte(`{"schemaVersion":2,"manifests":[]}`), ocischemav1.MediaTypeImageIndex)
+	registry.descriptors[subject.Digest] = subject
+	registry.tags["my.registry/namespace/my-app:my-tag"] = subject.Digest
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	signature := registry.content.add([]byte("signature"), "application/vnd.dev.cosign.simplesigning.v1+json")
+	return registry, ref, signature
+}
+
+func TestAttachReferrer(t *testing.T) {
+	registry, ref, signature := newReferrersRegistry(t)
+	sbom := registry.content.add([]byte("sbom"), "application/spdx+json")
+
+	signatureReferrer, err := AttachReferrer(context.Background(), registry, ref, signature, "application/vnd.dev.cosign.artifact.sig.v1+json")
+	assert.NilError(t, err)
+	sbomReferrer, err := AttachReferrer(context.Background(), registry, ref, sbom, "application/spdx+json")
+	assert.NilError(t, err)
+	// Attaching twice does not duplicate the referrer
+	_, err = AttachReferrer(context.Background(), registry, ref, sbom, "application/spdx+json")
+	assert.NilError(t, err)
+
+	// The pushed manifest references the bundle index as subject
+	var manifest referrerManifest
+	assert.NilError(t, json.Unmarshal(registry.content[signatureReferrer.Digest], &manifest))
+	assert.Equal(t, "application/vnd.dev.cosign.artifact.sig.v1+json", manifest.ArtifactType)
+	assert.Equal(t, registry.tags["my.registry/namespace/my-app:my-tag"], manifest.Subject.Digest)
+	assert.DeepEqual(t, []ocischemav1.Descriptor{signature}, manifest.Layers)
+
+	referrers, err := ListReferrers(context.Background(), registry, ref, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []Referrer{signatureReferrer, sbomReferrer}, referrers)
+	referrers, err = ListReferrers(context.Background(), registry, ref, "application/spdx+json")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []Referrer{sbomReferrer}, referrers)
+}
+
+func TestListReferrersWithoutReferrers(t *testing.T) {
+	registry, ref, _ := newReferrersRegistry(t)
+
+	referrers, err := ListReferrers(context.Background(), registry, ref, "")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(referrers))
+}
+
+func TestAttachReferrerUnsupported(t *testing.T) {
+	registry, ref, signature := newReferrersRegistry(t)
+	registry.pushErr = func(ref string, d ocischemav1.Descriptor) error {
+		if d.MediaType == ocischemav1.MediaTypeImageManifest {
+			return remoteserrors.ErrUnexpectedStatus{Status: "400 Bad Request", StatusCode: http.StatusBadRequest}
+		}
+		return nil
+	}
+
+	_, err := AttachReferrer(context.Background(), registry, ref, signature, "application/vnd.dev.cosign.artifact.sig.v1+json")
+	assert.Check(t, errors.Is(err, ErrReferrersUnsupported), err)
+}
+
+// newReferrersAPIRegistry serves the content of a memory registry, and the referrers of its subjects with the
+// referrers API if referrers is not nil
+func newReferrersAPIRegistry(t *testing.T, content *memoryRegistry, referrers map[string][]Referrer) *httptest.Server {
+	t.Helper()
+	public := newPublicRegistry(t, content, nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/namespace/my-app/referrers/") {
+			public.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		if referrers == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ocischemav1.MediaTypeImageIndex)
+		assert.NilError(t, json.NewEncoder(w).Encode(referrersIndex{
+			MediaType: ocischemav1.MediaTypeImageIndex,
+			Manifests: referrers[strings.TrimPrefix(r.URL.Path, "/v2/namespace/my-app/referrers/")],
+		}))
+	}))
+	public.URL = server.URL
+	t.Cleanup(func() {
+		server.Close()
+		public.Close()
+	})
+	return server
+}
+
+func TestPullWithReferrers(t *testing.T) {
+	signature := Referrer{
+		Descriptor: ocischemav1.Descriptor{
+			MediaType: ocischemav1.MediaTypeImageManifest,
+			Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0350",
+			Size:      42,
+		},
+		ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+	}
+	for _, tc := range []struct {
+		name         string
+		api          bool
+		tagSchema    bool
+		expectedType string
+	}{
+		{name: "referrers API", api: true, expectedType: signature.ArtifactType},
+		{name: "referrers tag schema", tagSchema: true, expectedType: "application/spdx+json"},
+		{name: "referrers API over the tag schema", api: true, tagSchema: true, expectedType: signature.ArtifactType},
+		{name: "no referrers"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content := newMemoryRegistry()
+			var referrers map[string][]Referrer
+			if tc.api {
+				referrers = map[string][]Referrer{}
+			}
+			server := newReferrersAPIRegistry(t, content, referrers)
+			host := strings.TrimPrefix(server.URL, "http://")
+			ref, err := reference.ParseNormalizedNamed(host + "/namespace/my-app:my-tag")
+			assert.NilError(t, err)
+			relocationMap, err := relocateToRepository(tests.MakeRelocationMap(), ref)
+			assert.NilError(t, err)
+			pushed, err := Push(context.Background(), tests.MakeTestBundle(), relocationMap, ref, content, false)
+			assert.NilError(t, err)
+			if tc.api {
+				referrers[pushed.Digest.String()] = []Referrer{signature}
+			}
+			if tc.tagSchema {
+				sbom := content.content.add([]byte("sbom"), "application/spdx+json")
+				_, err := AttachReferrer(context.Background(), content, ref, sbom, "application/spdx+json")
+				assert.NilError(t, err)
+			}
+
+			var pulled []Referrer
+			_, _, _, err = PullWithOptions(context.Background(), ref, NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}}), WithPulledReferrers(&pulled), WithoutBundleValidation())
+			assert.NilError(t, err)
+			if tc.expectedType == "" {
+				assert.Equal(t, 0, len(pulled))
+				return
+			}
+			assert.Equal(t, 1, len(pulled))
+			assert.Equal(t, tc.expectedType, pulled[0].ArtifactType)
+		})
+	}
+}
@@ -3,9 +3,11 @@ package remotes
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
@@ -25,6 +27,9 @@ type multiRegistryResolver struct {
 	authorizer          docker.Authorizer
 	skipTLSClient       *http.Client
 	skipTLSAuthorizer   docker.Authorizer
+	client              *http.Client
+	plainHTTP           func(host string) (bool, error)
+	rateLimiter         *RateLimiter
 }
 
 func (r *multiRegistryResolver) Resolve(ctx context.Context, ref string) (name string, desc ocispec.Descriptor, err error) {
@@ -63,7 +68,124 @@ func (r *multiRegistryResolver) Pusher(ctx context.Context, ref string) (remotes
 
 // CreateResolver creates a docker registry resolver, using the local docker CLI credentials
 func CreateResolver(cfg *configfile.ConfigFile, insecureRegistries ...string) remotes.Resolver {
+	result := newMultiRegistryResolver(cfg, nil, nil)
+
+	// Determine ahead of time how each registry is insecure
+	// 1. It uses TLS but has a bad cert
+	// 2. It doesn't use TLS
+	for _, r := range insecureRegistries {
+		pingURL := fmt.Sprintf("https://%s/v2/", r)
+		resp, err := result.skipTLSClient.Get(pingURL)
+		if err == nil {
+			resp.Body.Close()
+			result.skipTLSRegistries[r] = struct{}{}
+		} else {
+			result.plainHTTPRegistries[r] = struct{}{}
+		}
+	}
+
+	result.resolver = docker.NewResolver(docker.ResolverOptions{
+		Hosts: result.configureHosts(),
+	})
+
+	return result
+}
+
+// ResolverOptions configures the resolver created by NewResolver
+type ResolverOptions struct {
+	// ConfigFile provides the registry credentials, like the docker CLI config.json. No credentials are sent if nil.
+	ConfigFile *configfile.ConfigFile
+	// PlainHTTPRegistries are accessed with plain HTTP
+	PlainHTTPRegistries []string
+	// SkipTLSVerifyRegistries are accessed with HTTPS, without verifying their certificate
+	SkipTLSVerifyRegistries []string
+	// RootCAs are the certificate authorities verifying the registry certificates, like self-signed ones.
+	// The system certificate pool is used if nil.
+	RootCAs *x509.CertPool
+	// PlainHTTP decides if a registry which is not listed in PlainHTTPRegistries or SkipTLSVerifyRegistries is
+	// accessed with plain HTTP. Defaults to plain HTTP for localhost only.
+	PlainHTTP func(host string) (bool, error)
+	// RateLimiter is throttled for the delay of the Retry-After header of the registry 429 responses. It should be
+	// the limiter given to WithRateLimiter.
+	RateLimiter *RateLimiter
+	// Headers are added to all the registry requests, including the token requests, like a proxy authentication
+	// header or a tenant identifier
+	Headers http.Header
+	// Mirrors are the hosts the references of a registry are read from first, in order, keyed by registry host.
+	// See NewMirrorResolver.
+	Mirrors map[string][]string
+	// ResolveTimeout bounds each resolution of a reference, token fetch included. Zero inherits the context of the call.
+	// See NewTimeoutResolver.
+	ResolveTimeout time.Duration
+	// PushTimeout bounds each payload push, from the existence check to the commit. Zero inherits the context of the
+	// call. See NewTimeoutResolver.
+	PushTimeout time.Duration
+	// AnonymousReadFallback retries the resolutions and fetches anonymously when the registry rejects the credentials
+	// of ConfigFile, for public bundles. Pushes are never retried. See NewAnonymousFallbackResolver.
+	AnonymousReadFallback bool
+	// UserAgent replaces the containerd user agent of all the registry requests, including the token requests, to
+	// identify the client in the registry logs. The containerd user agent is kept if empty.
+	UserAgent string
+	// TokenProvider returns the bearer tokens obtained out of band authorizing the registry requests, instead of the
+	// tokens fetched with the credentials of ConfigFile. See TokenProvider.
+	TokenProvider TokenProvider
+}
+
+// NewResolver creates a docker registry resolver configured by the given options, without probing the registries
+// like CreateResolver does
+func NewResolver(opts ResolverOptions) remotes.Resolver {
+	if opts.UserAgent != "" {
+		headers := opts.Headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers.Set("User-Agent", opts.UserAgent)
+		opts.Headers = headers
+	}
+	var resolver remotes.Resolver = newConfiguredResolver(opts, opts.ConfigFile)
+	if opts.AnonymousReadFallback && opts.ConfigFile != nil {
+		resolver = NewAnonymousFallbackResolver(resolver, newConfiguredResolver(opts, nil))
+	}
+	if opts.ResolveTimeout > 0 || opts.PushTimeout > 0 {
+		// Bound each host of the mirrors separately, so a dead mirror fails over to the next host
+		resolver = NewTimeoutResolver(resolver, opts.ResolveTimeout, opts.PushTimeout)
+	}
+	if len(opts.Mirrors) > 0 {
+		return NewMirrorResolver(resolver, opts.Mirrors)
+	}
+	return resolver
+}
+
+// newConfiguredResolver creates a docker registry resolver sending the credentials of cfg, configured by the options
+func newConfiguredResolver(opts ResolverOptions, cfg *configfile.ConfigFile) *multiRegistryResolver {
+	result := newMultiRegistryResolver(cfg, opts.RootCAs, opts.Headers)
+	for _, r := range opts.PlainHTTPRegistries {
+		result.plainHTTPRegistries[r] = struct{}{}
+	}
+	for _, r := range opts.SkipTLSVerifyRegistries {
+		result.skipTLSRegistries[r] = struct{}{}
+	}
+	if opts.PlainHTTP != nil {
+		result.plainHTTP = opts.PlainHTTP
+	}
+	result.rateLimiter = opts.RateLimiter
+	if opts.TokenProvider != nil {
+		result.authorizer = newTokenProviderAuthorizer(opts.TokenProvider, result.authorizer)
+		result.skipTLSAuthorizer = newTokenProviderAuthorizer(opts.TokenProvider, result.skipTLSAuthorizer)
+	}
+	result.resolver = docker.NewResolver(docker.ResolverOptions{
+		Hosts: result.configureHosts(),
+		// The resolver adds its own default headers
+		Headers: opts.Headers.Clone(),
+	})
+	return result
+}
+
+func newMultiRegistryResolver(cfg *configfile.ConfigFile, rootCAs *x509.CertPool, headers http.Header) *multiRegistryResolver {
 	authCreds := docker.WithAuthCreds(func(hostName string) (string, string, error) {
+		if cfg == nil {
+			return "", "", nil
+		}
 		if hostName == registry.DefaultV2Registry.Host {
 			hostName = registry.IndexServer
 		}
@@ -84,40 +206,41 @@ func CreateResolver(cfg *configfile.ConfigFile, insecureRegistries ...string) re
 			},
 		},
 	}
+	// The token requests carry the same headers as the registry requests
+	authOpts := func(opts ...docker.AuthorizerOpt) []docker.AuthorizerOpt {
+		opts = append(opts, authCreds)
+		if headers != nil {
+			opts = append(opts, docker.WithAuthHeader(headers.Clone()))
+		}
+		return opts
+	}
+	client := http.DefaultClient
+	authorizer := docker.NewDockerAuthorizer(authOpts()...)
+	if rootCAs != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    rootCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+		client = &http.Client{Transport: transport}
+		authorizer = docker.NewDockerAuthorizer(authOpts(docker.WithAuthClient(client))...)
+	}
 
-	result := &multiRegistryResolver{
-		authorizer:          docker.NewDockerAuthorizer(authCreds),
+	return &multiRegistryResolver{
+		authorizer:          authorizer,
+		client:              client,
 		skipTLSClient:       clientSkipTLS,
-		skipTLSAuthorizer:   docker.NewDockerAuthorizer(authCreds, docker.WithAuthClient(clientSkipTLS)),
+		skipTLSAuthorizer:   docker.NewDockerAuthorizer(authOpts(docker.WithAuthClient(clientSkipTLS))...),
 		plainHTTPRegistries: make(map[string]struct{}),
 		skipTLSRegistries:   make(map[string]struct{}),
+		plainHTTP:           docker.MatchLocalhost,
 	}
-
-	// Determine ahead of time how each registry is insecure
-	// 1. It uses TLS but has a bad cert
-	// 2. It doesn't use TLS
-	for _, r := range insecureRegistries {
-		pingURL := fmt.Sprintf("https://%s/v2/", r)
-		resp, err := clientSkipTLS.Get(pingURL)
-		if err == nil {
-			resp.Body.Close()
-			result.skipTLSRegistries[r] = struct{}{}
-		} else {
-			result.plainHTTPRegistries[r] = struct{}{}
-		}
-	}
-
-	result.resolver = docker.NewResolver(docker.ResolverOptions{
-		Hosts: result.configureHosts(),
-	})
-
-	return result
 }
 
 func (r *multiRegistryResolver) configureHosts() docker.RegistryHosts {
 	return func(host string) ([]docker.RegistryHost, error) {
 		config := docker.RegistryHost{
-			Client:       http.DefaultClient,
+			Client:       r.client,
 			Authorizer:   r.authorizer,
 			Host:         host,
 			Scheme:       "https",
@@ -131,8 +254,8 @@ func (r *multiRegistryResolver) configureHosts() docker.RegistryHosts {
 		} else if _, plainHTTP := r.plainHTTPRegistries[host]; plainHTTP {
 			config.Scheme = "http"
 		} else {
-			// Default to plain http for localhost
-			match, err := docker.MatchLocalhost(host)
+			// Default to plain http for localhost, unless configured otherwise
+			match, err := r.plainHTTP(host)
 			if err != nil {
 				return nil, err
 			}
@@ -148,6 +271,16 @@ func (r *multiRegistryResolver) configureHosts() docker.RegistryHosts {
 			config.Host = "registry-1.docker.io"
 		}
 
+		client := *config.Client
+		if client.Transport == nil {
+			client.Transport = http.DefaultTransport
+		}
+		client.Transport = &contentDigestTransport{base: client.Transport}
+		if r.rateLimiter != nil {
+			client.Transport = &rateLimitTransport{base: client.Transport, limiter: r.rateLimiter, host: host}
+		}
+		config.Client = &client
+
 		return []docker.RegistryHost{config}, nil
 	}
 }
@@ -0,0 +1,121 @@
+package remotes
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+const testIndexDigest = "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0341"
+
+func newTestRegistryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/namespace/my-app/manifests/my-tag" {
+			w.Header().Set("Content-Type", ocischemav1.MediaTypeImageIndex)
+			w.Header().Set("Docker-Content-Digest", testIndexDigest)
+			w.Header().Set("Content-Length", "42")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+}
+
+func TestNewResolverWithRootCAs(t *testing.T) {
+	server := httptest.NewTLSServer(newTestRegistryHandler())
+	defer server.Close()
+	ref := strings.TrimPrefix(server.URL, "https://") + "/namespace/my-app:my-tag"
+	noPlainHTTP := func(string) (bool, error) { return false, nil }
+
+	// The self-signed certificate is rejected by default
+	_, _, err := NewResolver(ResolverOptions{PlainHTTP: noPlainHTTP}).Resolve(context.Background(), ref)
+	assert.ErrorContains(t, err, "certificate")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	_, descriptor, err := NewResolver(ResolverOptions{RootCAs: pool, PlainHTTP: noPlainHTTP}).Resolve(context.Background(), ref)
+	assert.NilError(t, err)
+	assert.Equal(t, testIndexDigest, descriptor.Digest.String())
+
+	// Or the certificate verification is skipped
+	host := strings.TrimPrefix(server.URL, "https://")
+	_, descriptor, err = NewResolver(ResolverOptions{SkipTLSVerifyRegistries: []string{host}}).Resolve(context.Background(), ref)
+	assert.NilError(t, err)
+	assert.Equal(t, testIndexDigest, descriptor.Digest.String())
+}
+
+func TestNewResolverWithPlainHTTP(t *testing.T) {
+	server := httptest.NewServer(newTestRegistryHandler())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	_, descriptor, err := NewResolver(ResolverOptions{
+		PlainHTTPRegistries: []string{host},
+		PlainHTTP:           func(string) (bool, error) { return false, nil },
+	}).Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	assert.Equal(t, testIndexDigest, descriptor.Digest.String())
+}
+
+func TestNewResolverWithHeaders(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	var tokenRequests int32
+	registry := newTokenAuthRegistry(index, &tokenRequests)
+	defer registry.Close()
+	var withoutHeader []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant") != "my-tenant" {
+			withoutHeader = append(withoutHeader, r.URL.Path)
+		}
+		registry.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	registry.URL = server.URL
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	headers := http.Header{"X-Tenant": []string{"my-tenant"}}
+	resolver := NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}, Headers: headers})
+	_, descriptor, err := resolver.Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	assert.Equal(t, digest.FromBytes(index), descriptor.Digest)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tokenRequests))
+	assert.Equal(t, 0, len(withoutHeader), withoutHeader)
+	// The given headers are not modified
+	assert.DeepEqual(t, http.Header{"X-Tenant": []string{"my-tenant"}}, headers)
+}
+
+func TestNewResolverWithUserAgent(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	var tokenRequests int32
+	registry := newTokenAuthRegistry(index, &tokenRequests)
+	defer registry.Close()
+	userAgents := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents[r.URL.Path] = r.Header.Get("User-Agent")
+		registry.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	registry.URL = server.URL
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	resolver := NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}, UserAgent: "my-tool/1.0"})
+	_, _, err := resolver.Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[string]string{
+		"/token":                                "my-tool/1.0",
+		"/v2/namespace/my-app/manifests/my-tag": "my-tool/1.0",
+	}, userAgents)
+
+	// The containerd user agent is kept by default
+	userAgents = map[string]string{}
+	_, _, err = NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}}).Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(userAgents["/v2/namespace/my-app/manifests/my-tag"], "containerd/"), userAgents)
+}
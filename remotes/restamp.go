@@ -0,0 +1,102 @@
+package remotes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReStampResult describes the index replaced by ReStamp
+type ReStampResult struct {
+	// Previous is the descriptor of the index ref referenced before
+	Previous ocischemav1.Descriptor
+	// Index is the descriptor of the pushed index, equal to Previous if the options changed nothing
+	Index ocischemav1.Descriptor
+}
+
+// ReStamp pulls the bundle index referenced by ref, applies the manifest options to it, like WithAnnotations or
+// WithCreatedAnnotation, and pushes only the modified index to ref. The bundle config and the images are never pushed
+// again: the options must keep the descriptors of the index exactly as they are, otherwise ReStamp fails without
+// pushing anything. The artifactType of the index is kept. Nothing is pushed if the index is unchanged.
+func ReStamp(ctx context.Context, ref reference.Named, resolver remotes.Resolver, options ...ManifestOption) (*ReStampResult, error) {
+	logger := log.G(ctx)
+	logger.Debugf("Re-stamping CNAB Bundle %s", ref)
+	ctx, err := WithRepositoryScope(ctx, ref, true)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, previous, err := getIndexPayload(ctx, ref, resolver)
+	if err != nil {
+		return nil, err
+	}
+	ix, err := converter.UnmarshalIndex(payload, previous.MediaType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull bundle manifest %q: %w", ref, err)
+	}
+	if !converter.IsCNABIndex(ix) {
+		return nil, fmt.Errorf("%q is not a CNAB bundle manifest", ref)
+	}
+	artifactType, err := converter.GetArtifactType(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull bundle manifest %q: %w", ref, err)
+	}
+	if ix.MediaType == "" {
+		ix.MediaType = previous.MediaType
+	}
+
+	// The descriptors are unmarshaled again, as the options may modify the maps of the ones of the index
+	var original ocischemav1.Index
+	if err := json.Unmarshal(payload, &original); err != nil {
+		return nil, fmt.Errorf("failed to pull bundle manifest %q: %w", ref, err)
+	}
+	// The pulled index is compared once marshaled again, as it may not have been marshaled the same way
+	unchangedPayload, _, err := marshalReStampedIndex(&ix, artifactType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest %q: %w", ref, err)
+	}
+	for _, opt := range options {
+		if err := opt(&ix); err != nil {
+			return nil, fmt.Errorf("failed to re-stamp bundle manifest %q: %w", ref, err)
+		}
+	}
+	if !reflect.DeepEqual(original.Manifests, ix.Manifests) {
+		return nil, fmt.Errorf("failed to re-stamp bundle manifest %q: the manifest options changed the descriptors of the index", ref)
+	}
+	indexPayload, indexDescriptor, err := marshalReStampedIndex(&ix, artifactType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest %q: %w", ref, err)
+	}
+	if bytes.Equal(indexPayload, unchangedPayload) {
+		logger.Debugf("%s is unchanged, nothing to push", ref)
+		return &ReStampResult{Previous: previous, Index: previous}, nil
+	}
+	indexDescriptor.Digest = previous.Digest.Algorithm().FromBytes(indexPayload)
+
+	cfg, err := newPushConfig()
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Pushing CNAB Index %s", indexDescriptor.Digest)
+	if err := pushPayload(ctx, resolver, ref.String(), cfg, indexDescriptor, indexPayload); err != nil {
+		return nil, fmt.Errorf("error while pushing bundle manifest %q: %w", ref, &PushError{Stage: PushStageIndex, Descriptor: indexDescriptor, Err: err})
+	}
+	logger.Debug("CNAB Bundle re-stamped")
+	return &ReStampResult{Previous: previous, Index: indexDescriptor}, nil
+}
+
+// marshalReStampedIndex marshals the index in the format set by its media type
+func marshalReStampedIndex(ix *ocischemav1.Index, artifactType string) ([]byte, ocischemav1.Descriptor, error) {
+	if ix.MediaType == converter.CNABManifestListMediaType {
+		return converter.MarshalDockerManifestList(ix, artifactType)
+	}
+	return converter.MarshalOCIIndex(ix, artifactType)
+}
@@ -0,0 +1,76 @@
+package remotes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestReStamp(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	pushed, err := Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, false)
+	assert.NilError(t, err)
+	before, _, err := getIndex(context.Background(), ref, registry)
+	assert.NilError(t, err)
+
+	var pushedDescriptors []ocischemav1.Descriptor
+	registry.pushErr = func(_ string, d ocischemav1.Descriptor) error {
+		pushedDescriptors = append(pushedDescriptors, d)
+		return nil
+	}
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	result, err := ReStamp(context.Background(), ref, registry, WithCreatedAnnotation(created), WithAnnotations(map[string]string{"key": "rotated"}))
+	assert.NilError(t, err)
+	assert.Equal(t, pushed.Digest, result.Previous.Digest)
+	assert.Assert(t, result.Index.Digest != result.Previous.Digest)
+
+	// Only the index is pushed, under the tag, with the same descriptors
+	assert.DeepEqual(t, []ocischemav1.Descriptor{result.Index}, pushedDescriptors)
+	after, afterDescriptor, err := getIndex(context.Background(), ref, registry)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Index.Digest, afterDescriptor.Digest)
+	assert.DeepEqual(t, before.Manifests, after.Manifests)
+	assert.Equal(t, "2021-03-04T05:06:07Z", after.Annotations[ocischemav1.AnnotationCreated])
+	assert.Equal(t, "rotated", after.Annotations["key"])
+
+	// The same options change nothing anymore
+	pushedDescriptors = nil
+	again, err := ReStamp(context.Background(), ref, registry, WithCreatedAnnotation(created))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, again.Previous, again.Index)
+	assert.Equal(t, result.Index.Digest, again.Index.Digest)
+	assert.Equal(t, 0, len(pushedDescriptors))
+}
+
+func TestReStampKeepsTheDescriptors(t *testing.T) {
+	registry := newMemoryRegistry()
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	pushed, err := Push(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, registry, false)
+	assert.NilError(t, err)
+
+	_, err = ReStamp(context.Background(), ref, registry, WithExtraDescriptors(ocischemav1.Descriptor{
+		MediaType: ocischemav1.MediaTypeImageManifest,
+		Digest:    "sha256:d59a1aa7866258751a261bae525a1842c7ff0662d4f34a355d5f36826abc0350",
+		Size:      42,
+	}))
+	assert.ErrorContains(t, err, "the manifest options changed the descriptors of the index")
+	_, err = ReStamp(context.Background(), ref, registry, func(ix *ocischemav1.Index) error {
+		ix.Manifests[0].Annotations[converter.CNABDescriptorTypeAnnotation] = "changed"
+		return nil
+	})
+	assert.ErrorContains(t, err, "the manifest options changed the descriptors of the index")
+
+	// Nothing was pushed
+	_, current, err := registry.Resolve(context.Background(), ref.String())
+	assert.NilError(t, err)
+	assert.Equal(t, pushed.Digest, current.Digest)
+}
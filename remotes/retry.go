@@ -0,0 +1,111 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+)
+
+// RetryPolicy defines how a payload push failing with a transient registry error is retried
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled for each following retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts. Zero means no cap.
+	MaxDelay time.Duration
+}
+
+// noRetryPolicy makes a single attempt
+var noRetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// delay returns the exponential backoff delay before the given retry (starting at 1), with a random jitter
+// spreading it between half and the whole computed delay
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay == 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay != 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half))) //nolint:gosec
+}
+
+// withRetry runs do until it succeeds, fails with a non transient error, or the policy max attempts are reached
+func withRetry(ctx context.Context, policy RetryPolicy, do func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := do()
+		if err == nil || attempt >= policy.MaxAttempts || !isTransientError(err) {
+			return err
+		}
+		delay := policy.delay(attempt)
+		log.G(ctx).Debugf("Attempt %d/%d failed with a transient error, retrying in %s: %s", attempt, policy.MaxAttempts, delay, err)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// CredentialRefresher refreshes the credentials of the resolver for a registry host which rejected them in the middle
+// of an operation, like an expired short-lived token
+type CredentialRefresher func(ctx context.Context, host string) error
+
+// withCredentialRefresh runs do, and runs it once more after refreshing the credentials of host if it failed with an
+// authorization error. A refresh does not count as an attempt of the retry policy, and is not delayed.
+func withCredentialRefresh(ctx context.Context, refresh CredentialRefresher, host string, do func() error) error {
+	err := do()
+	if err == nil || refresh == nil || !isAuthorizationError(err) {
+		return err
+	}
+	log.G(ctx).Debugf("The credentials for %s were rejected, refreshing them: %s", host, err)
+	if refreshErr := refresh(ctx, host); refreshErr != nil {
+		return fmt.Errorf("failed to refresh the credentials for %s rejected with %v: %w", host, err, refreshErr)
+	}
+	return do()
+}
+
+// sleep waits for the given delay, or returns the context error if it is done first
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isTransientError returns true for network timeouts, connection resets, and registry responses with a 429 or
+// 5xx status code. Authentication failures and other 4xx statuses are never transient.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, errdefs.ErrUnavailable)
+}
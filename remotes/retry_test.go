@@ -0,0 +1,180 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestPushPayloadRetriesTransientErrors(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	unavailable := remoteserrors.ErrUnexpectedStatus{Status: "503 Service Unavailable", StatusCode: http.StatusServiceUnavailable}
+	unauthorized := remoteserrors.ErrUnexpectedStatus{Status: "401 Unauthorized", StatusCode: http.StatusUnauthorized}
+	payload := []byte("payload")
+	descriptor := ocischemav1.Descriptor{Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+
+	testCases := []struct {
+		name             string
+		failures         int
+		err              error
+		expectedError    string
+		expectedAttempts int
+	}{
+		{name: "succeeds after transient failures", failures: 2, err: unavailable, expectedAttempts: 3},
+		{name: "gives up after max attempts", failures: 3, err: unavailable, expectedError: "503 Service Unavailable", expectedAttempts: 3},
+		{name: "rate limited", failures: 1, err: remoteserrors.ErrUnexpectedStatus{StatusCode: http.StatusTooManyRequests}, expectedAttempts: 2},
+		{name: "auth errors are not retried", failures: 1, err: unauthorized, expectedError: "401 Unauthorized", expectedAttempts: 1},
+		{name: "existing content is not retried", failures: 1, err: errdefs.ErrAlreadyExists, expectedAttempts: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pusher := &flakyPusher{Pusher: &mockPusher{}, failures: tc.failures, err: tc.err}
+			tracker := &recordingProgressTracker{}
+			cfg, err := newPushConfig(WithRetryPolicy(policy), WithProgressTracker(tracker))
+			assert.NilError(t, err)
+
+			err = pushPayload(context.Background(), &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload)
+			if tc.expectedError == "" {
+				assert.NilError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.expectedError)
+			}
+			assert.Equal(t, tc.expectedAttempts, pusher.attempts)
+			// The start is reported once, whatever the number of attempts
+			starts := 0
+			for _, event := range tracker.events {
+				if strings.HasPrefix(event, "start ") {
+					starts++
+				}
+			}
+			assert.Equal(t, 1, starts)
+		})
+	}
+}
+
+func TestPushPayloadResumesInterruptedWrites(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	payload := []byte("a large bundle config payload")
+	descriptor := ocischemav1.Descriptor{Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+
+	testCases := []struct {
+		name           string
+		resumable      bool
+		expectedPushes int
+	}{
+		{name: "resumes at the reported offset", resumable: true, expectedPushes: 1},
+		{name: "restarts without a reported offset", resumable: false, expectedPushes: 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var writers []*interruptedWriter
+			pusher := funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+				w := newInterruptedWriter(10, tc.resumable)
+				// Only the first write of the first push is interrupted
+				w.failed = len(writers) > 0
+				writers = append(writers, w)
+				return w, nil
+			})
+			cfg, err := newPushConfig(WithRetryPolicy(policy))
+			assert.NilError(t, err)
+
+			err = pushPayload(context.Background(), &mockResolver{pusher: pusher}, "my.registry/namespace/my-app", cfg, descriptor, payload)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.expectedPushes, len(writers))
+			assert.Equal(t, string(payload), writers[len(writers)-1].buf.String())
+		})
+	}
+}
+
+// expiringTokenPusher rejects the pushes with a 401 once its token authorized the given number of pushes, until it is
+// refreshed
+type expiringTokenPusher struct {
+	*mockPusher
+	lifetime  int
+	remaining int
+	rejected  int
+}
+
+func (p *expiringTokenPusher) Push(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+	if p.remaining == 0 {
+		p.rejected++
+		return nil, remoteserrors.ErrUnexpectedStatus{Status: "401 Unauthorized", StatusCode: http.StatusUnauthorized}
+	}
+	p.remaining--
+	return p.mockPusher.Push(ctx, d)
+}
+
+func (p *expiringTokenPusher) refresh(context.Context, string) error {
+	p.remaining = p.lifetime
+	return nil
+}
+
+func TestPushWithCredentialRefresher(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	// The token expires after each 2 pushes, in the middle of the 3 payloads of the bundle
+	pusher := &expiringTokenPusher{mockPusher: &mockPusher{}, lifetime: 2, remaining: 2}
+	var refreshedHosts []string
+	refresher := func(ctx context.Context, host string) error {
+		refreshedHosts = append(refreshedHosts, host)
+		return pusher.refresh(ctx, host)
+	}
+	// Refreshing is distinct from retrying transient errors, a single attempt is enough
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher},
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}), WithCredentialRefresher(refresher))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"my.registry"}, refreshedHosts)
+	assert.Equal(t, 1, pusher.rejected)
+	assert.Equal(t, 3, len(pusher.pushedDescriptors))
+
+	// Without a refresher, the push fails once the token expired
+	pusher = &expiringTokenPusher{mockPusher: &mockPusher{}, lifetime: 2, remaining: 2}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher},
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3}))
+	assert.ErrorContains(t, err, "401 Unauthorized")
+	assert.Equal(t, 1, pusher.rejected)
+
+	// A failed refresh fails the push
+	pusher = &expiringTokenPusher{mockPusher: &mockPusher{}, lifetime: 2, remaining: 2}
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher},
+		WithCredentialRefresher(func(context.Context, string) error { return errors.New("credentials revoked") }))
+	assert.ErrorContains(t, err, "failed to refresh the credentials for my.registry rejected with unexpected status: 401 Unauthorized: credentials revoked")
+
+	// A payload still rejected after a refresh fails the push, without refreshing again
+	pusher = &expiringTokenPusher{mockPusher: &mockPusher{}, lifetime: 0, remaining: 2}
+	refreshedHosts = nil
+	_, err = PushWithOptions(context.Background(), tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, &mockResolver{pusher: pusher},
+		WithCredentialRefresher(refresher))
+	assert.ErrorContains(t, err, "401 Unauthorized")
+	assert.Equal(t, 2, pusher.rejected)
+	assert.Equal(t, 1, len(refreshedHosts))
+
+	_, err = newPushConfig(WithCredentialRefresher(nil))
+	assert.ErrorContains(t, err, "credential refresher cannot be nil")
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, maxDelay := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		d := policy.delay(retry + 1)
+		assert.Assert(t, d >= maxDelay/2 && d <= maxDelay, "retry %d: %s", retry+1, d)
+	}
+}
+
+func TestInvalidRetryPolicy(t *testing.T) {
+	_, err := newPushConfig(WithRetryPolicy(RetryPolicy{}))
+	assert.ErrorContains(t, err, "max attempts must be at least 1")
+}
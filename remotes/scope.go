@@ -0,0 +1,27 @@
+package remotes
+
+import (
+	"context"
+
+	containerdreference "github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+)
+
+// WithRepositoryScope seeds the context with all the token scopes needed to access the repository of ref, so that
+// registries using token authentication issue a single token for a whole operation, instead of one each time the
+// requested scopes change (resolving only needs pull, pushing needs pull and push).
+func WithRepositoryScope(ctx context.Context, ref reference.Named, push bool) (context.Context, error) {
+	refspec, err := containerdreference.Parse(ref.String())
+	if err != nil {
+		return nil, err
+	}
+	ctx, err = docker.ContextWithRepositoryScope(ctx, refspec, false)
+	if err != nil {
+		return nil, err
+	}
+	if !push {
+		return ctx, nil
+	}
+	return docker.ContextWithRepositoryScope(ctx, refspec, true)
+}
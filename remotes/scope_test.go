@@ -0,0 +1,71 @@
+package remotes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+// newTokenAuthRegistry serves a bundle index under the "my-tag" tag of the namespace/my-app repository, behind a
+// token server counting the issued tokens.
+func newTokenAuthRegistry(index []byte, tokenRequests *int32) *httptest.Server {
+	indexDigest := digest.FromBytes(index)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			atomic.AddInt32(tokenRequests, 1)
+			fmt.Fprint(w, `{"token":"t"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer t" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:namespace/my-app:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut:
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.Header().Set("Docker-Content-Digest", indexDigest.String())
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/v2/namespace/my-app/manifests/my-tag", r.URL.Path == "/v2/namespace/my-app/manifests/"+indexDigest.String():
+			w.Header().Set("Content-Type", ocischemav1.MediaTypeImageIndex)
+			w.Header().Set("Docker-Content-Digest", indexDigest.String())
+			w.Header().Set("Content-Length", fmt.Sprint(len(index)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(index)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestTagFetchesASingleToken(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	var tokenRequests int32
+	server := newTokenAuthRegistry(index, &tokenRequests)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	src, err := reference.ParseNormalizedNamed(host + "/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	dst, err := reference.ParseNormalizedNamed(host + "/namespace/my-app:other-tag")
+	assert.NilError(t, err)
+
+	resolver := NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}})
+	descriptor, err := Tag(context.Background(), resolver, src, dst.(reference.NamedTagged))
+	assert.NilError(t, err)
+	assert.Equal(t, digest.FromBytes(index), descriptor.Digest)
+	// Resolving, fetching and pushing share the same token
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tokenRequests))
+}
@@ -0,0 +1,49 @@
+package remotes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/cnabio/cnab-to-oci/relocation"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PushToStore writes a bundle as an OCI Image Index manifest into a content store instead of a registry, for example
+// to create an oci-layout without network access. The config blob, the config manifest and the index are written in
+// the store, blobs already present being skipped. Fallbacks are never used as a content store accepts any media type.
+func PushToStore(ctx context.Context,
+	b *bundle.Bundle,
+	relocationMap relocation.ImageRelocationMap,
+	ref reference.Named,
+	store content.Ingester,
+	options ...PushOption) (ocischemav1.Descriptor, error) {
+	options = append(options[:len(options):len(options)], WithAllowFallbacks(false))
+	return PushWithOptions(ctx, b, relocationMap, ref, &ingesterResolver{ingester: store}, options...)
+}
+
+// ingesterResolver is a remotes.Resolver only able to push, into a content store
+type ingesterResolver struct {
+	ingester content.Ingester
+}
+
+func (r *ingesterResolver) Resolve(_ context.Context, ref string) (string, ocischemav1.Descriptor, error) {
+	return "", ocischemav1.Descriptor{}, fmt.Errorf("cannot resolve %q from a content store: %w", ref, errdefs.ErrNotImplemented)
+}
+
+func (r *ingesterResolver) Fetcher(_ context.Context, ref string) (remotes.Fetcher, error) {
+	return nil, fmt.Errorf("cannot fetch %q from a content store: %w", ref, errdefs.ErrNotImplemented)
+}
+
+func (r *ingesterResolver) Pusher(_ context.Context, _ string) (remotes.Pusher, error) {
+	return r, nil
+}
+
+// Push opens a writer on the content store. The store reports errdefs.ErrAlreadyExists for existing blobs.
+func (r *ingesterResolver) Push(ctx context.Context, desc ocischemav1.Descriptor) (content.Writer, error) {
+	return r.ingester.Writer(ctx, content.WithRef(remotes.MakeRefKey(ctx, desc)), content.WithDescriptor(desc))
+}
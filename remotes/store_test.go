@@ -0,0 +1,53 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestPushToStore(t *testing.T) {
+	store, err := local.NewStore(t.TempDir())
+	assert.NilError(t, err)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	descriptor, err := PushToStore(ctx, tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, store)
+	assert.NilError(t, err)
+	assert.Equal(t, tests.BundleDigest, descriptor.Digest)
+
+	// The index, the config manifest and the config blob are all in the store
+	indexPayload, err := content.ReadBlob(ctx, store, descriptor)
+	assert.NilError(t, err)
+	var index ocischemav1.Index
+	assert.NilError(t, json.Unmarshal(indexPayload, &index))
+	configManifestDescriptor, err := converter.GetBundleConfigManifestDescriptor(&index)
+	assert.NilError(t, err)
+	configManifestPayload, err := content.ReadBlob(ctx, store, configManifestDescriptor)
+	assert.NilError(t, err)
+	var configManifest ocischemav1.Manifest
+	assert.NilError(t, json.Unmarshal(configManifestPayload, &configManifest))
+	_, err = content.ReadBlob(ctx, store, configManifest.Config)
+	assert.NilError(t, err)
+
+	// Pushing again skips the existing blobs
+	again, err := PushToStore(ctx, tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, store)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, descriptor, again)
+
+	// The options of the caller are left untouched, even with spare capacity
+	options := make([]PushOption, 1, 2)
+	options[0] = WithPushParallelism(1)
+	_, err = PushToStore(ctx, tests.MakeTestBundle(), tests.MakeRelocationMap(), ref, store, options...)
+	assert.NilError(t, err)
+	assert.Assert(t, options[:2][1] == nil)
+}
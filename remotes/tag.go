@@ -0,0 +1,53 @@
+package remotes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tag pushes the bundle index referenced by src under the dst tag, in the same repository. Only the index manifest is
+// pushed again, reusing the same digest. Nothing is pushed if dst already references the same index.
+func Tag(ctx context.Context, resolver remotes.Resolver, src reference.Named, dst reference.NamedTagged) (ocischemav1.Descriptor, error) {
+	logger := log.G(ctx)
+	logger.Debugf("Tagging CNAB Bundle %s as %s", src, dst)
+	if src.Name() != dst.Name() {
+		return ocischemav1.Descriptor{}, fmt.Errorf("cannot tag %q as %q: tags must be in the same repository, use Copy instead", src, dst)
+	}
+	ctx, err := WithRepositoryScope(ctx, dst, true)
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+
+	_, descriptor, err := resolver.Resolve(withMutedContext(ctx), src.String())
+	if err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to resolve bundle manifest %q: %w", src, err)
+	}
+	if descriptor.MediaType != ocischemav1.MediaTypeImageIndex && descriptor.MediaType != images.MediaTypeDockerSchema2ManifestList {
+		return ocischemav1.Descriptor{}, fmt.Errorf("invalid media type %q for bundle manifest", descriptor.MediaType)
+	}
+	if _, existing, err := resolver.Resolve(withMutedContext(ctx), dst.String()); err == nil && existing.Digest == descriptor.Digest {
+		logger.Debugf("%s already references %s", dst, descriptor.Digest)
+		return descriptor, nil
+	}
+
+	payload, err := pullPayload(ctx, resolver, src.String(), descriptor)
+	if err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to pull bundle manifest %q: %w", src, err)
+	}
+	cfg, err := newPushConfig()
+	if err != nil {
+		return ocischemav1.Descriptor{}, err
+	}
+	if err := pushPayload(ctx, resolver, dst.String(), cfg, descriptor, payload); err != nil {
+		return ocischemav1.Descriptor{}, fmt.Errorf("failed to tag bundle manifest %q as %q: %w", src, dst, err)
+	}
+
+	logger.Debug("CNAB Bundle tagged")
+	return descriptor, nil
+}
@@ -0,0 +1,54 @@
+package remotes
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestTag(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"manifests":[]}`)
+	descriptor := ocischemav1.Descriptor{
+		MediaType: ocischemav1.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(index),
+		Size:      int64(len(index)),
+	}
+	src, err := reference.ParseNamed("my.registry/namespace/my-app@" + descriptor.Digest.String())
+	assert.NilError(t, err)
+	dst, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+
+	pusher := &mockPusher{}
+	resolver := &mockResolver{
+		pusher:  pusher,
+		fetcher: &mockFetcher{indexBuffers: []*bytes.Buffer{bytes.NewBuffer(index)}},
+		// The tag does not exist yet
+		resolvedDescriptors: []ocischemav1.Descriptor{descriptor, {Size: -1}},
+	}
+	tagged, err := Tag(context.Background(), resolver, src, dst.(reference.NamedTagged))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, descriptor, tagged)
+	assert.DeepEqual(t, []string{"my.registry/namespace/my-app:v1"}, resolver.pushedReferences)
+	assert.Equal(t, string(index), pusher.buffers[0].String())
+
+	// Tagging again is a no-op
+	resolver.resolvedDescriptors = []ocischemav1.Descriptor{descriptor, descriptor}
+	_, err = Tag(context.Background(), resolver, src, dst.(reference.NamedTagged))
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(resolver.pushedReferences))
+}
+
+func TestTagInOtherRepository(t *testing.T) {
+	src, err := reference.ParseNamed("my.registry/namespace/my-app:v1")
+	assert.NilError(t, err)
+	dst, err := reference.ParseNamed("my.registry/namespace/other-app:v1")
+	assert.NilError(t, err)
+
+	_, err = Tag(context.Background(), &mockResolver{}, src, dst.(reference.NamedTagged))
+	assert.ErrorContains(t, err, "tags must be in the same repository")
+}
@@ -0,0 +1,238 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/docker/distribution/reference"
+)
+
+// TagLister is implemented by the resolvers able to list the tags of a repository, given its name, like the resolvers
+// created by NewResolver and CreateResolver
+type TagLister interface {
+	ListTags(ctx context.Context, repository string) ([]string, error)
+}
+
+// UnsupportedTagListingError is returned by ListTags when the resolver or the registry does not support listing the
+// tags of a repository
+type UnsupportedTagListingError struct {
+	// Repository is the listed repository
+	Repository string
+	// Err is the error returned by the registry, if it rejected the listing
+	Err error
+}
+
+func (e *UnsupportedTagListingError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("tag listing is not supported in %q: %s", e.Repository, e.Err)
+	}
+	return fmt.Sprintf("tag listing is not supported in %q: the resolver cannot list tags", e.Repository)
+}
+
+func (e *UnsupportedTagListingError) Unwrap() error {
+	return e.Err
+}
+
+// listTagsConfig defines the input required for a ListTags operation
+type listTagsConfig struct {
+	bundlesOnly bool
+}
+
+// ListTagsOption is a helper for configuring a ListTags
+type ListTagsOption func(*listTagsConfig) error
+
+// WithBundleTagsOnly resolves each listed tag, and keeps only the tags referencing a CNAB bundle index. This costs
+// a resolution and an index fetch per tag.
+func WithBundleTagsOnly() ListTagsOption {
+	return func(cfg *listTagsConfig) error {
+		cfg.bundlesOnly = true
+		return nil
+	}
+}
+
+// ListTags lists the tags of the repository of repo with the tags/list API of the registry, following its pagination.
+// The resolver must implement TagLister, otherwise ListTags fails with an UnsupportedTagListingError, like when the
+// registry does not support the API.
+func ListTags(ctx context.Context, repo reference.Named, resolver remotes.Resolver, options ...ListTagsOption) ([]string, error) {
+	cfg := listTagsConfig{}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	repository := repo.Name()
+	log.G(ctx).Debugf("Listing the tags of %s", repository)
+	ctx, err := WithRepositoryScope(ctx, reference.TrimNamed(repo), false)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := listTags(ctx, resolver, repository)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.bundlesOnly {
+		return tags, nil
+	}
+	var bundles []string
+	for _, tag := range tags {
+		isBundle, err := isBundleTag(ctx, resolver, repository+":"+tag)
+		if err != nil {
+			return nil, err
+		}
+		if isBundle {
+			bundles = append(bundles, tag)
+		}
+	}
+	return bundles, nil
+}
+
+// listTags lists the tags of the repository if the resolver is a TagLister
+func listTags(ctx context.Context, resolver remotes.Resolver, repository string) ([]string, error) {
+	lister, ok := resolver.(TagLister)
+	if !ok {
+		return nil, &UnsupportedTagListingError{Repository: repository}
+	}
+	return lister.ListTags(ctx, repository)
+}
+
+// isBundleTag returns true if the tagged reference resolves to a CNAB bundle index
+func isBundleTag(ctx context.Context, resolver remotes.Resolver, ref string) (bool, error) {
+	_, desc, err := resolver.Resolve(withMutedContext(ctx), ref)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			// Deleted since the listing
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	if !images.IsIndexType(desc.MediaType) {
+		return false, nil
+	}
+	payload, err := pullPayload(ctx, resolver, ref, desc)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch %q: %w", ref, err)
+	}
+	index, err := converter.UnmarshalIndex(payload, desc.MediaType)
+	if err != nil {
+		return false, nil
+	}
+	return converter.IsCNABIndex(index), nil
+}
+
+// tagList is the response of the tags/list API
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+func (r *multiRegistryResolver) ListTags(ctx context.Context, repository string) ([]string, error) {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := r.configureHosts()(reference.Domain(named))
+	if err != nil {
+		return nil, err
+	}
+	host := hosts[0]
+	next := &url.URL{Scheme: host.Scheme, Host: host.Host, Path: fmt.Sprintf("%s/%s/tags/list", host.Path, reference.Path(named))}
+	var tags []string
+	for next != nil {
+		var page tagList
+		if next, err = getTagsPage(ctx, host, next, &page); err != nil {
+			var statusErr remoteserrors.ErrUnexpectedStatus
+			if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusMethodNotAllowed || statusErr.StatusCode == http.StatusNotImplemented) {
+				return nil, &UnsupportedTagListingError{Repository: repository, Err: err}
+			}
+			return nil, fmt.Errorf("failed to list the tags of %q: %w", repository, err)
+		}
+		tags = append(tags, page.Tags...)
+	}
+	return tags, nil
+}
+
+// getTagsPage fetches a page of the tags list and returns the URL of the next page, if any
+func getTagsPage(ctx context.Context, host docker.RegistryHost, u *url.URL, page *tagList) (*url.URL, error) {
+	resp, err := getAuthorized(ctx, host, u, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("repository not found: %w", errdefs.ErrNotFound)
+	default:
+		return nil, remoteserrors.NewUnexpectedStatusErr(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+		return nil, fmt.Errorf("invalid tags list: %w", err)
+	}
+	return nextPage(u, resp.Header.Get("Link")), nil
+}
+
+// getAuthorized sends a GET request to the registry host, authorizing it like the docker resolver does. The caller
+// closes the body of the response, whatever its status.
+func getAuthorized(ctx context.Context, host docker.RegistryHost, u *url.URL, accept string) (*http.Response, error) {
+	var responses []*http.Response
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", accept)
+		if host.Authorizer != nil {
+			if err := host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := host.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && host.Authorizer != nil && len(responses) < 5 {
+			resp.Body.Close()
+			responses = append(responses, resp)
+			if err := host.Authorizer.AddResponses(ctx, responses); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// nextPage returns the URL of the next page of the Link header, like `</v2/name/tags/list?last=b&n=2>; rel="next"`,
+// resolved against the current URL
+func nextPage(current *url.URL, link string) *url.URL {
+	for _, value := range strings.Split(link, ",") {
+		parts := strings.Split(value, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if strings.ReplaceAll(strings.TrimSpace(param), " ", "") != `rel="next"` {
+				continue
+			}
+			next, err := current.Parse(strings.Trim(target, "<>"))
+			if err != nil {
+				return nil
+			}
+			return next
+		}
+	}
+	return nil
+}
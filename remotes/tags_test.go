@@ -0,0 +1,68 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestListTags(t *testing.T) {
+	content := newMemoryRegistry()
+	server := newPublicRegistry(t, content, nil)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	repo, err := reference.ParseNormalizedNamed(host + "/namespace/my-app")
+	assert.NilError(t, err)
+	for _, tag := range []string{"v1", "v2", "v3"} {
+		ref, err := reference.WithTag(repo, tag)
+		assert.NilError(t, err)
+		relocationMap, err := relocateToRepository(tests.MakeRelocationMap(), ref)
+		assert.NilError(t, err)
+		_, err = Push(context.Background(), tests.MakeTestBundle(), relocationMap, ref, content, false)
+		assert.NilError(t, err)
+	}
+	// An image which is not a bundle
+	image := []byte(`{"schemaVersion":2,"config":{}}`)
+	imageDigest := digest.FromBytes(image)
+	content.content[imageDigest] = image
+	content.descriptors[imageDigest] = ocischemav1.Descriptor{MediaType: ocischemav1.MediaTypeImageManifest, Digest: imageDigest, Size: int64(len(image))}
+	content.tags[repo.Name()+":latest"] = imageDigest
+
+	resolver := NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}})
+	tags, err := ListTags(context.Background(), repo, resolver)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"latest", "v1", "v2", "v3"}, tags)
+
+	tags, err = ListTags(context.Background(), repo, resolver, WithBundleTagsOnly())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"v1", "v2", "v3"}, tags)
+}
+
+func TestListTagsUnsupported(t *testing.T) {
+	repo, err := reference.ParseNormalizedNamed("my.registry/namespace/my-app")
+	assert.NilError(t, err)
+	_, err = ListTags(context.Background(), repo, &mockResolver{})
+	var unsupportedErr *UnsupportedTagListingError
+	assert.Assert(t, errors.As(err, &unsupportedErr), err)
+	assert.Equal(t, "my.registry/namespace/my-app", unsupportedErr.Repository)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	repo, err = reference.ParseNormalizedNamed(host + "/namespace/my-app")
+	assert.NilError(t, err)
+	_, err = ListTags(context.Background(), repo, NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}}))
+	assert.Assert(t, errors.As(err, &unsupportedErr), err)
+	assert.ErrorContains(t, err, "405 Method Not Allowed")
+}
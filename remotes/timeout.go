@@ -0,0 +1,91 @@
+package remotes
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// timeoutResolver is a resolver bounding the resolutions and the pushes of the resolver it wraps
+type timeoutResolver struct {
+	resolver       remotes.Resolver
+	resolveTimeout time.Duration
+	pushTimeout    time.Duration
+}
+
+// NewTimeoutResolver wraps a resolver to bound each resolution, token fetch and HEAD request included, by
+// resolveTimeout, and each payload push, from the existence check to the commit, by pushTimeout. This fails fast on a
+// dead registry while the parent context can allow a long overall budget. A zero timeout inherits the parent context.
+// The timeouts derive from the context of each call, which keeps its token scopes and logging fields.
+func NewTimeoutResolver(resolver remotes.Resolver, resolveTimeout, pushTimeout time.Duration) remotes.Resolver {
+	return &timeoutResolver{resolver: resolver, resolveTimeout: resolveTimeout, pushTimeout: pushTimeout}
+}
+
+func (r *timeoutResolver) Resolve(ctx context.Context, ref string) (string, ocischemav1.Descriptor, error) {
+	ctx, cancel := withOptionalTimeout(ctx, r.resolveTimeout)
+	defer cancel()
+	return r.resolver.Resolve(ctx, ref)
+}
+
+func (r *timeoutResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return r.resolver.Fetcher(ctx, ref)
+}
+
+// ListTags lists the tags of the wrapped resolver, the whole listing being bounded by the resolve timeout
+func (r *timeoutResolver) ListTags(ctx context.Context, repository string) ([]string, error) {
+	ctx, cancel := withOptionalTimeout(ctx, r.resolveTimeout)
+	defer cancel()
+	return listTags(ctx, r.resolver, repository)
+}
+
+// ListReferrers lists the referrers with the wrapped resolver, the whole listing being bounded by the resolve timeout
+func (r *timeoutResolver) ListReferrers(ctx context.Context, repository string, subject digest.Digest) ([]Referrer, error) {
+	ctx, cancel := withOptionalTimeout(ctx, r.resolveTimeout)
+	defer cancel()
+	return listRegistryReferrers(ctx, r.resolver, repository, subject)
+}
+
+func (r *timeoutResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := r.resolver.Pusher(ctx, ref)
+	if err != nil || r.pushTimeout <= 0 {
+		return pusher, err
+	}
+	return &timeoutPusher{pusher: pusher, timeout: r.pushTimeout}, nil
+}
+
+type timeoutPusher struct {
+	pusher  remotes.Pusher
+	timeout time.Duration
+}
+
+func (p *timeoutPusher) Push(ctx context.Context, desc ocischemav1.Descriptor) (content.Writer, error) {
+	// The upload runs for the lifetime of the writer, the timeout is only released once it is closed
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	writer, err := p.pusher.Push(ctx, desc)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutWriter{Writer: writer, cancel: cancel}, nil
+}
+
+type timeoutWriter struct {
+	content.Writer
+	cancel context.CancelFunc
+}
+
+func (w *timeoutWriter) Close() error {
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,71 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+// Mock remotes.Resolver interface blocking the resolutions until their context is done, recording the context
+type blockingResolver struct {
+	remotes.Resolver
+	ctx context.Context
+}
+
+func (r *blockingResolver) Resolve(ctx context.Context, ref string) (string, ocischemav1.Descriptor, error) {
+	r.ctx = ctx
+	<-ctx.Done()
+	return "", ocischemav1.Descriptor{}, ctx.Err()
+}
+
+func TestTimeoutResolverBoundsResolutions(t *testing.T) {
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	ctx, err := WithRepositoryScope(context.Background(), ref, false)
+	assert.NilError(t, err)
+	ctx = withLogField(ctx, logFieldReference, ref.String())
+
+	blocking := &blockingResolver{}
+	_, _, err = NewTimeoutResolver(blocking, 10*time.Millisecond, 0).Resolve(ctx, ref.String())
+	assert.Check(t, errors.Is(err, context.DeadlineExceeded), err)
+	// The derived context keeps the token scopes and the logging fields
+	assert.DeepEqual(t, []string{"repository:namespace/my-app:pull"}, docker.GetTokenScopes(blocking.ctx, nil))
+	assert.Equal(t, ref.String(), log.G(blocking.ctx).Data[logFieldReference])
+
+	// Zero inherits the parent context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = NewTimeoutResolver(blocking, 0, 0).Resolve(ctx, ref.String())
+	assert.Check(t, errors.Is(err, context.Canceled), err)
+	_, hasDeadline := blocking.ctx.Deadline()
+	assert.Check(t, !hasDeadline)
+}
+
+func TestTimeoutResolverBoundsPushes(t *testing.T) {
+	var pushCtx context.Context
+	resolver := &mockResolver{pusher: funcPusher(func(ctx context.Context, d ocischemav1.Descriptor) (content.Writer, error) {
+		pushCtx = ctx
+		return mockWriter{WriteCloser: nopWriteCloser{}}, nil
+	})}
+	pusher, err := NewTimeoutResolver(resolver, 0, time.Hour).Pusher(context.Background(), "my.registry/namespace/my-app")
+	assert.NilError(t, err)
+
+	writer, err := pusher.Push(context.Background(), ocischemav1.Descriptor{})
+	assert.NilError(t, err)
+	deadline, ok := pushCtx.Deadline()
+	assert.Check(t, ok)
+	assert.Check(t, time.Until(deadline) > 59*time.Minute)
+	// The upload is not interrupted until the writer is closed
+	assert.NilError(t, pushCtx.Err())
+	assert.NilError(t, writer.Close())
+	assert.Check(t, errors.Is(pushCtx.Err(), context.Canceled))
+}
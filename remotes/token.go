@@ -0,0 +1,113 @@
+package remotes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"golang.org/x/sync/singleflight"
+)
+
+// TokenProvider returns a bearer token obtained out of band, like from a cloud metadata service, for the requests to
+// a registry host. The scopes are the token scopes of the operation, like "repository:namespace/my-app:pull,push".
+// refresh is set when the registry rejected the token previously returned for the same host and scopes, like when it
+// expired. An empty token lets the resolver authenticate the requests to the host itself: like a token, this answer is
+// cached for the host and scopes, and the provider is not asked again.
+type TokenProvider func(ctx context.Context, host string, scopes []string, refresh bool) (string, error)
+
+// tokenProviderAuthorizer authorizes the registry requests with the tokens of a TokenProvider, cached by host and
+// scopes, instead of fetching them from the token server of the registry
+type tokenProviderAuthorizer struct {
+	provider TokenProvider
+	base     docker.Authorizer
+	mut      sync.Mutex
+	// tokens are the cached tokens, keyed by host and scopes, empty when the provider returned no token
+	tokens map[string]string
+	// calls deduplicates the concurrent provider calls, keyed by host and scopes
+	calls singleflight.Group
+	// stale are the keys of the tokens rejected by the registry
+	stale map[string]struct{}
+	// provided are the hosts the provider returned a token for
+	provided map[string]struct{}
+}
+
+func newTokenProviderAuthorizer(provider TokenProvider, base docker.Authorizer) *tokenProviderAuthorizer {
+	return &tokenProviderAuthorizer{
+		provider: provider,
+		base:     base,
+		tokens:   map[string]string{},
+		stale:    map[string]struct{}{},
+		provided: map[string]struct{}{},
+	}
+}
+
+func (a *tokenProviderAuthorizer) Authorize(ctx context.Context, req *http.Request) error {
+	host := req.URL.Host
+	scopes := docker.GetTokenScopes(ctx, nil)
+	key := tokenKey(host, scopes)
+
+	a.mut.Lock()
+	_, refresh := a.stale[key]
+	token, ok := a.tokens[key]
+	a.mut.Unlock()
+	if !ok || refresh {
+		// The provider and the base authorizer may be slow, so the lock is only held to read and swap the cache, and
+		// the concurrent requests needing the same token share a single provider call
+		provided, err, _ := a.calls.Do(key, func() (interface{}, error) {
+			token, err := a.provider(ctx, host, scopes, refresh)
+			if err != nil {
+				return "", err
+			}
+			a.mut.Lock()
+			defer a.mut.Unlock()
+			delete(a.stale, key)
+			// An empty token is cached as well, so the provider is not asked again on every request
+			a.tokens[key] = token
+			if token == "" {
+				delete(a.provided, host)
+			} else {
+				a.provided[host] = struct{}{}
+			}
+			return token, nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get a token for %s: %w", host, err)
+		}
+		token = provided.(string)
+	}
+	if token == "" {
+		return a.base.Authorize(ctx, req)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *tokenProviderAuthorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	last := responses[len(responses)-1]
+	host := last.Request.URL.Host
+
+	a.mut.Lock()
+	_, provided := a.provided[host]
+	a.mut.Unlock()
+	if !provided {
+		return a.base.AddResponses(ctx, responses)
+	}
+	// The token was already refreshed for the previous response: the registry rejects the provided tokens
+	if len(responses) > 1 && responses[len(responses)-2].StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("registry %s rejected the provided token: %w", host, docker.ErrInvalidAuthorization)
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.stale[tokenKey(host, docker.GetTokenScopes(ctx, nil))] = struct{}{}
+	return nil
+}
+
+func tokenKey(host string, scopes []string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	return host + " " + strings.Join(sorted, " ")
+}
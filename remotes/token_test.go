@@ -0,0 +1,112 @@
+package remotes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	"gotest.tools/v3/assert"
+)
+
+func TestNewResolverWithTokenProvider(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	var tokenRequests int32
+	registry := newTokenAuthRegistry(index, &tokenRequests)
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	var calls []string
+	provider := func(_ context.Context, host string, scopes []string, refresh bool) (string, error) {
+		calls = append(calls, fmt.Sprintf("%s %s %t", host, strings.Join(scopes, ","), refresh))
+		// The first token is expired
+		if !refresh {
+			return "expired", nil
+		}
+		return "t", nil
+	}
+	resolver := NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}, TokenProvider: provider})
+	_, descriptor, err := resolver.Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	assert.Equal(t, digest.FromBytes(index), descriptor.Digest)
+	// The token server of the registry is never called
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tokenRequests))
+	assert.DeepEqual(t, []string{
+		host + " repository:namespace/my-app:pull false",
+		host + " repository:namespace/my-app:pull true",
+	}, calls)
+
+	// The refreshed token is cached
+	_, _, err = resolver.Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(calls))
+}
+
+func TestNewResolverWithRejectedProvidedToken(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	var tokenRequests int32
+	registry := newTokenAuthRegistry(index, &tokenRequests)
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	provider := func(context.Context, string, []string, bool) (string, error) {
+		return "invalid", nil
+	}
+	resolver := NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}, TokenProvider: provider})
+	_, _, err := resolver.Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+	assert.Check(t, errors.Is(err, docker.ErrInvalidAuthorization), err)
+}
+
+func TestNewResolverWithEmptyProvidedToken(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	var tokenRequests int32
+	registry := newTokenAuthRegistry(index, &tokenRequests)
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	// Without a provided token, the resolver fetches its token from the registry
+	var calls int32
+	provider := func(context.Context, string, []string, bool) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "", nil
+	}
+	resolver := NewResolver(ResolverOptions{PlainHTTPRegistries: []string{host}, TokenProvider: provider})
+	for i := 0; i < 3; i++ {
+		_, _, err := resolver.Resolve(context.Background(), host+"/namespace/my-app:my-tag")
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tokenRequests))
+	// The empty answer is cached, the provider is only asked once
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestTokenProviderAuthorizerDoesNotBlockOtherHosts(t *testing.T) {
+	slow := make(chan struct{})
+	started := make(chan struct{})
+	provider := func(_ context.Context, host string, _ []string, _ bool) (string, error) {
+		if host == "slow.registry" {
+			close(started)
+			<-slow
+		}
+		return "t", nil
+	}
+	authorizer := newTokenProviderAuthorizer(provider, nil)
+
+	done := make(chan error)
+	go func() {
+		done <- authorizer.Authorize(context.Background(), httptest.NewRequest(http.MethodGet, "http://slow.registry/v2/", nil))
+	}()
+	<-started
+	// The token of another host is provided while the slow provider call is in progress
+	req := httptest.NewRequest(http.MethodGet, "http://fast.registry/v2/", nil)
+	assert.NilError(t, authorizer.Authorize(context.Background(), req))
+	assert.Equal(t, "Bearer t", req.Header.Get("Authorization"))
+	close(slow)
+	assert.NilError(t, <-done)
+}
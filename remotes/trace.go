@@ -0,0 +1,93 @@
+package remotes
+
+import (
+	"context"
+
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tracer creates the spans wrapping the stages of a Push or a Pull, to see where their latency goes.
+// This package does not depend on a tracing library: implement Tracer with an adapter of an OpenTelemetry tracer, like
+// the one returned by otel.Tracer, converting the TraceAttribute values to attribute.KeyValue.
+// Payloads may be pushed concurrently, so implementations must be safe for concurrent use.
+type Tracer interface {
+	// Start starts a span as a child of the span carried by ctx, if any, and returns a context carrying the new span
+	Start(ctx context.Context, name string, attributes ...TraceAttribute) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttributes adds attributes only known once the stage completed, like the digest of the pushed index
+	SetAttributes(attributes ...TraceAttribute)
+	// End ends the span, err being the error failing the stage, if any
+	End(err error)
+}
+
+// TraceAttribute is an attribute of a span. Its value is a string, or an int64 for the sizes.
+type TraceAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+const (
+	// TraceAttributeReference is the attribute of the reference of the pushed or pulled bundle
+	TraceAttributeReference = "cnab.reference"
+	// TraceAttributeDigest is the attribute of the digest of the payload of a stage
+	TraceAttributeDigest = "cnab.digest"
+	// TraceAttributeSize is the attribute of the byte size of the payload of a stage
+	TraceAttributeSize = "cnab.size"
+)
+
+const (
+	// SpanPush is the span of a whole Push
+	SpanPush = "cnab.push"
+	// SpanPrepareConfig is the span preparing the bundle config payloads
+	SpanPrepareConfig = "cnab.push.prepare-config"
+	// SpanPushConfigBlob is the span pushing the bundle config blob
+	SpanPushConfigBlob = "cnab.push.config-blob"
+	// SpanPushConfigManifest is the span pushing the bundle config manifest
+	SpanPushConfigManifest = "cnab.push.config-manifest"
+	// SpanPushIndex is the span pushing the bundle index
+	SpanPushIndex = "cnab.push.index"
+	// SpanPull is the span of a whole Pull
+	SpanPull = "cnab.pull"
+	// SpanPullIndex is the span resolving and fetching the bundle index
+	SpanPullIndex = "cnab.pull.index"
+	// SpanPullConfig is the span fetching the bundle config manifest and blob
+	SpanPullConfig = "cnab.pull.config"
+)
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string, _ ...TraceAttribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...TraceAttribute) {}
+func (noopSpan) End(error)                       {}
+
+// stageSpanName returns the name of the span of a push stage
+func stageSpanName(stage PushStage) string {
+	switch stage {
+	case PushStageConfigBlob:
+		return SpanPushConfigBlob
+	case PushStageConfigManifest:
+		return SpanPushConfigManifest
+	default:
+		return SpanPushIndex
+	}
+}
+
+func referenceAttribute(ref string) TraceAttribute {
+	return TraceAttribute{Key: TraceAttributeReference, Value: ref}
+}
+
+// descriptorAttributes returns the digest and size attributes of a descriptor
+func descriptorAttributes(desc ocischemav1.Descriptor) []TraceAttribute {
+	return []TraceAttribute{
+		{Key: TraceAttributeDigest, Value: desc.Digest.String()},
+		{Key: TraceAttributeSize, Value: desc.Size},
+	}
+}
@@ -0,0 +1,61 @@
+package remotes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Walk calls fn for every descriptor referenced by the bundle index of ref, starting with the index itself: the
+// bundle config manifest and blob, every image manifest with its config and layers, following manifest lists into
+// their platform manifests. Only the manifests are fetched, never the layers. Each digest is only visited once.
+// Walk stops at the first error returned by fn, and returns it.
+func Walk(ctx context.Context, ref reference.Named, resolver remotes.Resolver, fn func(ocischemav1.Descriptor) error) error {
+	log.G(ctx).Debugf("Walking CNAB Bundle %s", ref)
+	index, indexDescriptor, err := getIndex(ctx, ref, resolver)
+	if err != nil {
+		return err
+	}
+	if _, err := converter.GetBundleConfigManifestDescriptor(&index); err != nil {
+		return fmt.Errorf("failed to walk bundle %q: %w", ref, err)
+	}
+	return walkIndex(ctx, ref, resolver, index, indexDescriptor, fn)
+}
+
+// walkIndex calls fn for the index descriptor, then for every descriptor referenced by the index, like Walk
+func walkIndex(ctx context.Context, ref reference.Named, resolver remotes.Resolver, index ocischemav1.Index, indexDescriptor ocischemav1.Descriptor, fn func(ocischemav1.Descriptor) error) error {
+	if err := fn(indexDescriptor); err != nil {
+		return err
+	}
+
+	ctx = withMutedContext(ctx)
+	fetcher, err := resolver.Fetcher(ctx, ref.Name())
+	if err != nil {
+		return err
+	}
+	visited := map[digest.Digest]struct{}{indexDescriptor.Digest: {}}
+	return walkDescriptors(ctx, fetcher, visited, fn, index.Manifests...)
+}
+
+// walkDescriptors calls fn for each of the descriptors and everything they reference, skipping the visited digests
+func walkDescriptors(ctx context.Context, fetcher remotes.Fetcher, visited map[digest.Digest]struct{}, fn func(ocischemav1.Descriptor) error, descriptors ...ocischemav1.Descriptor) error {
+	getChildren := images.ChildrenHandler(&imageContentProvider{fetcher})
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocischemav1.Descriptor) ([]ocischemav1.Descriptor, error) {
+		if _, ok := visited[desc.Digest]; ok {
+			return nil, images.ErrSkipDesc
+		}
+		visited[desc.Digest] = struct{}{}
+		if err := fn(desc); err != nil {
+			return nil, err
+		}
+		return getChildren(ctx, desc)
+	})
+	return images.Walk(ctx, handler, descriptors...)
+}
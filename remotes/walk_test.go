@@ -0,0 +1,112 @@
+package remotes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/cnabio/cnab-to-oci/converter"
+	"github.com/cnabio/cnab-to-oci/tests"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocischemav1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+)
+
+func TestWalk(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	fetched := map[digest.Digest]struct{}{}
+	resolver := &mockResolver{
+		fetcher: remotes.FetcherFunc(func(ctx context.Context, desc ocischemav1.Descriptor) (io.ReadCloser, error) {
+			fetched[desc.Digest] = struct{}{}
+			return fetcher.Fetch(ctx, desc)
+		}),
+		resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor},
+	}
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	var visited []ocischemav1.Descriptor
+	assert.NilError(t, Walk(context.Background(), ref, resolver, func(d ocischemav1.Descriptor) error {
+		visited = append(visited, d)
+		return nil
+	}))
+	// Every descriptor is visited once, starting with the index
+	assert.Equal(t, indexDescriptor.Digest, visited[0].Digest)
+	assert.Equal(t, len(fetcher), len(visited))
+	for _, d := range visited {
+		_, ok := fetcher[d.Digest]
+		assert.Check(t, ok, d.Digest)
+		// Only the manifests are fetched
+		_, ok = fetched[d.Digest]
+		isManifest := images.IsManifestType(d.MediaType) || images.IsIndexType(d.MediaType)
+		assert.Equal(t, isManifest, ok, d.MediaType)
+	}
+}
+
+func TestWalkFollowsManifestLists(t *testing.T) {
+	fetcher := contentFetcher{}
+	var platformManifests []ocischemav1.Descriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		layer := fetcher.add([]byte("layer-"+arch), ocischemav1.MediaTypeImageLayerGzip)
+		manifest, err := json.Marshal(ocischemav1.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config:    fetcher.add([]byte(`{"architecture":"`+arch+`"}`), ocischemav1.MediaTypeImageConfig),
+			Layers:    []ocischemav1.Descriptor{layer},
+		})
+		assert.NilError(t, err)
+		d := fetcher.add(manifest, ocischemav1.MediaTypeImageManifest)
+		d.Platform = &ocischemav1.Platform{OS: "linux", Architecture: arch}
+		platformManifests = append(platformManifests, d)
+	}
+	manifestList, err := json.Marshal(ocischemav1.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: platformManifests})
+	assert.NilError(t, err)
+	manifestListDescriptor := fetcher.add(manifestList, ocischemav1.MediaTypeImageIndex)
+	manifestListDescriptor.Annotations = map[string]string{converter.CNABDescriptorTypeAnnotation: converter.CNABDescriptorTypeInvocation}
+
+	bundleConfig, err := converter.PrepareForPush(tests.MakeTestBundle())
+	assert.NilError(t, err)
+	fetcher.add(bundleConfig.ConfigBlob, bundleConfig.ConfigBlobDescriptor.MediaType)
+	configManifestDescriptor := fetcher.add(bundleConfig.Manifest, bundleConfig.ManifestDescriptor.MediaType)
+	configManifestDescriptor.Annotations = map[string]string{converter.CNABDescriptorTypeAnnotation: converter.CNABDescriptorTypeConfig}
+	index, err := json.Marshal(ocischemav1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocischemav1.Descriptor{configManifestDescriptor, manifestListDescriptor},
+	})
+	assert.NilError(t, err)
+	indexDescriptor := fetcher.add(index, ocischemav1.MediaTypeImageIndex)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+
+	visited := map[digest.Digest]struct{}{}
+	assert.NilError(t, Walk(context.Background(), ref, &mockResolver{fetcher: fetcher, resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor}},
+		func(d ocischemav1.Descriptor) error {
+			visited[d.Digest] = struct{}{}
+			return nil
+		}))
+	assert.Equal(t, len(fetcher), len(visited))
+}
+
+func TestWalkStopsOnError(t *testing.T) {
+	fetcher, indexDescriptor := makeCopySource(t)
+	ref, err := reference.ParseNamed("my.registry/namespace/my-app:my-tag")
+	assert.NilError(t, err)
+	stop := errors.New("stop")
+
+	calls := 0
+	err = Walk(context.Background(), ref, &mockResolver{fetcher: fetcher, resolvedDescriptors: []ocischemav1.Descriptor{indexDescriptor}},
+		func(d ocischemav1.Descriptor) error {
+			calls++
+			if calls == 2 {
+				return stop
+			}
+			return nil
+		})
+	assert.Check(t, errors.Is(err, stop))
+	assert.Equal(t, 2, calls)
+}